@@ -102,7 +102,7 @@ const (
 )
 
 func makeConfigTemplates() error {
-	configFiles, err := mage.FindFiles(configTemplateGlob)
+	configFiles, err := mage.FindFilesRequired(configTemplateGlob)
 	if err != nil {
 		return errors.Wrap(err, "failed to find config templates")
 	}
@@ -0,0 +1,551 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// VerifyArchive reads every entry of a .zip, .tar.gz, or .tgz file to
+// completion without writing anything to disk. It returns the first error
+// encountered which indicates that the archive is truncated or corrupt.
+func VerifyArchive(sourceFile string) error {
+	ext := filepath.Ext(sourceFile)
+	switch {
+	case strings.HasSuffix(sourceFile, ".tar.gz"), ext == ".tgz":
+		return verifyTar(sourceFile)
+	case ext == ".zip":
+		return verifyZip(sourceFile)
+	default:
+		return errors.Errorf("failed to verify %v, unhandled file extension", sourceFile)
+	}
+}
+
+// ValidateArchivePaths checks the name of every entry of a .zip, .tar.gz, or
+// .tgz file without extracting anything. It returns an error if a name is
+// absolute or if it contains ".." segments after cleaning, because such entries
+// would be written outside of the destination directory.
+func ValidateArchivePaths(sourceFile string) error {
+	return walkArchive(sourceFile, func(name string, _ os.FileMode, _ io.Reader) error {
+		return validateArchivePath(name)
+	})
+}
+
+func validateArchivePath(name string) error {
+	slashed := strings.Replace(name, `\`, "/", -1)
+	if filepath.IsAbs(name) || path.IsAbs(slashed) || filepath.VolumeName(name) != "" {
+		return errors.Errorf("illegal absolute path %v", name)
+	}
+	for _, elem := range strings.Split(path.Clean(slashed), "/") {
+		if elem == ".." {
+			return errors.Errorf("illegal path %v refers to a parent directory", name)
+		}
+	}
+	return nil
+}
+
+func verifyZip(sourceFile string) error {
+	r, err := zip.OpenReader(sourceFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %v", sourceFile)
+	}
+	defer r.Close()
+
+	verifyEntry := func(f *zip.File) error {
+		innerFile, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer innerFile.Close()
+
+		sum := crc32.NewIEEE()
+		if _, err = io.Copy(sum, innerFile); err != nil {
+			return err
+		}
+
+		// The central directory always records a CRC, and zero is a valid
+		// value (e.g. for empty files), so only directories are exempt.
+		if !f.FileInfo().IsDir() && sum.Sum32() != f.CRC32 {
+			return errors.Errorf("CRC32 mismatch (expected=%08x, computed=%08x)", f.CRC32, sum.Sum32())
+		}
+		return nil
+	}
+
+	for _, f := range r.File {
+		if err := verifyEntry(f); err != nil {
+			return errors.Wrapf(err, "corrupt entry %v in %v", f.Name, sourceFile)
+		}
+	}
+
+	return nil
+}
+
+func verifyTar(sourceFile string) error {
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %v", sourceFile)
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrapf(err, "failed to read %v", sourceFile)
+		}
+
+		if _, err = io.Copy(ioutil.Discard, tarReader); err != nil {
+			return errors.Wrapf(err, "corrupt entry %v in %v", header.Name, sourceFile)
+		}
+	}
+
+	// Read any trailing data so that the gzip checksum is verified.
+	if _, err = io.Copy(ioutil.Discard, gzipReader); err != nil {
+		return errors.Wrapf(err, "failed to read %v", sourceFile)
+	}
+
+	return nil
+}
+
+// ExtractFlat extracts the files contained in a .zip, .tar.gz, or .tgz file
+// directly into destinationDir using only the base name of each entry.
+// Directory entries are skipped. It returns an error if two entries have the
+// same base name.
+func ExtractFlat(sourceFile, destinationDir string) error {
+	if err := os.MkdirAll(destinationDir, 0755); err != nil {
+		return err
+	}
+
+	sources := map[string]string{}
+	return walkArchive(sourceFile, func(name string, mode os.FileMode, r io.Reader) error {
+		if mode.IsDir() {
+			return nil
+		}
+		if !mode.IsRegular() {
+			return errors.Errorf("unable to extract %v with mode %v", name, mode)
+		}
+
+		base := filepath.Base(filepath.FromSlash(name))
+		if other, found := sources[base]; found {
+			return errors.Errorf("entries %v and %v both extract to %v", other, name, base)
+		}
+		sources[base] = name
+
+		// Archives created without Unix permissions report a mode of 0, which
+		// would leave the extracted file unreadable.
+		perm := mode.Perm()
+		if perm == 0 {
+			perm = 0644
+		}
+
+		out, err := os.OpenFile(filepath.Join(destinationDir, base), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		if _, err = io.Copy(out, r); err != nil {
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// errStopWalk is returned by a walkArchive callback to stop the walk early.
+var errStopWalk = errors.New("stop walk")
+
+// ExtractFileTo copies the contents of a single entry of a .zip, .tar.gz, or
+// .tgz file to w without writing anything to disk. entryName is the path of
+// the entry inside of the archive (e.g. beat-1.0/version.txt). It returns an
+// error if the archive has no such file.
+func ExtractFileTo(sourceFile, entryName string, w io.Writer) error {
+	want := path.Clean(strings.TrimPrefix(filepath.ToSlash(entryName), "./"))
+
+	found := false
+	err := walkArchive(sourceFile, func(name string, mode os.FileMode, r io.Reader) error {
+		if mode.IsDir() || path.Clean(strings.TrimPrefix(name, "./")) != want {
+			return nil
+		}
+		if !mode.IsRegular() {
+			return errors.Errorf("%v is not a regular file", name)
+		}
+
+		found = true
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+		return errStopWalk
+	})
+	if err != nil && errors.Cause(err) != errStopWalk {
+		return errors.Wrapf(err, "failed to extract %v from %v", entryName, sourceFile)
+	}
+	if !found {
+		return errors.Errorf("%v not found in %v", entryName, sourceFile)
+	}
+	return nil
+}
+
+// TarGzManifest creates a reproducible .tar.gz file containing exactly the
+// given includes. Each include is a path relative to baseDir and it is stored
+// under the same relative path. A directory include adds only the directory
+// entry, not its contents. Entries are sorted by name, owned by root, have
+// their modification time set to fixedModTime, and use mode 0755 or 0644
+// depending on whether the source is a directory or executable. It returns an
+// error listing every include that does not exist.
+func TarGzManifest(outputFile, baseDir string, includes []string, fixedModTime time.Time) error {
+	names := make([]string, 0, len(includes))
+	seen := map[string]struct{}{}
+	for _, include := range includes {
+		name := filepath.ToSlash(filepath.Clean(include))
+		if filepath.IsAbs(include) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("include %v must be a path inside of %v", include, baseDir)
+		}
+		if _, found := seen[name]; !found {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	infos := make([]os.FileInfo, len(names))
+	var missing []string
+	for i, name := range names {
+		info, err := os.Stat(filepath.Join(baseDir, filepath.FromSlash(name)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				missing = append(missing, name)
+				continue
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return errors.Errorf("include %v is not a regular file or directory", name)
+		}
+		infos[i] = info
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("includes not found in %v: %v", baseDir, strings.Join(missing, ", "))
+	}
+
+	out, err := os.Create(createDir(outputFile))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	for i, name := range names {
+		if err = addManifestEntry(tw, baseDir, name, infos[i], fixedModTime); err != nil {
+			return errors.Wrapf(err, "failed adding %v to %v", name, outputFile)
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// addManifestEntry writes a single file or directory entry to the tar.
+func addManifestEntry(tw *tar.Writer, baseDir, name string, info os.FileInfo, modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		ModTime: modTime,
+		Uname:   "root",
+		Gname:   "root",
+		Format:  tar.FormatPAX,
+	}
+	switch {
+	case info.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+		header.Mode = 0755
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Size = info.Size()
+		if info.Mode()&0111 != 0 {
+			header.Mode = 0755
+		}
+	}
+
+	logDebug("Adding", os.FileMode(header.Mode), header.Name)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(baseDir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = io.CopyN(tw, f, info.Size()); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// TarEntry is an entry of an archive written by TarGzReaders.
+type TarEntry struct {
+	Name    string      // Path inside of the archive. Directories end with a slash.
+	Mode    os.FileMode // Permissions and type bits. Defaults to 0644 (0755 for directories).
+	ModTime time.Time
+	Size    int64     // Length of Content. It must match exactly.
+	Content io.Reader // Contents of a regular file. Unused for directories.
+}
+
+// TarGzReaders creates a .tar.gz file from entries whose contents are read
+// from memory or any other io.Reader instead of from disk. The entries are
+// written in the order given and are owned by root.
+func TarGzReaders(outputFile string, entries []TarEntry) error {
+	out, err := os.Create(createDir(outputFile))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		if err = addReaderEntry(tw, entry); err != nil {
+			return errors.Wrapf(err, "failed adding %v to %v", entry.Name, outputFile)
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// addReaderEntry writes a single TarEntry to the tar.
+func addReaderEntry(tw *tar.Writer, entry TarEntry) error {
+	isDir := entry.Mode.IsDir() || strings.HasSuffix(entry.Name, "/")
+	header := &tar.Header{
+		Name:     entry.Name,
+		Mode:     int64(entry.Mode.Perm()),
+		ModTime:  entry.ModTime,
+		Uname:    "root",
+		Gname:    "root",
+		Typeflag: tar.TypeReg,
+		Size:     entry.Size,
+		Format:   tar.FormatPAX,
+	}
+	if isDir {
+		header.Typeflag = tar.TypeDir
+		header.Size = 0
+		if !strings.HasSuffix(header.Name, "/") {
+			header.Name += "/"
+		}
+	}
+	if header.Mode == 0 {
+		header.Mode = 0644
+		if isDir {
+			header.Mode = 0755
+		}
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if isDir || entry.Content == nil {
+		return nil
+	}
+
+	n, err := io.Copy(tw, entry.Content)
+	if err == tar.ErrWriteTooLong {
+		return errors.Errorf("content is longer than the size of %d bytes", entry.Size)
+	}
+	if err != nil {
+		return err
+	}
+	if n != entry.Size {
+		return errors.Errorf("content has %d bytes but the size is %d bytes", n, entry.Size)
+	}
+	return nil
+}
+
+// ZipReproducible creates a zip file that is byte-for-byte identical across
+// runs given the same inputs. files maps each entry name in the zip to the
+// path of a regular file to read. Entries are written in sorted order, their
+// modification time is set to fixedModTime, and their mode is 0755 or 0644
+// depending on whether the source is executable.
+func ZipReproducible(outputFile string, files map[string]string, fixedModTime time.Time) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out, err := os.Create(createDir(outputFile))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for _, name := range names {
+		if err = addReproducibleZipEntry(zw, name, files[name], fixedModTime); err != nil {
+			return errors.Wrapf(err, "failed adding %v to %v", name, outputFile)
+		}
+	}
+
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// addReproducibleZipEntry copies the source file into the zip under name.
+func addReproducibleZipEntry(zw *zip.Writer, name, source string, modTime time.Time) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.Errorf("%v is not a regular file", source)
+	}
+
+	mode := os.FileMode(0644)
+	if info.Mode()&0111 != 0 {
+		mode = 0755
+	}
+	header := &zip.FileHeader{
+		Name:     filepath.ToSlash(name),
+		Method:   zip.Deflate,
+		Modified: modTime.UTC(),
+	}
+	header.SetMode(mode)
+
+	logDebug("Adding", mode, header.Name)
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// walkArchive invokes fn for each entry in a .zip, .tar.gz, or .tgz file. The
+// reader passed to fn returns the contents of the entry.
+func walkArchive(sourceFile string, fn func(name string, mode os.FileMode, r io.Reader) error) error {
+	ext := filepath.Ext(sourceFile)
+	switch {
+	case strings.HasSuffix(sourceFile, ".tar.gz"), ext == ".tgz":
+		return walkTar(sourceFile, fn)
+	case ext == ".zip":
+		return walkZip(sourceFile, fn)
+	default:
+		return errors.Errorf("failed to read %v, unhandled file extension", sourceFile)
+	}
+}
+
+func walkZip(sourceFile string, fn func(name string, mode os.FileMode, r io.Reader) error) error {
+	r, err := zip.OpenReader(sourceFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %v", sourceFile)
+	}
+	defer r.Close()
+
+	visit := func(f *zip.File) error {
+		innerFile, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer innerFile.Close()
+
+		return fn(f.Name, f.Mode(), innerFile)
+	}
+
+	for _, f := range r.File {
+		if err := visit(f); err != nil {
+			return errors.Wrapf(err, "failed on entry %v in %v", f.Name, sourceFile)
+		}
+	}
+	return nil
+}
+
+func walkTar(sourceFile string, fn func(name string, mode os.FileMode, r io.Reader) error) error {
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %v", sourceFile)
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrapf(err, "failed to read %v", sourceFile)
+		}
+
+		if err = fn(header.Name, header.FileInfo().Mode(), tarReader); err != nil {
+			return errors.Wrapf(err, "failed on entry %v in %v", header.Name, sourceFile)
+		}
+	}
+	return nil
+}
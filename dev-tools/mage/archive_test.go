@@ -0,0 +1,664 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestZip writes a zip file containing the given name to content
+// entries.
+func writeTestZip(t testing.TB, file string, entries map[string]string) {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for name, content := range entries {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestTarGz writes a tar.gz file containing the given name to content
+// entries.
+func writeTestTarGz(t testing.TB, file string, entries map[string]string) {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	w := tar.NewWriter(gw)
+	for name, content := range entries {
+		header := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t testing.TB) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "mage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { SafeRemoveAll(dir, os.TempDir()) }
+}
+
+func TestVerifyArchive(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	entries := map[string]string{"a/b.txt": "hello world", "c.txt": "foo bar baz"}
+
+	zipFile := filepath.Join(dir, "test.zip")
+	writeTestZip(t, zipFile, entries)
+	assert.NoError(t, VerifyArchive(zipFile))
+
+	tarFile := filepath.Join(dir, "test.tar.gz")
+	writeTestTarGz(t, tarFile, entries)
+	assert.NoError(t, VerifyArchive(tarFile))
+
+	// Truncate the archives.
+	for _, f := range []string{zipFile, tarFile} {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(f, data[:len(data)-10], 0644); err != nil {
+			t.Fatal(err)
+		}
+		assert.Error(t, VerifyArchive(f), f)
+	}
+}
+
+func TestVerifyArchiveZeroCRC(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	writeRawZip := func(file, name, content string, crc uint32) {
+		buf := new(bytes.Buffer)
+		w := zip.NewWriter(buf)
+		f, err := w.CreateRaw(&zip.FileHeader{
+			Name:               name,
+			Method:             zip.Store,
+			CRC32:              crc,
+			CompressedSize64:   uint64(len(content)),
+			UncompressedSize64: uint64(len(content)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An empty file legitimately has a CRC of zero.
+	empty := filepath.Join(dir, "empty.zip")
+	writeRawZip(empty, "empty.txt", "", 0)
+	assert.NoError(t, VerifyArchive(empty))
+
+	// A zero CRC recorded for non-empty content must still be compared.
+	corrupt := filepath.Join(dir, "corrupt.zip")
+	writeRawZip(corrupt, "a.txt", "hello world", 0)
+	if err := VerifyArchive(corrupt); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "CRC32 mismatch")
+	}
+}
+
+func TestExtractFlat(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	entries := map[string]string{
+		"pkg/bin/tool":        "tool",
+		"pkg/share/doc/a.txt": "a",
+		"README":              "readme",
+	}
+	writeTestTarGz(t, filepath.Join(dir, "flat.tar.gz"), entries)
+
+	// Include a directory entry which must be skipped.
+	entries["pkg/"] = ""
+	writeTestZip(t, filepath.Join(dir, "flat.zip"), entries)
+
+	for _, name := range []string{"flat.zip", "flat.tar.gz"} {
+		out := filepath.Join(dir, name+"-out")
+		if err := ExtractFlat(filepath.Join(dir, name), out); err != nil {
+			t.Fatal(err)
+		}
+
+		infos, err := ioutil.ReadDir(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		assert.Equal(t, []string{"README", "a.txt", "tool"}, names, name)
+
+		data, err := ioutil.ReadFile(filepath.Join(out, "a.txt"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "a", string(data))
+		}
+	}
+}
+
+func TestExtractFlatZeroMode(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	// A Unix creator with no external attributes yields a mode of 0.
+	f, err := w.CreateHeader(&zip.FileHeader{Name: "tool", CreatorVersion: 3 << 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("tool")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "zero.zip")
+	if err = ioutil.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "out")
+	if err = ExtractFlat(archive, out); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(out, "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	}
+}
+
+func TestExtractFlatCollision(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	archive := filepath.Join(dir, "collide.zip")
+	writeTestZip(t, archive, map[string]string{
+		"linux/bin/tool":   "linux",
+		"windows/bin/tool": "windows",
+	})
+
+	err := ExtractFlat(archive, filepath.Join(dir, "out"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "both extract to tool")
+	}
+}
+
+func TestTarGzManifest(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	base := filepath.Join(dir, "build")
+	files := map[string]os.FileMode{
+		"bin/beat":         0755,
+		"beat.yml":         0600,
+		"kibana/dash.json": 0644,
+		"excluded.txt":     0644,
+	}
+	for name, mode := range files {
+		path := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	includes := []string{"kibana/dash.json", "bin/beat", "beat.yml", "bin", "./beat.yml"}
+	first := filepath.Join(dir, "first.tar.gz")
+	if err := TarGzManifest(first, base, includes, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		mode os.FileMode
+		data string
+	}
+	entries := map[string]entry{}
+	var names []string
+	err := walkArchive(first, func(name string, mode os.FileMode, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		names = append(names, name)
+		entries[name] = entry{mode, string(data)}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"beat.yml", "bin/", "bin/beat", "kibana/dash.json"}, names)
+	assert.Equal(t, entry{0644, "beat.yml"}, entries["beat.yml"])
+	assert.Equal(t, entry{0755, "bin/beat"}, entries["bin/beat"])
+	assert.True(t, entries["bin/"].mode.IsDir())
+
+	// The output does not depend on the modification times of the sources.
+	later := time.Now().Add(time.Hour)
+	for name := range files {
+		if err = os.Chtimes(filepath.Join(base, filepath.FromSlash(name)), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second := filepath.Join(dir, "second.tar.gz")
+	if err = TarGzManifest(second, base, []string{"beat.yml", "bin/beat", "bin", "kibana/dash.json"}, modTime); err != nil {
+		t.Fatal(err)
+	}
+	equal, err := FilesEqual(first, second)
+	if assert.NoError(t, err) {
+		assert.True(t, equal, "tar.gz files must be identical")
+	}
+}
+
+func TestTarGzManifestErrors(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "present"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "out", "pkg.tar.gz")
+
+	err := TarGzManifest(output, dir, []string{"present", "missing-b", "missing-a"}, time.Time{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "missing-a, missing-b")
+	}
+	_, err = os.Stat(output)
+	assert.True(t, os.IsNotExist(err), "no output must be written")
+
+	for _, include := range []string{"../present", ".", filepath.Join(dir, "present")} {
+		assert.Error(t, TarGzManifest(output, dir, []string{include}, time.Time{}), include)
+	}
+}
+
+func TestZipReproducible(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	sources := map[string]os.FileMode{"beat": 0755, "beat.yml": 0600, "README.md": 0644}
+	files := map[string]string{}
+	for name, mode := range sources {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(strings.Repeat(name, 100)), mode); err != nil {
+			t.Fatal(err)
+		}
+		files["beat-1.0/"+name] = path
+	}
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	first := filepath.Join(dir, "first.zip")
+	if err := ZipReproducible(first, files, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	for name := range sources {
+		if err := os.Chtimes(filepath.Join(dir, name), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second := filepath.Join(dir, "second.zip")
+	if err := ZipReproducible(second, files, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	equal, err := FilesEqual(first, second)
+	if assert.NoError(t, err) {
+		assert.True(t, equal, "zip files must be identical")
+	}
+
+	r, err := zip.OpenReader(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+		assert.True(t, f.Modified.Equal(modTime), f.Name)
+	}
+	assert.Equal(t, []string{"beat-1.0/README.md", "beat-1.0/beat", "beat-1.0/beat.yml"}, names)
+	assert.Equal(t, os.FileMode(0755), r.File[1].Mode())
+	assert.Equal(t, os.FileMode(0644), r.File[2].Mode())
+
+	assert.Error(t, ZipReproducible(filepath.Join(dir, "bad.zip"), map[string]string{"dir": dir}, modTime))
+}
+
+func TestExtractFileTo(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	entries := map[string]string{
+		"tool-1.0/version.txt": "1.0.0\n",
+		"tool-1.0/bin/tool":    "binary",
+		"version.txt":          "top-level",
+	}
+	writeTestTarGz(t, filepath.Join(dir, "tool.tar.gz"), entries)
+	writeTestZip(t, filepath.Join(dir, "tool.zip"), entries)
+
+	for _, name := range []string{"tool.zip", "tool.tar.gz"} {
+		archive := filepath.Join(dir, name)
+
+		var buf bytes.Buffer
+		if assert.NoError(t, ExtractFileTo(archive, "tool-1.0/version.txt", &buf), name) {
+			assert.Equal(t, "1.0.0\n", buf.String(), name)
+		}
+
+		buf.Reset()
+		if assert.NoError(t, ExtractFileTo(archive, "./version.txt", &buf), name) {
+			assert.Equal(t, "top-level", buf.String(), name)
+		}
+
+		err := ExtractFileTo(archive, "tool-1.0/missing.txt", &buf)
+		if assert.Error(t, err, name) {
+			assert.Contains(t, err.Error(), "not found")
+		}
+	}
+}
+
+func TestExtractWithHook(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	entries := map[string]string{
+		"keep.txt":  "keep",
+		"skip.txt":  "skip",
+		"other.txt": "other",
+	}
+	writeTestTarGz(t, filepath.Join(dir, "test.tar.gz"), entries)
+	writeTestZip(t, filepath.Join(dir, "test.zip"), entries)
+
+	for _, name := range []string{"test.zip", "test.tar.gz"} {
+		out := filepath.Join(dir, "out-"+name)
+		if err := os.MkdirAll(out, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		var seen []string
+		err := ExtractWithHook(filepath.Join(dir, name), out, func(entry string, info os.FileInfo) error {
+			seen = append(seen, entry)
+			assert.Equal(t, int64(len(entries[entry])), info.Size(), entry)
+			if entry == "skip.txt" {
+				return ErrSkipEntry
+			}
+			return nil
+		})
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		sort.Strings(seen)
+		assert.Equal(t, []string{"keep.txt", "other.txt", "skip.txt"}, seen, name)
+		assert.FileExists(t, filepath.Join(out, "keep.txt"), name)
+		assert.FileExists(t, filepath.Join(out, "other.txt"), name)
+		_, err = os.Stat(filepath.Join(out, "skip.txt"))
+		assert.True(t, os.IsNotExist(err), "skipped entry must not be extracted")
+
+		// Any other error aborts the extraction.
+		err = ExtractWithHook(filepath.Join(dir, name), out, func(entry string, info os.FileInfo) error {
+			return errors.New("boom")
+		})
+		if assert.Error(t, err, name) {
+			assert.Contains(t, err.Error(), "boom")
+		}
+	}
+}
+
+func TestExtractZipWithoutMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on Windows")
+	}
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	// Entries created by a Unix zip tool but without external attributes
+	// have mode 0000.
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for _, name := range []string{"dir/", "dir/file.txt"} {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: name, CreatorVersion: 3 << 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(name, "/") {
+			f.Write([]byte("content"))
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "windows.zip")
+	if err := ioutil.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "default")
+	if assert.NoError(t, Extract(archive, out)) {
+		assertFileMode(t, filepath.Join(out, "dir"), 0755)
+		assertFileMode(t, filepath.Join(out, "dir", "file.txt"), 0644)
+	}
+
+	out = filepath.Join(dir, "custom")
+	if assert.NoError(t, Extract(archive, out, ExtractWithMode(0600, 0700))) {
+		assertFileMode(t, filepath.Join(out, "dir"), 0700)
+		assertFileMode(t, filepath.Join(out, "dir", "file.txt"), 0600)
+	}
+}
+
+func assertFileMode(t testing.TB, path string, want os.FileMode) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, want, info.Mode().Perm(), path)
+	}
+}
+
+func TestTarGzReaders(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	config := "filebeat.inputs: []\n"
+	archive := filepath.Join(dir, "bundle.tar.gz")
+	err := TarGzReaders(archive, []TarEntry{
+		{Name: "bundle", Mode: os.ModeDir, ModTime: modTime},
+		{Name: "bundle/filebeat.yml", Mode: 0600, ModTime: modTime, Size: int64(len(config)), Content: strings.NewReader(config)},
+		{Name: "bundle/run.sh", Mode: 0755, ModTime: modTime, Size: 2, Content: bytes.NewReader([]byte("#!"))},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	out := filepath.Join(dir, "out")
+	if err = os.MkdirAll(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.NoError(t, Extract(archive, out)) {
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(out, "bundle", "filebeat.yml"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, config, string(data))
+	}
+	if runtime.GOOS != "windows" {
+		assertFileMode(t, filepath.Join(out, "bundle", "filebeat.yml"), 0600)
+		assertFileMode(t, filepath.Join(out, "bundle", "run.sh"), 0755)
+	}
+
+	// The size must match the content.
+	err = TarGzReaders(archive, []TarEntry{{Name: "short", Size: 10, Content: strings.NewReader("abc")}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "3 bytes")
+	}
+	err = TarGzReaders(archive, []TarEntry{{Name: "long", Size: 1, Content: strings.NewReader("abc")}})
+	assert.Error(t, err)
+}
+
+func TestValidateArchivePaths(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for _, ext := range []string{".zip", ".tar.gz"} {
+		write := writeTestZip
+		if ext != ".zip" {
+			write = writeTestTarGz
+		}
+
+		good := filepath.Join(dir, "good"+ext)
+		write(t, good, map[string]string{"a/b.txt": "b", "a/../c.txt": "c", "./d.txt": "d"})
+		assert.NoError(t, ValidateArchivePaths(good), ext)
+
+		for i, name := range []string{"../evil.txt", "a/../../evil.txt", "/etc/evil.txt", `..\evil.txt`} {
+			bad := filepath.Join(dir, fmt.Sprintf("bad%d%v", i, ext))
+			write(t, bad, map[string]string{"a/b.txt": "b", name: "evil"})
+			assert.Error(t, ValidateArchivePaths(bad), "%v in %v", name, ext)
+
+			dest := filepath.Join(dir, fmt.Sprintf("dest%d%v", i, ext))
+			assert.Error(t, Extract(bad, dest, ExtractValidatePaths()), "%v in %v", name, ext)
+			_, err := os.Stat(dest)
+			assert.True(t, os.IsNotExist(err), "nothing must be extracted from %v", bad)
+		}
+	}
+}
+
+func TestExtractExecutable(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	bin := "tool" + binaryExtension(runtime.GOOS)
+	archive := filepath.Join(dir, "tool.zip")
+	writeTestZip(t, archive, map[string]string{"tool-1.0/" + bin: "#!/bin/sh", "tool-1.0/README": "readme"})
+
+	dest := filepath.Join(dir, "out")
+	path, err := ExtractExecutable(archive, dest, "tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, filepath.Join(dest, "tool-1.0", bin), path)
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+		}
+	}
+
+	_, err = ExtractExecutable(archive, filepath.Join(dir, "out2"), "missing")
+	assert.Error(t, err)
+
+	ambiguous := filepath.Join(dir, "ambiguous.zip")
+	writeTestZip(t, ambiguous, map[string]string{"a/" + bin: "a", "b/" + bin: "b"})
+	_, err = ExtractExecutable(ambiguous, filepath.Join(dir, "out3"), "tool")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "found multiple")
+	}
+}
+
+func TestExtractMaxEntries(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	entries := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		entries[fmt.Sprintf("f%04d.txt", i)] = ""
+	}
+
+	for _, ext := range []string{".zip", ".tar.gz"} {
+		archive := filepath.Join(dir, "many"+ext)
+		if ext == ".zip" {
+			writeTestZip(t, archive, entries)
+		} else {
+			writeTestTarGz(t, archive, entries)
+		}
+
+		// untar requires the destination to exist.
+		limited, dest := filepath.Join(dir, "limited"+ext), filepath.Join(dir, "unlimited"+ext)
+		for _, d := range []string{limited, dest} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := Extract(archive, limited, ExtractMaxEntries(100))
+		if assert.Error(t, err, ext) {
+			assert.Contains(t, err.Error(), "more than the maximum of 100 entries")
+		}
+
+		assert.NoError(t, Extract(archive, dest, ExtractMaxEntries(1000)), ext)
+		files, err := ioutil.ReadDir(dest)
+		if assert.NoError(t, err) {
+			assert.Len(t, files, 1000)
+		}
+	}
+}
@@ -20,7 +20,6 @@ package mage
 import (
 	"fmt"
 	"go/build"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -139,6 +138,6 @@ func Build(params BuildArgs) error {
 		args = append(args, MustExpand(strings.Join(ldflags, " ")))
 	}
 
-	log.Println("Adding build environment vars:", env)
+	logDebug("Adding build environment vars:", env)
 	return sh.RunWith(env, "go", args...)
 }
@@ -0,0 +1,855 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/magefile/mage/mg"
+	"github.com/magefile/mage/sh"
+	"github.com/pkg/errors"
+)
+
+// Cmd describes an external command to execute.
+type Cmd struct {
+	Args []string          // Command name followed by its arguments.
+	Env  map[string]string // Variables added to the process environment. Values are expanded as templates.
+	Dir  string            // Working directory. Relative paths are resolved against the project's root dir.
+
+	Retries int           // Number of times to retry the command if it fails.
+	Backoff time.Duration // Delay before the first retry. It doubles after each attempt.
+	Timeout time.Duration // Maximum duration of each attempt. Zero means no limit.
+
+	// Stdin is the data written to the command's stdin. Use strings.NewReader
+	// or bytes.NewReader to pass a string or []byte. The data is never logged
+	// so it may contain secrets. When nil the process's stdin is inherited.
+	Stdin io.Reader
+
+	// Stream writes the command's output to the console as it is produced
+	// instead of only when the command fails (see streamOutput).
+	Stream bool
+
+	// Stdout receives the command's stdout as it is produced when it is set.
+	// Stderr is then only written to the console if Stream is enabled, but its
+	// tail is always included in the error. The output of failed attempts is
+	// written too if the command is retried.
+	Stdout io.Writer
+
+	// Stderr receives the command's stderr as it is produced when it is set.
+	// Like for Stdout, the other stream is then only written to the console if
+	// Stream is enabled.
+	Stderr io.Writer
+}
+
+// Run executes the command. Unlike os.Chdir, setting Dir only affects this
+// command so it is safe to use from parallel jobs.
+func (c Cmd) Run() error {
+	return c.RunContext(context.Background())
+}
+
+// RunContext executes the command. The command is killed if ctx is done or
+// the Timeout elapses before it completes. On Unix the whole process group is
+// killed so that any children started by the command also terminate.
+//
+// The command is executed by the Runner associated with ctx (see WithRunner).
+func (c Cmd) RunContext(ctx context.Context) error {
+	runner := RunnerFromContext(ctx)
+	return c.retry(ctx, func(ctx context.Context, c Cmd) error {
+		return runner.Run(ctx, c)
+	})
+}
+
+// retry invokes fn up to c.Retries+1 times until it succeeds. It stops early
+// if ctx is done. Stdin is buffered when retries are enabled so that each
+// attempt is passed a Cmd that receives the same input.
+func (c Cmd) retry(ctx context.Context, fn func(context.Context, Cmd) error) error {
+	var stdin []byte
+	if c.Stdin != nil && c.Retries > 0 {
+		data, err := ioutil.ReadAll(c.Stdin)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read stdin for command %q", c.String())
+		}
+		stdin = data
+	}
+
+	var err error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if stdin != nil {
+			c.Stdin = bytes.NewReader(stdin)
+		}
+
+		if attempt > 0 {
+			delay := c.Backoff << uint(attempt-1)
+			LoggerFromContext(ctx).Warnf("Command %q failed (attempt %d of %d), retrying in %v: %v",
+				c.String(), attempt, c.Retries+1, delay, err)
+			select {
+			case <-ctx.Done():
+				return errors.Wrapf(err, "command %q canceled before retrying (%v)", c.String(), ctx.Err())
+			case <-time.After(delay):
+			}
+		}
+
+		if err = fn(ctx, c); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// CmdFailureOutputLimit is the number of bytes of a command's combined output
+// that are retained while it runs. The output is only written to the console
+// if the command fails, unless output streaming is enabled.
+var CmdFailureOutputLimit = 64 * 1024
+
+// streamOutput returns true if command output should be written to the
+// console as it is produced. This is enabled by mage -v or by setting
+// DEV_TOOLS_STREAM_OUTPUT=true.
+func streamOutput() bool {
+	return mg.Verbose() || envFlag("DEV_TOOLS_STREAM_OUTPUT")
+}
+
+// run executes the command. Unless Stream or streamOutput is enabled the
+// output is captured and only written to stderr if the command fails.
+func (c Cmd) run(ctx context.Context) error {
+	if c.Stdout != nil || c.Stderr != nil {
+		stdout, stderr := c.Stdout, c.Stderr
+		if c.Stream || streamOutput() {
+			if stdout == nil {
+				stdout = os.Stdout
+			}
+			if stderr == nil {
+				stderr = os.Stderr
+			}
+		}
+		return c.execute(ctx, stdout, stderr)
+	}
+	if c.Stream || streamOutput() {
+		return c.execute(ctx, os.Stdout, os.Stderr)
+	}
+
+	out := &tailBuffer{limit: CmdFailureOutputLimit}
+	w := &lockedWriter{w: out}
+	err := c.execute(ctx, w, w)
+	if err != nil && len(out.buf) > 0 {
+		header := fmt.Sprintf(">> Output of %v:", c)
+		if out.written > int64(len(out.buf)) {
+			header = fmt.Sprintf(">> Output of %v (last %v):", c, HumanSize(int64(len(out.buf))))
+		}
+		fmt.Fprintf(os.Stderr, "%v\n%s\n", header, strings.TrimSuffix(out.String(), "\n"))
+	}
+	return err
+}
+
+// execute performs a single attempt at running the command with its output
+// written to the given writers (which may be nil). If the command fails the
+// returned error includes the tail of stderr.
+func (c Cmd) execute(ctx context.Context, stdout, stderr io.Writer) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	cmd, err := c.command(ctx)
+	if err != nil {
+		return err
+	}
+
+	stderrTail := &tailBuffer{limit: 2048}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderrTail
+	if stderr != nil {
+		cmd.Stderr = io.MultiWriter(stderr, stderrTail)
+	}
+
+	if c.announce(ctx) {
+		return nil
+	}
+	start := time.Now()
+	stopHeartbeat := c.heartbeat(ctx, start)
+	if err = cmd.Start(); err == nil {
+		stopKill := killProcessGroupOnCancel(ctx, cmd)
+		err = cmd.Wait()
+		stopKill()
+	}
+	stopHeartbeat()
+	if err != nil {
+		return c.wrapError(ctx, err, stderrTail.String(), time.Since(start))
+	}
+	return nil
+}
+
+// heartbeat periodically logs that the command is still running so that CI
+// systems do not consider a quiet, long running command to be hung. The
+// interval is set with DEV_TOOLS_HEARTBEAT_INTERVAL (default 1m). A value of
+// 0 disables it.
+func (c Cmd) heartbeat(ctx context.Context, start time.Time) (stop func()) {
+	log := LoggerFromContext(ctx)
+	interval, err := time.ParseDuration(EnvOr("DEV_TOOLS_HEARTBEAT_INTERVAL", "1m"))
+	if err != nil {
+		log.Warn("Ignoring invalid DEV_TOOLS_HEARTBEAT_INTERVAL:", err)
+		interval = time.Minute
+	}
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				log.Infof("Still running %v (%v elapsed)", c, time.Since(start).Round(time.Second))
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// withTimeout returns a context that expires after c.Timeout.
+func (c Cmd) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Timeout > 0 {
+		return context.WithTimeout(ctx, c.Timeout)
+	}
+	return ctx, func() {}
+}
+
+// CmdOutputLimit is the maximum number of bytes of stdout and of stderr that
+// are retained for each command by Cmd.Output and OutputCmds. For stdout the
+// beginning of the output is kept and for stderr the end is kept.
+var CmdOutputLimit = 1024 * 1024
+
+// CmdOutput contains the output captured from a command.
+type CmdOutput struct {
+	Stdout    string // Captured stdout with the trailing newline removed.
+	Stderr    string // Tail of the captured stderr.
+	Truncated bool   // True if stdout exceeded CmdOutputLimit.
+}
+
+// Output executes the command and captures its output. The output is also
+// written to the console when mage is run in verbose mode. If the command
+// fails the returned error contains the tail of stderr.
+func (c Cmd) Output() (CmdOutput, error) {
+	return c.OutputContext(context.Background())
+}
+
+// OutputContext executes the command and captures its output. The command is
+// killed if ctx is done or the Timeout elapses before it completes. The
+// command is executed by the Runner associated with ctx (see WithRunner).
+func (c Cmd) OutputContext(ctx context.Context) (CmdOutput, error) {
+	var out CmdOutput
+	runner := RunnerFromContext(ctx)
+	err := c.retry(ctx, func(ctx context.Context, c Cmd) error {
+		var err error
+		out, err = runner.Output(ctx, c)
+		return err
+	})
+	return out, err
+}
+
+func (c Cmd) output(ctx context.Context) (CmdOutput, error) {
+	stdout := &headBuffer{limit: CmdOutputLimit}
+	stderr := &tailBuffer{limit: CmdOutputLimit}
+
+	var stdoutWriter, stderrWriter io.Writer = stdout, stderr
+	if mg.Verbose() {
+		stdoutWriter = io.MultiWriter(stdout, os.Stdout)
+		stderrWriter = io.MultiWriter(stderr, os.Stderr)
+	}
+
+	err := c.execute(ctx, stdoutWriter, stderrWriter)
+	return CmdOutput{
+		Stdout:    strings.TrimSuffix(stdout.String(), "\n"),
+		Stderr:    stderr.String(),
+		Truncated: stdout.truncated,
+	}, err
+}
+
+// command returns an exec.Cmd configured with the command's args, working
+// directory, environment, and stdin. The process is killed when ctx is done.
+func (c Cmd) command(ctx context.Context) (*exec.Cmd, error) {
+	if len(c.Args) == 0 {
+		return nil, errors.New("no command specified")
+	}
+
+	dir, err := c.resolveDir()
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := expandEnv(c.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdin = os.Stdin
+	if c.Stdin != nil {
+		cmd.Stdin = c.Stdin
+	}
+	if ctx.Done() != nil {
+		setProcessGroup(cmd)
+	}
+	return cmd, nil
+}
+
+// announce logs the command to the logger of ctx prior to its execution. It
+// returns true if the command must not be executed because dry-run mode is
+// enabled.
+func (c Cmd) announce(ctx context.Context) (dryRun bool) {
+	log := LoggerFromContext(ctx)
+	switch {
+	case envFlag("DEV_TOOLS_DRY_RUN"):
+		log.Info("dry-run:", c.ShellString())
+		return true
+	case envFlag("DEV_TOOLS_ECHO"):
+		log.Info("exec:", c.ShellString())
+	default:
+		log.Debug("exec:", c.String())
+	}
+	return false
+}
+
+// ShellString returns the command line quoted such that it can be executed by
+// a POSIX shell. It includes the environment variables and working directory
+// specified for the command.
+func (c Cmd) ShellString() string {
+	var parts []string
+	if c.Dir != "" {
+		dir, err := c.resolveDir()
+		if err != nil {
+			dir = c.Dir
+		}
+		parts = append(parts, "cd", shellQuote(dir), "&&")
+	}
+
+	keys := make([]string, 0, len(c.Env))
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env, err := expandEnv(c.Env)
+	if err != nil {
+		env = c.Env
+	}
+	for _, k := range keys {
+		parts = append(parts, k+"="+shellQuote(env[k]))
+	}
+
+	for _, arg := range c.Args {
+		parts = append(parts, shellQuote(arg))
+	}
+	if c.Stdin != nil {
+		parts = append(parts, stdinMarker)
+	}
+	return strings.Join(parts, " ")
+}
+
+// stdinMarker is shown in place of the data when logging a command that has
+// Stdin set.
+const stdinMarker = "< [stdin]"
+
+// shellQuote quotes s for use as a single argument in a POSIX shell.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, func(r rune) bool { return !isShellSafe(r) }) == -1 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// ShellQuoteList quotes each path for use as a separate argument in a POSIX
+// shell (sh or bash) and joins them with spaces. Paths containing whitespace,
+// quotes, or other special characters are wrapped in single quotes.
+func ShellQuoteList(paths []string) string {
+	quoted := make([]string, 0, len(paths))
+	for _, p := range paths {
+		quoted = append(quoted, shellQuote(p))
+	}
+	return strings.Join(quoted, " ")
+}
+
+func isShellSafe(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("-_./:=,+@%", r)
+}
+
+// envFlag returns true if the environment variable is set to a true value as
+// parsed by EnvBool.
+func envFlag(name string) bool {
+	return EnvBool(name, false)
+}
+
+// String returns the command line.
+func (c Cmd) String() string {
+	s := strings.Join(c.Args, " ")
+	if c.Stdin != nil {
+		s += " " + stdinMarker
+	}
+	if c.Dir != "" {
+		s += " (in " + c.Dir + ")"
+	}
+	return s
+}
+
+// resolveDir returns the absolute working directory for the command. It
+// returns an empty string when no directory was specified.
+func (c Cmd) resolveDir() (string, error) {
+	if c.Dir == "" || filepath.IsAbs(c.Dir) {
+		return c.Dir, nil
+	}
+
+	repo, err := GetProjectRepoInfo()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to resolve command working directory")
+	}
+	return filepath.Join(repo.RootDir, c.Dir), nil
+}
+
+// wrapError adds the command line and the tail of stderr (if captured) to the
+// error returned by exec. It reports if the command was killed because ctx
+// was done.
+func (c Cmd) wrapError(ctx context.Context, err error, stderr string, elapsed time.Duration) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return errors.Errorf("command %q timed out after %v", c.String(), elapsed.Round(time.Millisecond))
+	case context.Canceled:
+		return errors.Errorf("command %q was canceled after %v", c.String(), elapsed.Round(time.Millisecond))
+	}
+
+	if ee, ok := err.(*exec.ExitError); ok && ee.Exited() {
+		code := sh.ExitStatus(err)
+		if stderr = strings.TrimSpace(stderr); stderr != "" {
+			return mg.Fatalf(code, "running \"%v\" failed with exit code %d, stderr:\n%v", c, code, stderr)
+		}
+		return mg.Fatalf(code, `running "%v" failed with exit code %d`, c, code)
+	}
+	return errors.Wrapf(err, `failed to run "%v"`, c)
+}
+
+// RunCmds runs the given commands and stops upon the first error. $VAR and
+// ${VAR} references in the args are expanded from the environment.
+//
+// The output of each command is captured and only written to stderr if the
+// command fails. Use mage -v or DEV_TOOLS_STREAM_OUTPUT=true to stream the
+// output instead.
+//
+// Commands are only logged, and not executed, when DEV_TOOLS_DRY_RUN=true.
+// When DEV_TOOLS_ECHO=true each command is logged prior to execution. This
+// applies to all of the command runners in this package.
+func RunCmds(cmds ...[]string) error {
+	return RunCmdsContext(context.Background(), cmds...)
+}
+
+// RunCmdsEnv runs the given commands with env added to the environment of each
+// command and stops upon the first error. The process environment is not
+// modified. The env values are expanded as templates (see Expand) prior to
+// use.
+func RunCmdsEnv(env map[string]string, cmds ...[]string) error {
+	for _, cmd := range cmds {
+		if err := (Cmd{Args: cmd, Env: env}).Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunCommands runs the given commands and stops upon the first error. Commands
+// that specify Retries are retried individually without re-executing the
+// commands that preceded them.
+func RunCommands(cmds ...Cmd) error {
+	for _, cmd := range cmds {
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OutputCmds runs the given commands and returns their captured output keyed
+// by command line (the args joined by spaces). It stops upon the first error
+// and returns the output collected up to and including the failed command.
+func OutputCmds(cmds ...[]string) (map[string]CmdOutput, error) {
+	outputs := make(map[string]CmdOutput, len(cmds))
+	for _, cmd := range cmds {
+		out, err := (Cmd{Args: cmd}).Output()
+		outputs[strings.Join(cmd, " ")] = out
+		if err != nil {
+			return outputs, err
+		}
+	}
+	return outputs, nil
+}
+
+// RunJSON runs the command and unmarshals its stdout as JSON into v. An error
+// that includes the command is returned if the output is not valid JSON or if
+// it was truncated because it exceeded CmdOutputLimit.
+func RunJSON(v interface{}, cmd string, args ...string) error {
+	return RunJSONContext(context.Background(), v, cmd, args...)
+}
+
+// RunJSONContext is like RunJSON but the command is killed if ctx is done and
+// it is executed by the Runner associated with ctx (see WithRunner).
+func RunJSONContext(ctx context.Context, v interface{}, cmd string, args ...string) error {
+	c := Cmd{Args: append([]string{cmd}, args...)}
+	out, err := c.OutputContext(ctx)
+	if err != nil {
+		return err
+	}
+	if out.Truncated {
+		return errors.Errorf("output of %v exceeded %v and was truncated", c, HumanSize(int64(CmdOutputLimit)))
+	}
+	if err = json.Unmarshal([]byte(out.Stdout), v); err != nil {
+		return errors.Wrapf(err, "failed to parse JSON output of %v", c)
+	}
+	return nil
+}
+
+// RunCmdsContext runs the given commands and stops upon the first error. A
+// command that is still running when ctx is done is killed. The commands are
+// executed by the Runner associated with ctx (see WithRunner). Like RunCmds,
+// $VAR and ${VAR} references in the args are expanded from the environment.
+func RunCmdsContext(ctx context.Context, cmds ...[]string) error {
+	for _, cmd := range cmds {
+		if err := (Cmd{Args: expandEnvArgs(cmd)}).RunContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandEnvArgs returns a copy of args with $VAR and ${VAR} references
+// replaced by the values of the environment variables. This matches the
+// behavior of sh.Run that RunCmds used previously.
+func expandEnvArgs(args []string) []string {
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = os.ExpandEnv(arg)
+	}
+	return expanded
+}
+
+// RunCmdsParallel runs the given commands concurrently. At most as many
+// commands run at once as Parallel allows jobs, but the commands don't occupy
+// the slots of Parallel so it is safe to call from within a Parallel job. The
+// combined stdout and stderr of each command is captured (up to
+// CmdFailureOutputLimit) and written to stdout as a unit when the command
+// completes so that the output of commands is not interleaved. Like for
+// RunCmds, the output is only written if the command fails unless output
+// streaming is enabled (see streamOutput). The output is written in the order
+// that the commands complete. All commands are executed and the returned error
+// identifies each command that failed. $VAR and ${VAR} references in the args
+// are expanded from the environment.
+func RunCmdsParallel(cmds ...[]string) error {
+	return runCmdsParallel(context.Background(), false, cmds)
+}
+
+// RunCmdsParallelOrdered is like RunCmdsParallel except that command output is
+// written in the order the commands were given.
+func RunCmdsParallelOrdered(cmds ...[]string) error {
+	return runCmdsParallel(context.Background(), true, cmds)
+}
+
+func runCmdsParallel(ctx context.Context, ordered bool, cmds [][]string) error {
+	type result struct {
+		cmd    Cmd
+		output *tailBuffer
+		err    error
+		done   bool
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make([]result, len(cmds))
+		next    int
+		limit   = make(chan struct{}, cap(parallelJobs()))
+	)
+
+	print := func(r result) {
+		if r.err == nil && !streamOutput() {
+			return
+		}
+		header := fmt.Sprintf(">> %v", r.cmd)
+		if r.output.written > int64(len(r.output.buf)) {
+			header = fmt.Sprintf(">> %v (last %v of output)", r.cmd, HumanSize(int64(len(r.output.buf))))
+		}
+		fmt.Fprintf(os.Stdout, "%v\n%s", header, r.output.String())
+	}
+
+	for i, args := range cmds {
+		wg.Add(1)
+		go func(i int, c Cmd) {
+			defer wg.Done()
+
+			limit <- struct{}{}
+			out := &tailBuffer{limit: CmdFailureOutputLimit}
+			w := &lockedWriter{w: out}
+			c.Stdout, c.Stderr = w, w
+			err := c.RunContext(ctx)
+			<-limit
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[i] = result{cmd: c, output: out, err: err, done: true}
+			if !ordered {
+				print(results[i])
+				return
+			}
+			for ; next < len(results) && results[next].done; next++ {
+				print(results[next])
+			}
+		}(i, Cmd{Args: expandEnvArgs(args)})
+	}
+	wg.Wait()
+
+	var errs []string
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", r.cmd, r.err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("%d of %d commands failed:\n%v", len(errs), len(cmds), strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// RunShellCmd expands the given script as a Go text/template (using FuncMap
+// and EnvMap) and executes it with the host's shell. On Unix the script is run
+// with "sh -c". On Windows it is run with "powershell -NoProfile -Command"
+// unless DEV_TOOLS_WINDOWS_SHELL=cmd is set, in which case "cmd /C" is used.
+//
+// Scripts are only portable between these shells if they are restricted to
+// running commands with arguments, chaining commands with "&&" (which requires
+// PowerShell 7 or cmd), and redirecting output with ">" or ">>". Globbing,
+// variable references, quoting rules, and control flow differ between the
+// shells so prefer RunCmds for anything else.
+func RunShellCmd(script string) error {
+	expanded, err := Expand(script)
+	if err != nil {
+		return errors.Wrap(err, "failed to expand shell script")
+	}
+
+	args, err := shellArgs(runtime.GOOS, os.Getenv("DEV_TOOLS_WINDOWS_SHELL"), expanded)
+	if err != nil {
+		return err
+	}
+	return Cmd{Args: args}.Run()
+}
+
+// shellArgs returns the command used to execute script on the given OS.
+func shellArgs(goos, windowsShell, script string) ([]string, error) {
+	if goos != "windows" {
+		return []string{"sh", "-c", script}, nil
+	}
+
+	switch strings.ToLower(windowsShell) {
+	case "", "powershell":
+		return []string{"powershell", "-NoProfile", "-NonInteractive", "-Command", script}, nil
+	case "cmd":
+		return []string{"cmd", "/C", script}, nil
+	default:
+		return nil, errors.Errorf("invalid DEV_TOOLS_WINDOWS_SHELL value %q (expected powershell or cmd)", windowsShell)
+	}
+}
+
+// RunWithEnv runs the command with env merged over the process environment
+// and streams its output. The process environment itself is not modified so
+// this is safe to use from parallel jobs, unlike os.Setenv. Values are
+// expanded as templates like Cmd.Env.
+func RunWithEnv(env map[string]string, cmd string, args ...string) error {
+	return Cmd{Args: append([]string{cmd}, args...), Env: env, Stream: true}.Run()
+}
+
+// RunScan runs the command and invokes lineFn for each line of its stdout as
+// it is produced, without buffering the whole output. If lineFn returns an
+// error the command is killed and the error is returned. Stderr is handled
+// like by RunCmds.
+func RunScan(lineFn func(line string) error, cmd string, args ...string) error {
+	return runScan(context.Background(), lineFn, cmd, args...)
+}
+
+func runScan(ctx context.Context, lineFn func(line string) error, cmd string, args ...string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	scanErr := make(chan error, 1)
+	go func() {
+		err := scanLines(pr, lineFn)
+		if err != nil {
+			// Kill the command and unblock its writes.
+			cancel()
+			pr.CloseWithError(err)
+		}
+		scanErr <- err
+	}()
+
+	err := Cmd{Args: append([]string{cmd}, args...), Stdout: pw}.RunContext(ctx)
+	pw.Close()
+	if lineErr := <-scanErr; lineErr != nil {
+		return lineErr
+	}
+	return err
+}
+
+// scanLines invokes lineFn for each line read from r until EOF or until
+// lineFn returns an error.
+func scanLines(r io.Reader, lineFn func(line string) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		if err := lineFn(s.Text()); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(s.Err(), "failed to read command output")
+}
+
+// RunCmdsIn runs the given commands in dir and stops upon the first error. A
+// relative dir is resolved against the project's root dir (not the CWD). The
+// process's working directory is not changed.
+func RunCmdsIn(dir string, cmds ...[]string) error {
+	for _, cmd := range cmds {
+		if err := (Cmd{Args: cmd, Dir: dir}).Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandEnv returns a copy of env with each value expanded as a template.
+func expandEnv(env map[string]string) (map[string]string, error) {
+	if len(env) == 0 {
+		return nil, nil
+	}
+
+	out := make(map[string]string, len(env))
+	for k, v := range env {
+		expanded, err := Expand(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to expand env var %v", k)
+		}
+		out[k] = expanded
+	}
+	return out, nil
+}
+
+// headBuffer is an io.Writer that retains the first limit bytes written to it
+// and discards the rest.
+type headBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if remaining := b.limit - b.buf.Len(); remaining < len(p) {
+		b.truncated = true
+		if remaining <= 0 {
+			return n, nil
+		}
+		p = p[:remaining]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+func (b *headBuffer) String() string {
+	return b.buf.String()
+}
+
+// tailBuffer is an io.Writer that retains the last limit bytes written to it.
+type tailBuffer struct {
+	buf     []byte
+	limit   int
+	written int64 // Total number of bytes written.
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.written += int64(n)
+	if len(p) >= b.limit {
+		b.buf = append(b.buf[:0], p[len(p)-b.limit:]...)
+		return n, nil
+	}
+	if overflow := len(b.buf) + len(p) - b.limit; overflow > 0 {
+		b.buf = append(b.buf[:0], b.buf[overflow:]...)
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+// Tail returns the last n bytes.
+func (b *tailBuffer) Tail(n int) string {
+	if len(b.buf) > n {
+		return string(b.buf[len(b.buf)-n:])
+	}
+	return string(b.buf)
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.buf)
+}
+
+// lockedWriter serializes writes to w. It allows one writer to be used for
+// both stdout and stderr of a command which are copied by separate goroutines.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
@@ -0,0 +1,725 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func skipIfNoShell(t testing.TB) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires sh")
+	}
+}
+
+// writeEnvCheckScript writes a script that exits non-zero if MAGE_TEST_VALUE
+// does not equal its first argument. A script is used because sh.Run expands
+// $VAR references contained in the command's arguments.
+func writeEnvCheckScript(t testing.TB) (script string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "mage-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script = filepath.Join(dir, "check_env.sh")
+	if err = ioutil.WriteFile(script, []byte(`test "$MAGE_TEST_VALUE" = "$1"`+"\n"), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return script, func() { os.RemoveAll(dir) }
+}
+
+func TestRunCmdsEnvIsolation(t *testing.T) {
+	skipIfNoShell(t)
+	script, cleanup := writeEnvCheckScript(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, value := range []string{"first", "second"} {
+		wg.Add(1)
+		go func(i int, value string) {
+			defer wg.Done()
+			errs[i] = RunCmdsEnv(map[string]string{"MAGE_TEST_VALUE": value},
+				[]string{"sleep", "0.1"},
+				[]string{"sh", script, value},
+			)
+		}(i, value)
+	}
+	wg.Wait()
+
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+	assert.Empty(t, os.Getenv("MAGE_TEST_VALUE"))
+}
+
+func TestRunWithEnv(t *testing.T) {
+	skipIfNoShell(t)
+	script, cleanup := writeEnvCheckScript(t)
+	defer cleanup()
+
+	defer os.Setenv("MAGE_TEST_VALUE", os.Getenv("MAGE_TEST_VALUE"))
+	os.Setenv("MAGE_TEST_VALUE", "parent")
+
+	assert.NoError(t, RunWithEnv(map[string]string{"MAGE_TEST_VALUE": "child"}, "sh", script, "child"))
+	assert.Error(t, RunWithEnv(map[string]string{"MAGE_TEST_VALUE": "child"}, "sh", script, "parent"))
+	assert.NoError(t, RunWithEnv(nil, "sh", script, "parent"))
+	assert.Equal(t, "parent", os.Getenv("MAGE_TEST_VALUE"))
+
+	// The output is streamed even though the command succeeds.
+	out := captureStdout(t, func() {
+		assert.NoError(t, RunWithEnv(map[string]string{"MAGE_TEST_VALUE": "streamed"}, "sh", "-c", `echo "$MAGE_TEST_VALUE"`))
+	})
+	assert.Equal(t, "streamed\n", out)
+}
+
+func TestRunCmdsEnvExpandsTemplates(t *testing.T) {
+	skipIfNoShell(t)
+	script, cleanup := writeEnvCheckScript(t)
+	defer cleanup()
+
+	err := RunCmdsEnv(map[string]string{"MAGE_TEST_VALUE": "{{ .GOOS }}"},
+		[]string{"sh", script, GOOS},
+	)
+	assert.NoError(t, err)
+
+	err = RunCmdsEnv(map[string]string{"MAGE_TEST_VALUE": "other"},
+		[]string{"sh", script, GOOS},
+	)
+	assert.Error(t, err)
+}
+
+func TestRunCmdsInParallel(t *testing.T) {
+	skipIfNoShell(t)
+
+	dirs := make([]string, 2)
+	for i := range dirs {
+		dir, cleanup := tempDir(t)
+		defer cleanup()
+		dirs[i] = dir
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(dirs))
+	for i, dir := range dirs {
+		wg.Add(1)
+		go func(i int, dir string) {
+			defer wg.Done()
+			errs[i] = RunCmdsIn(dir,
+				[]string{"sleep", "0.1"},
+				[]string{"sh", "-c", "pwd > out.txt"},
+			)
+		}(i, dir)
+	}
+	wg.Wait()
+
+	for i, dir := range dirs {
+		if !assert.NoError(t, errs[i]) {
+			continue
+		}
+		out, err := ioutil.ReadFile(filepath.Join(dir, "out.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := filepath.EvalSymlinks(strings.TrimSpace(string(out)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestRunCmdsInRelativeToRepoRoot(t *testing.T) {
+	skipIfNoShell(t)
+
+	assert.NoError(t, RunCmdsIn("dev-tools/mage", []string{"test", "-f", "command.go"}))
+	assert.Error(t, RunCmdsIn("dev-tools", []string{"test", "-f", "command.go"}))
+}
+
+func TestOutputCmds(t *testing.T) {
+	skipIfNoShell(t)
+
+	out, err := OutputCmds(
+		[]string{"echo", "hello"},
+		[]string{"sh", "-c", "echo world; echo warning >&2"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hello", out["echo hello"].Stdout)
+	assert.Equal(t, "world", out["sh -c echo world; echo warning >&2"].Stdout)
+	assert.Equal(t, "warning\n", out["sh -c echo world; echo warning >&2"].Stderr)
+}
+
+func TestOutputCmdsErrorIncludesStderr(t *testing.T) {
+	skipIfNoShell(t)
+
+	out, err := OutputCmds(
+		[]string{"echo", "hello"},
+		[]string{"sh", "-c", "echo something went wrong >&2; exit 3"},
+		[]string{"echo", "not executed"},
+	)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "exit code 3")
+		assert.Contains(t, err.Error(), "something went wrong")
+	}
+	assert.Len(t, out, 2)
+}
+
+func TestOutputCmdsLimit(t *testing.T) {
+	skipIfNoShell(t)
+
+	defer func(limit int) { CmdOutputLimit = limit }(CmdOutputLimit)
+	CmdOutputLimit = 4
+
+	out, err := (Cmd{Args: []string{"sh", "-c", "echo 123456789; echo abcdefghi >&2"}}).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1234", out.Stdout)
+	assert.True(t, out.Truncated)
+	assert.Equal(t, "ghi\n", out.Stderr)
+}
+
+func TestShellQuote(t *testing.T) {
+	cases := map[string]string{
+		"":                  "''",
+		"simple":            "simple",
+		"--flag=value":      "--flag=value",
+		"with space":        "'with space'",
+		"it's":              `'it'\''s'`,
+		`"double"`:          `'"double"'`,
+		"$HOME; rm -rf /":   "'$HOME; rm -rf /'",
+		"back\\slash`tick`": "'back\\slash`tick`'",
+	}
+	for in, expected := range cases {
+		assert.Equal(t, expected, shellQuote(in), in)
+	}
+}
+
+func TestShellQuoteList(t *testing.T) {
+	skipIfNoShell(t)
+
+	paths := []string{"plain.txt", "with space.txt", "it's.txt", "$(touch pwned)", "new\nline", "*", ""}
+	script := `for f in ` + ShellQuoteList(paths) + `; do printf '%s|' "$f"; done`
+	out, err := (Cmd{Args: []string{"sh", "-c", script}}).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, strings.Join(paths, "|")+"|", out.Stdout)
+	assert.Equal(t, "", ShellQuoteList(nil))
+}
+
+func TestRunScan(t *testing.T) {
+	skipIfNoShell(t)
+
+	var lines []string
+	err := RunScan(func(line string) error {
+		lines = append(lines, line)
+		return nil
+	}, "sh", "-c", "echo compiling; echo 'BUILD SUCCESSFUL'; echo ignored >&2")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"compiling", "BUILD SUCCESSFUL"}, lines)
+	}
+
+	// An error from lineFn kills the command.
+	start := time.Now()
+	err = RunScan(func(line string) error {
+		return errors.Errorf("unexpected line %q", line)
+	}, "sh", "-c", "echo started; sleep 30")
+	assert.EqualError(t, err, `unexpected line "started"`)
+	assert.True(t, time.Since(start) < 10*time.Second, "command was not killed")
+
+	assert.Error(t, RunScan(func(string) error { return nil }, "sh", "-c", "exit 3"))
+}
+
+func TestRunScanRunner(t *testing.T) {
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"gradle build": {Stdout: "compiling\nBUILD SUCCESSFUL\n"},
+	}}
+
+	var lines []string
+	err := runScan(WithRunner(context.Background(), fake), func(line string) error {
+		lines = append(lines, line)
+		return nil
+	}, "gradle", "build")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"compiling", "BUILD SUCCESSFUL"}, lines)
+	}
+	assert.Len(t, fake.Calls(), 1)
+}
+
+func TestRunCmdsDryRun(t *testing.T) {
+	skipIfNoShell(t)
+
+	defer os.Setenv("DEV_TOOLS_DRY_RUN", os.Getenv("DEV_TOOLS_DRY_RUN"))
+	os.Setenv("DEV_TOOLS_DRY_RUN", "true")
+
+	ctx, buf := captureLog(InfoLevel)
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	marker := filepath.Join(dir, "it's here")
+
+	err := RunCmdsContext(ctx, []string{"touch", marker})
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), `dry-run: touch '`+strings.Replace(marker, "'", `'\''`, -1)+`'`)
+
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err), "command must not run in dry-run mode")
+
+	err = (Cmd{Args: []string{"echo", "a b"}, Env: map[string]string{"B": "x y", "A": "1"}, Dir: dir}).RunContext(ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), `dry-run: cd `+shellQuote(dir)+` && A=1 B='x y' echo 'a b'`)
+}
+
+func TestRunCmdsEcho(t *testing.T) {
+	skipIfNoShell(t)
+
+	defer os.Setenv("DEV_TOOLS_ECHO", os.Getenv("DEV_TOOLS_ECHO"))
+	os.Setenv("DEV_TOOLS_ECHO", "1")
+
+	ctx, buf := captureLog(InfoLevel)
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	marker := filepath.Join(dir, "marker")
+
+	assert.NoError(t, RunCmdsContext(ctx, []string{"touch", marker}))
+	assert.Contains(t, buf.String(), "exec: touch "+marker)
+	_, err := os.Stat(marker)
+	assert.NoError(t, err)
+}
+
+func TestRunCommandsRetries(t *testing.T) {
+	skipIfNoShell(t)
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	// Fails until it has been invoked three times.
+	flaky := Cmd{
+		Args:    []string{"sh", "-c", `n=$(cat count 2>/dev/null || echo 0); n=$((n+1)); echo $n > count; [ $n -ge 3 ]`},
+		Dir:     dir,
+		Retries: 2,
+		Backoff: time.Millisecond,
+	}
+	counter := Cmd{
+		Args: []string{"sh", "-c", "echo x >> prior"},
+		Dir:  dir,
+	}
+
+	assert.NoError(t, RunCommands(counter, flaky))
+
+	count, err := ioutil.ReadFile(filepath.Join(dir, "count"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "3\n", string(count))
+
+	// The command preceding the flaky command is executed only once.
+	prior, err := ioutil.ReadFile(filepath.Join(dir, "prior"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "x\n", string(prior))
+
+	// Not enough retries.
+	os.Remove(filepath.Join(dir, "count"))
+	flaky.Retries = 1
+	assert.Error(t, RunCommands(flaky))
+
+	// Non-retryable commands fail immediately.
+	os.Remove(filepath.Join(dir, "count"))
+	flaky.Retries = 0
+	assert.Error(t, RunCommands(flaky))
+	count, err = ioutil.ReadFile(filepath.Join(dir, "count"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1\n", string(count))
+}
+
+func TestCmdTimeout(t *testing.T) {
+	skipIfNoShell(t)
+
+	start := time.Now()
+	err := (Cmd{Args: []string{"sleep", "30"}, Timeout: 200 * time.Millisecond}).Run()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `"sleep 30" timed out after`)
+	}
+	assert.True(t, time.Since(start) < 3*time.Second, "command was not killed promptly")
+}
+
+func TestCmdTimeoutKillsChildren(t *testing.T) {
+	skipIfNoShell(t)
+
+	// The background sleep holds stdout open so Output would block until it
+	// exits if the child was not killed along with the shell.
+	start := time.Now()
+	_, err := (Cmd{Args: []string{"sh", "-c", "sleep 30 & wait"}, Timeout: 200 * time.Millisecond}).Output()
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 3*time.Second, "child process was not killed promptly")
+}
+
+func TestRunCmdsContextExpandsEnv(t *testing.T) {
+	defer os.Setenv("MAGE_TEST_VALUE", os.Getenv("MAGE_TEST_VALUE"))
+	os.Setenv("MAGE_TEST_VALUE", "expanded")
+
+	fake := &fakeRunner{}
+	args := []string{"echo", "$MAGE_TEST_VALUE", "${MAGE_TEST_VALUE}-suffix"}
+	assert.NoError(t, RunCmdsContext(WithRunner(context.Background(), fake), args))
+	if calls := fake.Calls(); assert.Len(t, calls, 1) {
+		assert.Equal(t, []string{"echo", "expanded", "expanded-suffix"}, calls[0].Args)
+	}
+	assert.Equal(t, "$MAGE_TEST_VALUE", args[1], "args must not be modified")
+}
+
+func TestRunCmdsContextCanceled(t *testing.T) {
+	skipIfNoShell(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	err := RunCmdsContext(ctx, []string{"sleep", "30"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "canceled")
+	}
+}
+
+// captureStdout redirects os.Stdout while fn executes and returns what was
+// written.
+func captureStdout(t testing.TB, fn func()) string {
+	return captureFile(t, &os.Stdout, fn)
+}
+
+// captureStderr redirects os.Stderr while fn executes and returns what was
+// written.
+func captureStderr(t testing.TB, fn func()) string {
+	return captureFile(t, &os.Stderr, fn)
+}
+
+func captureFile(t testing.TB, f **os.File, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := *f
+	*f = w
+	defer func() { *f = orig }()
+
+	out := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- data
+	}()
+
+	fn()
+	w.Close()
+	return string(<-out)
+}
+
+// setParallelJobs replaces the parallel job semaphore for the duration of a
+// test so that results do not depend on the number of CPUs.
+func setParallelJobs(t testing.TB, n int) {
+	parallelJobsLock.Lock()
+	prev := parallelJobsSemaphore
+	parallelJobsSemaphore = make(chan int, n)
+	parallelJobsLock.Unlock()
+
+	t.Cleanup(func() {
+		parallelJobsLock.Lock()
+		parallelJobsSemaphore = prev
+		parallelJobsLock.Unlock()
+	})
+}
+
+func TestRunCmdsParallel(t *testing.T) {
+	skipIfNoShell(t)
+	setParallelJobs(t, 3)
+	defer os.Setenv("DEV_TOOLS_STREAM_OUTPUT", os.Getenv("DEV_TOOLS_STREAM_OUTPUT"))
+	os.Setenv("DEV_TOOLS_STREAM_OUTPUT", "true")
+
+	var err error
+	out := captureStdout(t, func() {
+		err = RunCmdsParallel(
+			[]string{"sh", "-c", "sleep 0.3; echo first >&2"},
+			[]string{"sh", "-c", "echo second; exit 2"},
+			[]string{"sh", "-c", "sleep 0.1; echo third"},
+		)
+	})
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "1 of 3 commands failed")
+		assert.Contains(t, err.Error(), "sh -c echo second; exit 2")
+	}
+
+	// Output is grouped by command and in completion order.
+	first := strings.Index(out, ">> sh -c sleep 0.3; echo first >&2\nfirst\n")
+	second := strings.Index(out, ">> sh -c echo second; exit 2\nsecond\n")
+	third := strings.Index(out, ">> sh -c sleep 0.1; echo third\nthird\n")
+	assert.True(t, first >= 0 && second >= 0 && third >= 0, out)
+	assert.True(t, second < third && third < first, out)
+}
+
+func TestRunCmdsParallelOrdered(t *testing.T) {
+	skipIfNoShell(t)
+	setParallelJobs(t, 2)
+	defer os.Setenv("DEV_TOOLS_STREAM_OUTPUT", os.Getenv("DEV_TOOLS_STREAM_OUTPUT"))
+	os.Setenv("DEV_TOOLS_STREAM_OUTPUT", "true")
+
+	var err error
+	out := captureStdout(t, func() {
+		err = RunCmdsParallelOrdered(
+			[]string{"sh", "-c", "sleep 0.2; echo first"},
+			[]string{"echo", "second"},
+		)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ">> sh -c sleep 0.2; echo first\nfirst\n>> echo second\nsecond\n", out)
+}
+
+func TestRunCmdsParallelCapturesOutput(t *testing.T) {
+	setParallelJobs(t, 2)
+	defer os.Setenv("DEV_TOOLS_STREAM_OUTPUT", os.Getenv("DEV_TOOLS_STREAM_OUTPUT"))
+	os.Unsetenv("DEV_TOOLS_STREAM_OUTPUT")
+	defer os.Setenv("MAGE_TEST_VALUE", os.Getenv("MAGE_TEST_VALUE"))
+	os.Setenv("MAGE_TEST_VALUE", "expanded")
+	defer func(limit int) { CmdFailureOutputLimit = limit }(CmdFailureOutputLimit)
+	CmdFailureOutputLimit = 8
+
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"ok":   {Stdout: "quiet\n"},
+		"fail": {Stdout: "0123456789\n", Stderr: "boom\n", Err: errors.New("exit status 1")},
+	}}
+	ctx := WithRunner(context.Background(), fake)
+
+	var err error
+	out := captureStdout(t, func() {
+		err = runCmdsParallel(ctx, true, [][]string{{"ok"}, {"fail"}, {"echo", "$MAGE_TEST_VALUE"}})
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "1 of 3 commands failed")
+	}
+
+	// Only the tail of the failed command's output is written.
+	assert.Equal(t, ">> fail (last 8 B of output)\n89\nboom\n", out)
+	assert.ElementsMatch(t, []string{"ok", "fail", "echo expanded"}, fakeCommands(fake))
+}
+
+func TestRunCmdsParallelInParallelJob(t *testing.T) {
+	setParallelJobs(t, 1)
+
+	fake := &fakeRunner{}
+	ctx := WithRunner(context.Background(), fake)
+
+	// The outer job holds the only slot of Parallel.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Parallel(func() error {
+			return runCmdsParallel(ctx, false, [][]string{{"a"}, {"b"}})
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunCmdsParallel deadlocked inside a Parallel job")
+	}
+	assert.Len(t, fake.Calls(), 2)
+}
+
+func TestCmdStdin(t *testing.T) {
+	skipIfNoShell(t)
+
+	out, err := Cmd{Args: []string{"cat"}, Stdin: strings.NewReader("secret-value")}.Output()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "secret-value", out.Stdout)
+	}
+
+	// Stdin is replayed for each attempt.
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	marker := filepath.Join(dir, "marker")
+	c := Cmd{
+		Args:    []string{"sh", "-c", `read v; [ "$v" = "abc" ] || exit 2; [ -f "$0" ] && exit 0; touch "$0"; exit 1`, marker},
+		Stdin:   bytes.NewReader([]byte("abc\n")),
+		Retries: 1,
+	}
+	assert.NoError(t, c.Run())
+}
+
+func TestCmdStdinNotEchoed(t *testing.T) {
+	skipIfNoShell(t)
+	os.Setenv("DEV_TOOLS_ECHO", "true")
+	defer os.Unsetenv("DEV_TOOLS_ECHO")
+	ctx, buf := captureLog(InfoLevel)
+
+	c := Cmd{Args: []string{"cat"}, Stdin: strings.NewReader("hunter2")}
+	if _, err := c.OutputContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, buf.String(), "exec: cat < [stdin]")
+	assert.NotContains(t, buf.String(), "hunter2")
+}
+
+func TestRunShellCmd(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	out := filepath.Join(dir, "out.txt")
+	err := RunShellCmd(`echo {{ .Greeting }}> ` + out + ` && echo done>> ` + out)
+	if err == nil {
+		t.Fatal("expected error because Greeting is not defined")
+	}
+
+	os.Setenv("Greeting", "hello")
+	defer os.Unsetenv("Greeting")
+	if err = RunShellCmd(`echo {{ .Greeting }}> ` + out + ` && echo done>> ` + out); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"hello", "done"}, strings.Fields(string(data)))
+
+	assert.Error(t, RunShellCmd("exit 3"))
+}
+
+func TestShellArgs(t *testing.T) {
+	args, err := shellArgs("linux", "cmd", "a && b")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"sh", "-c", "a && b"}, args)
+	}
+
+	args, err = shellArgs("windows", "", "a && b")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"powershell", "-NoProfile", "-NonInteractive", "-Command", "a && b"}, args)
+	}
+
+	args, err = shellArgs("windows", "CMD", "a && b")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"cmd", "/C", "a && b"}, args)
+	}
+
+	_, err = shellArgs("windows", "bash", "a")
+	assert.Error(t, err)
+}
+
+func TestCmdCapturesOutput(t *testing.T) {
+	skipIfNoShell(t)
+	defer os.Setenv("DEV_TOOLS_STREAM_OUTPUT", os.Getenv("DEV_TOOLS_STREAM_OUTPUT"))
+	os.Unsetenv("DEV_TOOLS_STREAM_OUTPUT")
+
+	var err error
+	stdout := captureStdout(t, func() {
+		stderr := captureStderr(t, func() {
+			err = RunCmds([]string{"sh", "-c", "echo quiet"})
+		})
+		assert.Empty(t, stderr)
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, stdout)
+
+	// The output is shown when the command fails.
+	stderr := captureStderr(t, func() {
+		err = RunCmds([]string{"sh", "-c", "echo to-stdout; echo to-stderr >&2; exit 1"})
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "to-stderr")
+	}
+	assert.Contains(t, stderr, ">> Output of sh -c")
+	assert.Contains(t, stderr, "to-stdout\n")
+	assert.Contains(t, stderr, "to-stderr\n")
+
+	// Only the tail is retained.
+	defer func(limit int) { CmdFailureOutputLimit = limit }(CmdFailureOutputLimit)
+	CmdFailureOutputLimit = 8
+	stderr = captureStderr(t, func() {
+		err = RunCmds([]string{"sh", "-c", "echo 0123456789; exit 1"})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "(last 8 B):\n3456789\n")
+}
+
+func TestCmdStreamOutput(t *testing.T) {
+	skipIfNoShell(t)
+	defer os.Setenv("DEV_TOOLS_STREAM_OUTPUT", os.Getenv("DEV_TOOLS_STREAM_OUTPUT"))
+	os.Setenv("DEV_TOOLS_STREAM_OUTPUT", "true")
+
+	var err error
+	stdout := captureStdout(t, func() {
+		err = RunCmds([]string{"echo", "streamed"})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "streamed\n", stdout)
+}
+
+func TestCmdHeartbeat(t *testing.T) {
+	skipIfNoShell(t)
+	os.Setenv("DEV_TOOLS_HEARTBEAT_INTERVAL", "50ms")
+	defer os.Unsetenv("DEV_TOOLS_HEARTBEAT_INTERVAL")
+	ctx, buf := captureLog(InfoLevel)
+
+	assert.NoError(t, RunCmdsContext(ctx, []string{"sleep", "0.3"}))
+	assert.Contains(t, buf.String(), "Still running sleep 0.3")
+}
+
+func TestRunJSON(t *testing.T) {
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"go list -json ./...": {Stdout: `{"ImportPath":"github.com/elastic/beats/libbeat","Name":"libbeat"}`},
+		"docker inspect bad":  {Stdout: `[{"Id":`},
+		"docker inspect gone": {Err: errors.New("exit status 1")},
+	}}
+	ctx := WithRunner(context.Background(), fake)
+
+	var pkg struct {
+		ImportPath string
+		Name       string
+	}
+	if assert.NoError(t, RunJSONContext(ctx, &pkg, "go", "list", "-json", "./...")) {
+		assert.Equal(t, "libbeat", pkg.Name)
+	}
+
+	var v interface{}
+	err := RunJSONContext(ctx, &v, "docker", "inspect", "bad")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to parse JSON output of docker inspect bad")
+	}
+	assert.Error(t, RunJSONContext(ctx, &v, "docker", "inspect", "gone"))
+}
@@ -0,0 +1,70 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build !windows
+// +build !windows
+
+package mage
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/mattn/go-isatty"
+)
+
+// setProcessGroup configures the command to start in a new process group so
+// that killProcessGroupOnCancel can terminate its children too.
+//
+// The command is left in mage's process group when its stdin is a terminal.
+// A background process group cannot read from the terminal and does not
+// receive the SIGINT sent by Ctrl-C. It must be called after cmd.Stdin is set.
+func setProcessGroup(cmd *exec.Cmd) {
+	if f, ok := cmd.Stdin.(*os.File); ok && isatty.IsTerminal(f.Fd()) {
+		return
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroupOnCancel kills the process group of the started command when
+// ctx is done. Only the command's process is killed (by exec.CommandContext)
+// if it was not started in its own process group. The returned function must
+// be called after the command exits.
+func killProcessGroupOnCancel(ctx context.Context, cmd *exec.Cmd) (stop func()) {
+	if ctx.Done() == nil || cmd.SysProcAttr == nil || !cmd.SysProcAttr.Setpgid {
+		return func() {}
+	}
+
+	pid := cmd.Process.Pid
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -24,30 +24,38 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"text/template"
 	"time"
 	"unicode"
 
-	"github.com/magefile/mage/sh"
-	"github.com/magefile/mage/target"
 	"github.com/magefile/mage/types"
 	"github.com/pkg/errors"
+	"github.com/theckman/go-flock"
 )
 
 // Expand expands the given Go text/template string.
@@ -55,6 +63,45 @@ func Expand(in string, args ...map[string]interface{}) (string, error) {
 	return expandTemplate("inline", in, FuncMap, EnvMap(args...))
 }
 
+// ExpandDeep expands the given Go text/template string like Expand, but the
+// args are combined with DeepMerge so that nested maps given in later args
+// add to the keys of earlier ones instead of replacing them.
+func ExpandDeep(in string, args ...map[string]interface{}) (string, error) {
+	vars := varMap()
+	for _, m := range args {
+		DeepMerge(vars, m)
+	}
+	// Like EnvMap, the environment has the highest precedence.
+	for _, e := range os.Environ() {
+		env := strings.SplitN(e, "=", 2)
+		vars[env[0]] = env[1]
+	}
+	return expandTemplate("inline", in, FuncMap, vars)
+}
+
+// DeepMerge merges src into dst and returns dst. Nested maps that are present
+// in both are merged recursively, otherwise the value from src wins. Nested
+// maps from src are copied so that later merges into dst never modify src. A
+// new map is allocated if dst is nil.
+func DeepMerge(dst, src map[string]interface{}) map[string]interface{} {
+	if dst == nil {
+		dst = make(map[string]interface{}, len(src))
+	}
+	for k, v := range src {
+		srcMap, srcIsMap := v.(map[string]interface{})
+		if !srcIsMap {
+			dst[k] = v
+			continue
+		}
+		if dstMap, ok := dst[k].(map[string]interface{}); ok {
+			dst[k] = DeepMerge(dstMap, srcMap)
+		} else {
+			dst[k] = DeepMerge(nil, srcMap)
+		}
+	}
+	return dst
+}
+
 // MustExpand expands the given Go text/template string. It panics if there is
 // an error.
 func MustExpand(in string, args ...map[string]interface{}) string {
@@ -65,6 +112,23 @@ func MustExpand(in string, args ...map[string]interface{}) string {
 	return out
 }
 
+// ExpandToCommand expands the Go text/template string and writes the result
+// to the stdin of the given command (e.g. "kubectl apply -f -"). The command's
+// output is streamed to the console like RunWithEnv.
+func ExpandToCommand(tmpl string, args map[string]interface{}, cmd string, cmdArgs ...string) error {
+	return expandToCommand(context.Background(), tmpl, args, cmd, cmdArgs...)
+}
+
+func expandToCommand(ctx context.Context, tmpl string, args map[string]interface{}, cmd string, cmdArgs ...string) error {
+	input, err := Expand(tmpl, args)
+	if err != nil {
+		return err
+	}
+
+	c := Cmd{Args: append([]string{cmd}, cmdArgs...), Stdin: strings.NewReader(input), Stream: true}
+	return errors.Wrapf(c.RunContext(ctx), "failed to run %v with the expanded template as stdin", cmd)
+}
+
 // ExpandFile expands the Go text/template read from src and writes the output
 // to dst.
 func ExpandFile(src, dst string, args ...map[string]interface{}) error {
@@ -79,6 +143,52 @@ func MustExpandFile(src, dst string, args ...map[string]interface{}) {
 	}
 }
 
+// ExpandFS expands the Go text/template read from src in fsys (e.g. an
+// embed.FS) and writes the output to dst on the OS filesystem.
+func ExpandFS(fsys fs.FS, src, dst string, args ...map[string]interface{}) error {
+	tmplData, err := fs.ReadFile(fsys, src)
+	if err != nil {
+		return errors.Wrapf(err, "failed reading from template %v", src)
+	}
+
+	return expandToFile(src, tmplData, dst, EnvMap(args...))
+}
+
+// ExpandConcat expands each of the Go text/template files and writes the
+// concatenated output to out.
+func ExpandConcat(out string, perm os.FileMode, templates []string, args ...map[string]interface{}) error {
+	return ExpandConcatSep(out, perm, templates, "", args...)
+}
+
+// ExpandConcatSep expands each of the Go text/template files and writes the
+// output to out with separator written between each rendered template.
+func ExpandConcatSep(out string, perm os.FileMode, templates []string, separator string, args ...map[string]interface{}) error {
+	vars := EnvMap(args...)
+
+	buf := new(bytes.Buffer)
+	for i, src := range templates {
+		tmplData, err := ioutil.ReadFile(src)
+		if err != nil {
+			return errors.Wrapf(err, "failed reading from template %v", src)
+		}
+
+		output, err := expandTemplate(src, string(tmplData), FuncMap, vars)
+		if err != nil {
+			return errors.Wrapf(err, "failed expanding %v", src)
+		}
+
+		if i > 0 {
+			buf.WriteString(separator)
+		}
+		buf.WriteString(output)
+	}
+
+	if err := ioutil.WriteFile(createDir(out), buf.Bytes(), perm); err != nil {
+		return errors.Wrap(err, "failed to write rendered templates")
+	}
+	return nil
+}
+
 func expandTemplate(name, tmpl string, funcs template.FuncMap, args ...map[string]interface{}) (string, error) {
 	t := template.New(name).Option("missingkey=error")
 	if len(funcs) > 0 {
@@ -127,6 +237,12 @@ func expandFile(src, dst string, args ...map[string]interface{}) error {
 		return errors.Wrapf(err, "failed reading from template %v", src)
 	}
 
+	return expandToFile(src, tmplData, dst, args...)
+}
+
+// expandToFile expands the template data and writes the output to dst. The
+// dst path is also expanded as a template.
+func expandToFile(src string, tmplData []byte, dst string, args ...map[string]interface{}) error {
 	output, err := expandTemplate(src, string(tmplData), FuncMap, args...)
 	if err != nil {
 		return err
@@ -144,6 +260,132 @@ func expandFile(src, dst string, args ...map[string]interface{}) error {
 	return nil
 }
 
+// CheckGenerated expands the Go text/template read from src and compares the
+// output with the contents of golden. It returns an error containing a diff if
+// they differ so that CI can fail when a generated file was not regenerated.
+// Line endings are normalized so that a CRLF checkout does not cause a diff.
+func CheckGenerated(src, golden string, args ...map[string]interface{}) error {
+	tmplData, err := ioutil.ReadFile(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed reading from template %v", src)
+	}
+
+	rendered, err := expandTemplate(src, string(tmplData), FuncMap, EnvMap(args...))
+	if err != nil {
+		return errors.Wrapf(err, "failed expanding %v", src)
+	}
+
+	committed, err := ioutil.ReadFile(golden)
+	if err != nil {
+		return errors.Wrapf(err, "failed reading generated file %v", golden)
+	}
+
+	want := strings.Replace(rendered, "\r\n", "\n", -1)
+	got := strings.Replace(string(committed), "\r\n", "\n", -1)
+	if want == got {
+		return nil
+	}
+	return errors.Errorf("%v is out of date with %v, regenerate it:\n%v",
+		golden, src, lineDiff(golden, src, got, want))
+}
+
+const (
+	// lineDiffLimit is the maximum number of changed lines reported by lineDiff.
+	lineDiffLimit = 50
+
+	// lineDiffMaxCells limits the size of the table used by lineDiff to find
+	// the longest common subsequence (about 8 MB). Larger regions are only
+	// summarized.
+	lineDiffMaxCells = 1 << 20
+)
+
+// lineDiff returns a unified style diff of the lines of a and b. Only the
+// region between the common prefix and suffix is shown. If that region is too
+// large to diff then only its size and first lines are reported.
+func lineDiff(aName, bName, a, b string) string {
+	aLines := strings.SplitAfter(a, "\n")
+	bLines := strings.SplitAfter(b, "\n")
+
+	prefix := 0
+	for prefix < len(aLines) && prefix < len(bLines) && aLines[prefix] == bLines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(aLines)-prefix && suffix < len(bLines)-prefix &&
+		aLines[len(aLines)-1-suffix] == bLines[len(bLines)-1-suffix] {
+		suffix++
+	}
+	aMid := aLines[prefix : len(aLines)-suffix]
+	bMid := bLines[prefix : len(bLines)-suffix]
+
+	if (len(aMid)+1)*(len(bMid)+1) > lineDiffMaxCells {
+		var buf strings.Builder
+		fmt.Fprintf(&buf, "--- %v\n+++ %v\n@@ -%d,%d +%d,%d @@\n",
+			aName, bName, prefix+1, len(aMid), prefix+1, len(bMid))
+		fmt.Fprintf(&buf, "... too many differing lines to diff, showing the first of each\n")
+		if len(aMid) > 0 {
+			fmt.Fprintf(&buf, "-%v\n", strings.TrimSuffix(aMid[0], "\n"))
+		}
+		if len(bMid) > 0 {
+			fmt.Fprintf(&buf, "+%v\n", strings.TrimSuffix(bMid[0], "\n"))
+		}
+		return buf.String()
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of aMid[i:]
+	// and bMid[j:].
+	lcs := make([][]int, len(aMid)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bMid)+1)
+	}
+	for i := len(aMid) - 1; i >= 0; i-- {
+		for j := len(bMid) - 1; j >= 0; j-- {
+			if aMid[i] == bMid[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %v\n+++ %v\n@@ -%d,%d +%d,%d @@\n",
+		aName, bName, prefix+1, len(aMid), prefix+1, len(bMid))
+	changes := 0
+	write := func(op byte, line string) {
+		if op != ' ' {
+			changes++
+		}
+		if changes > lineDiffLimit {
+			return
+		}
+		buf.WriteByte(op)
+		buf.WriteString(strings.TrimSuffix(line, "\n"))
+		buf.WriteByte('\n')
+	}
+	i, j := 0, 0
+	for i < len(aMid) || j < len(bMid) {
+		switch {
+		case i < len(aMid) && j < len(bMid) && aMid[i] == bMid[j]:
+			write(' ', aMid[i])
+			i++
+			j++
+		case j == len(bMid) || (i < len(aMid) && lcs[i+1][j] >= lcs[i][j+1]):
+			write('-', aMid[i])
+			i++
+		default:
+			write('+', bMid[j])
+			j++
+		}
+	}
+	if changes > lineDiffLimit {
+		fmt.Fprintf(&buf, "... %d more changed lines\n", changes-lineDiffLimit)
+	}
+	return buf.String()
+}
+
 // CWD return the current working directory.
 func CWD() string {
 	wd, err := os.Getwd()
@@ -163,54 +405,190 @@ func EnvOr(name, def string) string {
 	return s
 }
 
-var (
-	dockerInfoValue *DockerInfo
-	dockerInfoErr   error
-	dockerInfoOnce  sync.Once
-)
+// invalidEnvWarned holds the malformed environment variable values that have
+// already been reported by warnInvalidEnv.
+var invalidEnvWarned = struct {
+	sync.Mutex
+	values map[string]struct{}
+}{values: map[string]struct{}{}}
+
+// warnInvalidEnv logs a warning to the logger of ctx that the malformed value
+// of the environment variable is ignored. Each value of a variable is reported
+// only once because some variables (e.g. DEV_TOOLS_ECHO) are read for every
+// command.
+func warnInvalidEnv(ctx context.Context, name string, def interface{}, err error) {
+	key := name + "=" + os.Getenv(name)
+	invalidEnvWarned.Lock()
+	_, warned := invalidEnvWarned.values[key]
+	invalidEnvWarned.values[key] = struct{}{}
+	invalidEnvWarned.Unlock()
+
+	if !warned {
+		LoggerFromContext(ctx).Warnf("Ignoring %v, using the default value %v: %v", name, def, err)
+	}
+}
+
+// EnvBool returns the value of the environment variable parsed as a boolean
+// (see EnvBoolE). It returns def if the variable is unset or empty, and also
+// logs a warning if the value is malformed.
+func EnvBool(name string, def bool) bool {
+	v, err := EnvBoolE(name, def)
+	if err != nil {
+		warnInvalidEnv(context.Background(), name, def, err)
+		return def
+	}
+	return v
+}
+
+// EnvBoolE returns the value of the environment variable parsed as a boolean.
+// The values accepted by strconv.ParseBool (1, t, true, 0, f, false, ...) are
+// accepted regardless of case. It returns def if the variable is unset or
+// empty, and an error if the value is malformed.
+func EnvBoolE(name string, def bool) (bool, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseBool(strings.ToLower(s))
+	if err != nil {
+		return def, errors.Errorf("invalid boolean value %q for %v", s, name)
+	}
+	return v, nil
+}
 
-// DockerInfo contains information about the docker daemon.
-type DockerInfo struct {
-	OperatingSystem string   `json:"OperatingSystem"`
-	Labels          []string `json:"Labels"`
-	NCPU            int      `json:"NCPU"`
-	MemTotal        int      `json:"MemTotal"`
+// EnvInt returns the value of the environment variable parsed as an integer.
+// It returns def if the variable is unset or empty, and also logs a warning if
+// the value is malformed.
+func EnvInt(name string, def int) int {
+	v, err := EnvIntE(name, def)
+	if err != nil {
+		warnInvalidEnv(context.Background(), name, def, err)
+		return def
+	}
+	return v
 }
 
-// IsBoot2Docker returns true if the Docker OS is boot2docker.
-func (info *DockerInfo) IsBoot2Docker() bool {
-	return strings.Contains(strings.ToLower(info.OperatingSystem), "boot2docker")
+// EnvIntE returns the value of the environment variable parsed as an integer.
+// It returns def if the variable is unset or empty, and an error if the value
+// is malformed.
+func EnvIntE(name string, def int) (int, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return def, errors.Errorf("invalid integer value %q for %v", s, name)
+	}
+	return v, nil
 }
 
-// HaveDocker returns an error if docker is unavailable.
-func HaveDocker() error {
-	if _, err := GetDockerInfo(); err != nil {
-		return errors.Wrap(err, "docker is not available")
+// EnvFloat returns the value of the environment variable parsed as a float.
+// It returns def if the variable is unset or empty, and also logs a warning if
+// the value is malformed.
+func EnvFloat(name string, def float64) float64 {
+	v, err := EnvFloatE(name, def)
+	if err != nil {
+		warnInvalidEnv(context.Background(), name, def, err)
+		return def
 	}
-	return nil
+	return v
 }
 
-// GetDockerInfo returns data from the docker info command.
-func GetDockerInfo() (*DockerInfo, error) {
-	dockerInfoOnce.Do(func() {
-		dockerInfoValue, dockerInfoErr = dockerInfo()
-	})
+// EnvFloatE returns the value of the environment variable parsed as a float.
+// It returns def if the variable is unset or empty, and an error if the value
+// is malformed.
+func EnvFloatE(name string, def float64) (float64, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return def, errors.Errorf("invalid number %q for %v", s, name)
+	}
+	return v, nil
+}
 
-	return dockerInfoValue, dockerInfoErr
+// EnvDuration returns the value of the environment variable parsed with
+// time.ParseDuration (e.g. 90s or 1h30m). It returns def if the variable is
+// unset or empty, and also logs a warning if the value is malformed.
+func EnvDuration(name string, def time.Duration) time.Duration {
+	v, err := EnvDurationE(name, def)
+	if err != nil {
+		warnInvalidEnv(context.Background(), name, def, err)
+		return def
+	}
+	return v
 }
 
-func dockerInfo() (*DockerInfo, error) {
-	data, err := sh.Output("docker", "info", "-f", "{{ json .}}")
+// EnvDurationE returns the value of the environment variable parsed with
+// time.ParseDuration. It returns def if the variable is unset or empty, and an
+// error if the value is malformed.
+func EnvDurationE(name string, def time.Duration) (time.Duration, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := time.ParseDuration(strings.TrimSpace(s))
 	if err != nil {
-		return nil, err
+		return def, errors.Errorf("invalid duration %q for %v", s, name)
 	}
+	return v, nil
+}
 
-	var info DockerInfo
-	if err = json.Unmarshal([]byte(data), &info); err != nil {
-		return nil, err
+// RequireEnv returns an error if any of the given environment variables is
+// unset or empty. The error lists all of the missing variables.
+func RequireEnv(names ...string) error {
+	var missing []string
+	for _, name := range names {
+		if os.Getenv(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("required environment variables are not set: %v",
+			strings.Join(missing, ", "))
 	}
+	return nil
+}
+
+// MustRequireEnv invokes RequireEnv and panics if an error occurs.
+func MustRequireEnv(names ...string) {
+	if err := RequireEnv(names...); err != nil {
+		panic(err)
+	}
+}
+
+// toolInstallHints contains instructions for installing commonly used tools.
+// They are included in the error returned by LookPathVerbose.
+var toolInstallHints = map[string]string{
+	"docker": "install Docker from https://docs.docker.com/install/",
+	"git":    "install git from https://git-scm.com/downloads",
+	"go":     "install Go from https://golang.org/dl/",
+	"mage":   "go get -u github.com/magefile/mage",
+}
 
-	return &info, nil
+// LookPathVerbose searches for the named executable in the directories named
+// by the PATH environment variable. It returns an error describing how to
+// install the tool when it is not found, and it logs the resolved path on
+// success.
+func LookPathVerbose(name string) (string, error) {
+	return lookPathVerbose(context.Background(), name)
+}
+
+func lookPathVerbose(ctx context.Context, name string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		hint, found := toolInstallHints[name]
+		if !found {
+			hint = "install " + name + " and add it to your PATH"
+		}
+		return "", errors.Errorf("%v not found on PATH; %v", name, hint)
+	}
+
+	LoggerFromContext(ctx).Debugf("Found %v at %v", name, path)
+	return path, nil
 }
 
 // FindReplace reads a file, performs a find/replace operation, then writes the
@@ -239,14 +617,92 @@ func MustFindReplace(file string, re *regexp.Regexp, repl string) {
 
 // Copy copies a file or a directory (recursively) and preserves the permissions.
 func Copy(src, dest string) error {
+	return CopyWith(src, dest, CopyOptions{})
+}
+
+// CopyOptions controls how CopyWith copies files.
+type CopyOptions struct {
+	// DereferenceSymlinks causes symlinks within the source to be replaced by
+	// the contents of their targets in the destination. A dangling symlink
+	// results in an error and a symlink leading back to a directory that is
+	// already being copied is skipped.
+	DereferenceSymlinks bool
+
+	// PreserveSparse causes runs of zeros in regular files to be skipped
+	// rather than written so that sparse files (e.g. disk images) don't get
+	// fully allocated in the destination. It has no effect on Windows.
+	PreserveSparse bool
+}
+
+// CopyWith copies a file or a directory (recursively) using the given options
+// and preserves the permissions.
+func CopyWith(src, dest string, opts CopyOptions) error {
 	info, err := os.Stat(src)
 	if err != nil {
 		return errors.Wrapf(err, "failed to stat source file %v", src)
 	}
-	return recursiveCopy(src, dest, info)
+	return recursiveCopy(src, dest, info, opts, map[string]struct{}{})
+}
+
+// CopyGlob copies the files and directories matching the glob patterns into
+// destDir using their base names. It returns an error if two matches have the
+// same base name.
+func CopyGlob(globs []string, destDir string, options ...GlobOption) error {
+	params := newGlobParams(options)
+	files, err := findFilesOrdered(globs, params.RequireMatches)
+	if err != nil {
+		return err
+	}
+
+	sources := map[string]string{}
+	for _, f := range files {
+		base := filepath.Base(f)
+		if other, found := sources[base]; found {
+			return errors.Errorf("%v and %v both copy to %v", other, f, filepath.Join(destDir, base))
+		}
+		sources[base] = f
+	}
+
+	for _, f := range files {
+		if err := Copy(f, filepath.Join(destDir, filepath.Base(f))); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func fileCopy(src, dest string, info os.FileInfo) error {
+	return fileCopyProgress(src, dest, info, nil)
+}
+
+// CopyFileProgress copies the regular file src to dst while reporting the
+// progress to the given callback. The callback is invoked after each chunk
+// of data is written with the number of bytes copied so far and the size of
+// the source file. The destination file is created with the same permissions
+// as the source.
+func CopyFileProgress(src, dst string, progress func(copied, total int64)) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return errors.Wrap(err, "failed to stat source file")
+	}
+	return fileCopyProgress(src, dst, info, progress)
+}
+
+// progressWriter counts the bytes written to it and reports the count to a
+// callback.
+type progressWriter struct {
+	copied   int64
+	total    int64
+	progress func(copied, total int64)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.copied += int64(len(p))
+	w.progress(w.copied, w.total)
+	return len(p), nil
+}
+
+func fileCopyProgress(src, dest string, info os.FileInfo, progress func(copied, total int64)) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return err
@@ -263,13 +719,33 @@ func fileCopy(src, dest string, info os.FileInfo) error {
 	}
 	defer destFile.Close()
 
-	if _, err = io.Copy(destFile, srcFile); err != nil {
+	var w io.Writer = destFile
+	if progress != nil {
+		w = io.MultiWriter(destFile, &progressWriter{total: info.Size(), progress: progress})
+	}
+	if _, err = io.Copy(w, srcFile); err != nil {
 		return err
 	}
 	return destFile.Close()
 }
 
-func dirCopy(src, dest string, info os.FileInfo) error {
+// dirCopy copies the directory src to dest. active holds the real paths of
+// the directories being copied and is used to avoid following symlink cycles
+// when dereferencing symlinks.
+func dirCopy(src, dest string, info os.FileInfo, opts CopyOptions, active map[string]struct{}) error {
+	if opts.DereferenceSymlinks {
+		real, err := filepath.EvalSymlinks(src)
+		if err != nil {
+			return errors.Wrapf(err, "failed to resolve %v", src)
+		}
+		if _, found := active[real]; found {
+			logWarnf("Skipping %v because it links to %v which is already being copied", src, real)
+			return nil
+		}
+		active[real] = struct{}{}
+		defer delete(active, real)
+	}
+
 	if err := os.MkdirAll(dest, info.Mode()); err != nil {
 		return errors.Wrap(err, "failed creating dirs")
 	}
@@ -282,7 +758,7 @@ func dirCopy(src, dest string, info os.FileInfo) error {
 	for _, info := range contents {
 		srcFile := filepath.Join(src, info.Name())
 		destFile := filepath.Join(dest, info.Name())
-		if err = recursiveCopy(srcFile, destFile, info); err != nil {
+		if err = recursiveCopy(srcFile, destFile, info, opts, active); err != nil {
 			return errors.Wrapf(err, "failed to copy %v to %v", srcFile, destFile)
 		}
 	}
@@ -290,98 +766,568 @@ func dirCopy(src, dest string, info os.FileInfo) error {
 	return nil
 }
 
-func recursiveCopy(src, dest string, info os.FileInfo) error {
+func recursiveCopy(src, dest string, info os.FileInfo, opts CopyOptions, active map[string]struct{}) error {
+	if info.Mode()&os.ModeSymlink != 0 && opts.DereferenceSymlinks {
+		target, err := os.Stat(src)
+		if err != nil {
+			return errors.Wrapf(err, "failed to dereference symlink %v", src)
+		}
+		info = target
+	}
+
 	if info.IsDir() {
-		return dirCopy(src, dest, info)
+		return dirCopy(src, dest, info, opts, active)
+	}
+	if opts.PreserveSparse {
+		return sparseFileCopy(src, dest, info)
 	}
 	return fileCopy(src, dest, info)
 }
 
-// DownloadFile downloads the given URL and writes the file to destinationDir.
-// The path to the file is returned.
-func DownloadFile(url, destinationDir string) (string, error) {
-	log.Println("Downloading", url)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", errors.Wrap(err, "http get failed")
+// sparseFileCopy copies a regular file like fileCopy but preserves its holes.
+func sparseFileCopy(src, dest string, info os.FileInfo) error {
+	if !info.Mode().IsRegular() {
+		return errors.Errorf("failed to copy source file because it is not a regular file")
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", errors.Errorf("download failed with http status: %v", resp.StatusCode)
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
 	}
+	defer srcFile.Close()
 
-	name := filepath.Join(destinationDir, filepath.Base(url))
-	f, err := os.Create(createDir(name))
+	destFile, err := os.OpenFile(createDir(dest), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode()&os.ModePerm)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create output file")
+		return err
 	}
-	defer f.Close()
+	defer destFile.Close()
 
-	if _, err = io.Copy(f, resp.Body); err != nil {
-		return "", errors.Wrap(err, "failed to write file")
+	if err = copySparse(destFile, srcFile); err != nil {
+		return err
 	}
+	return destFile.Close()
+}
 
-	return name, f.Close()
+// HumanSize formats a number of bytes using binary (IEC) units
+// (e.g. 1.5 GiB).
+func HumanSize(bytes int64) string {
+	return humanSize(bytes, 1024, []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"})
 }
 
-// Extract extracts .zip, .tar.gz, or .tgz files to destinationDir.
-func Extract(sourceFile, destinationDir string) error {
-	ext := filepath.Ext(sourceFile)
-	switch {
-	case strings.HasSuffix(sourceFile, ".tar.gz"), ext == ".tgz":
-		return untar(sourceFile, destinationDir)
-	case ext == ".zip":
-		return unzip(sourceFile, destinationDir)
-	default:
-		return errors.Errorf("failed to extract %v, unhandled file extension", sourceFile)
-	}
+// HumanSizeSI formats a number of bytes using decimal (SI) units
+// (e.g. 1.5 GB).
+func HumanSizeSI(bytes int64) string {
+	return humanSize(bytes, 1000, []string{"KB", "MB", "GB", "TB", "PB", "EB"})
 }
 
-func unzip(sourceFile, destinationDir string) error {
-	r, err := zip.OpenReader(sourceFile)
-	if err != nil {
-		return err
+func humanSize(bytes int64, base float64, units []string) string {
+	if bytes < 0 {
+		return "-" + humanSize(-bytes, base, units)
+	}
+	if float64(bytes) < base {
+		return fmt.Sprintf("%d B", bytes)
 	}
-	defer r.Close()
 
-	if err = os.MkdirAll(destinationDir, 0755); err != nil {
-		return err
+	value := float64(bytes)
+	unit := -1
+	for value >= base && unit < len(units)-1 {
+		value /= base
+		unit++
 	}
+	return fmt.Sprintf("%.1f %v", value, units[unit])
+}
 
-	extractAndWriteFile := func(f *zip.File) error {
-		innerFile, err := f.Open()
-		if err != nil {
-			return err
-		}
-		defer innerFile.Close()
+// SafeRemoveAll removes path and any children it contains. It refuses to
+// remove an empty path, a filesystem root, or any path that is not located
+// under mustBeUnder.
+func SafeRemoveAll(path, mustBeUnder string) error {
+	if strings.TrimSpace(path) == "" {
+		return errors.New("refusing to remove an empty path")
+	}
+	if strings.TrimSpace(mustBeUnder) == "" {
+		return errors.Errorf("refusing to remove %v without a base directory", path)
+	}
 
-		path := filepath.Join(destinationDir, f.Name)
-		if !strings.HasPrefix(path, destinationDir) {
-			return errors.Errorf("illegal file path in zip: %v", f.Name)
-		}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get absolute path of %v", path)
+	}
+	if filepath.Dir(absPath) == absPath {
+		return errors.Errorf("refusing to remove filesystem root %v", path)
+	}
 
-		if f.FileInfo().IsDir() {
-			return os.MkdirAll(path, f.Mode())
-		}
+	absBase, err := filepath.Abs(mustBeUnder)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get absolute path of %v", mustBeUnder)
+	}
 
-		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-			return err
-		}
+	rel, err := filepath.Rel(absBase, absPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errors.Errorf("refusing to remove %v because it is not under %v", path, mustBeUnder)
+	}
 
-		out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			return err
-		}
-		defer out.Close()
+	return os.RemoveAll(absPath)
+}
 
-		if _, err = io.Copy(out, innerFile); err != nil {
-			return err
-		}
+// defaultDownloadTimeout is the total time allowed for each DownloadFile
+// attempt to complete.
+const defaultDownloadTimeout = 30 * time.Minute
 
-		return out.Close()
-	}
+// Number of DownloadFile attempts and the delay before the first retry.
+var (
+	downloadAttempts = 3
+	downloadBackoff  = 2 * time.Second
+)
+
+// DownloadFile downloads the given URL and writes the file to destinationDir.
+// The path to the file is returned. Each attempt is aborted if it does not
+// complete within 30 minutes. Downloads that time out, whose connection is
+// refused or reset, or that receive a 5xx or 429 response are retried. Other
+// failures, like 404s or DNS errors, are not.
+func DownloadFile(url, destinationDir string) (string, error) {
+	var name string
+	err := RetryIf(context.Background(), downloadAttempts, downloadBackoff, isRetryableDownloadError, func() error {
+		var err error
+		name, err = DownloadFileTimeout(url, destinationDir, defaultDownloadTimeout)
+		return err
+	})
+	return name, err
+}
+
+// diskAvailableSpace is used by AvailableSpace. Replaced in tests.
+var diskAvailableSpace = availableSpace
+
+// errAvailableSpaceUnsupported is returned by AvailableSpace on platforms where
+// the available space cannot be determined.
+var errAvailableSpaceUnsupported = errors.New("determining the available disk space is unsupported on this platform")
+
+// AvailableSpace returns the number of bytes available to the current user on
+// the filesystem that contains dir. If dir does not exist yet its nearest
+// existing parent is used. An error is returned on platforms other than Linux,
+// macOS, FreeBSD, and Windows.
+func AvailableSpace(dir string) (int64, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	free, err := diskAvailableSpace(dir)
+	return free, errors.Wrapf(err, "failed to determine the available space in %v", dir)
+}
+
+// DownloadFileChecked is like DownloadFile, but before starting the download
+// it fails if destinationDir lacks the room for the file plus marginBytes. The
+// size is taken from the Content-Length of a HEAD request. The check is
+// skipped if the server does not report a length.
+func DownloadFileChecked(url, destinationDir string, marginBytes int64) (string, error) {
+	if err := checkDownloadSpace(url, destinationDir, marginBytes); err != nil {
+		return "", err
+	}
+	return DownloadFile(url, destinationDir)
+}
+
+func checkDownloadSpace(url, destinationDir string, marginBytes int64) error {
+	client := &http.Client{Timeout: defaultDownloadTimeout}
+	resp, err := client.Head(url)
+	if err != nil {
+		logDebugf("Skipping the disk space check for %v: %v", url, err)
+		return nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 {
+		logDebugf("Skipping the disk space check for %v, size is unknown", url)
+		return nil
+	}
+
+	free, err := AvailableSpace(destinationDir)
+	if errors.Cause(err) == errAvailableSpaceUnsupported {
+		logDebugf("Skipping the disk space check for %v: %v", url, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if required := resp.ContentLength + marginBytes; free < required {
+		return errors.Errorf("insufficient disk space to download %v to %v: "+
+			"%v are required (%v plus a %v margin) but only %v are available",
+			url, destinationDir, HumanSize(required), HumanSize(resp.ContentLength),
+			HumanSize(marginBytes), HumanSize(free))
+	}
+	return nil
+}
+
+// httpStatusError is returned when a download receives a non-200 response.
+type httpStatusError struct {
+	StatusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("download failed with http status: %v", e.StatusCode)
+}
+
+// isRetryableDownloadError returns true if err is a transient error that may
+// succeed if the download is retried.
+func isRetryableDownloadError(err error) bool {
+	if e, ok := errors.Cause(err).(*httpStatusError); ok {
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+	return isTimeout(err) || isConnectionRefusedOrReset(err)
+}
+
+// isConnectionRefusedOrReset returns true if err was caused by the remote
+// host refusing or resetting the connection.
+func isConnectionRefusedOrReset(err error) bool {
+	err = errors.Cause(err)
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.ECONNREFUSED || e == syscall.ECONNRESET
+		default:
+			return false
+		}
+	}
+}
+
+// DownloadFileTimeout downloads the given URL and writes the file to
+// destinationDir. The timeout limits the total time spent connecting,
+// following redirects, and reading the response body. Upon timeout the
+// partially written file is removed. The path to the file is returned.
+func DownloadFileTimeout(url, destinationDir string, timeout time.Duration) (string, error) {
+	logInfo("Downloading", url)
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		if isTimeout(err) {
+			return "", errors.Wrapf(err, "download of %v timed out after %v", url, timeout)
+		}
+		return "", errors.Wrap(err, "http get failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &httpStatusError{StatusCode: resp.StatusCode}
+	}
+
+	name := filepath.Join(destinationDir, filepath.Base(url))
+	f, err := os.Create(createDir(name))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create output file")
+	}
+	defer f.Close()
+
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		SafeRemoveAll(name, destinationDir)
+		if isTimeout(err) {
+			return "", errors.Wrapf(err, "download of %v timed out after %v", url, timeout)
+		}
+		return "", errors.Wrap(err, "failed to write file")
+	}
+
+	return name, f.Close()
+}
+
+// isTimeout returns true if err was caused by a timeout.
+func isTimeout(err error) bool {
+	type timeout interface {
+		Timeout() bool
+	}
+
+	if t, ok := errors.Cause(err).(timeout); ok {
+		return t.Timeout()
+	}
+	return false
+}
+
+// WaitForURL polls the URL with GET requests every interval until it responds
+// with a 2xx status. It returns an error containing the last failure if ctx
+// is done first.
+func WaitForURL(ctx context.Context, url string, interval time.Duration) error {
+	client := &http.Client{Timeout: interval}
+	return waitFor(ctx, interval, "URL "+url, func(ctx context.Context) error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return errors.Errorf("http status %v", resp.StatusCode)
+		}
+		return nil
+	})
+}
+
+// WaitForTCP tries to connect to addr (host:port) every interval until a
+// connection is accepted. It returns an error containing the last failure if
+// ctx is done first.
+func WaitForTCP(ctx context.Context, addr string, interval time.Duration) error {
+	return waitFor(ctx, interval, "TCP "+addr, func(ctx context.Context) error {
+		d := net.Dialer{Timeout: interval}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// waitFor invokes check immediately and then every interval until it
+// succeeds or ctx is done. The interval must be positive.
+func waitFor(ctx context.Context, interval time.Duration, what string, check func(context.Context) error) error {
+	if interval <= 0 {
+		return errors.Errorf("invalid interval %v for waiting for %v, it must be positive", interval, what)
+	}
+	LoggerFromContext(ctx).Debug("Waiting for", what)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		err := check(ctx)
+		if err == nil {
+			return nil
+		}
+		// Keep the previous error if this check was aborted by ctx because
+		// it is more useful.
+		if lastErr == nil || ctx.Err() == nil {
+			lastErr = err
+		}
+		LoggerFromContext(ctx).Debugf("%v is not available yet: %v", what, err)
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(lastErr, "%v did not become available (%v)", what, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Extract extracts .zip, .tar.gz, or .tgz files to destinationDir.
+func Extract(sourceFile, destinationDir string, options ...ExtractOption) error {
+	return ExtractWithHook(sourceFile, destinationDir, nil, options...)
+}
+
+// ExtractOption defines an option to Extract and ExtractWithHook.
+type ExtractOption func(params *extractParams)
+
+// ExtractWithMode sets the modes used for zip entries that have no Unix
+// permissions (mode 0), which is common for zip files created on Windows. The
+// defaults are 0644 for files and 0755 for directories.
+func ExtractWithMode(fileMode, dirMode os.FileMode) func(params *extractParams) {
+	return func(params *extractParams) {
+		params.FileMode = fileMode
+		params.DirMode = dirMode
+	}
+}
+
+// ExtractValidatePaths makes the extraction fail before anything is written if
+// any entry has an absolute path or refers to a parent directory. See
+// ValidateArchivePaths.
+func ExtractValidatePaths() func(params *extractParams) {
+	return func(params *extractParams) {
+		params.ValidatePaths = true
+	}
+}
+
+// ExtractMaxEntries makes the extraction fail once the archive is found to
+// have more than n entries (including directories and skipped entries). This
+// protects against archives with millions of tiny entries exhausting inodes.
+// Zero means no limit.
+func ExtractMaxEntries(n int) func(params *extractParams) {
+	return func(params *extractParams) {
+		params.MaxEntries = n
+	}
+}
+
+type extractParams struct {
+	FileMode      os.FileMode
+	DirMode       os.FileMode
+	Hook          func(name string, info os.FileInfo) error
+	ValidatePaths bool
+	MaxEntries    int
+}
+
+// checkEntryCount returns an error if count exceeds the MaxEntries limit.
+func (p extractParams) checkEntryCount(sourceFile string, count int) error {
+	if p.MaxEntries > 0 && count > p.MaxEntries {
+		return errors.Errorf("failed to extract %v, it has more than the maximum of %d entries", sourceFile, p.MaxEntries)
+	}
+	return nil
+}
+
+// ErrSkipEntry is returned by an ExtractWithHook hook to skip the entry.
+var ErrSkipEntry = errors.New("skip this entry")
+
+// ExtractWithHook extracts .zip, .tar.gz, or .tgz files to destinationDir
+// like Extract, but calls hook with the name and info of each entry before it
+// is written. If the hook returns ErrSkipEntry only that entry is skipped
+// (skipping a directory does not skip its contents). Any other error aborts
+// the extraction.
+func ExtractWithHook(sourceFile, destinationDir string, hook func(name string, info os.FileInfo) error, options ...ExtractOption) error {
+	params := extractParams{FileMode: 0644, DirMode: 0755, Hook: hook}
+	for _, opt := range options {
+		opt(&params)
+	}
+
+	if params.ValidatePaths {
+		if err := ValidateArchivePaths(sourceFile); err != nil {
+			return err
+		}
+	}
+
+	ext := filepath.Ext(sourceFile)
+	switch {
+	case strings.HasSuffix(sourceFile, ".tar.gz"), ext == ".tgz":
+		return untar(sourceFile, destinationDir, params)
+	case ext == ".zip":
+		return unzip(sourceFile, destinationDir, params)
+	default:
+		return errors.Errorf("failed to extract %v, unhandled file extension", sourceFile)
+	}
+}
+
+// ExtractExecutable extracts .zip, .tar.gz, or .tgz files to destinationDir and
+// returns the path of the extracted binaryName. The binary extension of the
+// current OS (.exe on Windows) is appended to binaryName if it is missing. The
+// execute bits are added to the binary because zip files created on Windows
+// don't have them. It returns an error if the archive doesn't contain exactly
+// one file with that name.
+func ExtractExecutable(sourceFile, destinationDir, binaryName string) (string, error) {
+	want := binaryName
+	if ext := binaryExtension(runtime.GOOS); !strings.HasSuffix(want, ext) {
+		want += ext
+	}
+
+	var matches []string
+	hook := func(name string, info os.FileInfo) error {
+		if !info.IsDir() && filepath.Base(filepath.FromSlash(name)) == want {
+			matches = append(matches, name)
+		}
+		return nil
+	}
+	if err := ExtractWithHook(sourceFile, destinationDir, hook); err != nil {
+		return "", err
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", errors.Errorf("%v not found in %v", want, sourceFile)
+	case 1:
+	default:
+		return "", errors.Errorf("found multiple %v files in %v: %v", want, sourceFile, strings.Join(matches, ", "))
+	}
+
+	binary := filepath.Join(destinationDir, filepath.FromSlash(matches[0]))
+	info, err := os.Stat(binary)
+	if err != nil {
+		return "", err
+	}
+	if err = os.Chmod(binary, info.Mode().Perm()|0111); err != nil {
+		return "", errors.Wrapf(err, "failed to make %v executable", binary)
+	}
+	return binary, nil
+}
+
+// skipEntry invokes the extraction hook, if any, for an archive entry. It
+// returns true if the entry must be skipped.
+func skipEntry(hook func(name string, info os.FileInfo) error, sourceFile, name string, info os.FileInfo) (bool, error) {
+	if hook == nil {
+		return false, nil
+	}
+	switch err := hook(name, info); err {
+	case nil:
+		return false, nil
+	case ErrSkipEntry:
+		return true, nil
+	default:
+		return false, errors.Wrapf(err, "failed on entry %v in %v", name, sourceFile)
+	}
+}
+
+func unzip(sourceFile, destinationDir string, params extractParams) error {
+	r, err := zip.OpenReader(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err = os.MkdirAll(destinationDir, 0755); err != nil {
+		return err
+	}
+
+	extractAndWriteFile := func(f *zip.File) error {
+		innerFile, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer innerFile.Close()
+
+		path := filepath.Join(destinationDir, f.Name)
+		if !strings.HasPrefix(path, destinationDir) {
+			return errors.Errorf("illegal file path in zip: %v", f.Name)
+		}
+
+		if skip, err := skipEntry(params.Hook, sourceFile, f.Name, f.FileInfo()); skip || err != nil {
+			return err
+		}
+
+		// Entries without Unix permissions would be created with mode 0000.
+		mode := f.Mode()
+		if mode.Perm() == 0 {
+			if mode.IsDir() {
+				mode |= params.DirMode
+			} else {
+				mode |= params.FileMode
+			}
+		}
+
+		if f.FileInfo().IsDir() {
+			return os.MkdirAll(path, mode)
+		}
+
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		if _, err = io.Copy(out, innerFile); err != nil {
+			return err
+		}
+
+		return out.Close()
+	}
+
+	// The number of entries is known upfront so nothing is extracted from an
+	// archive that exceeds the limit.
+	if err = params.checkEntryCount(sourceFile, len(r.File)); err != nil {
+		return err
+	}
 
 	for _, f := range r.File {
 		err := extractAndWriteFile(f)
@@ -393,7 +1339,7 @@ func unzip(sourceFile, destinationDir string) error {
 	return nil
 }
 
-func untar(sourceFile, destinationDir string) error {
+func untar(sourceFile, destinationDir string, params extractParams) error {
 	file, err := os.Open(sourceFile)
 	if err != nil {
 		return err
@@ -411,7 +1357,7 @@ func untar(sourceFile, destinationDir string) error {
 
 	tarReader := tar.NewReader(fileReader)
 
-	for {
+	for entries := 1; ; entries++ {
 		header, err := tarReader.Next()
 		if err != nil {
 			if err == io.EOF {
@@ -419,12 +1365,23 @@ func untar(sourceFile, destinationDir string) error {
 			}
 			return err
 		}
+		if err = params.checkEntryCount(sourceFile, entries); err != nil {
+			return err
+		}
 
 		path := filepath.Join(destinationDir, header.Name)
 		if !strings.HasPrefix(path, destinationDir) {
 			return errors.Errorf("illegal file path in tar: %v", header.Name)
 		}
 
+		skip, err := skipEntry(params.Hook, sourceFile, header.Name, header.FileInfo())
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err = os.MkdirAll(path, os.FileMode(header.Mode)); err != nil {
@@ -459,14 +1416,57 @@ func isSeparator(r rune) bool {
 	return unicode.IsSpace(r) || r == ',' || r == ';'
 }
 
-// RunCmds runs the given commands and stops upon the first error.
-func RunCmds(cmds ...[]string) error {
-	for _, cmd := range cmds {
-		if err := sh.Run(cmd[0], cmd[1:]...); err != nil {
-			return err
+// BatchArgs splits files into batches such that the combined length of the
+// arguments in each batch (including a separator per argument) does not exceed
+// maxArgLen. This allows a command to be invoked once per batch without
+// exceeding the operating system's argument length limit. A file whose length
+// alone exceeds maxArgLen is placed in a batch by itself.
+func BatchArgs(files []string, maxArgLen int) [][]string {
+	var batches [][]string
+	var batch []string
+	var batchLen int
+
+	for _, f := range files {
+		argLen := len(f) + 1
+		if len(batch) > 0 && batchLen+argLen > maxArgLen {
+			batches = append(batches, batch)
+			batch, batchLen = nil, 0
 		}
+		batch = append(batch, f)
+		batchLen += argLen
 	}
-	return nil
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+var (
+	onceLock    sync.Mutex
+	onceResults = map[string]*onceResult{}
+)
+
+type onceResult struct {
+	once sync.Once
+	err  error
+}
+
+// Once invokes fn the first time it is called with the given key and returns
+// its error. Later calls with the same key don't invoke fn and return the same
+// error. Calls for a key block until the first invocation completes. This is
+// useful for memoizing idempotent setup steps by name.
+func Once(key string, fn func() error) error {
+	onceLock.Lock()
+	r, found := onceResults[key]
+	if !found {
+		r = &onceResult{}
+		onceResults[key] = r
+	}
+	onceLock.Unlock()
+
+	r.once.Do(func() { r.err = fn() })
+	return r.err
 }
 
 var (
@@ -481,7 +1481,7 @@ func parallelJobs() chan int {
 	if parallelJobsSemaphore == nil {
 		max := numParallel()
 		parallelJobsSemaphore = make(chan int, max)
-		log.Println("Max parallel jobs =", max)
+		logDebug("Max parallel jobs =", max)
 	}
 
 	return parallelJobsSemaphore
@@ -499,36 +1499,315 @@ func numParallel() int {
 	maxParallel := runtime.NumCPU()
 
 	info, err := GetDockerInfo()
-	if err == nil && info.NCPU < maxParallel {
+	if err == nil && info.NCPU > 0 && info.NCPU < maxParallel {
 		maxParallel = info.NCPU
 	}
 
+	// Inside of a container NumCPU reports the CPUs of the host rather than
+	// the CPU quota of the container.
+	if InContainer() {
+		if limit := containerCPULimit(); limit > 0 && limit < maxParallel {
+			maxParallel = limit
+		}
+	}
+
+	if limit := openFilesJobLimit(); limit > 0 && limit < maxParallel {
+		logDebugf("Limiting parallel jobs to %d based on the open files limit", limit)
+		maxParallel = limit
+	}
+
 	return maxParallel
 }
 
-// ParallelCtx runs the given functions in parallel with an upper limit set
-// based on GOMAXPROCS. The provided ctx is passed to the functions (if they
-// accept it as a param).
-func ParallelCtx(ctx context.Context, fns ...interface{}) {
-	var fnWrappers []func(context.Context) error
-	for _, f := range fns {
-		fnWrapper := types.FuncTypeWrap(f)
-		if fnWrapper == nil {
-			panic("attempted to add a dep that did not match required function type")
-		}
-		fnWrappers = append(fnWrappers, fnWrapper)
-	}
+// OpenFilesPerJob is the number of files that each parallel job is expected
+// to hold open at once. When set, the number of parallel jobs is capped such
+// that they use at most half of MaxOpenFiles. It must be set before the first
+// parallel job is started. Zero disables the cap.
+var OpenFilesPerJob = 0
 
-	var mu sync.Mutex
-	var errs []string
-	var wg sync.WaitGroup
+// maxOpenFilesProbe is used by MaxOpenFiles. Replaced in tests.
+var maxOpenFilesProbe = maxOpenFiles
 
-	for _, fw := range fnWrappers {
-		wg.Add(1)
-		go func(fw func(context.Context) error) {
-			defer func() {
-				if v := recover(); v != nil {
-					mu.Lock()
+// MaxOpenFiles returns the maximum number of files that the process can have
+// open at once (the soft RLIMIT_NOFILE on Unix). A large constant is returned
+// on Windows.
+func MaxOpenFiles() (int, error) {
+	return maxOpenFilesProbe()
+}
+
+// openFilesJobLimit returns the maximum number of parallel jobs allowed by
+// OpenFilesPerJob, or 0 if there is no limit.
+func openFilesJobLimit() int {
+	if OpenFilesPerJob <= 0 {
+		return 0
+	}
+	max, err := MaxOpenFiles()
+	if err != nil {
+		logDebug("Unable to determine the open files limit:", err)
+		return 0
+	}
+	if limit := max / 2 / OpenFilesPerJob; limit > 0 {
+		return limit
+	}
+	return 1
+}
+
+// These are used to detect the container environment. Replaced in tests.
+var (
+	containerGetenv     = os.Getenv
+	containerReadFile   = ioutil.ReadFile
+	containerFileExists = func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+)
+
+// containerCgroupHints are fragments of /proc/1/cgroup entries that are
+// created by container runtimes.
+var containerCgroupHints = []string{"docker", "kubepods", "containerd", "libpod", "lxc"}
+
+// InContainer returns true if the process runs inside of a Linux container.
+// It checks for the marker files created by docker (/.dockerenv) and podman
+// (/run/.containerenv), for the container environment variable that is set
+// by podman and systemd-nspawn, and for container runtime cgroups.
+func InContainer() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	if containerGetenv("container") != "" {
+		return true
+	}
+	if containerFileExists("/.dockerenv") || containerFileExists("/run/.containerenv") {
+		return true
+	}
+
+	cgroups, err := containerReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(cgroups), "\n") {
+		for _, hint := range containerCgroupHints {
+			if strings.Contains(line, hint) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containerCPULimit returns the number of CPUs allowed by the cgroup CPU
+// quota rounded up, or 0 if there is no quota. Both cgroup v2 (cpu.max) and
+// v1 (cpu.cfs_quota_us) are supported.
+func containerCPULimit() int {
+	var quota, period int64
+	if data, err := containerReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0
+		}
+		quota, _ = strconv.ParseInt(fields[0], 10, 64)
+		period, _ = strconv.ParseInt(fields[1], 10, 64)
+	} else {
+		data, err := containerReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+		if err != nil {
+			return 0
+		}
+		quota, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if data, err = containerReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us"); err != nil {
+			return 0
+		}
+		period, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+
+	if quota <= 0 || period <= 0 {
+		return 0
+	}
+	return int((quota + period - 1) / period)
+}
+
+// NamedJob associates a name with a function that is passed to Parallel or
+// ParallelCtx. The name is used when reporting the job's progress. fn must be
+// one of the function types accepted by ParallelCtx.
+func NamedJob(name string, fn interface{}) interface{} {
+	return namedJob{name: name, fn: fn}
+}
+
+type namedJob struct {
+	name string
+	fn   interface{}
+}
+
+// jobName returns a name for the given job function based on its symbol name.
+func jobName(fn interface{}) string {
+	f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer())
+	if f == nil {
+		return "unknown"
+	}
+	name := f.Name()
+	if idx := strings.LastIndex(name, "/"); idx >= 0 {
+		name = name[idx+1:]
+	}
+	return strings.TrimSuffix(name, "-fm")
+}
+
+type runningJob struct {
+	name  string
+	start time.Time
+}
+
+// jobTracker tracks the state of the jobs executed by ParallelCtx.
+type jobTracker struct {
+	mu       sync.Mutex
+	total    int
+	complete int
+	running  map[*runningJob]struct{}
+}
+
+func newJobTracker(total int) *jobTracker {
+	return &jobTracker{total: total, running: map[*runningJob]struct{}{}}
+}
+
+func (t *jobTracker) start(name string) *runningJob {
+	job := &runningJob{name: name, start: time.Now()}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running[job] = struct{}{}
+	return job
+}
+
+func (t *jobTracker) finish(job *runningJob, err error) {
+	if job == nil {
+		return
+	}
+
+	t.mu.Lock()
+	delete(t.running, job)
+	t.complete++
+	t.mu.Unlock()
+
+	elapsed := time.Since(job.start).Round(time.Millisecond)
+	if err != nil {
+		logWarnf("Job %v failed after %v: %v", job.name, elapsed, err)
+		return
+	}
+	logInfof("Job %v completed in %v", job.name, elapsed)
+}
+
+// progress returns a line describing how many jobs have completed and which
+// running job has been executing the longest.
+func (t *jobTracker) progress() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	msg := fmt.Sprintf("%d/%d jobs complete, %d running", t.complete, t.total, len(t.running))
+
+	var oldest *runningJob
+	for job := range t.running {
+		if oldest == nil || job.start.Before(oldest.start) {
+			oldest = job
+		}
+	}
+	if oldest != nil {
+		msg += fmt.Sprintf(" (oldest: %v, %v)", oldest.name, time.Since(oldest.start).Round(time.Second))
+	}
+	return msg
+}
+
+// reportProgress periodically logs the progress of the jobs until the returned
+// function is invoked. Nothing is reported when interval is zero.
+func (t *jobTracker) reportProgress(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				logInfo(t.progress())
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// parallelProgressInterval returns the interval at which ParallelCtx reports
+// progress. It can be set with PARALLEL_PROGRESS_INTERVAL (e.g. 10s). Progress
+// is not reported when PARALLEL_QUIET is set or when stderr is not a terminal.
+func parallelProgressInterval() time.Duration {
+	if os.Getenv("PARALLEL_QUIET") != "" || !isTerminal(os.Stderr) {
+		return 0
+	}
+
+	interval, err := time.ParseDuration(EnvOr("PARALLEL_PROGRESS_INTERVAL", "30s"))
+	if err != nil {
+		logWarn("Ignoring invalid PARALLEL_PROGRESS_INTERVAL:", err)
+		return 30 * time.Second
+	}
+	return interval
+}
+
+// isTerminal returns true if the file is a character device.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// ParallelCtx runs the given functions in parallel with an upper limit set
+// based on GOMAXPROCS. The provided ctx is passed to the functions (if they
+// accept it as a param).
+func ParallelCtx(ctx context.Context, fns ...interface{}) {
+	type job struct {
+		name string
+		fn   func(context.Context) error
+	}
+
+	var jobs []job
+	for _, f := range fns {
+		var name string
+		if nj, ok := f.(namedJob); ok {
+			name, f = nj.name, nj.fn
+		}
+
+		fnWrapper := types.FuncTypeWrap(f)
+		if fnWrapper == nil {
+			panic("attempted to add a dep that did not match required function type")
+		}
+
+		if name == "" {
+			name = jobName(f)
+		}
+		jobs = append(jobs, job{name: name, fn: fnWrapper})
+	}
+
+	var mu sync.Mutex
+	var errs []string
+	var wg sync.WaitGroup
+
+	tracker := newJobTracker(len(jobs))
+	stopProgress := tracker.reportProgress(parallelProgressInterval())
+
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j job) {
+			var running *runningJob
+			defer func() {
+				if v := recover(); v != nil {
+					tracker.finish(running, fmt.Errorf("%v", v))
+					mu.Lock()
 					errs = append(errs, fmt.Sprint(v))
 					mu.Unlock()
 				}
@@ -537,16 +1816,20 @@ func ParallelCtx(ctx context.Context, fns ...interface{}) {
 			}()
 			waitStart := time.Now()
 			parallelJobs() <- 1
-			log.Println("Parallel job waited", time.Since(waitStart), "before starting.")
-			if err := fw(ctx); err != nil {
+			LoggerFromContext(ctx).Debug("Parallel job waited", time.Since(waitStart), "before starting.")
+			running = tracker.start(j.name)
+			err := j.fn(ctx)
+			tracker.finish(running, err)
+			if err != nil {
 				mu.Lock()
 				errs = append(errs, fmt.Sprint(err))
 				mu.Unlock()
 			}
-		}(fw)
+		}(j)
 	}
 
 	wg.Wait()
+	stopProgress()
 	if len(errs) > 0 {
 		panic(errors.Errorf(strings.Join(errs, "\n")))
 	}
@@ -558,116 +1841,1943 @@ func Parallel(fns ...interface{}) {
 	ParallelCtx(context.Background(), fns...)
 }
 
-// FindFiles return a list of file matching the given glob patterns.
-func FindFiles(globs ...string) ([]string, error) {
-	var configFiles []string
-	for _, glob := range globs {
-		files, err := filepath.Glob(glob)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed on glob %v", glob)
+// RetryJobOption defines an option to RetryJob.
+type RetryJobOption func(params *retryJobParams)
+
+// RetryPanics causes RetryJob to recover from panics raised by the wrapped
+// function and to treat them like errors that can be retried.
+func RetryPanics() func(params *retryJobParams) {
+	return func(params *retryJobParams) {
+		params.RetryPanics = true
+	}
+}
+
+type retryJobParams struct {
+	RetryPanics bool
+}
+
+// RetryJob wraps fn such that it is re-invoked when it returns an error. It
+// makes at most attempts calls and sleeps between them using an exponential
+// backoff that starts at the given backoff duration. The returned function can
+// be passed to Parallel or ParallelCtx. fn must be one of the function types
+// accepted by ParallelCtx. Panics are not retried unless RetryPanics is given.
+func RetryJob(attempts int, backoff time.Duration, fn interface{}, options ...RetryJobOption) func(context.Context) error {
+	fnWrapper := types.FuncTypeWrap(fn)
+	if fnWrapper == nil {
+		panic("attempted to retry a job that did not match required function type")
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var params retryJobParams
+	for _, opt := range options {
+		opt(&params)
+	}
+
+	invoke := func(ctx context.Context) (err error) {
+		if params.RetryPanics {
+			defer func() {
+				if v := recover(); v != nil {
+					err = errors.Errorf("panic: %v", v)
+				}
+			}()
 		}
-		configFiles = append(configFiles, files...)
+		return fnWrapper(ctx)
+	}
+
+	return func(ctx context.Context) error {
+		var err error
+		for attempt := 1; attempt <= attempts; attempt++ {
+			if err = invoke(ctx); err == nil {
+				return nil
+			}
+
+			if attempt == attempts {
+				break
+			}
+
+			delay := backoff << uint(attempt-1)
+			logWarnf("Job attempt %d of %d failed (retrying in %v): %v", attempt, attempts, delay, err)
+			select {
+			case <-ctx.Done():
+				return errors.Errorf("job canceled after %d attempts: %v (last error: %v)", attempt, ctx.Err(), err)
+			case <-time.After(delay):
+			}
+		}
+
+		return errors.Wrapf(err, "job failed after %d attempts", attempts)
 	}
-	return configFiles, nil
 }
 
-// FileConcat concatenates files and writes the output to out.
-func FileConcat(out string, perm os.FileMode, files ...string) error {
-	f, err := os.OpenFile(createDir(out), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
-	if err != nil {
-		return errors.Wrap(err, "failed to create file")
+// RetryIf invokes fn until it succeeds, making at most attempts calls. It
+// only retries when retryable returns true for the error returned by fn. Any
+// other error is returned immediately. The delay between attempts starts at
+// backoff and doubles after each attempt. It stops early if ctx is done.
+func RetryIf(ctx context.Context, attempts int, backoff time.Duration, retryable func(error) bool, fn func() error) error {
+	if attempts < 1 {
+		attempts = 1
 	}
-	defer f.Close()
 
-	w := bufio.NewWriter(f)
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
 
-	append := func(file string) error {
-		in, err := os.Open(file)
-		if err != nil {
+		if !retryable(err) {
 			return err
 		}
-		defer in.Close()
+		if attempt == attempts {
+			break
+		}
 
-		if _, err := io.Copy(w, in); err != nil {
-			return err
+		delay := backoff << uint(attempt-1)
+		LoggerFromContext(ctx).Warnf("Attempt %d of %d failed (retrying in %v): %v", attempt, attempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(err, "canceled after %d attempts (%v)", attempt, ctx.Err())
+		case <-time.After(delay):
 		}
+	}
 
-		return nil
+	return errors.Wrapf(err, "failed after %d attempts", attempts)
+}
+
+// FindFiles return a list of file matching the given glob patterns. The
+// patterns use the filepath.Match syntax. Additionally, a path element that is
+// exactly ** matches zero or more directories (e.g. module/**/fields.yml).
+//
+// The result is sorted lexicographically. A file matched by more than one
+// pattern (compared by absolute path) is only returned once, in the form
+// matched by the first such pattern. Use FindFilesOrdered to keep the pattern
+// order.
+func FindFiles(globs ...string) ([]string, error) {
+	files, err := FindFilesOrdered(globs...)
+	if err != nil {
+		return nil, err
 	}
+	sort.Strings(files)
+	return files, nil
+}
 
-	for _, in := range files {
-		if err := append(in); err != nil {
-			return err
+// FindFilesOrdered is like FindFiles, but the matches are returned in the
+// order of the patterns. The matches of each pattern are sorted (per directory
+// for ** patterns). Duplicates are removed like they are by FindFiles.
+func FindFilesOrdered(globs ...string) ([]string, error) {
+	return findFilesOrdered(globs, false)
+}
+
+// FindFilesRequired is like FindFiles, but it returns an error naming every
+// pattern that matched no files. This catches typos in patterns that would
+// otherwise silently produce an empty list.
+func FindFilesRequired(globs ...string) ([]string, error) {
+	files, err := findFilesOrdered(globs, true)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func findFilesOrdered(globs []string, requireMatches bool) ([]string, error) {
+	var configFiles, unmatched []string
+	seen := map[string]struct{}{}
+	for _, glob := range globs {
+		files, err := findGlob(glob, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed on glob %v", glob)
+		}
+		if len(files) == 0 {
+			unmatched = append(unmatched, glob)
+		}
+		for _, f := range files {
+			abs, err := filepath.Abs(f)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get absolute path of %v", f)
+			}
+			if _, found := seen[abs]; found {
+				continue
+			}
+			seen[abs] = struct{}{}
+			configFiles = append(configFiles, f)
 		}
 	}
+	if requireMatches && len(unmatched) > 0 {
+		return nil, errors.Errorf("no files match the patterns [%v] (relative "+
+			"patterns are resolved from %v)", strings.Join(unmatched, ", "), CWD())
+	}
+	return configFiles, nil
+}
 
-	if err = w.Flush(); err != nil {
-		return err
+// GlobOption defines an option to FileConcatGlob and CopyGlob.
+type GlobOption func(params *globParams)
+
+// RequireMatches causes an error to be returned if any of the patterns
+// matches no files (see FindFilesRequired).
+func RequireMatches() func(params *globParams) {
+	return func(params *globParams) {
+		params.RequireMatches = true
 	}
-	return f.Close()
 }
 
-// MustFileConcat invokes FileConcat and panics if an error occurs.
-func MustFileConcat(out string, perm os.FileMode, files ...string) {
-	if err := FileConcat(out, perm, files...); err != nil {
-		panic(err)
+type globParams struct {
+	RequireMatches bool
+}
+
+func newGlobParams(options []GlobOption) globParams {
+	var params globParams
+	for _, opt := range options {
+		opt(&params)
 	}
+	return params
 }
 
-// VerifySHA256 reads a file and verifies that its SHA256 sum matches the
-// specified hash.
-func VerifySHA256(file string, hash string) error {
-	f, err := os.Open(file)
+// FindFilesExclude returns the files matching the include patterns (see
+// FindFiles) except for those matching one of the exclude patterns. An exclude
+// pattern without a path separator is matched against each element of the
+// path (e.g. vendor or *_test.go). Otherwise it is matched against the whole
+// path as returned for the include, so relative includes need relative
+// excludes, and may contain ** elements (e.g. build or module/**/_meta). When a
+// directory is excluded everything below it is excluded too and the walk for
+// ** includes does not descend into it.
+//
+// Like FindFiles, the result is sorted lexicographically and a file matched by
+// more than one include (compared by absolute path) is only returned once, in
+// the form matched by the first such include.
+func FindFilesExclude(includes, excludes []string) ([]string, error) {
+	exclude, err := newGlobExcluder(excludes)
 	if err != nil {
-		return errors.Wrap(err, "failed to open file for sha256 verification")
+		return nil, err
 	}
-	defer f.Close()
 
-	sum := sha256.New()
-	if _, err := io.Copy(sum, f); err != nil {
-		return errors.Wrap(err, "failed reading from input file")
+	var files []string
+	seen := map[string]struct{}{}
+	for _, glob := range includes {
+		matches, err := findGlob(glob, exclude.match)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed on glob %v", glob)
+		}
+		for _, f := range matches {
+			if exclude.match(f) {
+				continue
+			}
+			abs, err := filepath.Abs(f)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get absolute path of %v", f)
+			}
+			if _, found := seen[abs]; found {
+				continue
+			}
+			seen[abs] = struct{}{}
+			files = append(files, f)
+		}
 	}
+	sort.Strings(files)
+	return files, nil
+}
 
-	computedHash := hex.EncodeToString(sum.Sum(nil))
-	expectedHash := strings.TrimSpace(hash)
+// findGlob returns the paths matching the pattern. Paths for which exclude
+// returns true are not descended into when walking a ** pattern.
+func findGlob(pattern string, exclude func(path string) bool) ([]string, error) {
+	if strings.Contains(pattern, "**") {
+		return globRecursive(pattern, exclude)
+	}
+	return filepath.Glob(pattern)
+}
 
-	if computedHash != expectedHash {
-		return errors.Errorf("SHA256 verification of %v failed. Expected=%v, "+
-			"but computed=%v", f.Name(), expectedHash, computedHash)
+// globExcluder holds the elements of each exclude pattern.
+type globExcluder [][]string
+
+func newGlobExcluder(patterns []string) (globExcluder, error) {
+	var ex globExcluder
+	for _, pattern := range patterns {
+		parts := strings.Split(filepath.Clean(pattern), string(filepath.Separator))
+		if err := checkGlobElems(parts); err != nil {
+			return nil, errors.Wrapf(err, "invalid exclude pattern %v", pattern)
+		}
+		ex = append(ex, parts)
 	}
-	log.Println("SHA256 OK:", f.Name())
+	return ex, nil
+}
 
-	return nil
+// match returns true if the path or one of its parent directories matches an
+// exclude pattern.
+func (ex globExcluder) match(path string) bool {
+	elems := strings.Split(filepath.Clean(path), string(filepath.Separator))
+	for _, parts := range ex {
+		for i := range elems {
+			if len(parts) == 1 && parts[0] != "**" {
+				if ok, _ := filepath.Match(parts[0], elems[i]); ok {
+					return true
+				}
+			} else if matchGlobElems(parts, elems[:i+1]) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// CreateSHA512File computes the sha512 sum of the specified file the writes
-// a sidecar file containing the hash and filename.
-func CreateSHA512File(file string) error {
-	f, err := os.Open(file)
-	if err != nil {
-		return errors.Wrap(err, "failed to open file for sha512 summing")
+// checkGlobElems returns an error if any of the pattern elements is malformed.
+func checkGlobElems(parts []string) error {
+	for _, part := range parts {
+		if part == "**" {
+			continue
+		}
+		if _, err := filepath.Match(part, ""); err != nil {
+			return err
+		}
 	}
-	defer f.Close()
+	return nil
+}
 
-	sum := sha512.New()
-	if _, err := io.Copy(sum, f); err != nil {
-		return errors.Wrap(err, "failed reading from input file")
+// globRecursive returns the paths matching a pattern that contains ** path
+// elements. The leading literal elements of the pattern are used as the root
+// of the walk and directories that cannot contain a match, or for which the
+// optional exclude function returns true, are skipped. Like filepath.Glob, I/O
+// errors are ignored.
+func globRecursive(pattern string, exclude func(path string) bool) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	root := filepath.VolumeName(pattern)
+	rest := pattern[len(root):]
+	if strings.HasPrefix(rest, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+		rest = rest[1:]
 	}
 
-	computedHash := hex.EncodeToString(sum.Sum(nil))
-	out := fmt.Sprintf("%v  %v", computedHash, filepath.Base(file))
+	parts := strings.Split(rest, string(filepath.Separator))
+	if err := checkGlobElems(parts); err != nil {
+		return nil, err
+	}
+	for len(parts) > 1 && !hasGlobMeta(parts[0]) {
+		root = filepath.Join(root, parts[0])
+		parts = parts[1:]
+	}
+	if root == "" {
+		root = "."
+	}
 
-	return ioutil.WriteFile(file+".sha512", []byte(out), 0644)
+	var matches []string
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		if exclude != nil && exclude(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		elems := strings.Split(rel, string(filepath.Separator))
+		if matchGlobElems(parts, elems) {
+			matches = append(matches, path)
+		}
+		if d.IsDir() && !matchGlobPrefix(parts, elems) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return matches, nil
+}
+
+// hasGlobMeta returns true if the path element contains any of the special
+// characters recognized by filepath.Match.
+func hasGlobMeta(elem string) bool {
+	magic := `*?[`
+	if runtime.GOOS != "windows" {
+		magic = `*?[\`
+	}
+	return strings.ContainsAny(elem, magic)
+}
+
+// matchGlobElems returns true if the path elements match the pattern elements.
+// A ** pattern element matches zero or more path elements.
+func matchGlobElems(parts, elems []string) bool {
+	for len(parts) > 0 {
+		if parts[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchGlobElems(parts[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(parts[0], elems[0]); !ok {
+			return false
+		}
+		parts, elems = parts[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// matchGlobPrefix returns true if paths below the directory given by elems can
+// match the pattern elements.
+func matchGlobPrefix(parts, elems []string) bool {
+	for i, elem := range elems {
+		if i >= len(parts) {
+			return false
+		}
+		if parts[i] == "**" {
+			return true
+		}
+		if ok, _ := filepath.Match(parts[i], elem); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// FindOption defines an option to FindFilesRecursive.
+type FindOption func(params *findParams)
+
+// FollowSymlinks causes FindFilesRecursive to resolve symlinks and to descend
+// into symlinked directories. match is passed the FileInfo of the target. A
+// file or directory that is reachable through more than one path is reported
+// only once, by the first path encountered in the lexically ordered walk. An
+// error naming the link is returned if a symlink points to one of its own
+// parent directories.
+func FollowSymlinks() func(params *findParams) {
+	return func(params *findParams) {
+		params.FollowSymlinks = true
+	}
+}
+
+// FailOnPermissionDenied causes FindFilesRecursive to return an error when a
+// path cannot be read due to its permissions. By default such paths are
+// skipped with a warning.
+func FailOnPermissionDenied() func(params *findParams) {
+	return func(params *findParams) {
+		params.FailOnPermissionDenied = true
+	}
+}
+
+type findParams struct {
+	FollowSymlinks         bool
+	FailOnPermissionDenied bool
+}
+
+// FindFilesRecursive walks root and returns the paths, relative to root, of
+// the entries for which match returns true. match is invoked with the relative
+// path and the entry's FileInfo. Symlinks are passed with their own FileInfo
+// and are never followed, so the walk does not descend into symlinked
+// directories, unless FollowSymlinks is given. Paths that cannot be read due
+// to their permissions are skipped and reported in a single warning unless
+// FailOnPermissionDenied is given.
+func FindFilesRecursive(root string, match func(path string, info fs.FileInfo) bool, options ...FindOption) ([]string, error) {
+	var params findParams
+	for _, opt := range options {
+		opt(&params)
+	}
+	return findFilesRecursive(context.Background(), root, match, params)
+}
+
+func findFilesRecursive(ctx context.Context, root string, match func(path string, info fs.FileInfo) bool, params findParams) ([]string, error) {
+	if params.FollowSymlinks {
+		return findFilesFollowingSymlinks(ctx, root, match, params)
+	}
+
+	var files, denied []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path != root && !params.FailOnPermissionDenied && os.IsPermission(err) {
+				denied = append(denied, path)
+				if d != nil && d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			// The entry was removed during the walk.
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if match(rel, info) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to walk %v", root)
+	}
+	if len(denied) > 0 {
+		LoggerFromContext(ctx).Warnf("Skipped %d paths under %v due to insufficient permissions: %v",
+			len(denied), root, strings.Join(denied, ", "))
+	}
+	return files, nil
+}
+
+// symlinkWalker walks a directory tree while following symlinks.
+type symlinkWalker struct {
+	match   func(path string, info fs.FileInfo) bool
+	params  findParams
+	files   []string
+	denied  []string
+	visited map[string]struct{} // Real paths of the files and directories seen.
+	active  map[string]string   // Real paths of the directories being walked.
+}
+
+func findFilesFollowingSymlinks(ctx context.Context, root string, match func(path string, info fs.FileInfo) bool, params findParams) ([]string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to walk %v", root)
+	}
+
+	w := &symlinkWalker{
+		match:   match,
+		params:  params,
+		visited: map[string]struct{}{realRoot: {}},
+		active:  map[string]string{},
+	}
+	if err = w.walk(realRoot, "."); err != nil {
+		return nil, errors.Wrapf(err, "failed to walk %v", root)
+	}
+	if len(w.denied) > 0 {
+		LoggerFromContext(ctx).Warnf("Skipped %d paths under %v due to insufficient permissions: %v",
+			len(w.denied), root, strings.Join(w.denied, ", "))
+	}
+	return w.files, nil
+}
+
+// walk visits the entries of the directory whose real (symlink free) path is
+// dir and whose path relative to the root is rel.
+func (w *symlinkWalker) walk(dir, rel string) error {
+	w.active[dir] = rel
+	defer delete(w.active, dir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if rel != "." && !w.params.FailOnPermissionDenied && os.IsPermission(err) {
+			w.denied = append(w.denied, rel)
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(rel, entry.Name())
+		real := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			// The entry was removed during the walk.
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := filepath.EvalSymlinks(real)
+			if err == nil {
+				info, err = os.Stat(target)
+			}
+			if err == nil {
+				real = target
+			} else {
+				// Report dangling links with their own FileInfo.
+				info, _ = entry.Info()
+			}
+		}
+
+		if info.IsDir() {
+			if parent, found := w.active[real]; found {
+				return errors.Errorf("symlink cycle detected, %v points to its parent directory %v", path, parent)
+			}
+		}
+		if _, found := w.visited[real]; found {
+			continue
+		}
+		w.visited[real] = struct{}{}
+
+		if w.match(path, info) {
+			w.files = append(w.files, path)
+		}
+		if info.IsDir() {
+			if err = w.walk(real, path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ByRegexp returns a FindFilesRecursive predicate that matches paths (using
+// forward slashes) against the regular expression. It panics if expr is not
+// a valid regular expression.
+func ByRegexp(expr string) func(path string, info fs.FileInfo) bool {
+	re := regexp.MustCompile(expr)
+	return func(path string, _ fs.FileInfo) bool {
+		return re.MatchString(filepath.ToSlash(path))
+	}
+}
+
+// ByExt returns a FindFilesRecursive predicate that matches regular files
+// with any of the given extensions (e.g. ".yml" or "yml").
+func ByExt(exts ...string) func(path string, info fs.FileInfo) bool {
+	set := map[string]struct{}{}
+	for _, ext := range exts {
+		set["."+strings.TrimPrefix(ext, ".")] = struct{}{}
+	}
+	return func(path string, info fs.FileInfo) bool {
+		_, found := set[filepath.Ext(path)]
+		return found && info.Mode().IsRegular()
+	}
+}
+
+// Match is a line of a file found by FindFilesByContent.
+type Match struct {
+	Path string // Path of the file relative to the root.
+	Line int    // Line number starting at 1.
+	Text string // Content of the line without the line terminator.
+}
+
+// ContentOption defines an option to FindFilesByContent.
+type ContentOption func(params *contentParams)
+
+// ContentExclude skips the files and directories under the root that match any
+// of the patterns. The patterns are relative to the root and are interpreted
+// like the exclude patterns of FindFilesExclude (e.g. vendor, *.pb.go, or
+// module/**/_meta).
+func ContentExclude(patterns ...string) func(params *contentParams) {
+	return func(params *contentParams) {
+		params.Excludes = append(params.Excludes, patterns...)
+	}
+}
+
+type contentParams struct {
+	Excludes []string
+}
+
+// FindFilesByContent returns the lines of the regular files under root that
+// match re, like grep -rn but with the same behavior on all platforms. Binary
+// files (see looksBinary) are skipped. The files are scanned in parallel. The
+// matches are ordered by path and then by line number.
+func FindFilesByContent(root string, re *regexp.Regexp, options ...ContentOption) ([]Match, error) {
+	var params contentParams
+	for _, opt := range options {
+		opt(&params)
+	}
+	exclude, err := newGlobExcluder(params.Excludes)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if exclude.match(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to walk %v", root)
+	}
+
+	results := make([][]Match, len(files))
+	errs := make([]error, len(files))
+	sem := make(chan struct{}, numParallel())
+	var wg sync.WaitGroup
+	for i, rel := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, rel string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = grepFile(root, rel, re)
+		}(i, rel)
+	}
+	wg.Wait()
+
+	var matches []Match
+	for i := range files {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		matches = append(matches, results[i]...)
+	}
+	return matches, nil
+}
+
+// grepFile returns the lines of root/rel that match re.
+func grepFile(root, rel string, re *regexp.Regexp) ([]Match, error) {
+	f, err := os.Open(filepath.Join(root, rel))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if head, _ := r.Peek(binarySniffLen); looksBinary(head) {
+		return nil, nil
+	}
+
+	var matches []Match
+	for line := 1; ; line++ {
+		text, err := r.ReadString('\n')
+		if text != "" {
+			text = strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+			if re.MatchString(text) {
+				matches = append(matches, Match{Path: rel, Line: line, Text: text})
+			}
+		}
+		if err == io.EOF {
+			return matches, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %v", rel)
+		}
+	}
+}
+
+// binarySniffLen is the number of leading bytes examined by looksBinary.
+const binarySniffLen = 8000
+
+// looksBinary returns true if the beginning of a file contains a NUL byte,
+// which is the heuristic used by git and grep to detect binary files.
+func looksBinary(head []byte) bool {
+	if len(head) > binarySniffLen {
+		head = head[:binarySniffLen]
+	}
+	return bytes.IndexByte(head, 0) >= 0
+}
+
+// ListTrackedFiles returns the files under dir that are tracked by git, which
+// excludes anything matched by .gitignore. The paths are relative to dir and
+// use forward slashes. If dir is not in a git repository (or git is not
+// installed) a warning is logged and all regular files under dir are returned.
+func ListTrackedFiles(dir string) ([]string, error) {
+	return listTrackedFiles(context.Background(), dir)
+}
+
+func listTrackedFiles(ctx context.Context, dir string) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(bytes.Buffer)
+	err = Cmd{Args: []string{"git", "ls-files", "-z"}, Dir: dir, Stdout: out}.RunContext(ctx)
+	if err != nil {
+		LoggerFromContext(ctx).Warnf("Listing all files in %v because git ls-files failed (%v). "+
+			"Files ignored by .gitignore will be included.", dir, err)
+		return listAllFiles(dir)
+	}
+
+	var files []string
+	for _, file := range strings.Split(out.String(), "\x00") {
+		if file == "" {
+			continue
+		}
+
+		// Skip files that are tracked but were deleted from the working tree.
+		if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(file))); err != nil {
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// listAllFiles returns the relative paths of the regular files under dir,
+// excluding any .git directories.
+func listAllFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, errors.Wrapf(err, "failed to list files in %v", dir)
+}
+
+// FileConcat concatenates files and writes the output to out. A file that is
+// listed more than once (even if spelled differently) is only written once, at
+// the position of its first occurrence.
+func FileConcat(out string, perm os.FileMode, files ...string) error {
+	files, err := uniquePaths(files)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(createDir(out), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return errors.Wrap(err, "failed to create file")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	append := func(file string) error {
+		in, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		if _, err := io.Copy(w, in); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	for _, in := range files {
+		if err := append(in); err != nil {
+			return err
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// FileConcatGlob concatenates the files matching the glob patterns and writes
+// the output to out. The files are written in the order of the patterns (see
+// FindFilesOrdered).
+func FileConcatGlob(out string, perm os.FileMode, globs []string, options ...GlobOption) error {
+	params := newGlobParams(options)
+	files, err := findFilesOrdered(globs, params.RequireMatches)
+	if err != nil {
+		return err
+	}
+	return FileConcat(out, perm, files...)
+}
+
+// MustFileConcat invokes FileConcat and panics if an error occurs.
+func MustFileConcat(out string, perm os.FileMode, files ...string) {
+	if err := FileConcat(out, perm, files...); err != nil {
+		panic(err)
+	}
+}
+
+// VerifySHA256 reads a file and verifies that its SHA256 sum matches the
+// specified hash.
+func VerifySHA256(file string, hash string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file for sha256 verification")
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return errors.Wrap(err, "failed reading from input file")
+	}
+
+	computedHash := hex.EncodeToString(sum.Sum(nil))
+	expectedHash := strings.TrimSpace(hash)
+
+	if computedHash != expectedHash {
+		return errors.Errorf("SHA256 verification of %v failed. Expected=%v, "+
+			"but computed=%v", f.Name(), expectedHash, computedHash)
+	}
+	logDebug("SHA256 OK:", f.Name())
+
+	return nil
+}
+
+// CreateSHA512File computes the sha512 sum of the specified file the writes
+// a sidecar file containing the hash and filename.
+func CreateSHA512File(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file for sha512 summing")
+	}
+	defer f.Close()
+
+	sum := sha512.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return errors.Wrap(err, "failed reading from input file")
+	}
+
+	computedHash := hex.EncodeToString(sum.Sum(nil))
+	out := fmt.Sprintf("%v  %v", computedHash, filepath.Base(file))
+
+	return ioutil.WriteFile(file+".sha512", []byte(out), 0644)
+}
+
+// ArtifactInfo describes a build artifact.
+type ArtifactInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	SHA512  string    `json:"sha512"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// BuildManifest returns information about each regular file contained in dir.
+// Sub-directories are not inspected.
+func BuildManifest(dir string) ([]ArtifactInfo, error) {
+	contents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read dir %v", dir)
+	}
+
+	var artifacts []ArtifactInfo
+	for _, info := range contents {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		hashes, err := MultiHash(filepath.Join(dir, info.Name()), "sha256", "sha512")
+		if err != nil {
+			return nil, err
+		}
+
+		artifacts = append(artifacts, ArtifactInfo{
+			Name:    info.Name(),
+			Size:    info.Size(),
+			SHA256:  hashes["sha256"],
+			SHA512:  hashes["sha512"],
+			ModTime: info.ModTime().UTC(),
+		})
+	}
+
+	return artifacts, nil
+}
+
+// WriteManifestJSON writes the artifacts to the given path as JSON.
+func WriteManifestJSON(path string, artifacts []ArtifactInfo) error {
+	data, err := json.MarshalIndent(artifacts, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal manifest")
+	}
+
+	return ioutil.WriteFile(createDir(path), data, 0644)
+}
+
+// UpdateJSONFile performs a read-modify-write of a JSON object stored in
+// path. The object is passed to mutate (it is empty if the file does not
+// exist) and the result is written back atomically by renaming a temporary
+// file. An exclusive lock on path+".lock" is held for the duration so that
+// concurrent updates from other goroutines or processes are not lost.
+func UpdateJSONFile(path string, mutate func(m map[string]interface{}) error) error {
+	lock := flock.NewFlock(createDir(path) + ".lock")
+	if err := lock.Lock(); err != nil {
+		return errors.Wrapf(err, "failed to lock %v", path)
+	}
+	defer lock.Unlock()
+
+	m := map[string]interface{}{}
+	perm := os.FileMode(0644)
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(data, &m); err != nil {
+			return errors.Wrapf(err, "failed to parse %v", path)
+		}
+		if info, err := os.Stat(path); err == nil {
+			perm = info.Mode().Perm()
+		}
+	case !os.IsNotExist(err):
+		return errors.Wrapf(err, "failed to read %v", path)
+	}
+
+	if err = mutate(m); err != nil {
+		return err
+	}
+
+	if data, err = json.MarshalIndent(m, "", "  "); err != nil {
+		return errors.Wrapf(err, "failed to marshal %v", path)
+	}
+	return writeFileAtomic(path, append(data, '\n'), perm)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// path and then renames it to path so that readers never observe a partially
+// written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write temp file")
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write temp file")
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), path), "failed to replace %v", path)
+}
+
+// hashAlgorithms contains the algorithms supported by MultiHash.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// MultiHash computes the digests of the file for each of the given algorithms
+// (md5, sha1, sha256, or sha512) while reading the file only once. It returns
+// a map of lowercase algorithm name to hex encoded digest. Algorithm names are
+// case-insensitive.
+func MultiHash(file string, algos ...string) (map[string]string, error) {
+	if len(algos) == 0 {
+		return nil, errors.New("no hash algorithms specified")
+	}
+
+	hashes := make(map[string]hash.Hash, len(algos))
+	writers := make([]io.Writer, 0, len(algos))
+	for _, algo := range algos {
+		algo = strings.ToLower(algo)
+		newHash, found := hashAlgorithms[algo]
+		if !found {
+			return nil, errors.Errorf("unsupported hash algorithm %v", algo)
+		}
+		if _, dup := hashes[algo]; dup {
+			continue
+		}
+		h := newHash()
+		hashes[algo] = h
+		writers = append(writers, h)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file for hashing")
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, errors.Wrap(err, "failed reading from input file")
+	}
+
+	digests := make(map[string]string, len(hashes))
+	for algo, h := range hashes {
+		digests[algo] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, nil
+}
+
+// HashDir returns the hex encoded sha256 digest of a directory's contents.
+// The digest covers the relative path (using forward slashes) and the sha256
+// digest of each regular file in the tree so it does not depend on where the
+// directory is located or on file modification times.
+func HashDir(dir string) (string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to walk dir %v", dir)
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return "", err
+		}
+		digests, err := MultiHash(file, "sha256")
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%v\x00%v\n", filepath.ToSlash(rel), digests["sha256"])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CacheKey returns a sha256 digest summarizing the given input files and
+// directories. The key changes when an input is added or removed or when the
+// contents of an input change. It is independent of the order of the inputs.
+func CacheKey(inputs ...string) (string, error) {
+	return CacheKeySalted("", inputs...)
+}
+
+// CacheKeySalted is like CacheKey but it mixes salt into the digest. Changing
+// the salt invalidates all previously computed keys.
+func CacheKeySalted(salt string, inputs ...string) (string, error) {
+	paths, err := NormalizePaths(inputs)
+	if err != nil {
+		return "", err
+	}
+
+	cwd := CWD()
+	h := sha256.New()
+	fmt.Fprintf(h, "salt\x00%v\n", salt)
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to stat cache key input")
+		}
+
+		var digest string
+		if info.IsDir() {
+			digest, err = HashDir(p)
+		} else {
+			var digests map[string]string
+			digests, err = MultiHash(p, "sha256")
+			digest = digests["sha256"]
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// Use paths relative to the CWD so that keys are the same in
+		// different checkouts of the repo.
+		fmt.Fprintf(h, "%v\x00%v\n", cwdRelPath(cwd, p), digest)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FilesEqual returns true if the two files have identical contents. The
+// sizes are compared first and then the contents are streamed so that large
+// files are not loaded into memory. The comparison stops at the first
+// difference.
+func FilesEqual(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open file for comparison")
+	}
+	defer fa.Close()
+
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open file for comparison")
+	}
+	defer fb.Close()
+
+	infoA, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+	infoB, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+	if infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, 32*1024)
+	for {
+		nA, errA := readChunk(fa, bufA)
+		if errA != nil {
+			return false, errors.Wrapf(errA, "failed reading %v", a)
+		}
+		nB, errB := readChunk(fb, bufB)
+		if errB != nil {
+			return false, errors.Wrapf(errB, "failed reading %v", b)
+		}
+
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+		if nA < len(bufA) {
+			return true, nil
+		}
+	}
+}
+
+// readChunk fills buf from r. A short read at the end of r is not an error.
+func readChunk(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+// NewestModTime returns the most recent modification time of the files and
+// directories matching the glob patterns (see FindFiles) along with the path
+// that has it. Matching directories are walked recursively like by
+// IsUpToDate. Arguments without glob meta characters are paths that must
+// exist. An error is returned if one of them is missing or if nothing matches.
+func NewestModTime(globs ...string) (time.Time, string, error) {
+	r, err := globModTimes(globs)
+	return r.Newest.ModTime, r.Newest.Path, err
+}
+
+// OldestModTime is like NewestModTime but returns the least recent
+// modification time.
+func OldestModTime(globs ...string) (time.Time, string, error) {
+	r, err := globModTimes(globs)
+	return r.Oldest.ModTime, r.Oldest.Path, err
+}
+
+func globModTimes(globs []string) (modTimeRange, error) {
+	var paths, patterns []string
+	for _, glob := range globs {
+		if hasGlobMeta(glob) {
+			patterns = append(patterns, glob)
+			continue
+		}
+		if _, err := os.Stat(glob); err != nil {
+			return modTimeRange{}, errors.Wrapf(err, "failed to stat %v", glob)
+		}
+		paths = append(paths, glob)
+	}
+	if len(patterns) > 0 {
+		matches, err := FindFiles(patterns...)
+		if err != nil {
+			return modTimeRange{}, err
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return modTimeRange{}, errors.Errorf("no files match %v", strings.Join(globs, ", "))
+	}
+
+	var r modTimeRange
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimeRange{}, errors.Wrapf(err, "failed to stat %v", path)
+		}
+		if !info.IsDir() {
+			r.add(path, info.ModTime())
+			continue
+		}
+
+		dir, err := dirModTimes(path)
+		if err != nil {
+			return modTimeRange{}, errors.Wrapf(err, "failed to walk %v", path)
+		}
+		r.add(dir.Newest.Path, dir.Newest.ModTime)
+		r.add(dir.Oldest.Path, dir.Oldest.ModTime)
+	}
+	return r, nil
+}
+
+// FindFilesModifiedSince returns the files matching the glob patterns (see
+// FindFiles) that were modified after t.
+//
+// Modification times are unreliable in fresh git checkouts because git sets
+// them to the checkout time, so every file appears to be modified. Use
+// FindFilesContentChanged when only content changes matter.
+func FindFilesModifiedSince(t time.Time, globs ...string) ([]string, error) {
+	files, err := FindFiles(globs...)
+	if err != nil {
+		return nil, err
+	}
+
+	var modified []string
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to stat %v", f)
+		}
+		if info.ModTime().After(t) {
+			modified = append(modified, f)
+		}
+	}
+	return modified, nil
+}
+
+// FindFilesNewerThan returns the files matching the glob patterns that were
+// modified after the marker file. If the marker does not exist then all
+// matching files are returned. The caveats of FindFilesModifiedSince apply.
+func FindFilesNewerThan(markerPath string, globs ...string) ([]string, error) {
+	info, err := os.Stat(markerPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "failed to stat marker %v", markerPath)
+		}
+		logDebugf("Marker %v does not exist, treating all files as modified", markerPath)
+		return FindFiles(globs...)
+	}
+	return FindFilesModifiedSince(info.ModTime(), globs...)
+}
+
+// FindFilesContentChanged returns the regular files matching the glob patterns
+// whose sha256 digest differs from the one recorded in stateFile by
+// RecordFileHashes. Files that were not recorded, or all files if stateFile
+// does not exist, are returned too. Unlike FindFilesNewerThan this is not
+// affected by the modification times set by git.
+func FindFilesContentChanged(stateFile string, globs ...string) ([]string, error) {
+	recorded := map[string]string{}
+	data, err := ioutil.ReadFile(stateFile)
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(data, &recorded); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %v", stateFile)
+		}
+	case os.IsNotExist(err):
+		logDebugf("State file %v does not exist, treating all files as changed", stateFile)
+	default:
+		return nil, errors.Wrapf(err, "failed to read %v", stateFile)
+	}
+
+	files, err := FindFiles(globs...)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, f := range files {
+		if info, err := os.Stat(f); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		key, digest, err := fileHashEntry(stateFile, f)
+		if err != nil {
+			return nil, err
+		}
+		if recorded[key] != digest {
+			changed = append(changed, f)
+		}
+	}
+	return changed, nil
+}
+
+// RecordFileHashes records the sha256 digests of the files in stateFile for
+// use by FindFilesContentChanged. Entries for other files are kept. The paths
+// are stored relative to the directory of stateFile.
+func RecordFileHashes(stateFile string, files ...string) error {
+	return UpdateJSONFile(stateFile, func(m map[string]interface{}) error {
+		for _, f := range files {
+			key, digest, err := fileHashEntry(stateFile, f)
+			if err != nil {
+				return err
+			}
+			m[key] = digest
+		}
+		return nil
+	})
+}
+
+// fileHashEntry returns the state file key and the sha256 digest of a file.
+func fileHashEntry(stateFile, file string) (key, digest string, err error) {
+	absState, err := filepath.Abs(stateFile)
+	if err != nil {
+		return "", "", err
+	}
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return "", "", err
+	}
+	rel, err := filepath.Rel(filepath.Dir(absState), absFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	digests, err := MultiHash(file, "sha256")
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.ToSlash(rel), digests["sha256"], nil
 }
 
 // IsUpToDate returns true iff dst exists and is older based on modtime than all
-// of the sources.
+// of the sources. A directory source is expanded recursively and its modtime
+// is the newest modtime of the directory itself, its subdirectories, and the
+// files within them, so adding, removing, or editing a nested file is treated
+// as a change. Directory modtimes are cached until the modtime of the
+// directory itself changes or InvalidateModTimeCache is called.
+// It returns false and logs a warning if no sources are given or if a source
+// does not exist. Use IsUpToDateE to handle these cases as errors.
+//
+// The reason for the result is logged at debug level (DEV_TOOLS_LOG=debug).
+// See IsUpToDateExplain.
 func IsUpToDate(dst string, sources ...string) bool {
+	return checkUpToDate(context.Background(), dst, sources)
+}
+
+// checkUpToDate implements IsUpToDate and logs to the logger of ctx.
+func checkUpToDate(ctx context.Context, dst string, sources []string) bool {
+	if len(sources) == 0 {
+		LoggerFromContext(ctx).Warnf("No sources passed to IsUpToDate for %v, treating it as not up-to-date", dst)
+		return false
+	}
+	upToDate, reason, err := isUpToDate(dst, sources)
+	if err != nil {
+		LoggerFromContext(ctx).Warnf("Treating %v as not up-to-date: %v", dst, err)
+		return false
+	}
+	logUpToDateReason(ctx, dst, upToDate, reason)
+	return upToDate
+}
+
+// IsUpToDateE is like IsUpToDate but it returns an error if no sources are
+// given or if a source does not exist, as this usually indicates a mistake in
+// the list of sources. A missing dst is not an error, it is just not
+// up-to-date.
+func IsUpToDateE(dst string, sources ...string) (bool, error) {
+	upToDate, reason, err := isUpToDate(dst, sources)
+	if err != nil {
+		return false, err
+	}
+	logUpToDateReason(context.Background(), dst, upToDate, reason)
+	return upToDate, nil
+}
+
+// IsUpToDateExplain is like IsUpToDate but it also returns the reason for the
+// result, e.g. which source is newer than dst along with both modtimes.
+func IsUpToDateExplain(dst string, sources ...string) (upToDate bool, reason string) {
+	upToDate, reason, err := isUpToDate(dst, sources)
+	if err != nil {
+		return false, err.Error()
+	}
+	return upToDate, reason
+}
+
+func isUpToDate(dst string, sources []string) (upToDate bool, reason string, err error) {
+	if len(sources) == 0 {
+		return false, "", errors.Errorf("no sources passed to IsUpToDate for %v", dst)
+	}
+	if normalized, err := NormalizePaths(sources); err == nil {
+		sources = normalized
+	}
+
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, fmt.Sprintf("destination %v does not exist", dst), nil
+		}
+		return false, "", errors.Wrapf(err, "failed to stat destination %v", dst)
+	}
+	for _, src := range sources {
+		info, err := os.Stat(src)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, "", errors.Errorf("source %v does not exist", src)
+			}
+			return false, "", errors.Wrapf(err, "failed to stat source %v", src)
+		}
+		modTime := info.ModTime()
+		if info.IsDir() {
+			if modTime, err = dirModTime(src); err != nil {
+				return false, "", errors.Wrapf(err, "failed to get modtime of %v", src)
+			}
+		}
+		if modTime.After(dstInfo.ModTime()) {
+			return false, fmt.Sprintf("source %v (modified %v) is newer than destination %v (modified %v)",
+				src, formatModTime(modTime), dst, formatModTime(dstInfo.ModTime())), nil
+		}
+	}
+	return true, fmt.Sprintf("destination %v is not older than any of the %d sources", dst, len(sources)), nil
+}
+
+// logUpToDateReason logs the reason for the result of an up-to-date check at
+// debug level to the logger of ctx.
+func logUpToDateReason(ctx context.Context, dst string, upToDate bool, reason string) {
+	log := LoggerFromContext(ctx)
+	if !log.Enabled(DebugLevel) {
+		return
+	}
+	if upToDate {
+		log.Debugf("%v is up-to-date: %v", dst, reason)
+		return
+	}
+	log.Debugf("%v is not up-to-date: %v", dst, reason)
+}
+
+func formatModTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// IsUpToDateGlob is like IsUpToDate but the sources are glob patterns that are
+// expanded with FindFiles. If the patterns match nothing (e.g. the sources
+// have not been generated yet) a warning is logged and false is returned.
+func IsUpToDateGlob(dst string, sourceGlobs ...string) bool {
+	return checkUpToDateGlob(context.Background(), dst, sourceGlobs)
+}
+
+// checkUpToDateGlob implements IsUpToDateGlob and logs to the logger of ctx.
+func checkUpToDateGlob(ctx context.Context, dst string, sourceGlobs []string) bool {
+	sources, err := FindFiles(sourceGlobs...)
+	if err != nil {
+		LoggerFromContext(ctx).Warnf("Failed to expand sources of %v: %v", dst, err)
+		return false
+	}
+	if len(sources) == 0 {
+		LoggerFromContext(ctx).Warnf("Source patterns %v of %v matched no files, treating it as not up-to-date", sourceGlobs, dst)
+		return false
+	}
+	return checkUpToDate(ctx, dst, sources)
+}
+
+// OutOfDateSources returns the sources that are newer than dst based on
+// modtime. The sources are glob patterns (see FindFiles). Directories are
+// expanded to the files beneath them that are newer than dst, or to the
+// directory itself if only its entries changed (e.g. a file was removed). An
+// empty result means that dst is up-to-date. All sources are returned if dst
+// does not exist, and also along with an error if dst cannot be stat'ed.
+func OutOfDateSources(dst string, sources ...string) ([]string, error) {
+	paths, err := FindFiles(sources...)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errors.Errorf("no sources of %v match %v", dst, strings.Join(sources, ", "))
+	}
+
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return paths, nil
+		}
+		return paths, errors.Wrapf(err, "failed to stat destination %v", dst)
+	}
+
+	newer := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to stat source %v", path)
+		}
+		if !info.IsDir() {
+			if info.ModTime().After(dstInfo.ModTime()) {
+				newer = append(newer, path)
+			}
+			continue
+		}
+
+		modTime, err := dirModTime(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get modtime of %v", path)
+		}
+		if !modTime.After(dstInfo.ModTime()) {
+			continue
+		}
+		files, err := regularFiles([]string{path})
+		if err != nil {
+			return nil, err
+		}
+		var found bool
+		for _, f := range files {
+			if info, err := os.Stat(f); err == nil && info.ModTime().After(dstInfo.ModTime()) {
+				newer = append(newer, f)
+				found = true
+			}
+		}
+		if !found {
+			newer = append(newer, path)
+		}
+	}
+	return newer, nil
+}
+
+// OutOfDateSourcesHash is like OutOfDateSources but it returns the files whose
+// sha256 digest differs from the one recorded by RecordUpToDateHash, or that
+// were not recorded. All files are returned if dst does not exist or if no
+// valid state was recorded for it.
+func OutOfDateSourcesHash(dst string, sources ...string) ([]string, error) {
+	paths, err := FindFiles(sources...)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errors.Errorf("no sources of %v match %v", dst, strings.Join(sources, ", "))
+	}
+	files, err := regularFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = os.Stat(dst); err != nil {
+		if os.IsNotExist(err) {
+			return files, nil
+		}
+		return files, errors.Wrapf(err, "failed to stat destination %v", dst)
+	}
+	var state upToDateHashState
+	stateFile, err := upToDateHashFile(dst)
+	if err != nil {
+		return files, err
+	}
+	if data, err := ioutil.ReadFile(stateFile); err != nil || json.Unmarshal(data, &state) != nil {
+		return files, nil
+	}
+
+	cwd := CWD()
+	changed := []string{}
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+		digests, err := MultiHash(f, "sha256")
+		if err != nil {
+			return nil, err
+		}
+		if state.Files[cwdRelPath(cwd, abs)] != digests["sha256"] {
+			changed = append(changed, f)
+		}
+	}
+	return changed, nil
+}
+
+var (
+	dirModTimeCacheLock sync.Mutex
+	dirModTimeCache     = map[string]dirModTimeEntry{}
+)
+
+// dirModTimeEntry is the cached modtime range of a directory tree along with
+// the modtime of the directory itself when the tree was walked.
+type dirModTimeEntry struct {
+	DirModTime time.Time
+	Range      modTimeRange
+}
+
+// InvalidateModTimeCache discards the cached modtimes of directories used by
+// IsUpToDate and NewestModTime. A cached entry is already discarded when the
+// modtime of its directory changes (i.e. an entry is added to or removed from
+// it), but changes further down the tree are only seen after invalidating the
+// cache. It is called by RecordUpToDateHash and TargetCache.MarkDone, and
+// should be called by targets that generate files into the sources of other
+// targets.
+func InvalidateModTimeCache() {
+	dirModTimeCacheLock.Lock()
+	defer dirModTimeCacheLock.Unlock()
+	dirModTimeCache = map[string]dirModTimeEntry{}
+}
+
+// pathModTime is the modtime of a path.
+type pathModTime struct {
+	Path    string
+	ModTime time.Time
+}
+
+// modTimeRange holds the paths with the newest and the oldest modtimes in a
+// directory tree.
+type modTimeRange struct {
+	Newest, Oldest pathModTime
+}
+
+// dirModTime returns the newest modtime of dir and everything beneath it.
+func dirModTime(dir string) (time.Time, error) {
+	r, err := dirModTimes(dir)
+	return r.Newest.ModTime, err
+}
+
+// dirModTimes returns the newest and the oldest modtimes of dir and
+// everything beneath it. The result is cached by path because walking large
+// trees is expensive (see InvalidateModTimeCache).
+func dirModTimes(dir string) (modTimeRange, error) {
+	dirModTimeCacheLock.Lock()
+	defer dirModTimeCacheLock.Unlock()
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return modTimeRange{}, err
+	}
+	if entry, found := dirModTimeCache[dir]; found && entry.DirModTime.Equal(info.ModTime()) {
+		return entry.Range, nil
+	}
+
+	var r modTimeRange
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		r.add(path, info.ModTime())
+		return nil
+	})
+	if err != nil {
+		return modTimeRange{}, err
+	}
+	dirModTimeCache[dir] = dirModTimeEntry{DirModTime: info.ModTime(), Range: r}
+	return r, nil
+}
+
+// add updates the range with the modtime of a path. On ties the path that was
+// added first is kept.
+func (r *modTimeRange) add(path string, modTime time.Time) {
+	if r.Newest.Path == "" || modTime.After(r.Newest.ModTime) {
+		r.Newest = pathModTime{Path: path, ModTime: modTime}
+	}
+	if r.Oldest.Path == "" || modTime.Before(r.Oldest.ModTime) {
+		r.Oldest = pathModTime{Path: path, ModTime: modTime}
+	}
+}
+
+// upToDateHashDir is the directory in which IsUpToDateHash state files are
+// stored. Replaced in tests.
+var upToDateHashDir = filepath.Join("build", ".cache", "uptodate")
+
+// upToDateHashState is the content of an IsUpToDateHash state file.
+type upToDateHashState struct {
+	Target  string            `json:"target"`
+	Sources []string          `json:"sources"`
+	Digest  string            `json:"digest"`
+	Files   map[string]string `json:"files,omitempty"` // Digest of each file.
+}
+
+// IsUpToDateHash returns true iff dst exists and the sha256 digest of the
+// sources matches the digest recorded by RecordUpToDateHash. Unlike
+// IsUpToDate it does not depend on modtimes so it works in fresh git
+// checkouts. Directory sources are expanded recursively. A missing or
+// unreadable state file means that dst is stale.
+//
+// The digest is not recorded by IsUpToDateHash itself because the target
+// could fail to build, so call RecordUpToDateHash after dst has been built.
+func IsUpToDateHash(dst string, sources ...string) bool {
+	if len(sources) == 0 {
+		logWarnf("No sources passed to IsUpToDateHash for %v, treating it as not up-to-date", dst)
+		return false
+	}
+	upToDate, reason := IsUpToDateHashExplain(dst, sources...)
+	logUpToDateReason(context.Background(), dst, upToDate, reason)
+	return upToDate
+}
+
+// IsUpToDateHashExplain is like IsUpToDateHash but it also returns the reason
+// for the result.
+func IsUpToDateHashExplain(dst string, sources ...string) (upToDate bool, reason string) {
 	if len(sources) == 0 {
-		panic("No sources passed to IsUpToDate")
+		return false, "no sources"
+	}
+	if _, err := os.Stat(dst); err != nil {
+		if os.IsNotExist(err) {
+			return false, fmt.Sprintf("destination %v does not exist", dst)
+		}
+		return false, fmt.Sprintf("failed to stat destination %v: %v", dst, err)
+	}
+
+	stateFile, err := upToDateHashFile(dst)
+	if err != nil {
+		return false, err.Error()
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, fmt.Sprintf("no digest recorded in %v", stateFile)
+		}
+		return false, fmt.Sprintf("failed to read state file %v: %v", stateFile, err)
+	}
+	var state upToDateHashState
+	if err = json.Unmarshal(data, &state); err != nil || state.Digest == "" {
+		return false, fmt.Sprintf("state file %v is corrupt", stateFile)
+	}
+
+	current, err := sourcesDigest(sources)
+	if err != nil {
+		return false, fmt.Sprintf("failed to compute digest of sources: %v", err)
+	}
+	if state.Digest != current.Digest {
+		return false, fmt.Sprintf("digest of sources changed from %v to %v", state.Digest, current.Digest)
+	}
+	return true, fmt.Sprintf("digest of sources %v is unchanged", current.Digest)
+}
+
+// RecordUpToDateHash records the sha256 digest of the sources of dst for use
+// by IsUpToDateHash. The state file is replaced atomically.
+func RecordUpToDateHash(dst string, sources ...string) error {
+	stateFile, err := upToDateHashFile(dst)
+	if err != nil {
+		return err
+	}
+	state, err := sourcesDigest(sources)
+	if err != nil {
+		return errors.Wrapf(err, "failed to compute digest of sources of %v", dst)
+	}
+	abs, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	state.Target = cwdRelPath(CWD(), abs)
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// dst was (re)generated so directories containing it may have changed.
+	InvalidateModTimeCache()
+	return writeFileAtomic(createDir(stateFile), append(data, '\n'), 0644)
+}
+
+// InvalidateUpToDateHash removes the digest recorded for dst so that the next
+// IsUpToDateHash check reports it as stale.
+func InvalidateUpToDateHash(dst string) error {
+	stateFile, err := upToDateHashFile(dst)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// upToDateHashFile returns the path of the state file of dst. It is named
+// after the digest of the path of dst relative to the CWD so that it is the
+// same in different checkouts of the repo.
+func upToDateHashFile(dst string) (string, error) {
+	abs, err := filepath.Abs(dst)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get absolute path of %v", dst)
+	}
+	sum := sha256.Sum256([]byte(cwdRelPath(CWD(), abs)))
+	return filepath.Join(upToDateHashDir, hex.EncodeToString(sum[:16])+".json"), nil
+}
+
+// sourcesDigest computes a digest over the list of sources and the sha256 of
+// each file. Directories are expanded to the regular files that they contain
+// so that adding or removing a file changes the digest. Paths are relative to
+// the CWD so that the digest does not depend on the location of the checkout.
+func sourcesDigest(sources []string) (*upToDateHashState, error) {
+	sources, err := NormalizePaths(sources)
+	if err != nil {
+		return nil, err
+	}
+	files, err := regularFiles(sources)
+	if err != nil {
+		return nil, err
+	}
+
+	cwd := CWD()
+	h := sha256.New()
+	relSources := make([]string, 0, len(sources))
+	for _, src := range sources {
+		relSources = append(relSources, cwdRelPath(cwd, src))
+		fmt.Fprintf(h, "%s\n", cwdRelPath(cwd, src))
+	}
+	fileDigests := make(map[string]string, len(files))
+	for _, f := range files {
+		digests, err := MultiHash(f, "sha256")
+		if err != nil {
+			return nil, err
+		}
+		name := cwdRelPath(cwd, f)
+		fmt.Fprintf(h, "%s\x00%s\n", name, digests["sha256"])
+		fileDigests[name] = digests["sha256"]
+	}
+	return &upToDateHashState{
+		Sources: relSources,
+		Digest:  hex.EncodeToString(h.Sum(nil)),
+		Files:   fileDigests,
+	}, nil
+}
+
+// cwdRelPath returns the slash separated path of the absolute path p relative
+// to cwd. p is returned unchanged, but slash separated, if there is no
+// relative path (e.g. it's on a different drive on Windows).
+func cwdRelPath(cwd, p string) string {
+	if rel, err := filepath.Rel(cwd, p); err == nil {
+		p = rel
+	}
+	return filepath.ToSlash(p)
+}
+
+// RelOrAbs returns the path of target relative to base. If there is no
+// relative path between them (e.g. they are on different drives on Windows)
+// the cleaned absolute path of target is returned instead. It never fails.
+func RelOrAbs(base, target string) string {
+	if rel, err := filepath.Rel(base, target); err == nil {
+		return rel
+	}
+
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return filepath.Clean(target)
+	}
+	if absBase, err := filepath.Abs(base); err == nil {
+		if rel, err := filepath.Rel(absBase, absTarget); err == nil {
+			return rel
+		}
+	}
+	return absTarget
+}
+
+// regularFiles returns the given paths with each directory replaced by the
+// regular files beneath it in lexical order.
+func regularFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// NormalizePaths converts each path to a clean absolute path and returns the
+// sorted, de-duplicated list.
+func NormalizePaths(paths []string) ([]string, error) {
+	unique, err := uniquePaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(unique)
+	return unique, nil
+}
+
+// uniquePaths converts each path to a clean absolute path and removes
+// duplicates while preserving the order of the first occurrences.
+func uniquePaths(paths []string) ([]string, error) {
+	seen := make(map[string]struct{}, len(paths))
+	out := make([]string, 0, len(paths))
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get absolute path of %v", path)
+		}
+		if _, found := seen[abs]; found {
+			continue
+		}
+		seen[abs] = struct{}{}
+		out = append(out, abs)
 	}
-	execute, err := target.Path(dst, sources...)
-	return err == nil && !execute
+	return out, nil
 }
 
 // createDir creates the parent directory for the given file.
@@ -0,0 +1,2566 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryJob(t *testing.T) {
+	var calls int
+	job := RetryJob(3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+
+	assert.NoError(t, job(context.Background()))
+	assert.Equal(t, 3, calls)
+}
+
+func TestRetryJobExhausted(t *testing.T) {
+	var calls int
+	job := RetryJob(2, time.Millisecond, func(context.Context) error {
+		calls++
+		return errors.New("boom")
+	})
+
+	err := job(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "after 2 attempts")
+		assert.Contains(t, err.Error(), "boom")
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestRetryJobCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	job := RetryJob(5, time.Hour, func() error {
+		calls++
+		cancel()
+		return errors.New("boom")
+	})
+
+	err := job(ctx)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "canceled after 1 attempts")
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryJobPanics(t *testing.T) {
+	job := RetryJob(2, time.Millisecond, func() { panic("oops") })
+	assert.Panics(t, func() { job(context.Background()) })
+
+	var calls int
+	job = RetryJob(2, time.Millisecond, func() {
+		calls++
+		panic("oops")
+	}, RetryPanics())
+	err := job(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "oops")
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestJobTrackerProgress(t *testing.T) {
+	tracker := newJobTracker(3)
+	assert.Equal(t, "0/3 jobs complete, 0 running", tracker.progress())
+
+	first := tracker.start("package-linux-arm64")
+	first.start = first.start.Add(-2 * time.Minute)
+	second := tracker.start("package-linux-amd64")
+	tracker.finish(second, nil)
+
+	assert.Equal(t, "1/3 jobs complete, 1 running (oldest: package-linux-arm64, 2m0s)", tracker.progress())
+}
+
+func TestJobName(t *testing.T) {
+	assert.Equal(t, "mage.TestJobName", jobName(TestJobName))
+}
+
+func TestRequireEnv(t *testing.T) {
+	for _, name := range []string{"MAGE_TEST_SET", "MAGE_TEST_EMPTY", "MAGE_TEST_UNSET"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv("MAGE_TEST_SET", "value")
+	os.Setenv("MAGE_TEST_EMPTY", "")
+	os.Unsetenv("MAGE_TEST_UNSET")
+
+	assert.NoError(t, RequireEnv("MAGE_TEST_SET"))
+	assert.NoError(t, RequireEnv())
+
+	err := RequireEnv("MAGE_TEST_UNSET", "MAGE_TEST_SET", "MAGE_TEST_EMPTY")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "MAGE_TEST_UNSET, MAGE_TEST_EMPTY")
+	}
+
+	assert.Panics(t, func() { MustRequireEnv("MAGE_TEST_UNSET") })
+	assert.NotPanics(t, func() { MustRequireEnv("MAGE_TEST_SET") })
+}
+
+func TestLookPathVerbose(t *testing.T) {
+	skipIfNoShell(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	tool := filepath.Join(dir, "mage-test-tool")
+	if err := ioutil.WriteFile(tool, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	ctx, buf := captureLog(DebugLevel)
+
+	path, err := lookPathVerbose(ctx, "mage-test-tool")
+	if assert.NoError(t, err) {
+		assert.Equal(t, tool, path)
+	}
+	assert.Contains(t, buf.String(), "Found mage-test-tool at "+tool)
+
+	// Known tools include instructions for installing them.
+	_, err = LookPathVerbose("docker")
+	if assert.Error(t, err) {
+		assert.Equal(t, "docker not found on PATH; install Docker from https://docs.docker.com/install/", err.Error())
+	}
+
+	_, err = LookPathVerbose("mage-missing-tool")
+	if assert.Error(t, err) {
+		assert.Equal(t, "mage-missing-tool not found on PATH; install mage-missing-tool and add it to your PATH", err.Error())
+	}
+}
+
+func TestCopyWithDereferenceSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "mage-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target.txt")
+	if err = ioutil.WriteFile(target, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(dir, "src")
+	if err = os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(target, filepath.Join(src, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "dest")
+	if err = CopyWith(src, dest, CopyOptions{DereferenceSymlinks: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(filepath.Join(dest, "link.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, info.Mode().IsRegular())
+	data, err := ioutil.ReadFile(filepath.Join(dest, "link.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hello", string(data))
+
+	// Dangling links are an error.
+	if err = os.Remove(target); err != nil {
+		t.Fatal(err)
+	}
+	err = CopyWith(src, filepath.Join(dir, "dest2"), CopyOptions{DereferenceSymlinks: true})
+	assert.Error(t, err)
+}
+
+func TestCopyWithDereferenceSymlinkCycle(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "mage-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	sub := filepath.Join(src, "sub")
+	if err = os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(sub, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// sub/loop points back at the root of the copy.
+	if err = os.Symlink(src, filepath.Join(sub, "loop")); err != nil {
+		t.Fatal(err)
+	}
+	// shared is a non-cyclic link to a sibling directory and is copied.
+	if err = os.Symlink(sub, filepath.Join(src, "shared")); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "dest")
+	if err = CopyWith(src, dest, CopyOptions{DereferenceSymlinks: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"sub/a.txt", "shared/a.txt"} {
+		data, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, "a", string(data), name)
+		}
+	}
+	for _, name := range []string{"sub/loop", "shared/loop"} {
+		_, err = os.Lstat(filepath.Join(dest, filepath.FromSlash(name)))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestCopyFileProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mage-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("x"), 100*1024)
+	src := filepath.Join(dir, "src.bin")
+	if err = ioutil.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	var copied, total int64
+	dst := filepath.Join(dir, "sub", "dst.bin")
+	err = CopyFileProgress(src, dst, func(n, size int64) {
+		calls++
+		copied, total = n, size
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, calls > 1, "expected multiple progress callbacks")
+	assert.EqualValues(t, len(data), copied)
+	assert.EqualValues(t, len(data), total)
+
+	out, err := ioutil.ReadFile(dst)
+	if assert.NoError(t, err) {
+		assert.Equal(t, data, out)
+	}
+
+	assert.Error(t, CopyFileProgress(filepath.Join(dir, "missing"), dst, nil))
+}
+
+// writeSparseTestFile creates a file of the given size that contains data at
+// the given offsets and holes everywhere else.
+func writeSparseTestFile(t testing.TB, path string, size int64, data map[int64]string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for off, content := range data {
+		if _, err = f.WriteAt([]byte(content), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCopyWithPreserveSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mage-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string]map[int64]string{
+		"trailing-hole.img": {0: "head", 1 << 20: "middle"},
+		"leading-hole.img":  {(4 << 20) - 3: "end"},
+		"empty.img":         {},
+		"unaligned.img":     {4095: "across a block boundary"},
+	} {
+		src := filepath.Join(dir, name)
+		writeSparseTestFile(t, src, 4<<20, data)
+
+		dest := filepath.Join(dir, "dest", name)
+		if err = CopyWith(src, dest, CopyOptions{PreserveSparse: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		expected, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ioutil.ReadFile(dest)
+		if assert.NoError(t, err) {
+			assert.True(t, bytes.Equal(expected, actual), "content of %v differs", name)
+		}
+	}
+}
+
+func TestBatchArgs(t *testing.T) {
+	files := []string{"aaa", "bbb", "ccc", "ddd"}
+
+	// Each arg counts as len+1.
+	assert.Equal(t, [][]string{{"aaa", "bbb"}, {"ccc", "ddd"}}, BatchArgs(files, 8))
+	assert.Equal(t, [][]string{{"aaa"}, {"bbb"}, {"ccc"}, {"ddd"}}, BatchArgs(files, 7))
+	assert.Equal(t, [][]string{{"aaa", "bbb", "ccc", "ddd"}}, BatchArgs(files, 16))
+	assert.Equal(t, [][]string{{"aaa", "bbb", "ccc"}, {"ddd"}}, BatchArgs(files, 15))
+
+	// Args longer than the limit get their own batch.
+	assert.Equal(t, [][]string{{"aaa"}, {"bbb"}}, BatchArgs([]string{"aaa", "bbb"}, 2))
+
+	assert.Nil(t, BatchArgs(nil, 10))
+}
+
+func TestDownloadFileTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	_, err := DownloadFileTimeout(server.URL+"/file.tar.gz", dir, 100*time.Millisecond)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out")
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "file.tar.gz"))
+	assert.True(t, os.IsNotExist(err), "partial file should be removed")
+}
+
+func TestIsRetryableDownloadError(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	assert.True(t, isRetryableDownloadError(&httpStatusError{StatusCode: http.StatusServiceUnavailable}))
+	assert.True(t, isRetryableDownloadError(&httpStatusError{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, isRetryableDownloadError(&httpStatusError{StatusCode: http.StatusNotFound}))
+
+	// Timeouts keep their cause.
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	_, err := DownloadFileTimeout(slow.URL+"/file.tar.gz", dir, 50*time.Millisecond)
+	assert.True(t, isRetryableDownloadError(err), "timeout: %v", err)
+
+	// Connection refused.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	_, err = DownloadFileTimeout(closed.URL+"/file.tar.gz", dir, time.Second)
+	assert.True(t, isRetryableDownloadError(err), "refused: %v", err)
+
+	// Permanent failures are not retried.
+	_, err = DownloadFileTimeout("ftp://example.com/file.tar.gz", dir, time.Second)
+	assert.False(t, isRetryableDownloadError(err), "unsupported scheme: %v", err)
+	assert.False(t, isRetryableDownloadError(errors.New("x509: certificate signed by unknown authority")))
+}
+
+func TestRetryIf(t *testing.T) {
+	errTransient := errors.New("transient")
+	errPermanent := errors.New("permanent")
+	retryable := func(err error) bool { return errors.Cause(err) == errTransient }
+
+	var calls int
+	err := RetryIf(context.Background(), 3, time.Millisecond, retryable, func() error {
+		calls++
+		if calls < 3 {
+			return errTransient
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = RetryIf(context.Background(), 3, time.Millisecond, retryable, func() error {
+		calls++
+		return errPermanent
+	})
+	assert.Equal(t, errPermanent, err)
+	assert.Equal(t, 1, calls, "permanent errors must not be retried")
+
+	calls = 0
+	err = RetryIf(context.Background(), 2, time.Millisecond, retryable, func() error {
+		calls++
+		return errTransient
+	})
+	if assert.Error(t, err) {
+		assert.Equal(t, errTransient, errors.Cause(err))
+		assert.Contains(t, err.Error(), "failed after 2 attempts")
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestDownloadFileRetry(t *testing.T) {
+	defer func(backoff time.Duration) { downloadBackoff = backoff }(downloadBackoff)
+	downloadBackoff = time.Millisecond
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/missing.zip":
+			w.WriteHeader(http.StatusNotFound)
+		case requests == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("content"))
+		}
+	}))
+	defer server.Close()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	file, err := DownloadFile(server.URL+"/file.zip", dir)
+	if assert.NoError(t, err) {
+		assert.Equal(t, filepath.Join(dir, "file.zip"), file)
+	}
+	assert.Equal(t, 2, requests, "503 must be retried")
+
+	requests = 0
+	_, err = DownloadFile(server.URL+"/missing.zip", dir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "404")
+	}
+	assert.Equal(t, 1, requests, "404 must not be retried")
+}
+
+func TestDownloadFileChecked(t *testing.T) {
+	defer func(orig func(string) (int64, error)) { diskAvailableSpace = orig }(diskAvailableSpace)
+	diskAvailableSpace = func(string) (int64, error) { return 1000, nil }
+
+	var gets int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		switch r.URL.Path {
+		case "/unknown.zip":
+			// Chunked responses have no Content-Length.
+			w.(http.Flusher).Flush()
+			w.Write([]byte("content"))
+		case "/large.zip":
+			w.Header().Set("Content-Length", "900")
+			if r.Method == http.MethodGet {
+				w.Write(make([]byte, 900))
+			}
+		}
+	}))
+	defer server.Close()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	destination := filepath.Join(dir, "not", "created", "yet")
+
+	_, err := DownloadFileChecked(server.URL+"/large.zip", destination, 200)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "insufficient disk space")
+	}
+	assert.Equal(t, 0, gets, "download must not start")
+
+	_, err = DownloadFileChecked(server.URL+"/large.zip", destination, 100)
+	assert.NoError(t, err)
+	_, err = DownloadFileChecked(server.URL+"/unknown.zip", destination, 1<<40)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, gets)
+}
+
+func TestAvailableSpace(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	free, err := AvailableSpace(filepath.Join(dir, "missing", "dir"))
+	if assert.NoError(t, err) {
+		assert.True(t, free > 0)
+	}
+}
+
+func TestWaitForURL(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" || atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, WaitForURL(ctx, server.URL, time.Millisecond))
+	assert.EqualValues(t, 3, atomic.LoadInt32(&requests))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := WaitForURL(ctx, server.URL+"/down", 10*time.Millisecond)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "http status 503")
+	}
+}
+
+func TestWaitForTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, WaitForTCP(ctx, addr, time.Millisecond))
+
+	// Nothing is listening after the listener is closed.
+	l.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = WaitForTCP(ctx, addr, 10*time.Millisecond)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "did not become available")
+	}
+
+	// A non-positive interval is rejected instead of panicking.
+	assert.Error(t, WaitForTCP(ctx, addr, 0))
+	assert.Error(t, WaitForURL(ctx, "http://"+addr, -time.Second))
+}
+
+func TestDeepMerge(t *testing.T) {
+	src := map[string]interface{}{
+		"output": map[string]interface{}{"hosts": []string{"b"}, "ssl": map[string]interface{}{"enabled": true}},
+		"name":   "src",
+	}
+	dst := DeepMerge(map[string]interface{}{
+		"output": map[string]interface{}{"hosts": []string{"a"}, "timeout": 30},
+		"name":   "dst",
+		"tags":   []string{"x"},
+	}, src)
+
+	assert.Equal(t, map[string]interface{}{
+		"output": map[string]interface{}{
+			"hosts":   []string{"b"},
+			"timeout": 30,
+			"ssl":     map[string]interface{}{"enabled": true},
+		},
+		"name": "src",
+		"tags": []string{"x"},
+	}, dst)
+
+	// Nested maps of src are copied.
+	DeepMerge(dst, map[string]interface{}{"output": map[string]interface{}{"ssl": map[string]interface{}{"enabled": false}}})
+	assert.Equal(t, true, src["output"].(map[string]interface{})["ssl"].(map[string]interface{})["enabled"])
+
+	assert.Equal(t, map[string]interface{}{"a": 1}, DeepMerge(nil, map[string]interface{}{"a": 1}))
+}
+
+func TestExpandDeep(t *testing.T) {
+	base := map[string]interface{}{"Output": map[string]interface{}{"Host": "localhost", "Port": 9200}}
+	override := map[string]interface{}{"Output": map[string]interface{}{"Port": 9201}}
+	tmpl := "{{.Output.Host}}:{{.Output.Port}}"
+
+	out, err := ExpandDeep(tmpl, base, override)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "localhost:9201", out)
+	}
+
+	// Expand keeps the shallow merge semantics.
+	_, err = Expand(tmpl, varMap(base, override))
+	assert.Error(t, err)
+}
+
+func TestExpandToCommand(t *testing.T) {
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"kubectl apply -f - --dry-run=server": {Err: errors.New("exit status 1")},
+	}}
+	ctx := WithRunner(context.Background(), fake)
+	args := map[string]interface{}{"Name": "filebeat"}
+
+	err := expandToCommand(ctx, "name: {{.Name}}\n", args, "kubectl", "apply", "-f", "-")
+	assert.NoError(t, err)
+
+	err = expandToCommand(ctx, "name: {{.Name}}\n", args, "kubectl", "apply", "-f", "-", "--dry-run=server")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to run kubectl")
+	}
+
+	// Templates that fail to expand are not passed to the command.
+	err = expandToCommand(ctx, "{{.Name", args, "kubectl", "apply", "-f", "-")
+	assert.Error(t, err)
+
+	if calls := fake.Calls(); assert.Len(t, calls, 2) {
+		assert.Equal(t, []string{"kubectl", "apply", "-f", "-"}, calls[0].Args)
+		assert.Equal(t, "name: filebeat\n", calls[0].Stdin)
+		assert.True(t, calls[0].Stream)
+	}
+}
+
+func TestExpandFS(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	fsys := fstest.MapFS{
+		"templates/config.yml.tmpl": {Data: []byte("name: {{.Name}}\n")},
+	}
+
+	dst := filepath.Join(dir, "{{.Name}}", "config.yml")
+	if err := ExpandFS(fsys, "templates/config.yml.tmpl", dst, map[string]interface{}{"Name": "testbeat"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "testbeat", "config.yml"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "name: testbeat\n", string(data))
+	}
+
+	err = ExpandFS(fsys, "templates/missing.tmpl", dst)
+	assert.Error(t, err)
+}
+
+func TestExpandConcat(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	first := filepath.Join(dir, "first.tmpl")
+	second := filepath.Join(dir, "second.tmpl")
+	if err := ioutil.WriteFile(first, []byte("name: {{.Name}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(second, []byte("value: {{.Value}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := map[string]interface{}{"Name": "foo", "Value": 42}
+
+	out := filepath.Join(dir, "out", "combined.yml")
+	if err := ExpandConcat(out, 0644, []string{first, second}, args); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "name: foo\nvalue: 42\n", string(data))
+
+	if err = ExpandConcatSep(out, 0644, []string{first, second}, "---\n", args); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "name: foo\n---\nvalue: 42\n", string(data))
+}
+
+func TestCheckGenerated(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	src := filepath.Join(dir, "config.yml.tmpl")
+	golden := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(src, []byte("name: {{.Name}}\nport: 5044\nenabled: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(golden, []byte("name: foo\r\nport: 5044\r\nenabled: true\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, CheckGenerated(src, golden, map[string]interface{}{"Name": "foo"}))
+
+	err := CheckGenerated(src, golden, map[string]interface{}{"Name": "bar"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "-name: foo\n+name: bar\n")
+		assert.Contains(t, err.Error(), "@@ -1,1 +1,1 @@")
+	}
+
+	assert.Error(t, CheckGenerated(src, filepath.Join(dir, "missing.yml"), map[string]interface{}{"Name": "foo"}))
+}
+
+func TestLineDiff(t *testing.T) {
+	diff := lineDiff("a", "b", "1\n2\n3\n4\n", "1\n3\n4\n5\n")
+	assert.Equal(t, "--- a\n+++ b\n@@ -2,3 +2,3 @@\n-2\n 3\n 4\n+5\n", diff)
+
+	var a, b strings.Builder
+	for i := 0; i < 2*lineDiffLimit; i++ {
+		fmt.Fprintf(&a, "a%d\n", i)
+		fmt.Fprintf(&b, "b%d\n", i)
+	}
+	diff = lineDiff("a", "b", a.String(), b.String())
+	assert.Contains(t, diff, "... 150 more changed lines")
+
+	// Large differing regions are summarized instead of diffed.
+	a.Reset()
+	b.Reset()
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&a, "a%d\n", i)
+		fmt.Fprintf(&b, "b%d\n", i)
+	}
+	diff = lineDiff("a", "b", "same\n"+a.String(), "same\n"+b.String())
+	assert.Equal(t, "--- a\n+++ b\n@@ -2,2000 +2,2000 @@\n"+
+		"... too many differing lines to diff, showing the first of each\n-a0\n+b0\n", diff)
+}
+
+func TestSafeRemoveAll(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	target := filepath.Join(dir, "build", "output")
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, SafeRemoveAll("", dir))
+	assert.Error(t, SafeRemoveAll("  ", dir))
+	assert.Error(t, SafeRemoveAll("/", "/"))
+	assert.Error(t, SafeRemoveAll(target, ""))
+	assert.Error(t, SafeRemoveAll(dir, dir))
+	assert.Error(t, SafeRemoveAll(filepath.Join(dir, ".."), dir))
+	assert.Error(t, SafeRemoveAll(filepath.Join(dir, "build", "..", ".."), dir))
+	assert.Error(t, SafeRemoveAll(dir+"-sibling", dir))
+	assert.DirExists(t, target)
+
+	assert.NoError(t, SafeRemoveAll(filepath.Join(dir, "build"), dir))
+	_, err := os.Stat(target)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNewestModTime(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	defer InvalidateModTimeCache()
+
+	now := time.Now().Truncate(time.Second)
+	ages := map[string]time.Duration{
+		"0.txt":           time.Hour,
+		"1.txt":           time.Minute,
+		"2.txt":           2 * time.Hour,
+		"sub/a/b/new.yml": time.Second,
+		"sub/a/old.yml":   3 * time.Hour,
+		"sub/a/b":         time.Hour,
+		"sub/a":           time.Hour,
+		"sub":             time.Hour,
+	}
+	for _, name := range []string{"0.txt", "1.txt", "2.txt", "sub/a/b/new.yml", "sub/a/old.yml"} {
+		f := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, age := range ages {
+		if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(name)), now, now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newest, path, err := NewestModTime(filepath.Join(dir, "*.txt"))
+	if assert.NoError(t, err) {
+		assert.True(t, now.Add(-time.Minute).Equal(newest))
+		assert.Equal(t, filepath.Join(dir, "1.txt"), path)
+	}
+
+	oldest, path, err := OldestModTime(filepath.Join(dir, "*.txt"))
+	if assert.NoError(t, err) {
+		assert.True(t, now.Add(-2*time.Hour).Equal(oldest))
+		assert.Equal(t, filepath.Join(dir, "2.txt"), path)
+	}
+
+	// Directories are walked recursively.
+	newest, path, err = NewestModTime(filepath.Join(dir, "*.txt"), filepath.Join(dir, "sub"))
+	if assert.NoError(t, err) {
+		assert.True(t, now.Add(-time.Second).Equal(newest))
+		assert.Equal(t, filepath.Join(dir, "sub", "a", "b", "new.yml"), path)
+	}
+	oldest, path, err = OldestModTime(filepath.Join(dir, "sub"))
+	if assert.NoError(t, err) {
+		assert.True(t, now.Add(-3*time.Hour).Equal(oldest))
+		assert.Equal(t, filepath.Join(dir, "sub", "a", "old.yml"), path)
+	}
+
+	_, _, err = NewestModTime(filepath.Join(dir, "missing"), filepath.Join(dir, "*.go"))
+	assert.Error(t, err)
+
+	// A missing literal path is an error even when other arguments exist.
+	_, _, err = NewestModTime(filepath.Join(dir, "1.txt"), filepath.Join(dir, "missing"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "missing")
+	}
+	_, _, err = OldestModTime(filepath.Join(dir, "*.txt"), filepath.Join(dir, "sub", "missing.yml"))
+	assert.Error(t, err)
+
+	// A pattern that matches nothing is fine when other arguments match.
+	_, path, err = NewestModTime(filepath.Join(dir, "1.txt"), filepath.Join(dir, "*.go"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, filepath.Join(dir, "1.txt"), path)
+	}
+	_, _, err = OldestModTime()
+	assert.Error(t, err)
+}
+
+func TestHumanSize(t *testing.T) {
+	cases := []struct {
+		bytes int64
+		iec   string
+		si    string
+	}{
+		{0, "0 B", "0 B"},
+		{999, "999 B", "999 B"},
+		{1000, "1000 B", "1.0 KB"},
+		{1023, "1023 B", "1.0 KB"},
+		{1024, "1.0 KiB", "1.0 KB"},
+		{1536, "1.5 KiB", "1.5 KB"},
+		{1024 * 1024, "1.0 MiB", "1.0 MB"},
+		{3 * 1024 * 1024 * 1024 / 2, "1.5 GiB", "1.6 GB"},
+		{-2048, "-2.0 KiB", "-2.0 KB"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.iec, HumanSize(c.bytes), "HumanSize(%d)", c.bytes)
+		assert.Equal(t, c.si, HumanSizeSI(c.bytes), "HumanSizeSI(%d)", c.bytes)
+	}
+
+	out, err := Expand("{{ humanSize 1536 }} / {{ humanSizeSI 1500 }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1.5 KiB / 1.5 KB", out)
+}
+
+func TestJoinAndSplitListFuncs(t *testing.T) {
+	cases := []struct {
+		template string
+		args     map[string]interface{}
+		expected string
+	}{
+		{`{{ join "," .Items }}`, map[string]interface{}{"Items": []string{"a", "b", "c"}}, "a,b,c"},
+		{`{{ join ", " .Items }}`, map[string]interface{}{"Items": []interface{}{"a", 1, true}}, "a, 1, true"},
+		{`{{ join "," .Items }}`, map[string]interface{}{"Items": []string{}}, ""},
+		{`{{ join "," .Items }}`, map[string]interface{}{"Items": nil}, ""},
+		{`{{ range splitList "," .CSV }}[{{ . }}]{{ end }}`, map[string]interface{}{"CSV": "x,y,z"}, "[x][y][z]"},
+		{`{{ len (splitList "," .CSV) }}`, map[string]interface{}{"CSV": ""}, "0"},
+		{`{{ splitList "," .CSV | join ";" }}`, map[string]interface{}{"CSV": "x,y"}, "x;y"},
+	}
+
+	for _, c := range cases {
+		out, err := Expand(c.template, c.args)
+		if assert.NoError(t, err, c.template) {
+			assert.Equal(t, c.expected, out, c.template)
+		}
+	}
+
+	_, err := Expand(`{{ join "," .Items }}`, map[string]interface{}{"Items": 42})
+	assert.Error(t, err)
+}
+
+func TestFilesEqual(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mage-equal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	large := bytes.Repeat([]byte("0123456789"), 10*1024)
+	differing := append([]byte(nil), large...)
+	differing[len(differing)-1] = 'x'
+
+	files := map[string][]byte{
+		"a":         large,
+		"b":         large,
+		"differing": differing,
+		"short":     large[:len(large)-1],
+		"empty1":    nil,
+		"empty2":    nil,
+	}
+	for name, data := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"a", "b", true},
+		{"empty1", "empty2", true},
+		{"a", "differing", false},
+		{"a", "short", false},
+		{"short", "a", false},
+	}
+	for _, tc := range cases {
+		equal, err := FilesEqual(filepath.Join(dir, tc.a), filepath.Join(dir, tc.b))
+		if assert.NoError(t, err) {
+			assert.Equal(t, tc.equal, equal, "%v == %v", tc.a, tc.b)
+		}
+	}
+
+	_, err = FilesEqual(filepath.Join(dir, "a"), filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestMultiHash(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	file := filepath.Join(dir, "artifact")
+	if err := ioutil.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := MultiHash(file, "md5", "sha1", "sha256", "sha512", "sha256")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, hashes, 4)
+	assert.Equal(t, "b1946ac92492d2347c6235b4d2611184", hashes["md5"])
+	assert.Equal(t, "f572d396fae9206628714fb2ce00f72e94f2258f", hashes["sha1"])
+	assert.Equal(t, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", hashes["sha256"])
+	assert.Equal(t, "e7c22b994c59d9cf2b48e549b1e24666636045930d3da7c1acb299d1c3b7f931"+
+		"f94aae41edda2c2b207a36e10f8bcb8d45223e54878f5b316e7ce3b6bc019629", hashes["sha512"])
+
+	// Names are case-insensitive and the keys are lowercase.
+	hashes, err = MultiHash(file, "SHA256", "sha256", "Md5")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{
+			"md5":    "b1946ac92492d2347c6235b4d2611184",
+			"sha256": "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+		}, hashes)
+	}
+
+	_, err = MultiHash(file, "crc32")
+	assert.Error(t, err)
+	_, err = MultiHash(file)
+	assert.Error(t, err)
+	_, err = MultiHash(filepath.Join(dir, "missing"), "sha256")
+	assert.Error(t, err)
+}
+
+func TestBuildManifest(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	modTime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	artifact := filepath.Join(dir, "beat.tar.gz")
+	if err := ioutil.WriteFile(artifact, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(artifact, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	// Sub-directories are not inspected.
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "other.zip"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	artifacts, err := BuildManifest(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected := []ArtifactInfo{{
+		Name:   "beat.tar.gz",
+		Size:   6,
+		SHA256: "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+		SHA512: "e7c22b994c59d9cf2b48e549b1e24666636045930d3da7c1acb299d1c3b7f931" +
+			"f94aae41edda2c2b207a36e10f8bcb8d45223e54878f5b316e7ce3b6bc019629",
+		ModTime: modTime,
+	}}
+	assert.Equal(t, expected, artifacts)
+
+	manifest := filepath.Join(dir, "out", "manifest.json")
+	if !assert.NoError(t, WriteManifestJSON(manifest, artifacts)) {
+		return
+	}
+	data, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `[
+  {
+    "name": "beat.tar.gz",
+    "size": 6,
+    "sha256": "`+expected[0].SHA256+`",
+    "sha512": "`+expected[0].SHA512+`",
+    "mod_time": "2018-06-01T12:00:00Z"
+  }
+]`, string(data))
+
+	_, err = BuildManifest(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestCacheKey(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	files := map[string]string{
+		"a.txt":           "a",
+		"b.txt":           "b",
+		"src/main.go":     "package main",
+		"src/lib/lib.go":  "package lib",
+		"copy/main.go":    "package main",
+		"copy/lib/lib.go": "package lib",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, src := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt"), filepath.Join(dir, "src")
+
+	// Directory digests do not depend on the location of the directory.
+	srcHash, err := HashDir(src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	copyHash, err := HashDir(filepath.Join(dir, "copy"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, srcHash, copyHash)
+	}
+
+	key, err := CacheKey(a, b, src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, key, 64)
+
+	same, err := CacheKey(src, b, a, a)
+	if assert.NoError(t, err) {
+		assert.Equal(t, key, same, "order and duplicates must not matter")
+	}
+
+	salted, err := CacheKeySalted("v2", a, b, src)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, key, salted)
+	}
+
+	fewer, err := CacheKey(a, src)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, key, fewer)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(src, "lib", "lib.go"), []byte("package lib2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := CacheKey(a, b, src)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, key, changed)
+	}
+
+	_, err = CacheKey(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestListTrackedFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	files := map[string]string{
+		".gitignore":     "build/\n*.log\n",
+		"main.go":        "package main",
+		"docs/README.md": "docs",
+		"build/out.bin":  "binary",
+		"debug.log":      "log",
+		"deleted.txt":    "deleted",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without a repository every file is listed.
+	all, err := ListTrackedFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(all)
+	assert.Equal(t, []string{".gitignore", "build/out.bin", "debug.log", "deleted.txt", "docs/README.md", "main.go"}, all)
+
+	for _, args := range [][]string{{"init", "-q"}, {"add", "."}} {
+		if err = (Cmd{Args: append([]string{"git"}, args...), Dir: dir}).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Remove(filepath.Join(dir, "deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	tracked, err := ListTrackedFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(tracked)
+	assert.Equal(t, []string{".gitignore", "docs/README.md", "main.go"}, tracked)
+}
+
+func TestListTrackedFilesRunner(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, name := range []string{"main.go", "docs/README.md"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"git ls-files -z": {Stdout: "docs/README.md\x00deleted.txt\x00main.go\x00"},
+	}}
+	files, err := listTrackedFiles(WithRunner(context.Background(), fake), dir)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"docs/README.md", "main.go"}, files)
+	}
+	if calls := fake.Calls(); assert.Len(t, calls, 1) {
+		assert.Equal(t, dir, calls[0].Dir)
+	}
+}
+
+func TestUpdateJSONFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "state", "build.json")
+
+	err := UpdateJSONFile(path, func(m map[string]interface{}) error {
+		assert.Empty(t, m)
+		m["name"] = "beat"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors from mutate abort the update.
+	err = UpdateJSONFile(path, func(m map[string]interface{}) error {
+		m["name"] = "changed"
+		return errors.New("abort")
+	})
+	assert.Error(t, err)
+
+	const workers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := UpdateJSONFile(path, func(m map[string]interface{}) error {
+				count, _ := m["count"].(float64)
+				m["count"] = count + 1
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]interface{}{"name": "beat", "count": float64(workers)}, m)
+}
+
+func TestNormalizePaths(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := NormalizePaths([]string{
+		"b.txt",
+		"./a.txt",
+		filepath.Join(cwd, "b.txt"),
+		filepath.Join("sub", "..", "a.txt"),
+		filepath.Join("sub", "c.txt") + string(filepath.Separator),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		filepath.Join(cwd, "a.txt"),
+		filepath.Join(cwd, "b.txt"),
+		filepath.Join(cwd, "sub", "c.txt"),
+	}, paths)
+}
+
+func TestFileConcatDuplicates(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	header := filepath.Join(dir, "header.txt")
+	body := filepath.Join(dir, "body.txt")
+	if err := ioutil.WriteFile(header, []byte("header\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(body, []byte("body\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "out.txt")
+	err := FileConcat(out, 0644, header, body, filepath.Join(dir, ".", "header.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "header\nbody\n", string(data))
+	}
+}
+
+// fakeContainerEnv replaces the container detection with one that sees only
+// the given environment variables and files for the duration of the test.
+func fakeContainerEnv(t testing.TB, env, files map[string]string) {
+	getenv, readFile, fileExists := containerGetenv, containerReadFile, containerFileExists
+	t.Cleanup(func() {
+		containerGetenv, containerReadFile, containerFileExists = getenv, readFile, fileExists
+	})
+
+	containerGetenv = func(name string) string { return env[name] }
+	containerReadFile = func(path string) ([]byte, error) {
+		if data, found := files[path]; found {
+			return []byte(data), nil
+		}
+		return nil, os.ErrNotExist
+	}
+	containerFileExists = func(path string) bool {
+		_, found := files[path]
+		return found
+	}
+}
+
+func TestInContainer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("container detection is only supported on linux")
+	}
+
+	cases := map[string]struct {
+		env   map[string]string
+		files map[string]string
+		want  bool
+	}{
+		"host": {
+			files: map[string]string{"/proc/1/cgroup": "0::/init.scope\n"},
+		},
+		"dockerenv": {
+			files: map[string]string{"/.dockerenv": ""},
+			want:  true,
+		},
+		"podman": {
+			files: map[string]string{"/run/.containerenv": ""},
+			want:  true,
+		},
+		"env": {
+			env:  map[string]string{"container": "systemd-nspawn"},
+			want: true,
+		},
+		"kubernetes": {
+			files: map[string]string{"/proc/1/cgroup": "12:cpu,cpuacct:/kubepods/burstable/pod1234/abcd\n"},
+			want:  true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fakeContainerEnv(t, tc.env, tc.files)
+			assert.Equal(t, tc.want, InContainer())
+		})
+	}
+}
+
+func TestContainerCPULimit(t *testing.T) {
+	fakeContainerEnv(t, nil, map[string]string{"/sys/fs/cgroup/cpu.max": "150000 100000\n"})
+	assert.Equal(t, 2, containerCPULimit())
+
+	fakeContainerEnv(t, nil, map[string]string{"/sys/fs/cgroup/cpu.max": "max 100000\n"})
+	assert.Equal(t, 0, containerCPULimit())
+
+	fakeContainerEnv(t, nil, map[string]string{
+		"/sys/fs/cgroup/cpu/cpu.cfs_quota_us":  "400000\n",
+		"/sys/fs/cgroup/cpu/cpu.cfs_period_us": "100000\n",
+	})
+	assert.Equal(t, 4, containerCPULimit())
+
+	fakeContainerEnv(t, nil, map[string]string{
+		"/sys/fs/cgroup/cpu/cpu.cfs_quota_us":  "-1\n",
+		"/sys/fs/cgroup/cpu/cpu.cfs_period_us": "100000\n",
+	})
+	assert.Equal(t, 0, containerCPULimit())
+
+	fakeContainerEnv(t, nil, nil)
+	assert.Equal(t, 0, containerCPULimit())
+}
+
+func TestFindFilesRecursive(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for _, f := range []string{
+		"module/a/_meta/fields.yml",
+		"module/b/c/_meta/fields.yml",
+		"module/b/c/d/_meta/fields.yml",
+		"module/b/c/d/_meta/config.yml",
+		"module/_meta/fields.yml",
+		"other/_meta/fields.yml",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	find := func(patterns ...string) []string {
+		t.Helper()
+		for i, p := range patterns {
+			patterns[i] = filepath.Join(dir, filepath.FromSlash(p))
+		}
+		files, err := FindFiles(patterns...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, f := range files {
+			rel, err := filepath.Rel(dir, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[i] = filepath.ToSlash(rel)
+		}
+		sort.Strings(files)
+		return files
+	}
+
+	assert.Equal(t, []string{
+		"module/_meta/fields.yml",
+		"module/a/_meta/fields.yml",
+		"module/b/c/_meta/fields.yml",
+		"module/b/c/d/_meta/fields.yml",
+	}, find("module/**/_meta/fields.yml"))
+	assert.Equal(t, []string{
+		"module/b/c/d/_meta/config.yml",
+		"module/b/c/d/_meta/fields.yml",
+	}, find("module/b/**/d/_meta/*.yml"))
+	assert.Equal(t, []string{
+		"module/a/_meta/fields.yml",
+		"module/b/c/_meta/fields.yml",
+		"module/b/c/d/_meta/fields.yml",
+	}, find("module/[ab]/**/fields.yml"))
+	assert.Equal(t, []string{
+		"module/_meta/fields.yml",
+		"module/a/_meta/fields.yml",
+		"module/b/c/_meta/fields.yml",
+		"module/b/c/d/_meta/fields.yml",
+		"other/_meta/fields.yml",
+	}, find("**/fields.yml"))
+	assert.Empty(t, find("missing/**/fields.yml"))
+
+	// Patterns without ** behave like filepath.Glob.
+	assert.Equal(t, []string{"module/a/_meta/fields.yml"}, find("module/*/_meta/fields.yml"))
+
+	_, err := FindFiles(filepath.Join(dir, "module", "**", "[a"))
+	assert.Error(t, err)
+}
+
+func TestFindFilesExclude(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for _, f := range []string{
+		"a.go",
+		"a_test.go",
+		"build/gen.go",
+		"module/x/x.go",
+		"module/x/x_test.go",
+		"module/x/vendor/lib/lib.go",
+		"module/y/_meta/y.go",
+		"vendor/lib/lib.go",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	abs := func(paths ...string) []string {
+		out := make([]string, len(paths))
+		for i, p := range paths {
+			out[i] = filepath.Join(dir, filepath.FromSlash(p))
+		}
+		return out
+	}
+
+	files, err := FindFilesExclude(
+		abs("**/*.go", "*.go", "module/x/*.go"),
+		append([]string{"vendor", "*_test.go"}, abs("build", "module/**/_meta")...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, abs("a.go", "module/x/x.go"), files)
+
+	// The result doesn't depend on the include order.
+	files, err = FindFilesExclude(abs("module/**/*.go", "*.go", "**/*.go"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, abs(
+		"a.go",
+		"a_test.go",
+		"build/gen.go",
+		"module/x/vendor/lib/lib.go",
+		"module/x/x.go",
+		"module/x/x_test.go",
+		"module/y/_meta/y.go",
+		"vendor/lib/lib.go",
+	), files)
+
+	// Overlapping includes spelled differently return each file once, in the
+	// form matched by the first include.
+	defer os.Chdir(CWD())
+	if err := os.Chdir(filepath.Join(dir, "module")); err != nil {
+		t.Fatal(err)
+	}
+	files, err = FindFilesExclude(
+		[]string{filepath.Join("x", "*.go"), filepath.Join(dir, "module", "**", "*.go")},
+		[]string{"vendor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		filepath.Join(dir, "module", "y", "_meta", "y.go"),
+		filepath.Join("x", "x.go"),
+		filepath.Join("x", "x_test.go"),
+	}, files)
+
+	_, err = FindFilesExclude(abs("*.go"), []string{"[a"})
+	assert.Error(t, err)
+}
+
+func TestGlobExcluderPrunesWalk(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	if err := os.MkdirAll(filepath.Join(dir, "vendor", "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var visited []string
+	_, err := globRecursive(filepath.Join(dir, "**", "*.go"), func(path string) bool {
+		visited = append(visited, path)
+		return filepath.Base(path) == "vendor"
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "vendor")}, visited)
+}
+
+func TestFindFilesRecursiveMatch(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for name, content := range map[string]string{
+		"module/a/fields.yml":        "a",
+		"module/a/empty.yml":         "",
+		"module/b/c/config.yml":      "c",
+		"module/b/c/README.md":       "readme",
+		"outside/target/hidden.yml":  "hidden",
+		"outside/target/hidden2.yml": "hidden",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := filepath.Join(dir, "module")
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink(filepath.Join(dir, "outside", "target"), filepath.Join(root, "link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := FindFilesRecursive(root, func(path string, info fs.FileInfo) bool {
+		return info.Mode().IsRegular() && info.Size() > 0 && strings.HasSuffix(path, ".yml")
+	})
+	if assert.NoError(t, err) {
+		sort.Strings(files)
+		assert.Equal(t, []string{
+			filepath.Join("a", "fields.yml"),
+			filepath.Join("b", "c", "config.yml"),
+		}, files)
+	}
+
+	files, err = FindFilesRecursive(root, ByExt("md"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{filepath.Join("b", "c", "README.md")}, files)
+	}
+
+	files, err = FindFilesRecursive(root, ByRegexp(`^b/.*\.yml$`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{filepath.Join("b", "c", "config.yml")}, files)
+	}
+
+	_, err = FindFilesRecursive(filepath.Join(dir, "missing"), ByExt(".yml"))
+	assert.Error(t, err)
+}
+
+func TestFindFilesRecursivePermissionDenied(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("requires a non-root user on a Unix system")
+	}
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	locked := filepath.Join(dir, "locked")
+	if err := os.MkdirAll(locked, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ok.yml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0755)
+
+	for _, params := range []findParams{{}, {FollowSymlinks: true}} {
+		ctx, buf := captureLog(WarnLevel)
+		files, err := findFilesRecursive(ctx, dir, ByExt(".yml"), params)
+		if assert.NoError(t, err, "%+v", params) {
+			assert.Equal(t, []string{"ok.yml"}, files, "%+v", params)
+		}
+		assert.Contains(t, buf.String(), "insufficient permissions", "%+v", params)
+	}
+
+	_, err := FindFilesRecursive(dir, ByExt(".yml"), FailOnPermissionDenied())
+	assert.Error(t, err)
+	_, err = FindFilesRecursive(dir, ByExt(".yml"), FailOnPermissionDenied(), FollowSymlinks())
+	assert.Error(t, err)
+}
+
+func TestFindFilesOverlapping(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for _, name := range []string{"b.yml", "a.yml", "c.yml", filepath.Join("sub", "d.yml")} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	globs := []string{
+		filepath.Join(dir, "c.yml"),
+		filepath.Join(dir, "sub", "*.yml"),
+		filepath.Join(dir, "*.yml"),
+		filepath.Join(dir, "sub", "..", "b.yml"),
+		filepath.Join(dir, "**", "*.yml"),
+	}
+	want := []string{
+		filepath.Join(dir, "a.yml"),
+		filepath.Join(dir, "b.yml"),
+		filepath.Join(dir, "c.yml"),
+		filepath.Join(dir, "sub", "d.yml"),
+	}
+
+	// The output does not depend on the pattern order.
+	for i := 0; i < len(globs); i++ {
+		rotated := append(append([]string{}, globs[i:]...), globs[:i]...)
+		files, err := FindFiles(rotated...)
+		if assert.NoError(t, err) {
+			assert.Equal(t, want, files)
+		}
+	}
+
+	files, err := FindFilesOrdered(globs...)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			filepath.Join(dir, "c.yml"),
+			filepath.Join(dir, "sub", "d.yml"),
+			filepath.Join(dir, "a.yml"),
+			filepath.Join(dir, "b.yml"),
+		}, files)
+	}
+}
+
+func TestFindFilesRequired(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.yml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := FindFilesRequired(filepath.Join(dir, "*.yml"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{filepath.Join(dir, "a.yml")}, files)
+	}
+
+	_, err = FindFilesRequired(filepath.Join(dir, "*.yml"), "typo/*.yml", "**/*.ymml")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "typo/*.yml, **/*.ymml")
+		assert.Contains(t, err.Error(), CWD())
+	}
+
+	// The lenient default is unchanged.
+	files, err = FindFiles("typo/*.yml")
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestFileConcatGlob(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for name, content := range map[string]string{"p1.yml": "1\n", "m/b.yml": "b\n", "m/a.yml": "a\n", "p2.yml": "2\n"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(dir, "out", "combined.yml")
+	globs := []string{filepath.Join(dir, "p1.yml"), filepath.Join(dir, "m", "*.yml"), filepath.Join(dir, "p2.yml")}
+	if assert.NoError(t, FileConcatGlob(out, 0644, globs, RequireMatches())) {
+		data, err := ioutil.ReadFile(out)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "1\na\nb\n2\n", string(data))
+		}
+	}
+
+	globs = append(globs, filepath.Join(dir, "missing", "*.yml"))
+	assert.NoError(t, FileConcatGlob(out, 0644, globs))
+	err := FileConcatGlob(out, 0644, globs, RequireMatches())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), filepath.Join(dir, "missing", "*.yml"))
+	}
+}
+
+func TestCopyGlob(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for _, name := range []string{"src/a.yml", "src/sub/b.yml", "other/a.yml"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dest := filepath.Join(dir, "dest")
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := CopyGlob([]string{filepath.Join(dir, "src", "*")}, dest, RequireMatches())
+	if assert.NoError(t, err) {
+		assert.FileExists(t, filepath.Join(dest, "a.yml"))
+		assert.FileExists(t, filepath.Join(dest, "sub", "b.yml"))
+	}
+
+	err = CopyGlob([]string{filepath.Join(dir, "src", "*.yml"), filepath.Join(dir, "other", "*.yml")}, dest)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "both copy to")
+	}
+
+	err = CopyGlob([]string{filepath.Join(dir, "nothing", "*")}, dest, RequireMatches())
+	assert.Error(t, err)
+}
+
+func TestFindFilesModifiedSince(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	past := time.Now().Add(-time.Hour)
+	for name, modTime := range map[string]time.Time{
+		"old.md":    past.Add(-time.Hour),
+		"new.md":    past.Add(time.Minute),
+		"newer.md":  time.Now(),
+		"marker":    past,
+		"other.txt": time.Now(),
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	glob := filepath.Join(dir, "*.md")
+
+	files, err := FindFilesModifiedSince(past, glob)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{filepath.Join(dir, "new.md"), filepath.Join(dir, "newer.md")}, files)
+	}
+
+	files, err = FindFilesNewerThan(filepath.Join(dir, "marker"), glob)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{filepath.Join(dir, "new.md"), filepath.Join(dir, "newer.md")}, files)
+	}
+
+	files, err = FindFilesNewerThan(filepath.Join(dir, "missing-marker"), glob)
+	if assert.NoError(t, err) {
+		assert.Len(t, files, 3)
+	}
+}
+
+func TestFindFilesContentChanged(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a := write("a.md", "a")
+	b := write("b.md", "b")
+	state := filepath.Join(dir, "build", "hashes.json")
+	glob := filepath.Join(dir, "*.md")
+
+	files, err := FindFilesContentChanged(state, glob)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{a, b}, files)
+	}
+	if err = RecordFileHashes(state, files...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Touching a file without changing its content is not a change.
+	now := time.Now().Add(time.Hour)
+	if err = os.Chtimes(a, now, now); err != nil {
+		t.Fatal(err)
+	}
+	write("b.md", "changed")
+	c := write("c.md", "c")
+
+	files, err = FindFilesContentChanged(state, glob)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{b, c}, files)
+	}
+
+	data, err := ioutil.ReadFile(state)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(data), `"../a.md"`)
+	}
+}
+
+func TestFindFilesRecursiveFollowSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	mkdir := func(name string) {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := func(target, name string) {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Diamond: module/a and module/b both link to shared/mod.
+	mkdir("shared/mod/_meta")
+	write("shared/mod/_meta/fields.yml")
+	mkdir("x-pack/module")
+	write("x-pack/module/own.yml")
+	link("../../shared/mod", "x-pack/module/a")
+	link("../../shared/mod", "x-pack/module/b")
+	link("../../shared/mod/_meta/fields.yml", "x-pack/module/c.yml")
+	root := filepath.Join(dir, "x-pack")
+
+	files, err := FindFilesRecursive(root, ByExt(".yml"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{filepath.Join("module", "own.yml")}, files)
+	}
+
+	files, err = FindFilesRecursive(root, ByExt(".yml"), FollowSymlinks())
+	if assert.NoError(t, err) {
+		// Each file is reported once, by the first path in lexical order.
+		assert.Equal(t, []string{
+			filepath.Join("module", "a", "_meta", "fields.yml"),
+			filepath.Join("module", "own.yml"),
+		}, files)
+	}
+
+	// Loop: a link to a parent directory.
+	link("..", "x-pack/module/loop")
+	_, err = FindFilesRecursive(root, ByExt(".yml"), FollowSymlinks())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "symlink cycle detected")
+		assert.Contains(t, err.Error(), filepath.Join("module", "loop"))
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	n, err := MaxOpenFiles()
+	if assert.NoError(t, err) {
+		assert.True(t, n > 0)
+	}
+}
+
+func TestOpenFilesJobLimit(t *testing.T) {
+	defer func(orig func() (int, error), perJob int) {
+		maxOpenFilesProbe, OpenFilesPerJob = orig, perJob
+	}(maxOpenFilesProbe, OpenFilesPerJob)
+	maxOpenFilesProbe = func() (int, error) { return 256, nil }
+
+	OpenFilesPerJob = 0
+	assert.Equal(t, 0, openFilesJobLimit())
+
+	OpenFilesPerJob = 16
+	assert.Equal(t, 8, openFilesJobLimit())
+
+	OpenFilesPerJob = 1000
+	assert.Equal(t, 1, openFilesJobLimit())
+
+	maxOpenFilesProbe = func() (int, error) { return 0, errors.New("unsupported") }
+	assert.Equal(t, 0, openFilesJobLimit())
+}
+
+func TestIsUpToDateDirectory(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	past := time.Now().Add(-time.Hour)
+	nested := filepath.Join(dir, "_meta", "a", "b", "c")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(nested, "fields.yml")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{file, nested, filepath.Dir(nested), filepath.Join(dir, "_meta", "a"), filepath.Join(dir, "_meta")} {
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := filepath.Join(dir, "fields.go")
+	if err := ioutil.WriteFile(dst, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "_meta")
+
+	defer InvalidateModTimeCache()
+
+	assert.True(t, IsUpToDate(dst, src))
+
+	// Editing a deeply nested file doesn't change the modtime of _meta.
+	now := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, now, now); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, IsUpToDate(dst, src), "expected cached result")
+	InvalidateModTimeCache()
+	assert.False(t, IsUpToDate(dst, src))
+
+	// Removing the file only changes the modtime of its parent directory.
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(nested, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dst, now.Add(-time.Second), now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	InvalidateModTimeCache()
+	assert.False(t, IsUpToDate(dst, src))
+
+	assert.False(t, IsUpToDate(filepath.Join(dir, "missing"), src))
+	assert.False(t, IsUpToDate(dst, filepath.Join(dir, "missing")))
+}
+
+func TestIsUpToDateGeneratedSources(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	defer func(orig string) { upToDateHashDir = orig }(upToDateHashDir)
+	upToDateHashDir = filepath.Join(dir, "cache")
+
+	past := time.Now().Add(-time.Hour)
+	src := filepath.Join(dir, "include")
+	nested := filepath.Join(src, "list")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{nested, src} {
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := filepath.Join(dir, "fields.go")
+	if err := ioutil.WriteFile(dst, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer InvalidateModTimeCache()
+
+	assert.True(t, IsUpToDate(dst, src))
+
+	// A generator writes into the source directory between two checks in
+	// the same process.
+	now := time.Now().Add(time.Minute)
+	generated := filepath.Join(src, "list.go")
+	if err := ioutil.WriteFile(generated, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(generated, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(src, now, now); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, IsUpToDate(dst, src))
+
+	if err := os.Chtimes(dst, now.Add(time.Minute), now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, IsUpToDate(dst, src))
+
+	// Generating into a nested directory doesn't change the modtime of src
+	// but recording the generated output invalidates the cache.
+	later := now.Add(time.Hour)
+	generated = filepath.Join(nested, "list.go")
+	if err := ioutil.WriteFile(generated, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(generated, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(src, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordUpToDateHash(filepath.Join(dir, "other.go"), generated); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, IsUpToDate(dst, src))
+}
+
+func TestIsUpToDateHash(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	defer func(orig string) { upToDateHashDir = orig }(upToDateHashDir)
+	upToDateHashDir = filepath.Join(dir, "cache")
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	src := write("src/main.go", "package main")
+	meta := filepath.Join(dir, "_meta")
+	write("_meta/a/fields.yml", "- key: a")
+	dst := filepath.Join(dir, "out")
+
+	// dst and the state file don't exist.
+	assert.False(t, IsUpToDateHash(dst, src, meta))
+	write("out", "built")
+	assert.False(t, IsUpToDateHash(dst, src, meta))
+
+	if assert.NoError(t, RecordUpToDateHash(dst, src, meta)) {
+		assert.True(t, IsUpToDateHash(dst, src, meta))
+		assert.True(t, IsUpToDateHash(dst, meta, src), "order of sources must not matter")
+		assert.False(t, IsUpToDateHash(dst, src), "list of sources changed")
+	}
+
+	// Modtimes are ignored.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(src, future, future); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, IsUpToDateHash(dst, src, meta))
+
+	// Contents are not.
+	write("_meta/a/fields.yml", "- key: b")
+	assert.False(t, IsUpToDateHash(dst, src, meta))
+	assert.NoError(t, RecordUpToDateHash(dst, src, meta))
+	write("_meta/b/fields.yml", "- key: b")
+	assert.False(t, IsUpToDateHash(dst, src, meta))
+	assert.NoError(t, RecordUpToDateHash(dst, src, meta))
+	assert.True(t, IsUpToDateHash(dst, src, meta))
+
+	// A corrupt state file means stale.
+	stateFile, err := upToDateHashFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(stateFile, []byte("{garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, IsUpToDateHash(dst, src, meta))
+
+	assert.NoError(t, RecordUpToDateHash(dst, src, meta))
+	assert.NoError(t, InvalidateUpToDateHash(dst))
+	assert.False(t, IsUpToDateHash(dst, src, meta))
+	assert.NoError(t, InvalidateUpToDateHash(dst))
+
+	// A missing dst is never up-to-date.
+	assert.NoError(t, RecordUpToDateHash(dst, src, meta))
+	if err = os.Remove(dst); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, IsUpToDateHash(dst, src, meta))
+}
+
+func TestIsUpToDateHashRelocatedCheckout(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	defer func(orig string) { upToDateHashDir = orig }(upToDateHashDir)
+	upToDateHashDir = filepath.Join(dir, "cache")
+
+	// Two checkouts with the same content at different paths.
+	for _, checkout := range []string{"job-1", "job-2"} {
+		for name, content := range map[string]string{"src/main.go": "package main", "out": "built"} {
+			path := filepath.Join(dir, checkout, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	defer os.Chdir(CWD())
+	if err := os.Chdir(filepath.Join(dir, "job-1")); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.NoError(t, RecordUpToDateHash("out", "src")) {
+		return
+	}
+
+	if err := os.Chdir(filepath.Join(dir, "job-2")); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, IsUpToDateHash("out", "src"))
+	changed, err := OutOfDateSourcesHash("out", "src")
+	if assert.NoError(t, err) {
+		assert.Empty(t, changed)
+	}
+}
+
+func TestIsUpToDateGlob(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	ctx, buf := captureLog(WarnLevel)
+
+	past := time.Now().Add(-time.Hour)
+	src := filepath.Join(dir, "_meta", "fields.yml")
+	dst := filepath.Join(dir, "fields.go")
+	glob := filepath.Join(dir, "_meta", "*.yml")
+
+	// Nothing has been generated yet.
+	assert.False(t, checkUpToDateGlob(ctx, dst, []string{glob}))
+	assert.Contains(t, buf.String(), "matched no files")
+
+	if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{src, dst} {
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(src, past, past); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, IsUpToDateGlob(dst, glob))
+
+	if err := os.Chtimes(src, time.Now().Add(time.Minute), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, IsUpToDateGlob(dst, glob))
+}
+
+func TestIsUpToDateNoSources(t *testing.T) {
+	ctx, buf := captureLog(WarnLevel)
+
+	assert.False(t, checkUpToDate(ctx, "fields.go", nil))
+	assert.Contains(t, buf.String(), "No sources passed to IsUpToDate")
+}
+
+func TestIsUpToDateExplain(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	defer func(orig string) { upToDateHashDir = orig }(upToDateHashDir)
+	upToDateHashDir = filepath.Join(dir, "cache")
+
+	src := filepath.Join(dir, "fields.yml")
+	dst := filepath.Join(dir, "fields.go")
+	if err := ioutil.WriteFile(src, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	upToDate, reason := IsUpToDateExplain(dst, src)
+	assert.False(t, upToDate)
+	assert.Equal(t, "destination "+dst+" does not exist", reason)
+
+	if err := ioutil.WriteFile(dst, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srcTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	dstTime := srcTime.Add(-time.Hour)
+	if err := os.Chtimes(src, srcTime, srcTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dst, dstTime, dstTime); err != nil {
+		t.Fatal(err)
+	}
+	upToDate, reason = IsUpToDateExplain(dst, src)
+	assert.False(t, upToDate)
+	assert.Equal(t, "source "+src+" (modified 2020-01-02T03:04:05Z) is newer than destination "+
+		dst+" (modified 2020-01-02T02:04:05Z)", reason)
+
+	upToDate, reason = IsUpToDateExplain(dst, filepath.Join(dir, "missing"))
+	assert.False(t, upToDate)
+	assert.Equal(t, "source "+filepath.Join(dir, "missing")+" does not exist", reason)
+
+	// The reason is logged at debug level.
+	ctx, buf := captureLog(DebugLevel)
+	assert.False(t, checkUpToDate(ctx, dst, []string{src}))
+	assert.Contains(t, buf.String(), dst+" is not up-to-date: source "+src)
+
+	// Checksum based variant.
+	upToDate, reason = IsUpToDateHashExplain(dst, src)
+	assert.False(t, upToDate)
+	assert.Contains(t, reason, "no digest recorded in")
+
+	if err := RecordUpToDateHash(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	upToDate, reason = IsUpToDateHashExplain(dst, src)
+	assert.True(t, upToDate)
+	assert.Contains(t, reason, "is unchanged")
+
+	if err := ioutil.WriteFile(src, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upToDate, reason = IsUpToDateHashExplain(dst, src)
+	assert.False(t, upToDate)
+	assert.Contains(t, reason, "digest of sources changed from")
+}
+
+// resetOnce forgets the results of the functions invoked by Once.
+func resetOnce() {
+	onceLock.Lock()
+	defer onceLock.Unlock()
+	onceResults = map[string]*onceResult{}
+}
+
+func TestOnce(t *testing.T) {
+	resetOnce()
+	defer resetOnce()
+
+	var calls int32
+	fn := func() error {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return errors.New("setup failed")
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = Once("TestOnce", fn)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	for _, err := range errs {
+		assert.EqualError(t, err, "setup failed")
+	}
+
+	// Other keys are independent.
+	assert.NoError(t, Once("TestOnce-other", func() error { return nil }))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestIsUpToDateE(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	src := filepath.Join(dir, "fields.yml")
+	dst := filepath.Join(dir, "fields.go")
+	missing := filepath.Join(dir, "missing.yml")
+	if err := ioutil.WriteFile(src, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing dst is just stale.
+	upToDate, err := IsUpToDateE(dst, src)
+	assert.NoError(t, err)
+	assert.False(t, upToDate)
+
+	past := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(src, past, past); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dst, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	upToDate, err = IsUpToDateE(dst, src)
+	assert.NoError(t, err)
+	assert.True(t, upToDate)
+
+	// Missing sources and empty source lists are errors.
+	_, err = IsUpToDateE(dst, src, missing)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "source "+missing+" does not exist")
+	}
+	_, err = IsUpToDateE(dst)
+	assert.Error(t, err)
+
+	// The bool version warns instead.
+	ctx, buf := captureLog(WarnLevel)
+	assert.False(t, checkUpToDate(ctx, dst, []string{src, missing}))
+	assert.Contains(t, buf.String(), "WARN: Treating "+dst+" as not up-to-date: source "+missing+" does not exist")
+	buf.Reset()
+	assert.False(t, checkUpToDate(ctx, dst, nil))
+	assert.Contains(t, buf.String(), "WARN: No sources passed to IsUpToDate")
+}
+
+func TestRelOrAbs(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		base, target, expected string
+	}{
+		{"a/b", "a/b/c/d.txt", filepath.Join("c", "d.txt")},
+		{"a/b", "a/x", filepath.Join("..", "x")},
+		{cwd, "a/b", filepath.Join("a", "b")},
+		{"a", filepath.Join(cwd, "a", "b"), "b"},
+	}
+	if runtime.GOOS == "windows" {
+		cases = append(cases, struct{ base, target, expected string }{`C:\beats`, `D:\tmp\..\file.txt`, `D:\file.txt`})
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, RelOrAbs(filepath.FromSlash(c.base), filepath.FromSlash(c.target)), "%+v", c)
+	}
+}
+
+func TestFindFilesByContent(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for name, content := range map[string]string{
+		"b.yml":                 "output.elasticsearch:\n  hosts: [localhost]\r\n  old.setting: true\n",
+		"a/config.yml":          "old.setting: false",
+		"a/other.yml":           "new.setting: true\n",
+		"vendor/lib/config.yml": "old.setting: vendored\n",
+		"module/x/_meta/f.yml":  "old.setting: meta\n",
+		"binary.bin":            "old.setting\x00\x01\x02",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	re := regexp.MustCompile(`old\.setting`)
+	matches, err := FindFilesByContent(dir, re, ContentExclude("vendor", "module/**/_meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Match{
+		{Path: filepath.Join("a", "config.yml"), Line: 1, Text: "old.setting: false"},
+		{Path: "b.yml", Line: 3, Text: "  old.setting: true"},
+	}, matches)
+
+	matches, err = FindFilesByContent(dir, re)
+	if assert.NoError(t, err) {
+		assert.Len(t, matches, 4)
+	}
+
+	_, err = FindFilesByContent(filepath.Join(dir, "missing"), re)
+	assert.Error(t, err)
+}
+
+func TestOutOfDateSources(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	defer func(orig string) { upToDateHashDir = orig }(upToDateHashDir)
+	upToDateHashDir = filepath.Join(dir, "cache")
+	defer InvalidateModTimeCache()
+
+	base := time.Now().Add(-time.Hour)
+	path := func(name string) string { return filepath.Join(dir, filepath.FromSlash(name)) }
+	for name, age := range map[string]time.Duration{
+		"docs/a.asciidoc":       -time.Minute,
+		"docs/b.asciidoc":       time.Minute,
+		"module/x/_meta/f.yml":  time.Minute,
+		"module/y/_meta/f.yml":  -time.Minute,
+		"other/old/readme.md":   -time.Minute,
+		"fields.go":             0,
+		"modules.d/empty/.keep": -time.Minute,
+	} {
+		if err := os.MkdirAll(filepath.Dir(path(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path(name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path(name), base.Add(age), base.Add(age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"docs", "module", "module/x", "module/x/_meta", "module/y", "module/y/_meta", "other", "other/old", "modules.d"} {
+		if err := os.Chtimes(path(name), base.Add(-time.Minute), base.Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A file was removed from modules.d/empty.
+	if err := os.Chtimes(path("modules.d/empty"), base.Add(time.Minute), base.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		dst      string
+		sources  []string
+		expected []string
+		err      bool
+	}{
+		{"up-to-date", "fields.go", []string{"docs/a.asciidoc", "other"}, []string{}, false},
+		{"newer file", "fields.go", []string{"docs/*.asciidoc"}, []string{"docs/b.asciidoc"}, false},
+		{"nested newer file", "fields.go", []string{"module"}, []string{"module/x/_meta/f.yml"}, false},
+		{"recursive glob", "fields.go", []string{"module/**/f.yml", "other"}, []string{"module/x/_meta/f.yml"}, false},
+		{"removed file", "fields.go", []string{"modules.d"}, []string{"modules.d"}, false},
+		{"missing dst", "missing.go", []string{"docs/*.asciidoc"}, []string{"docs/a.asciidoc", "docs/b.asciidoc"}, false},
+		{"no sources", "fields.go", []string{"nothing/*"}, nil, true},
+	}
+	for _, c := range cases {
+		sources := make([]string, len(c.sources))
+		for i, s := range c.sources {
+			sources[i] = path(s)
+		}
+		var expected []string
+		if c.expected != nil {
+			expected = []string{}
+			for _, e := range c.expected {
+				expected = append(expected, path(e))
+			}
+		}
+
+		actual, err := OutOfDateSources(path(c.dst), sources...)
+		if c.err {
+			assert.Error(t, err, c.name)
+			continue
+		}
+		if assert.NoError(t, err, c.name) {
+			assert.Equal(t, expected, actual, c.name)
+		}
+	}
+
+	// Checksum mode.
+	sources := []string{path("docs"), path("module/**/f.yml")}
+	changed, err := OutOfDateSourcesHash(path("fields.go"), sources...)
+	if assert.NoError(t, err) {
+		assert.Len(t, changed, 4, "nothing was recorded")
+	}
+	if err = RecordUpToDateHash(path("fields.go"), path("docs"), path("module")); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = OutOfDateSourcesHash(path("fields.go"), sources...)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{}, changed)
+	}
+	if err = ioutil.WriteFile(path("docs/a.asciidoc"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = OutOfDateSourcesHash(path("fields.go"), sources...)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{path("docs/a.asciidoc")}, changed)
+	}
+}
+
+func TestEnvTyped(t *testing.T) {
+	const name = "MAGE_TEST_TYPED_ENV"
+	defer os.Unsetenv(name)
+
+	boolCases := []struct {
+		value    string
+		expected bool
+		err      bool
+	}{
+		{"", true, false},
+		{"1", true, false},
+		{"TRUE", true, false},
+		{"False", false, false},
+		{"f", false, false},
+		{"yes", true, true},
+	}
+	for _, c := range boolCases {
+		os.Setenv(name, c.value)
+		v, err := EnvBoolE(name, true)
+		assert.Equal(t, c.err, err != nil, c.value)
+		assert.Equal(t, c.expected, v, c.value)
+		assert.Equal(t, c.expected, EnvBool(name, true), c.value)
+	}
+
+	// A malformed value is only reported once.
+	ctx, buf := captureLog(WarnLevel)
+	invalidEnvWarned.Lock()
+	invalidEnvWarned.values = map[string]struct{}{}
+	invalidEnvWarned.Unlock()
+	os.Setenv(name, "yes")
+	_, err := EnvBoolE(name, true)
+	for i := 0; i < 3; i++ {
+		warnInvalidEnv(ctx, name, true, err)
+	}
+	assert.Contains(t, buf.String(), `WARN: Ignoring `+name+`, using the default value true: invalid boolean value "yes" for `+name)
+	assert.Equal(t, 1, strings.Count(buf.String(), `invalid boolean value "yes"`))
+
+	os.Setenv(name, "")
+	assert.Equal(t, 7, EnvInt(name, 7))
+	os.Setenv(name, " 42 ")
+	assert.Equal(t, 42, EnvInt(name, 7))
+	os.Setenv(name, "4.2")
+	assert.Equal(t, 4.2, EnvFloat(name, 1))
+	assert.Equal(t, 7, EnvInt(name, 7))
+	_, err = EnvIntE(name, 7)
+	assert.Error(t, err)
+
+	os.Setenv(name, "1m30s")
+	assert.Equal(t, 90*time.Second, EnvDuration(name, time.Minute))
+	os.Setenv(name, "90")
+	assert.Equal(t, time.Minute, EnvDuration(name, time.Minute))
+	_, err = EnvDurationE(name, time.Minute)
+	assert.Error(t, err)
+	os.Setenv(name, "fast")
+	_, err = EnvFloatE(name, 1)
+	assert.Error(t, err)
+}
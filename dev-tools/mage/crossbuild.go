@@ -19,7 +19,6 @@ package mage
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -90,14 +89,14 @@ func CrossBuild(options ...CrossBuildOption) error {
 	}
 
 	if len(params.Platforms) == 0 {
-		log.Printf("Skipping cross-build of target=%v because platforms list is empty.", params.Target)
+		logInfof("Skipping cross-build of target=%v because platforms list is empty.", params.Target)
 		return nil
 	}
 
 	// Build the magefile for Linux so we can run it inside the container.
 	mg.Deps(buildMage)
 
-	log.Println("crossBuild: Platform list =", params.Platforms)
+	logDebug("crossBuild: Platform list =", params.Platforms)
 	var deps []interface{}
 	for _, buildPlatform := range params.Platforms {
 		if !buildPlatform.Flags.CanCrossBuild() {
@@ -111,7 +110,7 @@ func CrossBuild(options ...CrossBuildOption) error {
 					params.Target, buildPlatform.Name)
 			}
 		} else {
-			deps = append(deps, builder.Build)
+			deps = append(deps, NamedJob(params.Target+"-"+buildPlatform.Name, builder.Build))
 		}
 	}
 
@@ -183,11 +182,19 @@ func (b GolangCrossBuilder) Build() error {
 		workDir = filepath.ToSlash(filepath.Join(workDir, repoInfo.SubDir))
 	}
 
+	rootDir, err := DockerMountPath(repoInfo.RootDir)
+	if err != nil {
+		return err
+	}
+
 	dockerRun := sh.RunCmd("docker", "run")
 	image, err := crossBuildImage(b.Platform)
 	if err != nil {
 		return errors.Wrap(err, "failed to determine golang-crossbuild image tag")
 	}
+	if err = EnsureDockerImage(image); err != nil {
+		return err
+	}
 	verbose := ""
 	if mg.Verbose() {
 		verbose = "true"
@@ -203,7 +210,7 @@ func (b GolangCrossBuilder) Build() error {
 		"--rm",
 		"--env", "MAGEFILE_VERBOSE="+verbose,
 		"--env", "MAGEFILE_TIMEOUT="+EnvOr("MAGEFILE_TIMEOUT", ""),
-		"-v", repoInfo.RootDir+":"+mountPoint,
+		"-v", rootDir+":"+mountPoint,
 		"-w", workDir,
 		image,
 		"--build-cmd", "build/mage-linux-amd64 "+b.Target,
@@ -221,7 +228,7 @@ func DockerChown(file string) {
 	gid, _ := strconv.Atoi(EnvOr("EXEC_GID", "-1"))
 	if uid > 0 && gid > 0 {
 		if err := chownPaths(uid, gid, file); err != nil {
-			log.Println(err)
+			logWarn(err)
 		}
 	}
 }
@@ -0,0 +1,1976 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dockerInfoCache holds the result of the last docker info probe. Successful
+// results are kept forever. Errors are kept for dockerInfoRetryInterval so
+// that a daemon that starts after mage is still detected.
+var dockerInfoCache struct {
+	sync.Mutex
+	info    *DockerInfo
+	err     error
+	checked time.Time
+}
+
+var (
+	dockerInfoRetryInterval = 5 * time.Second
+	dockerInfoProbe         = dockerInfo // Replaced in tests.
+)
+
+// DockerInfo contains information about the docker daemon.
+type DockerInfo struct {
+	OperatingSystem string      `json:"OperatingSystem"`
+	Labels          []string    `json:"Labels"`
+	NCPU            int         `json:"NCPU"`
+	MemTotal        int         `json:"MemTotal"`
+	ServerVersion   string      `json:"ServerVersion"`
+	Architecture    string      `json:"Architecture"` // e.g. x86_64 or aarch64.
+	OSType          string      `json:"OSType"`       // linux or windows.
+	KernelVersion   string      `json:"KernelVersion"`
+	Driver          string      `json:"Driver"`
+	DriverStatus    [][2]string `json:"DriverStatus"`
+	SecurityOptions []string    `json:"SecurityOptions"` // e.g. name=seccomp,profile=default.
+	CgroupVersion   string      `json:"CgroupVersion"`   // 1 or 2, empty for old daemons.
+
+	Context         string `json:"-"` // Name of the active docker context.
+	ContextEndpoint string `json:"-"` // Daemon endpoint of the context (e.g. unix:///var/run/docker.sock).
+
+	podman bool // Info was reported by podman.
+}
+
+// IsBoot2Docker returns true if the Docker OS is boot2docker.
+func (info *DockerInfo) IsBoot2Docker() bool {
+	return strings.Contains(strings.ToLower(info.OperatingSystem), "boot2docker")
+}
+
+// IsPodman returns true if the container engine is podman (possibly invoked
+// through its docker compatible CLI).
+func (info *DockerInfo) IsPodman() bool {
+	return info.podman
+}
+
+// IsWindowsDaemon returns true if the daemon runs Windows containers.
+func (info *DockerInfo) IsWindowsDaemon() bool {
+	return strings.EqualFold(info.OSType, "windows")
+}
+
+// IsContainerdImageStore returns true if the daemon uses the containerd image
+// store (containerd snapshotter). With it enabled, images can hold
+// multi-platform manifest lists and "docker buildx build --load" works for
+// more than one platform.
+func (info *DockerInfo) IsContainerdImageStore() bool {
+	for _, kv := range info.DriverStatus {
+		if kv[0] == "driver-type" && strings.HasPrefix(kv[1], "io.containerd.snapshotter") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRootless returns true if the daemon (docker or podman) runs as an
+// unprivileged user. Rootless daemons cannot bind privileged ports, may not
+// report cgroup stats, and map root in containers to the invoking user.
+func (info *DockerInfo) IsRootless() bool {
+	for _, opt := range info.SecurityOptions {
+		if opt == "name=rootless" || strings.HasPrefix(opt, "name=rootless,") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRemoteDaemon returns true if the daemon is not reachable through a local
+// socket or a loopback address (e.g. an ssh:// or tcp:// context for a remote
+// engine). Local paths cannot be bind mounted into containers run by a remote
+// daemon.
+func (info *DockerInfo) IsRemoteDaemon() bool {
+	return isRemoteDockerEndpoint(info.ContextEndpoint)
+}
+
+// isRemoteDockerEndpoint returns true if the endpoint is not a local socket,
+// named pipe, or loopback address.
+func isRemoteDockerEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || endpoint == "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "unix", "npipe":
+		return false
+	case "tcp", "http", "https":
+		host := u.Hostname()
+		if host == "localhost" {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip == nil || !ip.IsLoopback()
+	default:
+		return true
+	}
+}
+
+// ServerVersionAtLeast returns true if the daemon's version is greater than
+// or equal to the given version (e.g. "20.10"). The edition suffix used by
+// older releases (e.g. 18.09.1-ce) is ignored. It returns false if either
+// version cannot be parsed.
+func (info *DockerInfo) ServerVersionAtLeast(version string) bool {
+	server := strings.TrimSuffix(strings.TrimSuffix(info.ServerVersion, "-ce"), "-ee")
+	cmp, err := CompareVersions(server, version)
+	return err == nil && cmp >= 0
+}
+
+// RootlessDocker returns true if the Docker daemon runs in rootless mode so
+// that the caller can skip or adapt the given step. The reason is logged.
+// False is returned if docker is unavailable.
+func RootlessDocker(step string) bool {
+	return rootlessDocker(context.Background(), step)
+}
+
+func rootlessDocker(ctx context.Context, step string) bool {
+	info, err := GetDockerInfo()
+	if err != nil {
+		LoggerFromContext(ctx).Debug("Unable to determine if docker is rootless:", err)
+		return false
+	}
+	if !info.IsRootless() {
+		return false
+	}
+	LoggerFromContext(ctx).Infof("Docker daemon is running rootless, adapting step: %v", step)
+	return true
+}
+
+// MemTotalHuman returns the memory available to the daemon in a human
+// readable form (e.g. 1.9 GiB).
+func (info *DockerInfo) MemTotalHuman() string {
+	return HumanSize(int64(info.MemTotal))
+}
+
+// DockerResources are the minimum resources that the Docker daemon must
+// provide for a target. Targets can declare their requirements once and call
+// Check before starting any containers.
+type DockerResources struct {
+	CPUs   int   // Minimum number of CPUs.
+	Memory int64 // Minimum memory in bytes.
+}
+
+// Check returns an error if the Docker daemon has fewer resources than
+// required.
+func (r DockerResources) Check() error {
+	info, err := GetDockerInfo()
+	if err != nil {
+		return errors.Wrap(err, "failed to get docker info")
+	}
+	return info.checkResources(r)
+}
+
+// CheckDockerResources returns an error if the Docker daemon has fewer than
+// minCPU CPUs or less than minMemoryBytes of memory. The error explains how
+// to increase the resources.
+func CheckDockerResources(minCPU int, minMemoryBytes int) error {
+	return DockerResources{CPUs: minCPU, Memory: int64(minMemoryBytes)}.Check()
+}
+
+func (info *DockerInfo) checkResources(r DockerResources) error {
+	var problems []string
+	if info.NCPU < r.CPUs {
+		problems = append(problems, fmt.Sprintf("%d CPUs are available but %d are required", info.NCPU, r.CPUs))
+	}
+	if int64(info.MemTotal) < r.Memory {
+		problems = append(problems, fmt.Sprintf("%v of memory is available but %v is required",
+			info.MemTotalHuman(), HumanSize(r.Memory)))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	var hint string
+	switch {
+	case info.OperatingSystem == "Docker Desktop":
+		hint = "increase the Docker Desktop resources (Settings > Resources) to"
+	case info.IsBoot2Docker():
+		hint = "increase the resources of the boot2docker VM to"
+	default:
+		hint = "use a docker host with"
+	}
+	var needs []string
+	if r.CPUs > 0 {
+		needs = append(needs, fmt.Sprintf("%d CPUs", r.CPUs))
+	}
+	if r.Memory > 0 {
+		needs = append(needs, HumanSize(r.Memory)+" of memory")
+	}
+	return errors.Errorf("insufficient docker resources: %v; %v at least %v",
+		strings.Join(problems, ", "), hint, strings.Join(needs, " and "))
+}
+
+// Host capabilities that can be passed to RequireCapabilities.
+const (
+	CapCgroupV2       = "cgroupv2" // The daemon uses cgroup v2.
+	CapSeccomp        = "seccomp"  // The daemon supports seccomp profiles.
+	CapUserNamespaces = "userns"   // Unprivileged user namespaces are allowed.
+	CapInotify        = "inotify"  // At least MinInotifyWatches inotify watches.
+)
+
+// MinInotifyWatches is the number of inotify watches per user that is
+// required by CapInotify.
+const MinInotifyWatches = 65536
+
+// procReadFile reads files below /proc. Replaced in tests.
+var procReadFile = ioutil.ReadFile
+
+// HostCapabilities describes the kernel features of the docker host that are
+// needed by some integration test containers.
+type HostCapabilities struct {
+	CgroupV2 bool
+	Seccomp  bool
+
+	// Probed is true if the daemon shares the kernel of this machine so that
+	// the values below were read from /proc. Otherwise they are assumed to be
+	// available.
+	Probed                bool
+	UserNamespaces        bool
+	InotifyMaxUserWatches int
+}
+
+// DockerHostCapabilities returns the capabilities of the docker host. They
+// are derived from docker info and, when the daemon runs on the local kernel,
+// from /proc/sys.
+func DockerHostCapabilities() (*HostCapabilities, error) {
+	info, err := GetDockerInfo()
+	if err != nil {
+		return nil, err
+	}
+	return info.hostCapabilities(), nil
+}
+
+func (info *DockerInfo) hostCapabilities() *HostCapabilities {
+	caps := &HostCapabilities{
+		CgroupV2:       info.CgroupVersion == "2",
+		UserNamespaces: true,
+	}
+	for _, opt := range info.SecurityOptions {
+		if opt == "name=seccomp" || strings.HasPrefix(opt, "name=seccomp,") {
+			caps.Seccomp = true
+		}
+	}
+
+	// Docker Desktop, boot2docker, and remote daemons run on another kernel.
+	if runtime.GOOS != "linux" || info.IsWindowsDaemon() || info.IsRemoteDaemon() ||
+		info.OperatingSystem == "Docker Desktop" || info.IsBoot2Docker() {
+		return caps
+	}
+
+	caps.Probed = true
+	if readProcInt("/proc/sys/user/max_user_namespaces", -1) == 0 ||
+		readProcInt("/proc/sys/kernel/unprivileged_userns_clone", -1) == 0 ||
+		readProcInt("/proc/sys/kernel/apparmor_restrict_unprivileged_userns", -1) == 1 {
+		caps.UserNamespaces = false
+	}
+	caps.InotifyMaxUserWatches = readProcInt("/proc/sys/fs/inotify/max_user_watches", -1)
+	return caps
+}
+
+// readProcInt returns the integer value of a /proc file or def if the file
+// cannot be read.
+func readProcInt(path string, def int) int {
+	data, err := procReadFile(path)
+	if err != nil {
+		return def
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// RequireCapabilities returns an error if the docker host lacks any of the
+// given capabilities (see the Cap constants). The error lists everything that
+// is missing along with how to enable it. Call it before starting containers
+// that depend on these features so that they don't fail in obscure ways.
+func RequireCapabilities(caps ...string) error {
+	hostCaps, err := DockerHostCapabilities()
+	if err != nil {
+		return errors.Wrap(err, "failed to determine the docker host capabilities")
+	}
+	return hostCaps.Require(caps...)
+}
+
+// Require returns an error listing each of the given capabilities that is
+// missing.
+func (c *HostCapabilities) Require(caps ...string) error {
+	var missing []string
+	for _, name := range caps {
+		switch name {
+		case CapCgroupV2:
+			if !c.CgroupV2 {
+				missing = append(missing, "cgroup v2 is not enabled (boot the "+
+					"host with systemd.unified_cgroup_hierarchy=1)")
+			}
+		case CapSeccomp:
+			if !c.Seccomp {
+				missing = append(missing, "seccomp is not supported by the "+
+					"daemon (use a kernel and docker build with seccomp enabled)")
+			}
+		case CapUserNamespaces:
+			if !c.UserNamespaces {
+				missing = append(missing, "unprivileged user namespaces are "+
+					"disabled (sysctl -w kernel.unprivileged_userns_clone=1 "+
+					"user.max_user_namespaces=15000 "+
+					"kernel.apparmor_restrict_unprivileged_userns=0)")
+			}
+		case CapInotify:
+			if c.Probed && c.InotifyMaxUserWatches >= 0 && c.InotifyMaxUserWatches < MinInotifyWatches {
+				missing = append(missing, fmt.Sprintf("only %d inotify watches "+
+					"are allowed but %d are required (sysctl -w "+
+					"fs.inotify.max_user_watches=%d)",
+					c.InotifyMaxUserWatches, MinInotifyWatches, MinInotifyWatches))
+			}
+		default:
+			return errors.Errorf("unknown host capability %q", name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("the docker host is missing required capabilities:\n  - %v",
+			strings.Join(missing, "\n  - "))
+	}
+	return nil
+}
+
+// HaveDocker returns an error if docker is unavailable.
+func HaveDocker() error {
+	if _, err := GetDockerInfo(); err != nil {
+		return errors.Wrap(err, "docker is not available")
+	}
+	return nil
+}
+
+// GetDockerInfo returns information about the Docker daemon. The daemon's API
+// is queried directly (honoring DOCKER_HOST, DOCKER_TLS_VERIFY, and
+// DOCKER_CERT_PATH) and the docker CLI is used if the API is unreachable.
+//
+// A successful result is cached for the life of the process. A failure is
+// cached for a few seconds after which the daemon is probed again.
+func GetDockerInfo() (*DockerInfo, error) {
+	dockerInfoCache.Lock()
+	defer dockerInfoCache.Unlock()
+
+	if dockerInfoCache.info != nil {
+		return dockerInfoCache.info, nil
+	}
+	if dockerInfoCache.err != nil && time.Since(dockerInfoCache.checked) < dockerInfoRetryInterval {
+		return nil, dockerInfoCache.err
+	}
+	return refreshDockerInfo()
+}
+
+// RefreshDockerInfo probes the Docker daemon again and replaces the cached
+// result that is returned by GetDockerInfo.
+func RefreshDockerInfo() (*DockerInfo, error) {
+	dockerInfoCache.Lock()
+	defer dockerInfoCache.Unlock()
+	return refreshDockerInfo()
+}
+
+// refreshDockerInfo must be called while holding the dockerInfoCache lock.
+// The probe is bounded by DEV_TOOLS_DOCKER_INFO_TIMEOUT (default 15s) so that
+// a hung daemon cannot block the build indefinitely.
+func refreshDockerInfo() (*DockerInfo, error) {
+	timeout, err := time.ParseDuration(EnvOr("DEV_TOOLS_DOCKER_INFO_TIMEOUT", "15s"))
+	if err != nil || timeout <= 0 {
+		logWarn("Ignoring invalid DEV_TOOLS_DOCKER_INFO_TIMEOUT:", os.Getenv("DEV_TOOLS_DOCKER_INFO_TIMEOUT"))
+		timeout = 15 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	info, err := dockerInfoProbe(ctx)
+	if err != nil {
+		err = dockerInfoError(ctx, timeout, err)
+	}
+	dockerInfoCache.info, dockerInfoCache.err = info, err
+	dockerInfoCache.checked = time.Now()
+	return info, err
+}
+
+// errDockerCLINotFound is returned by dockerCLIInfo when neither docker nor
+// podman is installed.
+var errDockerCLINotFound = errors.New("docker CLI not found")
+
+// dockerInfoError wraps an error from the docker info probe with the reason
+// that it failed and the DOCKER_HOST that was used.
+func dockerInfoError(ctx context.Context, timeout time.Duration, err error) error {
+	host := dockerAPIConfigFromEnv().Host
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return errors.Wrapf(err, "docker info probe timed out after %v (DOCKER_HOST=%v)", timeout, host)
+	case errors.Cause(err) == errDockerCLINotFound:
+		return errors.Errorf("docker CLI not found and the daemon API is not reachable (DOCKER_HOST=%v)", host)
+	default:
+		return errors.Wrapf(err, "docker daemon not reachable at %v", host)
+	}
+}
+
+// dockerInfo queries the daemon's API for its info. The docker CLI is used as
+// a fallback when the API is unreachable.
+func dockerInfo(ctx context.Context) (*DockerInfo, error) {
+	dockerCtx, err := currentDockerContext()
+	if err != nil {
+		return nil, err
+	}
+
+	config := dockerAPIConfigFromEnv()
+	config.Host = dockerCtx.Host
+	info, err := dockerAPIInfo(ctx, config)
+	if err != nil {
+		LoggerFromContext(ctx).Debug("Using the docker CLI because the Docker API is unavailable:", err)
+		if info, err = dockerCLIInfo(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	info.Context, info.ContextEndpoint = dockerCtx.Name, dockerCtx.Host
+	return info, nil
+}
+
+// dockerContext is the docker context that selects the daemon.
+type dockerContext struct {
+	Name string
+	Host string // Endpoint of the daemon.
+}
+
+// dockerContextMeta is the metadata file of a docker context that is stored
+// in contexts/meta/<sha256 of name>/meta.json in the docker config dir.
+type dockerContextMeta struct {
+	Name      string `json:"Name"`
+	Endpoints map[string]struct {
+		Host string `json:"Host"`
+	} `json:"Endpoints"`
+}
+
+// currentDockerContext returns the context that the docker CLI would use. In
+// order of precedence it is selected by DOCKER_HOST, DOCKER_CONTEXT, or the
+// currentContext of config.json.
+func currentDockerContext() (dockerContext, error) {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return dockerContext{Name: "default", Host: host}, nil
+	}
+
+	name := os.Getenv("DOCKER_CONTEXT")
+	if name == "" {
+		config, err := readDockerConfig()
+		if err != nil {
+			return dockerContext{}, err
+		}
+		name = config.CurrentContext
+	}
+	if name == "" || name == "default" {
+		return dockerContext{Name: "default", Host: defaultDockerHost}, nil
+	}
+
+	dir, err := dockerConfigDir()
+	if err != nil {
+		return dockerContext{}, err
+	}
+	sum := sha256.Sum256([]byte(name))
+	metaFile := filepath.Join(dir, "contexts", "meta", hex.EncodeToString(sum[:]), "meta.json")
+	data, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		return dockerContext{}, errors.Wrapf(err, "failed to read docker context %v", name)
+	}
+	return parseDockerContextMeta(data)
+}
+
+// parseDockerContextMeta parses a context's meta.json file.
+func parseDockerContextMeta(data []byte) (dockerContext, error) {
+	var meta dockerContextMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return dockerContext{}, errors.Wrap(err, "failed to parse docker context")
+	}
+	endpoint, found := meta.Endpoints["docker"]
+	if !found || endpoint.Host == "" {
+		return dockerContext{}, errors.Errorf("docker context %v has no docker endpoint", meta.Name)
+	}
+	return dockerContext{Name: meta.Name, Host: endpoint.Host}, nil
+}
+
+// dockerCLIInfo runs "docker info". If docker is not installed but podman is
+// then "podman info" is used.
+func dockerCLIInfo(ctx context.Context) (*DockerInfo, error) {
+	binary := "docker"
+	_, lookErr := exec.LookPath(binary)
+	if lookErr != nil {
+		if _, err := exec.LookPath("podman"); err == nil {
+			binary, lookErr = "podman", nil
+		}
+	}
+
+	out, err := Cmd{Args: []string{binary, "info", "-f", "{{ json .}}"}}.OutputContext(ctx)
+	if err != nil {
+		if lookErr != nil && ctx.Err() == nil {
+			return nil, errDockerCLINotFound
+		}
+		return nil, err
+	}
+
+	return parseDockerInfo([]byte(out.Stdout))
+}
+
+// dockerAPIConfig contains the settings used to connect to the Docker API.
+type dockerAPIConfig struct {
+	Host      string // DOCKER_HOST (e.g. unix:///var/run/docker.sock or tcp://host:2376).
+	TLSVerify bool   // DOCKER_TLS_VERIFY
+	CertPath  string // DOCKER_CERT_PATH containing ca.pem, cert.pem, and key.pem.
+}
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// dockerAPIConfigFromEnv returns the Docker API settings from the same
+// environment variables that are used by the docker CLI.
+func dockerAPIConfigFromEnv() dockerAPIConfig {
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			certPath = filepath.Join(home, ".docker")
+		}
+	}
+
+	return dockerAPIConfig{
+		Host:      EnvOr("DOCKER_HOST", defaultDockerHost),
+		TLSVerify: os.Getenv("DOCKER_TLS_VERIFY") != "",
+		CertPath:  certPath,
+	}
+}
+
+// client returns an HTTP client for the Docker API and the base URL of the
+// API.
+func (c dockerAPIConfig) client() (*http.Client, string, error) {
+	transport := &http.Transport{}
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	switch {
+	case strings.HasPrefix(c.Host, "unix://"):
+		socket := strings.TrimPrefix(c.Host, "unix://")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		return client, "http://docker", nil
+	case strings.HasPrefix(c.Host, "tcp://"):
+		addr := strings.TrimPrefix(c.Host, "tcp://")
+		if !c.TLSVerify {
+			return client, "http://" + addr, nil
+		}
+
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return nil, "", err
+		}
+		transport.TLSClientConfig = tlsConfig
+		return client, "https://" + addr, nil
+	default:
+		return nil, "", errors.Errorf("unsupported DOCKER_HOST %v", c.Host)
+	}
+}
+
+// tlsConfig returns a TLS config that verifies the daemon's certificate
+// using ca.pem and that presents cert.pem and key.pem if they exist.
+func (c dockerAPIConfig) tlsConfig() (*tls.Config, error) {
+	caPEM, err := ioutil.ReadFile(filepath.Join(c.CertPath, "ca.pem"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read docker CA certificate")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("failed to parse docker CA certificate")
+	}
+
+	config := &tls.Config{RootCAs: pool}
+	certFile := filepath.Join(c.CertPath, "cert.pem")
+	keyFile := filepath.Join(c.CertPath, "key.pem")
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load docker client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// dockerAPIInfo gets the daemon's info from the /info endpoint of the API.
+func dockerAPIInfo(ctx context.Context, config dockerAPIConfig) (*DockerInfo, error) {
+	client, baseURL, err := config.client()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/info", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query the docker API")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("docker API returned http status %v", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the docker API response")
+	}
+	return parseDockerInfo(data)
+}
+
+// podmanInfo is the subset of the "podman info" output that is used to
+// populate DockerInfo.
+type podmanInfo struct {
+	Host struct {
+		Arch     string `json:"arch"`
+		CPUs     int    `json:"cpus"`
+		MemTotal int    `json:"memTotal"`
+		OS       string `json:"os"`
+		Kernel   string `json:"kernel"`
+		Cgroup   string `json:"cgroupVersion"` // v1 or v2.
+		Security struct {
+			AppArmorEnabled bool `json:"apparmorEnabled"`
+			Rootless        bool `json:"rootless"`
+			SeccompEnabled  bool `json:"seccompEnabled"`
+			SELinuxEnabled  bool `json:"selinuxEnabled"`
+		} `json:"security"`
+		Distribution struct {
+			Distribution string `json:"distribution"`
+			Version      string `json:"version"`
+		} `json:"distribution"`
+	} `json:"host"`
+	Version struct {
+		Version string `json:"Version"`
+	} `json:"version"`
+}
+
+// parseDockerInfo parses the JSON output of "docker info" or "podman info".
+// Podman's output is recognized by its top-level "host" object.
+func parseDockerInfo(data []byte) (*DockerInfo, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errors.Wrap(err, "failed to parse docker info")
+	}
+
+	if _, found := fields["host"]; !found {
+		var info DockerInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, errors.Wrap(err, "failed to parse docker info")
+		}
+		return &info, nil
+	}
+
+	var p podmanInfo
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, errors.Wrap(err, "failed to parse podman info")
+	}
+
+	// Podman reports GOARCH values while docker uses the kernel's names.
+	arch := p.Host.Arch
+	switch arch {
+	case "amd64":
+		arch = "x86_64"
+	case "arm64":
+		arch = "aarch64"
+	}
+
+	// Report podman's security settings in the same form as docker.
+	var securityOptions []string
+	for _, opt := range []struct {
+		enabled bool
+		name    string
+	}{
+		{p.Host.Security.AppArmorEnabled, "name=apparmor"},
+		{p.Host.Security.SeccompEnabled, "name=seccomp"},
+		{p.Host.Security.SELinuxEnabled, "name=selinux"},
+		{p.Host.Security.Rootless, "name=rootless"},
+	} {
+		if opt.enabled {
+			securityOptions = append(securityOptions, opt.name)
+		}
+	}
+
+	return &DockerInfo{
+		OperatingSystem: strings.TrimSpace(p.Host.Distribution.Distribution + " " + p.Host.Distribution.Version),
+		NCPU:            p.Host.CPUs,
+		MemTotal:        p.Host.MemTotal,
+		ServerVersion:   p.Version.Version,
+		Architecture:    arch,
+		OSType:          p.Host.OS,
+		KernelVersion:   p.Host.Kernel,
+		SecurityOptions: securityOptions,
+		CgroupVersion:   strings.TrimPrefix(p.Host.Cgroup, "v"),
+		podman:          true,
+	}, nil
+}
+
+var (
+	dockerPullAttempts = 5
+	dockerPullBackoff  = 10 * time.Second
+)
+
+// HaveDockerImage returns true if the image exists in the local image store.
+func HaveDockerImage(ref string) (bool, error) {
+	return haveDockerImage(context.Background(), ref)
+}
+
+func haveDockerImage(ctx context.Context, ref string) (bool, error) {
+	_, err := Cmd{Args: []string{"docker", "image", "inspect", "--format", "{{.Id}}", ref}}.OutputContext(ctx)
+	if err == nil {
+		return true, nil
+	}
+	if msg := strings.ToLower(err.Error()); strings.Contains(msg, "no such image") || strings.Contains(msg, "no such object") {
+		return false, nil
+	}
+	return false, errors.Wrapf(err, "failed to inspect docker image %v", ref)
+}
+
+// DockerPull pulls the image. Transient failures like network errors, server
+// errors, and rate limiting (HTTP 429) are retried with an exponential
+// backoff. The pull output is not streamed, instead a message is logged
+// periodically while the pull is running.
+func DockerPull(ref string) error {
+	return dockerPull(context.Background(), ref)
+}
+
+func dockerPull(ctx context.Context, ref string) error {
+	LoggerFromContext(ctx).Info("Pulling docker image", ref)
+	cmd := Cmd{Args: []string{"docker", "pull", "--quiet", ref}}
+	return RetryIf(ctx, dockerPullAttempts, dockerPullBackoff, isRetryablePullError, func() error {
+		_, err := cmd.OutputContext(ctx)
+		return err
+	})
+}
+
+// retryablePullErrors are fragments of docker pull errors that indicate a
+// transient failure.
+var retryablePullErrors = []string{
+	"toomanyrequests",
+	"too many requests",
+	"500 internal server error",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"tls handshake timeout",
+	"i/o timeout",
+	"connection reset by peer",
+	"unexpected eof",
+	"net/http: request canceled",
+}
+
+// isRetryablePullError returns true if a docker pull error is transient.
+func isRetryablePullError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, fragment := range retryablePullErrors {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsureDockerImage pulls the image unless it is already present in the local
+// image store. Use this before running containers so that a missing image or
+// a rate limited registry fails fast with a clear error.
+func EnsureDockerImage(ref string) error {
+	return ensureDockerImage(context.Background(), ref)
+}
+
+func ensureDockerImage(ctx context.Context, ref string) error {
+	found, err := haveDockerImage(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if found {
+		LoggerFromContext(ctx).Debug("Docker image is present:", ref)
+		return nil
+	}
+	return errors.Wrapf(dockerPull(ctx, ref), "failed to pull docker image %v", ref)
+}
+
+// DockerLoginOptions controls the behavior of DockerLoginContext.
+type DockerLoginOptions struct {
+	// SkipIfAuthenticated skips the login when the credentials that docker
+	// already has for the registry are accepted by the registry.
+	SkipIfAuthenticated bool
+
+	// VerifyStored checks that docker stored credentials for the registry
+	// after a successful login.
+	VerifyStored bool
+}
+
+// DockerLogin logs in to the given Docker registry using the username and
+// password read from the named environment variables. The password is passed
+// to docker on stdin so that it does not appear in the process list or in the
+// logs. The default registry (Docker Hub) is used when registry is empty.
+func DockerLogin(registry, usernameEnv, passwordEnv string) error {
+	return DockerLoginContext(context.Background(), registry, usernameEnv, passwordEnv, DockerLoginOptions{})
+}
+
+// DockerLoginContext is like DockerLogin but it uses the given context and
+// options.
+func DockerLoginContext(ctx context.Context, registry, usernameEnv, passwordEnv string, opts DockerLoginOptions) error {
+	if opts.SkipIfAuthenticated {
+		ok, err := dockerRegistryAuthenticated(ctx, registry)
+		if err != nil {
+			LoggerFromContext(ctx).Debugf("Unable to check existing credentials for %v: %v", dockerRegistryName(registry), err)
+		}
+		if ok {
+			LoggerFromContext(ctx).Infof("Already logged in to %v", dockerRegistryName(registry))
+			return nil
+		}
+	}
+
+	if err := RequireEnv(usernameEnv, passwordEnv); err != nil {
+		return errors.Wrap(err, "missing docker registry credentials")
+	}
+
+	args := []string{"docker", "login", "--username", os.Getenv(usernameEnv), "--password-stdin"}
+	if registry != "" {
+		args = append(args, dockerRegistryHost(registry))
+	}
+	cmd := Cmd{Args: args, Stdin: strings.NewReader(os.Getenv(passwordEnv))}
+	if err := cmd.RunContext(ctx); err != nil {
+		return errors.Wrapf(err, "failed to log in to %v", dockerRegistryName(registry))
+	}
+
+	if opts.VerifyStored {
+		// With a credential store, config.json only contains an empty entry
+		// for the registry and the secret is kept by the helper.
+		config, err := readDockerConfig()
+		if err != nil {
+			return errors.Wrap(err, "failed to verify stored docker credentials")
+		}
+		if _, found := config.Auths[dockerConfigKey(registry)]; !found {
+			if _, _, found, err = dockerStoredCredentials(ctx, registry); err != nil || !found {
+				return errors.Errorf("docker did not store credentials for %v (err=%v)",
+					dockerRegistryName(registry), err)
+			}
+		}
+	}
+	return nil
+}
+
+// DockerLogout removes the credentials that docker stored for the registry.
+func DockerLogout(registry string) error {
+	args := []string{"docker", "logout"}
+	if registry != "" {
+		args = append(args, dockerRegistryHost(registry))
+	}
+	return Cmd{Args: args}.Run()
+}
+
+// dockerHubConfigKey is the key that docker uses for Docker Hub credentials.
+const dockerHubConfigKey = "https://index.docker.io/v1/"
+
+// dockerRegistryHost returns the registry without a URL scheme or path.
+func dockerRegistryHost(registry string) string {
+	if i := strings.Index(registry, "://"); i >= 0 {
+		registry = registry[i+3:]
+	}
+	return strings.SplitN(registry, "/", 2)[0]
+}
+
+// dockerRegistryName returns the registry name to use in messages.
+func dockerRegistryName(registry string) string {
+	if registry == "" {
+		return "Docker Hub"
+	}
+	return dockerRegistryHost(registry)
+}
+
+// dockerRegistryEndpoint returns the URL of the registry's v2 API. An
+// explicit scheme (e.g. http://localhost:5000) is honored, otherwise https is
+// used.
+func dockerRegistryEndpoint(registry string) string {
+	switch {
+	case registry == "":
+		return "https://registry-1.docker.io/v2/"
+	case strings.Contains(registry, "://"):
+		return strings.TrimSuffix(registry, "/") + "/v2/"
+	default:
+		return "https://" + dockerRegistryHost(registry) + "/v2/"
+	}
+}
+
+// dockerConfigFile is the subset of docker's config.json that describes
+// where credentials are stored.
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+	CredsStore     string            `json:"credsStore"`
+	CredHelpers    map[string]string `json:"credHelpers"`
+	CurrentContext string            `json:"currentContext"`
+}
+
+// dockerConfigDir returns the docker CLI's config dir, DOCKER_CONFIG or
+// ~/.docker.
+func dockerConfigDir() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker"), nil
+}
+
+// readDockerConfig reads config.json from DOCKER_CONFIG or ~/.docker. An
+// empty config is returned if the file does not exist.
+func readDockerConfig() (*dockerConfigFile, error) {
+	dir, err := dockerConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &dockerConfigFile{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, errors.Wrap(err, "failed to parse docker config.json")
+	}
+	return config, nil
+}
+
+// dockerConfigKey returns the key under which docker stores the registry's
+// credentials.
+func dockerConfigKey(registry string) string {
+	if registry == "" {
+		return dockerHubConfigKey
+	}
+	return dockerRegistryHost(registry)
+}
+
+// dockerStoredCredentials returns the credentials that docker has stored for
+// the registry, either in config.json or in a credential helper.
+func dockerStoredCredentials(ctx context.Context, registry string) (username, secret string, found bool, err error) {
+	config, err := readDockerConfig()
+	if err != nil {
+		return "", "", false, err
+	}
+
+	key := dockerConfigKey(registry)
+	helper := config.CredHelpers[key]
+	if helper == "" {
+		helper = config.CredsStore
+	}
+	if helper != "" {
+		out, err := Cmd{
+			Args:  []string{"docker-credential-" + helper, "get"},
+			Stdin: strings.NewReader(key),
+		}.OutputContext(ctx)
+		if err != nil {
+			// Helpers fail when they have no credentials for the server.
+			return "", "", false, nil
+		}
+		var creds struct {
+			Username string `json:"Username"`
+			Secret   string `json:"Secret"`
+		}
+		if err = json.Unmarshal([]byte(out.Stdout), &creds); err != nil {
+			return "", "", false, errors.Wrap(err, "failed to parse credential helper output")
+		}
+		return creds.Username, creds.Secret, creds.Secret != "", nil
+	}
+
+	auth, found := config.Auths[key]
+	if !found || auth.Auth == "" {
+		return "", "", false, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+	if err != nil {
+		return "", "", false, errors.Wrap(err, "failed to decode docker credentials")
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false, errors.New("invalid docker credentials in config.json")
+	}
+	return parts[0], parts[1], true, nil
+}
+
+// dockerRegistryAuthenticated returns true if the registry accepts the
+// credentials that docker has stored for it.
+func dockerRegistryAuthenticated(ctx context.Context, registry string) (bool, error) {
+	username, secret, found, err := dockerStoredCredentials(ctx, registry)
+	if err != nil || !found {
+		return false, err
+	}
+	return probeDockerRegistry(ctx, &http.Client{Timeout: 10 * time.Second},
+		dockerRegistryEndpoint(registry), username, secret)
+}
+
+// probeDockerRegistry sends a HEAD request to the registry's v2 endpoint
+// using basic auth. Registries that use token authentication respond with a
+// Bearer challenge, in which case the credentials are checked by requesting a
+// token from the advertised realm.
+func probeDockerRegistry(ctx context.Context, client *http.Client, endpoint, username, secret string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	req.SetBasicAuth(username, secret)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return true, nil
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return false, errors.Errorf("registry returned http status %v", resp.StatusCode)
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return false, nil
+	}
+	params := parseAuthChallenge(challenge[len("bearer "):])
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return false, errors.Errorf("invalid registry auth challenge %q", challenge)
+	}
+	if service := params["service"]; service != "" {
+		q := realm.Query()
+		q.Set("service", service)
+		realm.RawQuery = q.Encode()
+	}
+
+	req, err = http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.SetBasicAuth(username, secret)
+	resp, err = client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// parseAuthChallenge parses the comma separated key="value" parameters of a
+// WWW-Authenticate challenge.
+func parseAuthChallenge(params string) map[string]string {
+	out := map[string]string{}
+	for _, param := range strings.Split(params, ",") {
+		parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(parts) == 2 {
+			out[strings.ToLower(parts[0])] = strings.Trim(parts[1], `"`)
+		}
+	}
+	return out
+}
+
+// buildxInfoCache holds the result of the first successful buildx probe.
+var buildxInfoCache struct {
+	sync.Mutex
+	info *BuildxInfo
+}
+
+// BuildxInfo contains information about the current docker buildx builder.
+type BuildxInfo struct {
+	Name   string       // Name of the builder instance.
+	Driver string       // Builder driver (e.g. docker or docker-container).
+	Nodes  []BuildxNode // Nodes of the builder.
+}
+
+// BuildxNode is a node of a buildx builder.
+type BuildxNode struct {
+	Name      string
+	Endpoint  string
+	Status    string
+	Buildkit  string   // BuildKit version.
+	Platforms []string // Platforms that the node can build (e.g. linux/arm64).
+}
+
+// Platforms returns the platforms that can be built by any node of the
+// builder.
+func (b *BuildxInfo) Platforms() []string {
+	var platforms []string
+	seen := map[string]struct{}{}
+	for _, n := range b.Nodes {
+		for _, p := range n.Platforms {
+			if _, found := seen[p]; !found {
+				seen[p] = struct{}{}
+				platforms = append(platforms, p)
+			}
+		}
+	}
+	return platforms
+}
+
+// SupportsPlatform returns true if the builder can build the given platform.
+// A platform without a variant (e.g. linux/arm) matches any variant of it.
+func (b *BuildxInfo) SupportsPlatform(platform string) bool {
+	for _, p := range b.Platforms() {
+		if p == platform || strings.HasPrefix(p, platform+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// MissingPlatforms returns the platforms from the given list that the builder
+// cannot build.
+func (b *BuildxInfo) MissingPlatforms(platforms ...string) []string {
+	var missing []string
+	for _, p := range platforms {
+		if !b.SupportsPlatform(p) {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// HaveBuildx returns an error if docker buildx is unavailable.
+func HaveBuildx() error {
+	if _, err := GetBuildxInfo(); err != nil {
+		return errors.Wrap(err, "docker buildx is not available")
+	}
+	return nil
+}
+
+// GetBuildxInfo returns information about the current buildx builder. The
+// builder is started if necessary. A successful result is cached for the life
+// of the process.
+func GetBuildxInfo() (*BuildxInfo, error) {
+	buildxInfoCache.Lock()
+	defer buildxInfoCache.Unlock()
+
+	if buildxInfoCache.info != nil {
+		return buildxInfoCache.info, nil
+	}
+
+	out, err := Cmd{Args: []string{"docker", "buildx", "inspect", "--bootstrap"}}.Output()
+	if err != nil {
+		return nil, err
+	}
+	info, err := parseBuildxInfo(out.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	buildxInfoCache.info = info
+	return info, nil
+}
+
+// RequireBuildxPlatforms returns an error if docker buildx is unavailable or
+// if its builder cannot build all of the given platforms. The error lists
+// every missing platform.
+func RequireBuildxPlatforms(platforms ...string) error {
+	info, err := GetBuildxInfo()
+	if err != nil {
+		return errors.Wrap(err, "docker buildx is not available")
+	}
+
+	if missing := info.MissingPlatforms(platforms...); len(missing) > 0 {
+		return errors.Errorf("docker buildx builder %v cannot build platforms "+
+			"[%v] (available: %v); foreign platforms require QEMU to be "+
+			"registered with binfmt_misc (e.g. docker run --privileged --rm "+
+			"tonistiigi/binfmt --install all)",
+			info.Name, strings.Join(missing, ", "), strings.Join(info.Platforms(), ", "))
+	}
+	return nil
+}
+
+// haveBuildx is the buildx detection used by DockerManifestPush. Replaced in
+// tests.
+var haveBuildx = HaveBuildx
+
+// DockerManifestPush creates a multi-arch manifest list named targetRef from
+// the per-architecture images and pushes it. perArchRefs is keyed by platform
+// (e.g. amd64, arm64, arm/v7, or linux/arm64). The OS defaults to linux.
+//
+// docker buildx imagetools is used when buildx is available, otherwise the
+// legacy docker manifest commands are used. Every per-architecture image must
+// already exist in the registry. The returned error lists each one that is
+// missing. With DEV_TOOLS_DRY_RUN=true the commands are only logged.
+func DockerManifestPush(targetRef string, perArchRefs map[string]string) error {
+	return dockerManifestPush(context.Background(), targetRef, perArchRefs)
+}
+
+func dockerManifestPush(ctx context.Context, targetRef string, perArchRefs map[string]string) error {
+	if len(perArchRefs) == 0 {
+		return errors.Errorf("no images were given for manifest %v", targetRef)
+	}
+
+	platforms := make([]string, 0, len(perArchRefs))
+	for platform := range perArchRefs {
+		if _, _, _, err := parseManifestPlatform(platform); err != nil {
+			return err
+		}
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+
+	useBuildx := haveBuildx() == nil
+	inspect := []string{"docker", "manifest", "inspect"}
+	if useBuildx {
+		inspect = []string{"docker", "buildx", "imagetools", "inspect"}
+	}
+
+	var missing []string
+	for _, platform := range platforms {
+		ref := perArchRefs[platform]
+		if _, err := (Cmd{Args: append(inspect, ref)}).OutputContext(ctx); err != nil {
+			LoggerFromContext(ctx).Debugf("Failed to inspect %v: %v", ref, err)
+			missing = append(missing, platform+"="+ref)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("cannot create manifest %v, images not found in "+
+			"the registry: %v", targetRef, strings.Join(missing, ", "))
+	}
+
+	refs := make([]string, 0, len(platforms))
+	for _, platform := range platforms {
+		refs = append(refs, perArchRefs[platform])
+	}
+
+	if useBuildx {
+		LoggerFromContext(ctx).Info("Pushing manifest", targetRef, "with docker buildx imagetools")
+		args := append([]string{"docker", "buildx", "imagetools", "create", "--tag", targetRef}, refs...)
+		return Cmd{Args: args}.RunContext(ctx)
+	}
+
+	LoggerFromContext(ctx).Info("Pushing manifest", targetRef, "with docker manifest")
+	cmds := []Cmd{{Args: append([]string{"docker", "manifest", "create", "--amend", targetRef}, refs...)}}
+	for _, platform := range platforms {
+		goos, arch, variant, _ := parseManifestPlatform(platform)
+		args := []string{"docker", "manifest", "annotate", "--os", goos, "--arch", arch}
+		if variant != "" {
+			args = append(args, "--variant", variant)
+		}
+		cmds = append(cmds, Cmd{Args: append(args, targetRef, perArchRefs[platform])})
+	}
+	cmds = append(cmds, Cmd{Args: []string{"docker", "manifest", "push", "--purge", targetRef}})
+
+	for _, cmd := range cmds {
+		if err := cmd.RunContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseManifestPlatform splits a platform of the form [<os>/]<arch>[/<variant>]
+// into its parts.
+func parseManifestPlatform(platform string) (goos, arch, variant string, err error) {
+	parts := strings.Split(platform, "/")
+	if _, found := knownGOOS[parts[0]]; found && len(parts) > 1 {
+		goos, parts = parts[0], parts[1:]
+	} else {
+		goos = "linux"
+	}
+	if len(parts) > 2 || parts[0] == "" {
+		return "", "", "", errors.Errorf("invalid manifest platform %q, "+
+			"expected [<os>/]<arch>[/<variant>]", platform)
+	}
+	arch = parts[0]
+	if len(parts) == 2 {
+		variant = parts[1]
+	}
+	return goos, arch, variant, nil
+}
+
+// parseBuildxInfo parses the output of "docker buildx inspect". The output
+// consists of "Key: value" lines describing the builder followed by a
+// "Nodes:" section with one block per node. Indented lines (like labels) are
+// ignored.
+func parseBuildxInfo(output string) (*BuildxInfo, error) {
+	info := &BuildxInfo{}
+	var node *BuildxNode
+	inNodes := false
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		if line == "Nodes:" {
+			inNodes = true
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		if !inNodes {
+			switch key {
+			case "Name":
+				info.Name = value
+			case "Driver":
+				info.Driver = value
+			}
+			continue
+		}
+
+		if key == "Name" {
+			info.Nodes = append(info.Nodes, BuildxNode{Name: value})
+			node = &info.Nodes[len(info.Nodes)-1]
+			continue
+		}
+		if node == nil {
+			continue
+		}
+		switch key {
+		case "Endpoint":
+			node.Endpoint = value
+		case "Status":
+			node.Status = value
+		case "Buildkit", "BuildKit version":
+			node.Buildkit = value
+		case "Platforms":
+			for _, p := range strings.Split(value, ",") {
+				// A trailing asterisk marks platforms set by the user.
+				if p = strings.TrimSuffix(strings.TrimSpace(p), "*"); p != "" {
+					node.Platforms = append(node.Platforms, p)
+				}
+			}
+		}
+	}
+
+	if info.Name == "" {
+		return nil, errors.New("failed to parse docker buildx inspect output")
+	}
+	return info, nil
+}
+
+// dockerMountEnv describes the environment of the docker client and daemon
+// that affects how host paths must be written in bind mounts.
+type dockerMountEnv struct {
+	GOOS          string // OS of the docker client (runtime.GOOS).
+	WSL           bool   // Client runs inside of WSL2.
+	DockerDesktop bool   // Daemon is provided by Docker Desktop.
+	Boot2Docker   bool   // Daemon runs in a boot2docker VM.
+	WindowsDaemon bool   // Daemon runs Windows containers.
+	RemoteDaemon  bool   // Daemon is on another machine.
+	Endpoint      string // Endpoint of the daemon.
+	Rootless      bool   // Daemon runs as an unprivileged user.
+}
+
+// windowsDrivePath matches absolute Windows paths like C:\Users\elastic.
+var windowsDrivePath = regexp.MustCompile(`^([A-Za-z]):(?:[\\/](.*))?$`)
+
+// wslDrivePath matches the mount points of Windows drives in WSL like
+// /mnt/c/Users/elastic.
+var wslDrivePath = regexp.MustCompile(`^/mnt/([a-z])(/.*)?$`)
+
+// detectDockerMountEnv inspects the local machine and the Docker daemon.
+func detectDockerMountEnv() (dockerMountEnv, error) {
+	info, err := GetDockerInfo()
+	if err != nil {
+		return dockerMountEnv{}, errors.Wrap(err, "failed to get docker info")
+	}
+
+	return dockerMountEnv{
+		GOOS:          runtime.GOOS,
+		WSL:           isWSL(),
+		DockerDesktop: info.OperatingSystem == "Docker Desktop",
+		Boot2Docker:   info.IsBoot2Docker(),
+		WindowsDaemon: info.IsWindowsDaemon(),
+		RemoteDaemon:  info.IsRemoteDaemon(),
+		Endpoint:      info.ContextEndpoint,
+		Rootless:      info.IsRootless(),
+	}, nil
+}
+
+// isWSL returns true if the process runs inside of the Windows Subsystem for
+// Linux.
+func isWSL() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	if os.Getenv("WSL_DISTRO_NAME") != "" {
+		return true
+	}
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	return err == nil && strings.Contains(strings.ToLower(string(release)), "microsoft")
+}
+
+// DockerMountPath returns hostPath in the form that must be used as the
+// source of a bind mount (docker run -v) for the current environment. On
+// native Linux and macOS the absolute path is used as is. Windows paths are
+// given as drive-letter paths with forward slashes (C:/src/beats), or as
+// /c/src/beats for boot2docker. Windows drives mounted in WSL2 (/mnt/c) are
+// translated to the location where Docker Desktop exposes them.
+func DockerMountPath(hostPath string) (string, error) {
+	abs, err := filepath.Abs(hostPath)
+	if err != nil {
+		return "", err
+	}
+
+	env, err := detectDockerMountEnv()
+	if err != nil {
+		return "", err
+	}
+	return env.mountPath(abs)
+}
+
+// CheckDockerMountPath returns an error if hostPath does not exist or if it
+// is outside of the directories that the Docker daemon shares with the host
+// by default (e.g. /Users for Docker Desktop on macOS and boot2docker).
+func CheckDockerMountPath(hostPath string) error {
+	abs, err := filepath.Abs(hostPath)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(abs); err != nil {
+		return errors.Wrap(err, "invalid docker mount path")
+	}
+
+	env, err := detectDockerMountEnv()
+	if err != nil {
+		return err
+	}
+	return env.checkShared(abs)
+}
+
+func (e dockerMountEnv) mountPath(hostPath string) (string, error) {
+	if e.RemoteDaemon {
+		return "", errors.Errorf("cannot bind mount %v because the docker daemon "+
+			"at %v is remote; copy the files into a volume (docker volume create "+
+			"and docker cp) or into the image instead", hostPath, e.Endpoint)
+	}
+
+	if e.GOOS == "windows" {
+		m := windowsDrivePath.FindStringSubmatch(hostPath)
+		if m == nil {
+			return "", errors.Errorf("%v is not an absolute path with a drive letter", hostPath)
+		}
+		drive, rest := m[1], strings.Replace(m[2], `\`, "/", -1)
+
+		switch {
+		case e.WindowsDaemon:
+			return strings.ToUpper(drive) + `:\` + strings.Replace(rest, "/", `\`, -1), nil
+		case e.Boot2Docker:
+			return path.Join("/", strings.ToLower(drive), rest), nil
+		default:
+			return strings.ToUpper(drive) + ":" + path.Join("/", rest), nil
+		}
+	}
+
+	hostPath = path.Clean(hostPath)
+	if !path.IsAbs(hostPath) {
+		return "", errors.Errorf("%v is not an absolute path", hostPath)
+	}
+	if e.WSL && e.DockerDesktop {
+		if m := wslDrivePath.FindStringSubmatch(hostPath); m != nil {
+			return path.Join("/run/desktop/mnt/host", m[1], m[2]), nil
+		}
+	}
+	return hostPath, nil
+}
+
+// dockerDesktopMacShares are the directories shared by Docker Desktop for Mac
+// in its default configuration.
+var dockerDesktopMacShares = []string{"/Users", "/Volumes", "/private", "/tmp", "/var/folders"}
+
+func (e dockerMountEnv) checkShared(hostPath string) error {
+	if e.RemoteDaemon {
+		return errors.Errorf("%v cannot be shared with the remote docker daemon at %v", hostPath, e.Endpoint)
+	}
+
+	var shares []string
+	switch {
+	case e.Boot2Docker && e.GOOS == "windows":
+		shares = []string{`C:\Users`}
+	case e.Boot2Docker:
+		shares = []string{"/Users"}
+	case e.DockerDesktop && e.GOOS == "darwin":
+		shares = dockerDesktopMacShares
+	default:
+		return nil
+	}
+
+	for _, share := range shares {
+		if hasPathPrefix(hostPath, share, e.GOOS == "windows") {
+			return nil
+		}
+	}
+	return errors.Errorf("%v is not shared with the docker daemon (shared "+
+		"directories: %v); move it or add it to the daemon's file sharing "+
+		"settings", hostPath, strings.Join(shares, ", "))
+}
+
+// hasPathPrefix returns true if p is dir or is contained in dir. Windows
+// paths are compared case-insensitively.
+func hasPathPrefix(p, dir string, windows bool) bool {
+	sep := "/"
+	if windows {
+		p, dir, sep = strings.ToLower(p), strings.ToLower(dir), `\`
+	}
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, sep)+sep)
+}
+
+// DockerDiskUsageInfo describes the disk space used by docker as reported by
+// "docker system df".
+type DockerDiskUsageInfo struct {
+	Images     DockerDiskUsageEntry
+	Containers DockerDiskUsageEntry
+	Volumes    DockerDiskUsageEntry
+	BuildCache DockerDiskUsageEntry
+}
+
+// DockerDiskUsageEntry is the disk usage of one type of docker object. Sizes
+// are in bytes.
+type DockerDiskUsageEntry struct {
+	TotalCount  int
+	Active      int
+	Size        int64
+	Reclaimable int64
+}
+
+// DockerDiskUsage returns the disk space used by images, containers, volumes,
+// and the build cache.
+func DockerDiskUsage() (*DockerDiskUsageInfo, error) {
+	return dockerDiskUsage(context.Background())
+}
+
+func dockerDiskUsage(ctx context.Context) (*DockerDiskUsageInfo, error) {
+	out, err := Cmd{Args: []string{"docker", "system", "df", "--format", "{{json .}}"}}.OutputContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return parseDockerDiskUsage(out.Stdout)
+}
+
+// parseDockerDiskUsage parses the output of "docker system df" which contains
+// one JSON object per type of object.
+func parseDockerDiskUsage(output string) (*DockerDiskUsageInfo, error) {
+	usage := &DockerDiskUsageInfo{}
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		var row struct {
+			Type        string
+			TotalCount  string
+			Active      string
+			Size        string
+			Reclaimable string
+		}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			return nil, errors.Wrap(err, "failed to parse docker system df output")
+		}
+
+		var entry *DockerDiskUsageEntry
+		switch row.Type {
+		case "Images":
+			entry = &usage.Images
+		case "Containers":
+			entry = &usage.Containers
+		case "Local Volumes":
+			entry = &usage.Volumes
+		case "Build Cache":
+			entry = &usage.BuildCache
+		default:
+			continue
+		}
+
+		var err error
+		if entry.TotalCount, err = strconv.Atoi(row.TotalCount); err != nil {
+			return nil, errors.Wrapf(err, "invalid %v count", row.Type)
+		}
+		if entry.Active, err = strconv.Atoi(row.Active); err != nil {
+			return nil, errors.Wrapf(err, "invalid %v active count", row.Type)
+		}
+		if entry.Size, err = parseDockerSize(row.Size); err != nil {
+			return nil, err
+		}
+		// Reclaimable contains a percentage, e.g. "1.2GB (50%)".
+		if entry.Reclaimable, err = parseDockerSize(strings.SplitN(row.Reclaimable, " ", 2)[0]); err != nil {
+			return nil, err
+		}
+	}
+	return usage, nil
+}
+
+// dockerSizeRegexp matches sizes formatted by docker (e.g. 1.5GB or 0B).
+var dockerSizeRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([kKMGTP]?B)$`)
+
+// parseDockerSize converts a size in decimal units, as printed by docker, to
+// bytes.
+func parseDockerSize(s string) (int64, error) {
+	m := dockerSizeRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, errors.Errorf("invalid docker size %q", s)
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid docker size %q", s)
+	}
+
+	multiplier := map[string]float64{
+		"B":  1,
+		"kB": 1e3,
+		"KB": 1e3,
+		"MB": 1e6,
+		"GB": 1e9,
+		"TB": 1e12,
+		"PB": 1e15,
+	}[m[2]]
+	return int64(value * multiplier), nil
+}
+
+// DockerPruneOptions controls what DockerPrune removes.
+type DockerPruneOptions struct {
+	// OlderThan limits the pruning to dangling images and build cache that
+	// are older than the given age. Zero removes everything that is unused.
+	OlderThan time.Duration
+
+	// DryRun only reports what would be removed.
+	DryRun bool
+}
+
+// DockerPrune removes dangling images and unused build cache and returns the
+// number of bytes that were reclaimed (or that would be reclaimed in dry-run
+// mode). Nothing is removed when the DOCKER_PRUNE_DISABLE environment
+// variable is set so that shared machines can opt out.
+func DockerPrune(opts DockerPruneOptions) (int64, error) {
+	return dockerPrune(context.Background(), opts)
+}
+
+func dockerPrune(ctx context.Context, opts DockerPruneOptions) (int64, error) {
+	if os.Getenv("DOCKER_PRUNE_DISABLE") != "" {
+		LoggerFromContext(ctx).Info("Skipping docker prune because DOCKER_PRUNE_DISABLE is set")
+		return 0, nil
+	}
+
+	var filter []string
+	if opts.OlderThan > 0 {
+		filter = []string{"--filter", "until=" + opts.OlderThan.String()}
+	}
+
+	if opts.DryRun {
+		images, err := danglingImagesSize(ctx, opts.OlderThan)
+		if err != nil {
+			return 0, err
+		}
+		out, err := Cmd{Args: append([]string{"docker", "buildx", "du"}, filter...)}.OutputContext(ctx)
+		if err != nil {
+			return 0, err
+		}
+		cache, err := parseReclaimed(out.Stdout, "Reclaimable:")
+		if err != nil {
+			return 0, err
+		}
+		LoggerFromContext(ctx).Infof("Docker prune would reclaim %v (images: %v, build cache: %v)",
+			HumanSize(images+cache), HumanSize(images), HumanSize(cache))
+		return images + cache, nil
+	}
+
+	out, err := Cmd{Args: append([]string{"docker", "image", "prune", "--force"}, filter...)}.OutputContext(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to prune docker images")
+	}
+	images, err := parseReclaimed(out.Stdout, "Total reclaimed space:")
+	if err != nil {
+		return 0, err
+	}
+
+	out, err = Cmd{Args: append([]string{"docker", "builder", "prune", "--force"}, filter...)}.OutputContext(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to prune docker build cache")
+	}
+	cache, err := parseReclaimed(out.Stdout, "Total:", "Total reclaimed space:")
+	if err != nil {
+		return 0, err
+	}
+
+	LoggerFromContext(ctx).Infof("Docker prune reclaimed %v (images: %v, build cache: %v)",
+		HumanSize(images+cache), HumanSize(images), HumanSize(cache))
+	return images + cache, nil
+}
+
+// danglingImagesSize returns the total size of the dangling images that were
+// created before the given age.
+func danglingImagesSize(ctx context.Context, olderThan time.Duration) (int64, error) {
+	out, err := Cmd{Args: []string{"docker", "image", "ls", "--filter", "dangling=true", "--format", "{{json .}}"}}.OutputContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, line := range strings.Split(out.Stdout, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		var image struct {
+			ID        string
+			CreatedAt string
+			Size      string
+		}
+		if err := json.Unmarshal([]byte(line), &image); err != nil {
+			return 0, errors.Wrap(err, "failed to parse docker image ls output")
+		}
+
+		if olderThan > 0 {
+			created, err := time.Parse("2006-01-02 15:04:05 -0700 MST", image.CreatedAt)
+			if err != nil {
+				return 0, errors.Wrapf(err, "invalid creation time of image %v", image.ID)
+			}
+			if time.Since(created) < olderThan {
+				continue
+			}
+		}
+
+		size, err := parseDockerSize(image.Size)
+		if err != nil {
+			return 0, err
+		}
+		LoggerFromContext(ctx).Infof("Would remove dangling image %v (%v)", image.ID, HumanSize(size))
+		total += size
+	}
+	return total, nil
+}
+
+// parseReclaimed returns the size from the first line of the output that
+// starts with one of the given labels. Zero is returned if there is none
+// because docker omits the total when nothing was removed.
+func parseReclaimed(output string, labels ...string) (int64, error) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		for _, label := range labels {
+			if strings.HasPrefix(line, label) {
+				return parseDockerSize(strings.TrimPrefix(line, label))
+			}
+		}
+	}
+	return 0, nil
+}
+
+// DockerRunOptions controls how DockerRun runs a container.
+type DockerRunOptions struct {
+	Args       []string          // Command and arguments to run in the container.
+	Workspace  string            // Host directory to mount. Defaults to the CWD.
+	WorkDir    string            // Mount point and working directory in the container. Defaults to /workspace.
+	Env        map[string]string // Environment variables to set in the container.
+	PassEnv    []string          // Names of host environment variables to pass through when they are set.
+	DockerArgs []string          // Additional arguments for docker run (e.g. --network host).
+}
+
+// stdinIsTerminal returns true if stdin is a terminal. Replaced in tests.
+var stdinIsTerminal = func() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// DockerRun runs a command in a new container of the given image. The
+// workspace is bind mounted (see DockerMountPath) and used as the working
+// directory. On a native Linux daemon the container runs with the UID and GID
+// of the current user so that the files it creates are owned by the user.
+// This is not done for Docker Desktop and boot2docker, whose file sharing
+// already maps ownership, or for rootless daemons, which map root in the
+// container to the current user. The container is interactive when stdin is
+// a terminal.
+func DockerRun(image string, opts DockerRunOptions) error {
+	return dockerRunContext(context.Background(), image, opts)
+}
+
+func dockerRunContext(ctx context.Context, image string, opts DockerRunOptions) error {
+	env, err := detectDockerMountEnv()
+	if err != nil {
+		return err
+	}
+
+	interactive := stdinIsTerminal()
+	args, err := dockerRunArgs(env, image, opts, interactive)
+	if err != nil {
+		return err
+	}
+
+	// The values of Env are given to the docker client through its environment
+	// so that they do not show up in the process list. The variables named by
+	// PassEnv are inherited from mage's environment and are never logged. An
+	// interactive session must show its output as it is produced.
+	return Cmd{Args: args, Env: opts.Env, Stream: interactive}.RunContext(ctx)
+}
+
+// dockerRunArgs returns the docker run command line for the environment.
+func dockerRunArgs(env dockerMountEnv, image string, opts DockerRunOptions, interactive bool) ([]string, error) {
+	workspace := opts.Workspace
+	if workspace == "" {
+		workspace = CWD()
+	}
+	mountPath, err := env.mountPath(workspace)
+	if err != nil {
+		return nil, err
+	}
+	workDir := opts.WorkDir
+	if workDir == "" {
+		workDir = "/workspace"
+	}
+
+	args := []string{"docker", "run", "--rm"}
+	if interactive {
+		args = append(args, "--interactive", "--tty")
+	}
+	if env.GOOS != "windows" && !env.DockerDesktop && !env.Boot2Docker && !env.Rootless && !env.WindowsDaemon {
+		args = append(args, "--user", strconv.Itoa(os.Getuid())+":"+strconv.Itoa(os.Getgid()))
+	}
+	args = append(args, "--volume", mountPath+":"+workDir, "--workdir", workDir)
+
+	// Only the names are given with --env. The docker client reads the values
+	// from its own environment.
+	for _, name := range opts.PassEnv {
+		if _, found := os.LookupEnv(name); found {
+			args = append(args, "--env", name)
+		}
+	}
+	names := make([]string, 0, len(opts.Env))
+	for name := range opts.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "--env", name)
+	}
+
+	args = append(args, opts.DockerArgs...)
+	args = append(args, image)
+	return append(args, opts.Args...), nil
+}
+
+// DockerCopyFromImage copies srcPath (a file or directory) from the image to
+// dstPath on the host without running the image. A stopped container is
+// created from the image, the path is copied with docker cp (which preserves
+// file modes), and the container is removed even if the copy fails.
+func DockerCopyFromImage(image, srcPath, dstPath string) error {
+	return dockerCopyFromImage(context.Background(), image, srcPath, dstPath)
+}
+
+func dockerCopyFromImage(ctx context.Context, image, srcPath, dstPath string) error {
+	return withDockerContainer(ctx, image, func(id string) error {
+		return Cmd{Args: []string{"docker", "cp", id + ":" + srcPath, dstPath}}.RunContext(ctx)
+	})
+}
+
+// DockerReadFileFromImage returns the contents of a small file contained in
+// the image without running the image or writing to disk. The file must be
+// smaller than CmdOutputLimit.
+func DockerReadFileFromImage(image, srcPath string) ([]byte, error) {
+	return dockerReadFileFromImage(context.Background(), image, srcPath)
+}
+
+func dockerReadFileFromImage(ctx context.Context, image, srcPath string) ([]byte, error) {
+	var data []byte
+	err := withDockerContainer(ctx, image, func(id string) error {
+		// With "-" as destination docker cp writes a tar stream to stdout.
+		out, err := Cmd{Args: []string{"docker", "cp", id + ":" + srcPath, "-"}}.OutputContext(ctx)
+		if err != nil {
+			return err
+		}
+		if out.Truncated {
+			return errors.Errorf("%v is larger than %v", srcPath, HumanSize(int64(CmdOutputLimit)))
+		}
+
+		tr := tar.NewReader(strings.NewReader(out.Stdout))
+		header, err := tr.Next()
+		if err != nil {
+			return errors.Wrap(err, "failed to read docker cp output")
+		}
+		if header.Typeflag != tar.TypeReg {
+			return errors.Errorf("%v is not a regular file", srcPath)
+		}
+		data, err = ioutil.ReadAll(tr)
+		return err
+	})
+	return data, err
+}
+
+// withDockerContainer creates a container from the image without starting it,
+// invokes fn with the container's ID, and then removes the container.
+func withDockerContainer(ctx context.Context, image string, fn func(id string) error) (err error) {
+	// The command is never run, but it is required for images that do not
+	// define one.
+	out, err := Cmd{Args: []string{"docker", "create", image, "mage-copy"}}.OutputContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create a container from %v", image)
+	}
+	id := strings.TrimSpace(out.Stdout)
+	if id == "" {
+		return errors.Errorf("docker create returned no container ID for %v", image)
+	}
+
+	defer func() {
+		// Use a fresh context so that the container is removed even when
+		// ctx was canceled.
+		rmCtx := WithRunner(context.Background(), RunnerFromContext(ctx))
+		if rmErr := (Cmd{Args: []string{"docker", "rm", "--force", id}}).RunContext(rmCtx); rmErr != nil {
+			LoggerFromContext(ctx).Warnf("Failed to remove container %v: %v", id, rmErr)
+			if err == nil {
+				err = rmErr
+			}
+		}
+	}()
+
+	return fn(id)
+}
@@ -0,0 +1,1283 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func readDockerInfoFixture(t testing.TB, name string) *DockerInfo {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "docker", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := parseDockerInfo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestDockerInfoFixtures(t *testing.T) {
+	linux := readDockerInfoFixture(t, "info-linux.json")
+	assert.Equal(t, "20.10.7", linux.ServerVersion)
+	assert.Equal(t, "aarch64", linux.Architecture)
+	assert.Equal(t, "linux", linux.OSType)
+	assert.Equal(t, "5.4.0-1048-aws", linux.KernelVersion)
+	assert.Equal(t, 16, linux.NCPU)
+	assert.False(t, linux.IsWindowsDaemon())
+	assert.False(t, linux.IsBoot2Docker())
+	assert.True(t, linux.ServerVersionAtLeast("20.10"))
+	assert.True(t, linux.ServerVersionAtLeast("20.10.7"))
+	assert.False(t, linux.ServerVersionAtLeast("20.10.8"))
+
+	desktop := readDockerInfoFixture(t, "info-desktop.json")
+	assert.Equal(t, "Docker Desktop", desktop.OperatingSystem)
+	assert.Equal(t, "x86_64", desktop.Architecture)
+	assert.False(t, desktop.IsWindowsDaemon())
+	assert.True(t, desktop.ServerVersionAtLeast("18.09"))
+	assert.False(t, desktop.ServerVersionAtLeast("20.10"))
+
+	windows := readDockerInfoFixture(t, "info-windows.json")
+	assert.Equal(t, "windows", windows.OSType)
+	assert.True(t, windows.IsWindowsDaemon())
+	assert.True(t, windows.ServerVersionAtLeast("20.10"))
+	assert.Equal(t, 2, windows.NCPU)
+}
+
+func TestDockerInfoServerVersionAtLeast(t *testing.T) {
+	info := &DockerInfo{ServerVersion: "18.09.1-ce"}
+	assert.True(t, info.ServerVersionAtLeast("18.09.1"))
+	assert.False(t, info.ServerVersionAtLeast("18.10"))
+
+	// Unparseable versions are never considered new enough.
+	info = &DockerInfo{ServerVersion: "dev"}
+	assert.False(t, info.ServerVersionAtLeast("1.0"))
+	info = &DockerInfo{ServerVersion: "20.10.7"}
+	assert.False(t, info.ServerVersionAtLeast("latest"))
+}
+
+func TestDockerInfoPodman(t *testing.T) {
+	info := readDockerInfoFixture(t, "info-podman.json")
+	assert.True(t, info.IsPodman())
+	assert.Equal(t, "fedora 37", info.OperatingSystem)
+	assert.Equal(t, 8, info.NCPU)
+	assert.Equal(t, 16480256000, info.MemTotal)
+	assert.Equal(t, "4.3.1", info.ServerVersion)
+	assert.Equal(t, "x86_64", info.Architecture)
+	assert.Equal(t, "linux", info.OSType)
+	assert.Equal(t, "6.0.15-300.fc37.x86_64", info.KernelVersion)
+	assert.False(t, info.IsWindowsDaemon())
+	assert.True(t, info.ServerVersionAtLeast("4.0"))
+
+	for _, name := range []string{"info-linux.json", "info-desktop.json", "info-windows.json"} {
+		assert.False(t, readDockerInfoFixture(t, name).IsPodman(), name)
+	}
+
+	_, err := parseDockerInfo([]byte("not json"))
+	assert.Error(t, err)
+}
+
+func TestDockerInfoContainerdImageStore(t *testing.T) {
+	info := readDockerInfoFixture(t, "info-containerd.json")
+	assert.True(t, info.IsContainerdImageStore())
+	assert.Equal(t, "overlayfs", info.Driver)
+
+	for _, name := range []string{"info-linux.json", "info-desktop.json", "info-windows.json", "info-podman.json"} {
+		assert.False(t, readDockerInfoFixture(t, name).IsContainerdImageStore(), name)
+	}
+}
+
+func TestDockerInfoRootless(t *testing.T) {
+	rootless := readDockerInfoFixture(t, "info-rootless.json")
+	assert.True(t, rootless.IsRootless())
+	assert.False(t, rootless.IsPodman())
+
+	podman := readDockerInfoFixture(t, "info-podman-rootless.json")
+	assert.True(t, podman.IsRootless())
+	assert.True(t, podman.IsPodman())
+	assert.Contains(t, podman.SecurityOptions, "name=seccomp")
+
+	for _, name := range []string{"info-linux.json", "info-desktop.json", "info-windows.json", "info-podman.json"} {
+		assert.False(t, readDockerInfoFixture(t, name).IsRootless(), name)
+	}
+}
+
+// resetDockerInfoCache clears the cached docker info. The probe, its retry
+// interval, and an empty cache are restored when the test completes.
+func resetDockerInfoCache(t testing.TB) {
+	probe, interval := dockerInfoProbe, dockerInfoRetryInterval
+	reset := func() {
+		dockerInfoCache.Lock()
+		dockerInfoCache.info, dockerInfoCache.err = nil, nil
+		dockerInfoCache.Unlock()
+	}
+	reset()
+	t.Cleanup(func() {
+		dockerInfoProbe, dockerInfoRetryInterval = probe, interval
+		reset()
+	})
+}
+
+func TestRootlessDocker(t *testing.T) {
+	resetDockerInfoCache(t)
+
+	var info *DockerInfo
+	dockerInfoProbe = func(context.Context) (*DockerInfo, error) {
+		if info == nil {
+			return nil, errors.New("daemon is not running")
+		}
+		return info, nil
+	}
+
+	ctx, buf := captureLog(InfoLevel)
+
+	_, _ = RefreshDockerInfo()
+	assert.False(t, rootlessDocker(ctx, "chown files"))
+
+	info = &DockerInfo{SecurityOptions: []string{"name=seccomp,profile=default"}}
+	_, _ = RefreshDockerInfo()
+	assert.False(t, rootlessDocker(ctx, "chown files"))
+	assert.Empty(t, buf.String())
+
+	info = &DockerInfo{SecurityOptions: []string{"name=rootless"}}
+	_, _ = RefreshDockerInfo()
+	assert.True(t, rootlessDocker(ctx, "chown files"))
+	assert.Contains(t, buf.String(), "rootless, adapting step: chown files")
+}
+
+func TestDockerInfoCheckResources(t *testing.T) {
+	const gib = 1 << 30
+	desktop := readDockerInfoFixture(t, "info-desktop.json")
+	assert.Equal(t, "1.9 GiB", desktop.MemTotalHuman())
+
+	assert.NoError(t, desktop.checkResources(DockerResources{CPUs: 2, Memory: gib}))
+	assert.NoError(t, desktop.checkResources(DockerResources{}))
+
+	err := desktop.checkResources(DockerResources{CPUs: 2, Memory: 4 * gib})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "1.9 GiB of memory is available but 4.0 GiB is required")
+		assert.Contains(t, err.Error(), "increase the Docker Desktop resources")
+		assert.NotContains(t, err.Error(), "CPUs are available")
+	}
+
+	linux := readDockerInfoFixture(t, "info-linux.json")
+	err = linux.checkResources(DockerResources{CPUs: 32})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "16 CPUs are available but 32 are required")
+		assert.Contains(t, err.Error(), "use a docker host with at least 32 CPUs")
+	}
+}
+
+func readBuildxInfoFixture(t testing.TB, name string) *BuildxInfo {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "docker", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := parseBuildxInfo(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestBuildxInfoDesktop(t *testing.T) {
+	info := readBuildxInfoFixture(t, "buildx-desktop.txt")
+	assert.Equal(t, "desktop-linux", info.Name)
+	assert.Equal(t, "docker", info.Driver)
+	if assert.Len(t, info.Nodes, 1) {
+		node := info.Nodes[0]
+		assert.Equal(t, "desktop-linux", node.Name)
+		assert.Equal(t, "running", node.Status)
+		assert.Equal(t, "v0.12.3", node.Buildkit)
+		assert.Len(t, node.Platforms, 12)
+	}
+
+	assert.True(t, info.SupportsPlatform("linux/arm64"))
+	assert.True(t, info.SupportsPlatform("linux/arm/v7"))
+	assert.True(t, info.SupportsPlatform("linux/arm"))
+	assert.False(t, info.SupportsPlatform("windows/amd64"))
+	assert.Empty(t, info.MissingPlatforms("linux/amd64", "linux/arm64", "linux/s390x"))
+}
+
+func TestBuildxInfoLinux(t *testing.T) {
+	info := readBuildxInfoFixture(t, "buildx-linux.txt")
+	assert.Equal(t, "default", info.Name)
+	assert.Equal(t, []string{"linux/amd64", "linux/amd64/v2", "linux/amd64/v3", "linux/386"}, info.Platforms())
+
+	// Without QEMU registered only the native platforms are available.
+	assert.Equal(t, []string{"linux/arm64", "linux/ppc64le"},
+		info.MissingPlatforms("linux/amd64", "linux/arm64", "linux/ppc64le"))
+}
+
+func TestParseBuildxInfo(t *testing.T) {
+	info, err := parseBuildxInfo(strings.Join([]string{
+		"Name:          multiarch",
+		"Driver:        docker-container",
+		"",
+		"Nodes:",
+		"Name:             multiarch0",
+		"Endpoint:         unix:///var/run/docker.sock",
+		"Status:           running",
+		"BuildKit version: v0.13.0",
+		"Platforms:        linux/amd64*, linux/arm64*",
+		"Name:             multiarch1",
+		"Endpoint:         ssh://builder",
+		"Status:           inactive",
+		"Platforms:        linux/arm64, linux/arm/v7",
+	}, "\r\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "docker-container", info.Driver)
+	if assert.Len(t, info.Nodes, 2) {
+		assert.Equal(t, "v0.13.0", info.Nodes[0].Buildkit)
+		assert.Equal(t, "inactive", info.Nodes[1].Status)
+	}
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64", "linux/arm/v7"}, info.Platforms())
+
+	_, err = parseBuildxInfo("ERROR: no builder found")
+	assert.Error(t, err)
+}
+
+// dockerInfoHandler serves the /info route of the Docker API using the given
+// fixture.
+func dockerInfoHandler(t testing.TB, fixture string) http.Handler {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "docker", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/info" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+func TestDockerAPIInfoTCP(t *testing.T) {
+	server := httptest.NewServer(dockerInfoHandler(t, "info-linux.json"))
+	defer server.Close()
+
+	config := dockerAPIConfig{Host: "tcp://" + strings.TrimPrefix(server.URL, "http://")}
+	info, err := dockerAPIInfo(context.Background(), config)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "20.10.7", info.ServerVersion)
+		assert.Equal(t, 16, info.NCPU)
+	}
+}
+
+func TestDockerAPIInfoUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not used on Windows")
+	}
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(dockerInfoHandler(t, "info-desktop.json"))
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	info, err := dockerAPIInfo(context.Background(), dockerAPIConfig{Host: "unix://" + socket})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Docker Desktop", info.OperatingSystem)
+	}
+}
+
+func TestDockerAPIInfoTLS(t *testing.T) {
+	server := httptest.NewTLSServer(dockerInfoHandler(t, "info-windows.json"))
+	defer server.Close()
+
+	certPath, cleanup := tempDir(t)
+	defer cleanup()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(filepath.Join(certPath, "ca.pem"), ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := dockerAPIConfig{
+		Host:      "tcp://" + strings.TrimPrefix(server.URL, "https://"),
+		TLSVerify: true,
+		CertPath:  certPath,
+	}
+	info, err := dockerAPIInfo(context.Background(), config)
+	if assert.NoError(t, err) {
+		assert.True(t, info.IsWindowsDaemon())
+	}
+
+	// Verification fails without the CA.
+	config.CertPath = filepath.Join(certPath, "missing")
+	_, err = dockerAPIInfo(context.Background(), config)
+	assert.Error(t, err)
+}
+
+func TestDockerAPIInfoErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	_, err := dockerAPIInfo(context.Background(), dockerAPIConfig{Host: "tcp://" + strings.TrimPrefix(server.URL, "http://")})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "404")
+	}
+
+	_, err = dockerAPIInfo(context.Background(), dockerAPIConfig{Host: "npipe:////./pipe/docker_engine"})
+	assert.Error(t, err)
+}
+
+func TestGetDockerInfoRefresh(t *testing.T) {
+	var probes int32
+	var available atomic.Value
+	available.Store(false)
+	resetDockerInfoCache(t)
+
+	dockerInfoProbe = func(context.Context) (*DockerInfo, error) {
+		atomic.AddInt32(&probes, 1)
+		if !available.Load().(bool) {
+			return nil, errors.New("daemon is not running")
+		}
+		return &DockerInfo{NCPU: 2}, nil
+	}
+	dockerInfoRetryInterval = time.Hour
+
+	// Concurrent callers share a single probe and the error is cached.
+	getAll := func() []error {
+		errs := make([]error, 10)
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = HaveDocker()
+			}(i)
+		}
+		wg.Wait()
+		return errs
+	}
+	for _, err := range getAll() {
+		assert.Error(t, err)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&probes))
+
+	// The daemon comes up. The cached error is used until it is refreshed.
+	available.Store(true)
+	assert.Error(t, HaveDocker())
+
+	info, err := RefreshDockerInfo()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, info.NCPU)
+	}
+	for _, err := range getAll() {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&probes))
+
+	// Errors are re-probed automatically once the interval passes.
+	dockerInfoRetryInterval = 0
+	available.Store(false)
+	if _, err = RefreshDockerInfo(); !assert.Error(t, err) {
+		return
+	}
+	available.Store(true)
+	assert.NoError(t, HaveDocker())
+	assert.EqualValues(t, 4, atomic.LoadInt32(&probes))
+}
+
+// slowRunner is a Runner that sleeps before returning the scripted result.
+type slowRunner struct {
+	fakeRunner
+	delay time.Duration
+}
+
+func (r *slowRunner) Output(ctx context.Context, c Cmd) (CmdOutput, error) {
+	select {
+	case <-time.After(r.delay):
+		return r.fakeRunner.Output(ctx, c)
+	case <-ctx.Done():
+		return CmdOutput{}, ctx.Err()
+	}
+}
+
+func TestGetDockerInfoTimeout(t *testing.T) {
+	resetDockerInfoCache(t)
+	defer os.Unsetenv("DEV_TOOLS_DOCKER_INFO_TIMEOUT")
+	defer os.Setenv("DOCKER_HOST", os.Getenv("DOCKER_HOST"))
+	os.Setenv("DEV_TOOLS_DOCKER_INFO_TIMEOUT", "50ms")
+	os.Setenv("DOCKER_HOST", "tcp://192.0.2.1:2376")
+
+	runner := &slowRunner{delay: time.Minute}
+	dockerInfoProbe = func(ctx context.Context) (*DockerInfo, error) {
+		return dockerCLIInfo(WithRunner(ctx, runner))
+	}
+	dockerInfoRetryInterval = time.Hour
+
+	start := time.Now()
+	_, err := RefreshDockerInfo()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out after 50ms")
+		assert.Contains(t, err.Error(), "DOCKER_HOST=tcp://192.0.2.1:2376")
+	}
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	// Later callers see the same detailed error.
+	err = HaveDocker()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out after 50ms")
+	}
+}
+
+func TestDockerMountPath(t *testing.T) {
+	var (
+		linux       = dockerMountEnv{GOOS: "linux"}
+		mac         = dockerMountEnv{GOOS: "darwin", DockerDesktop: true}
+		windows     = dockerMountEnv{GOOS: "windows", DockerDesktop: true}
+		windowsCtr  = dockerMountEnv{GOOS: "windows", DockerDesktop: true, WindowsDaemon: true}
+		wslDesktop  = dockerMountEnv{GOOS: "linux", WSL: true, DockerDesktop: true}
+		wslNative   = dockerMountEnv{GOOS: "linux", WSL: true}
+		boot2docker = dockerMountEnv{GOOS: "windows", Boot2Docker: true}
+	)
+
+	cases := []struct {
+		env      dockerMountEnv
+		hostPath string
+		expected string
+	}{
+		{linux, "/home/ci/src/beats/", "/home/ci/src/beats"},
+		{mac, "/Users/elastic/src/beats", "/Users/elastic/src/beats"},
+		{windows, `C:\Users\elastic\src\beats`, "C:/Users/elastic/src/beats"},
+		{windows, `d:\`, "D:/"},
+		{windowsCtr, `c:\src\beats`, `C:\src\beats`},
+		{wslDesktop, "/mnt/c/Users/elastic/beats", "/run/desktop/mnt/host/c/Users/elastic/beats"},
+		{wslDesktop, "/home/elastic/beats", "/home/elastic/beats"},
+		{wslNative, "/mnt/c/Users/elastic/beats", "/mnt/c/Users/elastic/beats"},
+		{boot2docker, `C:\Users\elastic\beats`, "/c/Users/elastic/beats"},
+	}
+	for _, tc := range cases {
+		p, err := tc.env.mountPath(tc.hostPath)
+		if assert.NoError(t, err, "%+v %v", tc.env, tc.hostPath) {
+			assert.Equal(t, tc.expected, p, "%+v %v", tc.env, tc.hostPath)
+		}
+	}
+
+	_, err := windows.mountPath(`\\server\share\beats`)
+	assert.Error(t, err)
+	_, err = linux.mountPath("relative/beats")
+	assert.Error(t, err)
+}
+
+func TestDockerMountPathShared(t *testing.T) {
+	mac := dockerMountEnv{GOOS: "darwin", DockerDesktop: true}
+	assert.NoError(t, mac.checkShared("/Users/elastic/beats"))
+	assert.NoError(t, mac.checkShared("/private/var/tmp"))
+	assert.Error(t, mac.checkShared("/opt/beats"))
+	assert.Error(t, mac.checkShared("/Usersfoo/beats"))
+
+	b2dMac := dockerMountEnv{GOOS: "darwin", Boot2Docker: true}
+	assert.NoError(t, b2dMac.checkShared("/Users/elastic/beats"))
+	assert.Error(t, b2dMac.checkShared("/Volumes/data/beats"))
+
+	b2dWindows := dockerMountEnv{GOOS: "windows", Boot2Docker: true}
+	assert.NoError(t, b2dWindows.checkShared(`c:\users\elastic\beats`))
+	assert.Error(t, b2dWindows.checkShared(`D:\beats`))
+
+	for _, env := range []dockerMountEnv{
+		{GOOS: "linux"},
+		{GOOS: "linux", WSL: true, DockerDesktop: true},
+		{GOOS: "windows", DockerDesktop: true},
+	} {
+		assert.NoError(t, env.checkShared("/anywhere"), "%+v", env)
+	}
+}
+
+// writeDockerConfig writes a docker config.json to a temporary dir and points
+// DOCKER_CONFIG to it.
+func writeDockerConfig(t testing.TB, config string) (cleanup func()) {
+	dir, rmDir := tempDir(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	prev, hadPrev := os.LookupEnv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+	return func() {
+		if hadPrev {
+			os.Setenv("DOCKER_CONFIG", prev)
+		} else {
+			os.Unsetenv("DOCKER_CONFIG")
+		}
+		rmDir()
+	}
+}
+
+// registryHandler serves a registry v2 endpoint that accepts the given basic
+// auth credentials. With bearer it uses token authentication like Docker Hub.
+func registryHandler(username, password string, bearer bool) http.Handler {
+	mux := http.NewServeMux()
+	authorized := func(r *http.Request) bool {
+		u, p, ok := r.BasicAuth()
+		return ok && u == username && p == password
+	}
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if bearer {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="http://`+r.Host+`/token",service="registry.test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("service") != "registry.test" || !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"token":"abc"}`))
+	})
+	return mux
+}
+
+func TestDockerLogin(t *testing.T) {
+	defer writeDockerConfig(t, `{"auths":{"docker.elastic.co":{}}}`)()
+	for _, name := range []string{"MAGE_TEST_DOCKER_USER", "MAGE_TEST_DOCKER_PASS"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv("MAGE_TEST_DOCKER_USER", "builder")
+	os.Setenv("MAGE_TEST_DOCKER_PASS", "s3cret")
+
+	fake := &fakeRunner{}
+	ctx := WithRunner(context.Background(), fake)
+	err := DockerLoginContext(ctx, "docker.elastic.co", "MAGE_TEST_DOCKER_USER", "MAGE_TEST_DOCKER_PASS",
+		DockerLoginOptions{VerifyStored: true})
+	if assert.NoError(t, err) && assert.Len(t, fake.Calls(), 1) {
+		call := fake.Calls()[0]
+		assert.Equal(t, []string{"docker", "login", "--username", "builder", "--password-stdin", "docker.elastic.co"}, call.Args)
+		assert.Equal(t, "s3cret", call.Stdin)
+	}
+
+	// Docker did not store credentials for the registry.
+	fake = &fakeRunner{}
+	err = DockerLoginContext(WithRunner(context.Background(), fake), "", "MAGE_TEST_DOCKER_USER", "MAGE_TEST_DOCKER_PASS",
+		DockerLoginOptions{VerifyStored: true})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Docker Hub")
+		assert.NotContains(t, err.Error(), "s3cret")
+	}
+
+	// Credentials are checked before docker is invoked.
+	os.Unsetenv("MAGE_TEST_DOCKER_PASS")
+	fake = &fakeRunner{}
+	err = DockerLoginContext(WithRunner(context.Background(), fake), "", "MAGE_TEST_DOCKER_USER", "MAGE_TEST_DOCKER_PASS",
+		DockerLoginOptions{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "MAGE_TEST_DOCKER_PASS")
+	}
+	assert.Empty(t, fake.Calls())
+}
+
+func TestDockerLoginSkipIfAuthenticated(t *testing.T) {
+	for _, bearer := range []bool{false, true} {
+		srv := httptest.NewServer(registryHandler("builder", "s3cret", bearer))
+		registry := srv.URL
+		host := strings.TrimPrefix(srv.URL, "http://")
+
+		for _, password := range []string{"s3cret", "expired"} {
+			auth := base64.StdEncoding.EncodeToString([]byte("builder:" + password))
+			cleanup := writeDockerConfig(t, `{"auths":{"`+host+`":{"auth":"`+auth+`"}}}`)
+
+			ok, err := dockerRegistryAuthenticated(context.Background(), registry)
+			assert.NoError(t, err)
+			assert.Equal(t, password == "s3cret", ok, "bearer=%v password=%v", bearer, password)
+
+			// Login is only executed when the stored credentials are rejected.
+			fake := &fakeRunner{}
+			os.Setenv("MAGE_TEST_DOCKER_USER", "builder")
+			os.Setenv("MAGE_TEST_DOCKER_PASS", "s3cret")
+			err = DockerLoginContext(WithRunner(context.Background(), fake), registry,
+				"MAGE_TEST_DOCKER_USER", "MAGE_TEST_DOCKER_PASS", DockerLoginOptions{SkipIfAuthenticated: true})
+			os.Unsetenv("MAGE_TEST_DOCKER_USER")
+			os.Unsetenv("MAGE_TEST_DOCKER_PASS")
+			if assert.NoError(t, err) {
+				if password == "s3cret" {
+					assert.Empty(t, fake.Calls())
+				} else if assert.Len(t, fake.Calls(), 1) {
+					assert.Equal(t, host, fake.Calls()[0].Args[5])
+				}
+			}
+			cleanup()
+		}
+		srv.Close()
+	}
+}
+
+func TestDockerStoredCredentialsHelper(t *testing.T) {
+	defer writeDockerConfig(t, `{"credsStore":"desktop","credHelpers":{"gcr.io":"gcloud"}}`)()
+
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"docker-credential-desktop get": {Stdout: `{"ServerURL":"docker.elastic.co","Username":"builder","Secret":"s3cret"}`},
+		"docker-credential-gcloud get":  {Err: errors.New("credentials not found in native keychain")},
+	}}
+	ctx := WithRunner(context.Background(), fake)
+
+	username, secret, found, err := dockerStoredCredentials(ctx, "docker.elastic.co")
+	if assert.NoError(t, err) {
+		assert.True(t, found)
+		assert.Equal(t, "builder", username)
+		assert.Equal(t, "s3cret", secret)
+	}
+
+	_, _, found, err = dockerStoredCredentials(ctx, "gcr.io")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	if calls := fake.Calls(); assert.Len(t, calls, 2) {
+		assert.Equal(t, "docker.elastic.co", calls[0].Stdin)
+		assert.Equal(t, "gcr.io", calls[1].Stdin)
+	}
+}
+
+func TestDockerRegistryEndpoint(t *testing.T) {
+	assert.Equal(t, "https://registry-1.docker.io/v2/", dockerRegistryEndpoint(""))
+	assert.Equal(t, "https://docker.elastic.co/v2/", dockerRegistryEndpoint("docker.elastic.co"))
+	assert.Equal(t, "https://docker.elastic.co/v2/", dockerRegistryEndpoint("docker.elastic.co/beats"))
+	assert.Equal(t, "http://localhost:5000/v2/", dockerRegistryEndpoint("http://localhost:5000/"))
+	assert.Equal(t, "localhost:5000", dockerRegistryHost("http://localhost:5000/"))
+}
+
+func TestHaveDockerImage(t *testing.T) {
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"docker image inspect --format {{.Id}} missing:1.0": {
+			Err: errors.New("exit status 1: Error: No such image: missing:1.0"),
+		},
+		"docker image inspect --format {{.Id}} broken:1.0": {
+			Err: errors.New("exit status 1: Cannot connect to the Docker daemon"),
+		},
+	}}
+	ctx := WithRunner(context.Background(), fake)
+
+	found, err := haveDockerImage(ctx, "golang:1.14")
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = haveDockerImage(ctx, "missing:1.0")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	_, err = haveDockerImage(ctx, "broken:1.0")
+	assert.Error(t, err)
+}
+
+// sequenceRunner is a Runner that returns the scripted errors in order and
+// then succeeds.
+type sequenceRunner struct {
+	fakeRunner
+	errs []error
+}
+
+func (r *sequenceRunner) Output(ctx context.Context, c Cmd) (CmdOutput, error) {
+	out, err := r.fakeRunner.Output(ctx, c)
+	if err == nil && len(r.errs) > 0 {
+		err, r.errs = r.errs[0], r.errs[1:]
+	}
+	return out, err
+}
+
+func TestDockerPullRetries(t *testing.T) {
+	defer func(backoff time.Duration) { dockerPullBackoff = backoff }(dockerPullBackoff)
+	dockerPullBackoff = time.Millisecond
+	ctx, buf := captureLog(WarnLevel)
+
+	runner := &sequenceRunner{errs: []error{
+		errors.New("toomanyrequests: You have reached your pull rate limit."),
+		errors.New("Get https://registry-1.docker.io/v2/: net/http: TLS handshake timeout"),
+	}}
+	err := dockerPull(WithRunner(ctx, runner), "golang:1.14")
+	assert.NoError(t, err)
+	if calls := runner.Calls(); assert.Len(t, calls, 3) {
+		assert.Equal(t, []string{"docker", "pull", "--quiet", "golang:1.14"}, calls[2].Args)
+	}
+	assert.Equal(t, 2, strings.Count(buf.String(), "WARN: Attempt"))
+
+	// Permanent errors are not retried.
+	runner = &sequenceRunner{errs: []error{errors.New("manifest for golang:0.0 not found: manifest unknown")}}
+	err = dockerPull(WithRunner(ctx, runner), "golang:0.0")
+	assert.Error(t, err)
+	assert.Len(t, runner.Calls(), 1)
+}
+
+func TestEnsureDockerImage(t *testing.T) {
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"docker image inspect --format {{.Id}} missing:1.0": {Err: errors.New("Error: No such image: missing:1.0")},
+	}}
+	ctx := WithRunner(context.Background(), fake)
+
+	assert.NoError(t, ensureDockerImage(ctx, "present:1.0"))
+	assert.NoError(t, ensureDockerImage(ctx, "missing:1.0"))
+
+	var commands []string
+	for _, call := range fake.Calls() {
+		commands = append(commands, strings.Join(call.Args, " "))
+	}
+	assert.Equal(t, []string{
+		"docker image inspect --format {{.Id}} present:1.0",
+		"docker image inspect --format {{.Id}} missing:1.0",
+		"docker pull --quiet missing:1.0",
+	}, commands)
+}
+
+func TestDockerDiskUsage(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "docker", "system-df.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"docker system df --format {{json .}}": {Stdout: string(data)},
+	}}
+
+	usage, err := dockerDiskUsage(WithRunner(context.Background(), fake))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, DockerDiskUsageEntry{TotalCount: 31, Active: 12, Size: 7446000000, Reclaimable: 3127000000}, usage.Images)
+	assert.Equal(t, DockerDiskUsageEntry{TotalCount: 2, Active: 1, Size: 2092, Reclaimable: 1046}, usage.Containers)
+	assert.Equal(t, DockerDiskUsageEntry{TotalCount: 3, Active: 3, Size: 412300000}, usage.Volumes)
+	assert.Equal(t, DockerDiskUsageEntry{TotalCount: 148, Size: 5381000000, Reclaimable: 5381000000}, usage.BuildCache)
+
+	for _, invalid := range []string{"1.5XB", "GB", ""} {
+		_, err = parseDockerSize(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestDockerPrune(t *testing.T) {
+	defer os.Setenv("DOCKER_PRUNE_DISABLE", os.Getenv("DOCKER_PRUNE_DISABLE"))
+	os.Unsetenv("DOCKER_PRUNE_DISABLE")
+	ctx, buf := captureLog(InfoLevel)
+
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"docker image prune --force --filter until=24h0m0s": {
+			Stdout: "Deleted Images:\ndeleted: sha256:1a2b\n\nTotal reclaimed space: 1.5GB",
+		},
+		"docker builder prune --force --filter until=24h0m0s": {
+			Stdout: "ID\t\t\t\t\t\tRECLAIMABLE\tSIZE\t\tLAST ACCESSED\nx5kv3rfj0\ttrue\t\t500MB\t\t2 days ago\nTotal:\t500MB",
+		},
+	}}
+	reclaimed, err := dockerPrune(WithRunner(ctx, fake), DockerPruneOptions{OlderThan: 24 * time.Hour})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 2000000000, reclaimed)
+	}
+	assert.Len(t, fake.Calls(), 2)
+	assert.Contains(t, buf.String(), "Docker prune reclaimed 1.9 GiB")
+
+	// Opted out.
+	os.Setenv("DOCKER_PRUNE_DISABLE", "1")
+	fake = &fakeRunner{}
+	reclaimed, err = dockerPrune(WithRunner(ctx, fake), DockerPruneOptions{})
+	assert.NoError(t, err)
+	assert.Zero(t, reclaimed)
+	assert.Empty(t, fake.Calls())
+	assert.Contains(t, buf.String(), "Skipping docker prune")
+}
+
+func TestDockerPruneDryRun(t *testing.T) {
+	defer os.Setenv("DOCKER_PRUNE_DISABLE", os.Getenv("DOCKER_PRUNE_DISABLE"))
+	os.Unsetenv("DOCKER_PRUNE_DISABLE")
+	ctx, _ := captureLog(WarnLevel)
+
+	old := time.Now().Add(-72 * time.Hour).Format("2006-01-02 15:04:05 -0700 MST")
+	recent := time.Now().Add(-time.Hour).Format("2006-01-02 15:04:05 -0700 MST")
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"docker image ls --filter dangling=true --format {{json .}}": {Stdout: strings.Join([]string{
+			`{"ID":"1a2b","Repository":"<none>","Tag":"<none>","CreatedAt":"` + old + `","Size":"300MB"}`,
+			`{"ID":"3c4d","Repository":"<none>","Tag":"<none>","CreatedAt":"` + recent + `","Size":"1GB"}`,
+		}, "\n")},
+		"docker buildx du --filter until=48h0m0s": {
+			Stdout: "ID\tRECLAIMABLE\tSIZE\tLAST ACCESSED\nx5kv3rfj0\ttrue\t200MB\t3 days ago\nShared:\t\t0B\nPrivate:\t200MB\nReclaimable:\t200MB\nTotal:\t\t200MB",
+		},
+	}}
+	reclaimed, err := dockerPrune(WithRunner(ctx, fake), DockerPruneOptions{OlderThan: 48 * time.Hour, DryRun: true})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 500000000, reclaimed)
+	}
+	for _, call := range fake.Calls() {
+		assert.NotContains(t, call.Args, "prune")
+	}
+}
+
+// installDockerContext copies a context fixture into the docker config dir.
+func installDockerContext(t testing.TB, fixture string) (name string) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "docker", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dockerCtx, err := parseDockerContextMeta(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte(dockerCtx.Name))
+	dir := filepath.Join(os.Getenv("DOCKER_CONFIG"), "contexts", "meta", hex.EncodeToString(sum[:]))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "meta.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dockerCtx.Name
+}
+
+func TestCurrentDockerContext(t *testing.T) {
+	for _, name := range []string{"DOCKER_HOST", "DOCKER_CONTEXT"} {
+		if value, found := os.LookupEnv(name); found {
+			defer os.Setenv(name, value)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Unsetenv(name)
+	}
+	defer writeDockerConfig(t, `{"currentContext":"colima"}`)()
+	assert.Equal(t, "colima", installDockerContext(t, "context-local.json"))
+	assert.Equal(t, "build-server", installDockerContext(t, "context-ssh.json"))
+
+	dockerCtx, err := currentDockerContext()
+	if assert.NoError(t, err) {
+		assert.Equal(t, dockerContext{Name: "colima", Host: "unix:///Users/elastic/.colima/default/docker.sock"}, dockerCtx)
+	}
+
+	os.Setenv("DOCKER_CONTEXT", "build-server")
+	dockerCtx, err = currentDockerContext()
+	if assert.NoError(t, err) {
+		assert.Equal(t, dockerContext{Name: "build-server", Host: "ssh://ci@build-server.example.com"}, dockerCtx)
+	}
+
+	os.Setenv("DOCKER_CONTEXT", "default")
+	dockerCtx, err = currentDockerContext()
+	if assert.NoError(t, err) {
+		assert.Equal(t, defaultDockerHost, dockerCtx.Host)
+	}
+
+	os.Setenv("DOCKER_CONTEXT", "missing")
+	_, err = currentDockerContext()
+	assert.Error(t, err)
+
+	// DOCKER_HOST takes precedence over contexts.
+	os.Setenv("DOCKER_HOST", "tcp://10.0.0.1:2376")
+	dockerCtx, err = currentDockerContext()
+	if assert.NoError(t, err) {
+		assert.Equal(t, dockerContext{Name: "default", Host: "tcp://10.0.0.1:2376"}, dockerCtx)
+	}
+}
+
+func TestDockerInfoIsRemoteDaemon(t *testing.T) {
+	cases := map[string]bool{
+		"":                                  false,
+		"unix:///var/run/docker.sock":       false,
+		"npipe:////./pipe/docker_engine":    false,
+		"tcp://127.0.0.1:2375":              false,
+		"tcp://localhost:2376":              false,
+		"tcp://[::1]:2376":                  false,
+		"tcp://10.0.0.1:2376":               true,
+		"tcp://docker.example.com:2376":     true,
+		"ssh://ci@build-server.example.com": true,
+	}
+	for endpoint, remote := range cases {
+		info := &DockerInfo{ContextEndpoint: endpoint}
+		assert.Equal(t, remote, info.IsRemoteDaemon(), endpoint)
+	}
+}
+
+func TestDockerMountPathRemoteDaemon(t *testing.T) {
+	for _, fixture := range []string{"context-local.json", "context-ssh.json"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "docker", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dockerCtx, err := parseDockerContextMeta(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info := &DockerInfo{ContextEndpoint: dockerCtx.Host}
+		env := dockerMountEnv{GOOS: "darwin", RemoteDaemon: info.IsRemoteDaemon(), Endpoint: dockerCtx.Host}
+		p, err := env.mountPath("/Users/elastic/src/beats")
+		if fixture == "context-local.json" {
+			assert.NoError(t, err)
+			assert.Equal(t, "/Users/elastic/src/beats", p)
+			assert.NoError(t, env.checkShared("/Users/elastic/src/beats"))
+			continue
+		}
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "ssh://ci@build-server.example.com is remote")
+			assert.Contains(t, err.Error(), "docker volume create")
+		}
+		assert.Error(t, env.checkShared("/Users/elastic/src/beats"))
+	}
+}
+
+func TestDockerRunArgs(t *testing.T) {
+	defer os.Setenv("MAGE_TEST_PASS", os.Getenv("MAGE_TEST_PASS"))
+	os.Setenv("MAGE_TEST_PASS", "passed")
+	os.Unsetenv("MAGE_TEST_UNSET")
+
+	opts := DockerRunOptions{
+		Args:       []string{"make", "check"},
+		Workspace:  "/src/beats",
+		Env:        map[string]string{"B": "2", "A": "1"},
+		PassEnv:    []string{"MAGE_TEST_PASS", "MAGE_TEST_UNSET"},
+		DockerArgs: []string{"--network", "host"},
+	}
+	user := strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid())
+	common := []string{
+		"--volume", "/src/beats:/workspace", "--workdir", "/workspace",
+		"--env", "MAGE_TEST_PASS", "--env", "A", "--env", "B",
+		"--network", "host", "golang:1.14", "make", "check",
+	}
+
+	args, err := dockerRunArgs(dockerMountEnv{GOOS: "linux"}, "golang:1.14", opts, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, append([]string{"docker", "run", "--rm", "--user", user}, common...), args)
+	}
+
+	// No user mapping where the daemon already maps file ownership.
+	for _, env := range []dockerMountEnv{
+		{GOOS: "darwin", DockerDesktop: true},
+		{GOOS: "darwin", Boot2Docker: true},
+		{GOOS: "linux", Rootless: true},
+	} {
+		args, err = dockerRunArgs(env, "golang:1.14", opts, true)
+		if assert.NoError(t, err, "%+v", env) {
+			assert.Equal(t, append([]string{"docker", "run", "--rm", "--interactive", "--tty"}, common...), args, "%+v", env)
+		}
+	}
+
+	_, err = dockerRunArgs(dockerMountEnv{GOOS: "linux", RemoteDaemon: true}, "golang:1.14", opts, false)
+	assert.Error(t, err)
+}
+
+func TestDockerRunEnvNotInArgs(t *testing.T) {
+	skipIfNoShell(t)
+	resetDockerInfoCache(t)
+	defer func(isTerminal func() bool) { stdinIsTerminal = isTerminal }(stdinIsTerminal)
+	defer os.Setenv("MAGE_TEST_TOKEN", os.Getenv("MAGE_TEST_TOKEN"))
+	os.Setenv("MAGE_TEST_TOKEN", "s3cr3t-pass")
+
+	dockerInfoProbe = func(context.Context) (*DockerInfo, error) {
+		return &DockerInfo{OperatingSystem: "Docker Desktop"}, nil
+	}
+	stdinIsTerminal = func() bool { return false }
+	if _, err := RefreshDockerInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeRunner{}
+	err := dockerRunContext(WithRunner(context.Background(), fake), "alpine:3", DockerRunOptions{
+		Args:    []string{"env"},
+		Env:     map[string]string{"API_KEY": "s3cr3t-env"},
+		PassEnv: []string{"MAGE_TEST_TOKEN"},
+	})
+	if assert.NoError(t, err) && assert.Len(t, fake.Calls(), 1) {
+		call := fake.Calls()[0]
+		for _, arg := range call.Args {
+			assert.NotContains(t, arg, "s3cr3t")
+		}
+		assert.Contains(t, call.Args, "MAGE_TEST_TOKEN")
+		assert.Contains(t, call.Args, "API_KEY")
+		assert.Equal(t, map[string]string{"API_KEY": "s3cr3t-env"}, call.Env)
+	}
+}
+
+func TestDockerRunFakeRunner(t *testing.T) {
+	skipIfNoShell(t)
+	resetDockerInfoCache(t)
+	defer func(isTerminal func() bool) { stdinIsTerminal = isTerminal }(stdinIsTerminal)
+
+	dockerInfoProbe = func(context.Context) (*DockerInfo, error) {
+		return &DockerInfo{OperatingSystem: "Docker Desktop"}, nil
+	}
+	stdinIsTerminal = func() bool { return false }
+	if _, err := RefreshDockerInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeRunner{}
+	err := dockerRunContext(WithRunner(context.Background(), fake), "alpine:3", DockerRunOptions{
+		Args:    []string{"ls"},
+		WorkDir: "/src",
+	})
+	if assert.NoError(t, err) && assert.Len(t, fake.Calls(), 1) {
+		assert.Equal(t, []string{
+			"docker", "run", "--rm", "--volume", CWD() + ":/src", "--workdir", "/src", "alpine:3", "ls",
+		}, fake.Calls()[0].Args)
+		assert.False(t, fake.Calls()[0].Stream)
+	}
+
+	// Interactive sessions stream their output.
+	stdinIsTerminal = func() bool { return true }
+	fake = &fakeRunner{}
+	err = dockerRunContext(WithRunner(context.Background(), fake), "alpine:3", DockerRunOptions{Args: []string{"sh"}})
+	if assert.NoError(t, err) && assert.Len(t, fake.Calls(), 1) {
+		assert.Contains(t, fake.Calls()[0].Args, "--tty")
+		assert.True(t, fake.Calls()[0].Stream)
+	}
+}
+
+func fakeCommands(fake *fakeRunner) []string {
+	var commands []string
+	for _, call := range fake.Calls() {
+		commands = append(commands, strings.Join(call.Args, " "))
+	}
+	return commands
+}
+
+func TestDockerCopyFromImage(t *testing.T) {
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"docker create filebeat:8.0 mage-copy":              {Stdout: "c0ffee\n"},
+		"docker cp c0ffee:/usr/share/filebeat/missing /tmp": {Err: errors.New("no such file")},
+		"docker create missing:1.0 mage-copy":               {Err: errors.New("No such image: missing:1.0")},
+	}}
+	ctx := WithRunner(context.Background(), fake)
+
+	assert.NoError(t, dockerCopyFromImage(ctx, "filebeat:8.0", "/usr/share/filebeat/filebeat.yml", "/tmp"))
+	assert.Error(t, dockerCopyFromImage(ctx, "filebeat:8.0", "/usr/share/filebeat/missing", "/tmp"))
+	assert.Error(t, dockerCopyFromImage(ctx, "missing:1.0", "/etc/os-release", "/tmp"))
+
+	assert.Equal(t, []string{
+		"docker create filebeat:8.0 mage-copy",
+		"docker cp c0ffee:/usr/share/filebeat/filebeat.yml /tmp",
+		"docker rm --force c0ffee",
+		"docker create filebeat:8.0 mage-copy",
+		"docker cp c0ffee:/usr/share/filebeat/missing /tmp",
+		"docker rm --force c0ffee",
+		"docker create missing:1.0 mage-copy",
+	}, fakeCommands(fake))
+}
+
+func TestDockerReadFileFromImage(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := "filebeat.inputs: []\n"
+	if err := tw.WriteHeader(&tar.Header{Name: "filebeat.yml", Mode: 0600, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte(content))
+	tw.Close()
+
+	var dirBuf bytes.Buffer
+	tw = tar.NewWriter(&dirBuf)
+	tw.WriteHeader(&tar.Header{Name: "filebeat/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.Close()
+
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"docker create filebeat:8.0 mage-copy":                {Stdout: "c0ffee"},
+		"docker cp c0ffee:/usr/share/filebeat/filebeat.yml -": {Stdout: buf.String()},
+		"docker cp c0ffee:/usr/share/filebeat -":              {Stdout: dirBuf.String()},
+	}}
+	ctx := WithRunner(context.Background(), fake)
+
+	data, err := dockerReadFileFromImage(ctx, "filebeat:8.0", "/usr/share/filebeat/filebeat.yml")
+	if assert.NoError(t, err) {
+		assert.Equal(t, content, string(data))
+	}
+
+	_, err = dockerReadFileFromImage(ctx, "filebeat:8.0", "/usr/share/filebeat")
+	assert.Error(t, err)
+
+	commands := fakeCommands(fake)
+	assert.Len(t, commands, 6)
+	assert.Equal(t, "docker rm --force c0ffee", commands[2])
+	assert.Equal(t, "docker rm --force c0ffee", commands[5])
+}
+
+func TestDockerManifestPushLegacy(t *testing.T) {
+	defer func(orig func() error) { haveBuildx = orig }(haveBuildx)
+	haveBuildx = func() error { return errors.New("buildx not found") }
+
+	fake := &fakeRunner{}
+	err := dockerManifestPush(WithRunner(context.Background(), fake), "elastic/filebeat:8.0", map[string]string{
+		"amd64":  "elastic/filebeat:8.0-amd64",
+		"arm/v7": "elastic/filebeat:8.0-armv7",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"docker manifest inspect elastic/filebeat:8.0-amd64",
+		"docker manifest inspect elastic/filebeat:8.0-armv7",
+		"docker manifest create --amend elastic/filebeat:8.0 elastic/filebeat:8.0-amd64 elastic/filebeat:8.0-armv7",
+		"docker manifest annotate --os linux --arch amd64 elastic/filebeat:8.0 elastic/filebeat:8.0-amd64",
+		"docker manifest annotate --os linux --arch arm --variant v7 elastic/filebeat:8.0 elastic/filebeat:8.0-armv7",
+		"docker manifest push --purge elastic/filebeat:8.0",
+	}, fakeCommands(fake))
+}
+
+func TestDockerManifestPushBuildx(t *testing.T) {
+	defer func(orig func() error) { haveBuildx = orig }(haveBuildx)
+	haveBuildx = func() error { return nil }
+
+	fake := &fakeRunner{}
+	err := dockerManifestPush(WithRunner(context.Background(), fake), "elastic/filebeat:8.0", map[string]string{
+		"linux/arm64": "elastic/filebeat:8.0-arm64",
+		"linux/amd64": "elastic/filebeat:8.0-amd64",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"docker buildx imagetools inspect elastic/filebeat:8.0-amd64",
+		"docker buildx imagetools inspect elastic/filebeat:8.0-arm64",
+		"docker buildx imagetools create --tag elastic/filebeat:8.0 elastic/filebeat:8.0-amd64 elastic/filebeat:8.0-arm64",
+	}, fakeCommands(fake))
+}
+
+func TestDockerManifestPushMissingRef(t *testing.T) {
+	defer func(orig func() error) { haveBuildx = orig }(haveBuildx)
+	haveBuildx = func() error { return nil }
+
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"docker buildx imagetools inspect elastic/filebeat:8.0-arm64": {Err: errors.New("not found")},
+	}}
+	err := dockerManifestPush(WithRunner(context.Background(), fake), "elastic/filebeat:8.0", map[string]string{
+		"amd64": "elastic/filebeat:8.0-amd64",
+		"arm64": "elastic/filebeat:8.0-arm64",
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "arm64=elastic/filebeat:8.0-arm64")
+		assert.NotContains(t, err.Error(), "amd64=")
+	}
+	assert.Len(t, fake.Calls(), 2, "manifest must not be created")
+
+	err = dockerManifestPush(context.Background(), "elastic/filebeat:8.0", map[string]string{"linux/": "x"})
+	assert.Error(t, err)
+	err = dockerManifestPush(context.Background(), "elastic/filebeat:8.0", nil)
+	assert.Error(t, err)
+}
+
+func TestDockerManifestPushDryRun(t *testing.T) {
+	defer func(orig func() error) { haveBuildx = orig }(haveBuildx)
+	haveBuildx = func() error { return nil }
+
+	defer os.Setenv("DEV_TOOLS_DRY_RUN", os.Getenv("DEV_TOOLS_DRY_RUN"))
+	os.Setenv("DEV_TOOLS_DRY_RUN", "true")
+
+	ctx, buf := captureLog(InfoLevel)
+
+	err := dockerManifestPush(ctx, "elastic/filebeat:8.0", map[string]string{"amd64": "elastic/filebeat:8.0-amd64"})
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "dry-run: docker buildx imagetools create --tag elastic/filebeat:8.0 elastic/filebeat:8.0-amd64")
+}
+
+// fakeProcFiles replaces the /proc reader with one that sees only the given
+// files for the duration of the test.
+func fakeProcFiles(t testing.TB, files map[string]string) {
+	orig := procReadFile
+	t.Cleanup(func() { procReadFile = orig })
+	procReadFile = func(path string) ([]byte, error) {
+		if data, found := files[path]; found {
+			return []byte(data), nil
+		}
+		return nil, os.ErrNotExist
+	}
+}
+
+func TestDockerHostCapabilities(t *testing.T) {
+	fakeProcFiles(t, map[string]string{
+		"/proc/sys/user/max_user_namespaces":    "0\n",
+		"/proc/sys/fs/inotify/max_user_watches": "8192\n",
+	})
+
+	cases := []struct {
+		fixture  string
+		cgroupV2 bool
+		seccomp  bool
+		probed   bool
+	}{
+		{"info-linux.json", false, true, true},
+		{"info-rootless.json", false, true, true},
+		{"info-desktop.json", false, true, false},
+		{"info-containerd.json", true, true, false},
+		{"info-podman.json", true, true, true},
+		{"info-windows.json", false, false, false},
+	}
+	for _, tc := range cases {
+		caps := readDockerInfoFixture(t, tc.fixture).hostCapabilities()
+		assert.Equal(t, tc.cgroupV2, caps.CgroupV2, tc.fixture)
+		assert.Equal(t, tc.seccomp, caps.Seccomp, tc.fixture)
+		if runtime.GOOS != "linux" {
+			continue
+		}
+		assert.Equal(t, tc.probed, caps.Probed, tc.fixture)
+		assert.Equal(t, !tc.probed, caps.UserNamespaces, tc.fixture)
+		if tc.probed {
+			assert.Equal(t, 8192, caps.InotifyMaxUserWatches, tc.fixture)
+		}
+	}
+}
+
+func TestHostCapabilitiesRequire(t *testing.T) {
+	caps := &HostCapabilities{
+		CgroupV2:              true,
+		Seccomp:               true,
+		Probed:                true,
+		UserNamespaces:        false,
+		InotifyMaxUserWatches: 8192,
+	}
+	assert.NoError(t, caps.Require(CapCgroupV2, CapSeccomp))
+	assert.Error(t, caps.Require("ipv6"))
+
+	err := caps.Require(CapCgroupV2, CapUserNamespaces, CapInotify)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unprivileged user namespaces are disabled")
+		assert.Contains(t, err.Error(), "fs.inotify.max_user_watches=65536")
+		assert.NotContains(t, err.Error(), "cgroup")
+	}
+
+	// Values that could not be probed are assumed to be available.
+	caps = &HostCapabilities{UserNamespaces: true}
+	assert.NoError(t, caps.Require(CapUserNamespaces, CapInotify))
+	assert.Error(t, caps.Require(CapCgroupV2))
+}
@@ -19,7 +19,6 @@ package mage
 
 import (
 	"errors"
-	"log"
 	"os"
 )
 
@@ -38,7 +37,7 @@ func BuildGoDaemon() error {
 	output := MustExpand("build/golang-crossbuild/god-{{.Platform.GOOS}}-{{.Platform.Arch}}")
 	input := MustExpand("{{ elastic_beats_dir }}/dev-tools/vendor/github.com/tsg/go-daemon/god.c")
 	if IsUpToDate(output, input) {
-		log.Println(">>> buildGoDaemon is up-to-date for", Platform.Name)
+		logInfo(">>> buildGoDaemon is up-to-date for", Platform.Name)
 		return nil
 	}
 
@@ -0,0 +1,382 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ExpandAndValidateJSON expands the Go text/template read from src, parses
+// the output as JSON, and validates it against the JSON schema. The rendered
+// bytes are returned if they are valid. Otherwise the error lists each path
+// that failed validation (e.g. $.inputs[0].type).
+//
+// The validator supports the commonly used subset of JSON Schema: type, enum,
+// const, properties, required, additionalProperties, patternProperties,
+// items, minItems, maxItems, uniqueItems, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, minLength, maxLength, pattern, allOf,
+// anyOf, oneOf, not, and local $ref pointers (e.g. #/definitions/input).
+// Other keywords are ignored.
+func ExpandAndValidateJSON(src string, schema []byte, args ...map[string]interface{}) ([]byte, error) {
+	tmplData, err := ioutil.ReadFile(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading from template %v", src)
+	}
+
+	rendered, err := expandTemplate(src, string(tmplData), FuncMap, EnvMap(args...))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed expanding %v", src)
+	}
+
+	var doc interface{}
+	if err = json.Unmarshal([]byte(rendered), &doc); err != nil {
+		return nil, errors.Wrapf(err, "output of %v is not valid JSON", src)
+	}
+
+	var root interface{}
+	if err = json.Unmarshal(schema, &root); err != nil {
+		return nil, errors.Wrap(err, "failed to parse JSON schema")
+	}
+
+	v := &jsonSchemaValidator{root: root}
+	v.validate("$", doc, root)
+	if len(v.errs) > 0 {
+		return nil, errors.Errorf("output of %v does not match the JSON schema:\n  %v",
+			src, strings.Join(v.errs, "\n  "))
+	}
+	return []byte(rendered), nil
+}
+
+// jsonSchemaValidator validates decoded JSON values against a decoded JSON
+// schema and collects the validation errors.
+type jsonSchemaValidator struct {
+	root interface{}
+	errs []string
+}
+
+func (v *jsonSchemaValidator) fail(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, path+": "+fmt.Sprintf(format, args...))
+}
+
+// valid returns true if value matches the schema without recording errors.
+func (v *jsonSchemaValidator) valid(path string, value, schema interface{}) bool {
+	sub := &jsonSchemaValidator{root: v.root}
+	sub.validate(path, value, schema)
+	return len(sub.errs) == 0
+}
+
+func (v *jsonSchemaValidator) validate(path string, value, schema interface{}) {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		// The boolean schemas true and false accept and reject everything.
+		if b, isBool := schema.(bool); isBool && !b {
+			v.fail(path, "no value is allowed")
+		}
+		return
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		target, err := v.resolve(ref)
+		if err != nil {
+			v.fail(path, "%v", err)
+			return
+		}
+		v.validate(path, value, target)
+		return
+	}
+
+	if t, found := s["type"]; found && !jsonTypeMatches(value, t) {
+		v.fail(path, "expected %v, got %v", jsonTypeNames(t), jsonTypeOf(value))
+		return
+	}
+	if enum, ok := s["enum"].([]interface{}); ok && !jsonContains(enum, value) {
+		v.fail(path, "value %v is not one of %v", jsonString(value), jsonString(enum))
+	}
+	if c, found := s["const"]; found && !reflect.DeepEqual(c, value) {
+		v.fail(path, "value %v must be %v", jsonString(value), jsonString(c))
+	}
+
+	v.validateCombinators(path, value, s)
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(path, value, s)
+	case []interface{}:
+		v.validateArray(path, value, s)
+	case string:
+		v.validateString(path, value, s)
+	case float64:
+		v.validateNumber(path, value, s)
+	}
+}
+
+func (v *jsonSchemaValidator) validateCombinators(path string, value interface{}, s map[string]interface{}) {
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			v.validate(path, value, sub)
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if v.valid(path, value, sub) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "value does not match any of the anyOf schemas")
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range oneOf {
+			if v.valid(path, value, sub) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.fail(path, "value matches %d of the oneOf schemas, expected exactly 1", matched)
+		}
+	}
+	if not, found := s["not"]; found && v.valid(path, value, not) {
+		v.fail(path, "value must not match the schema in not")
+	}
+}
+
+func (v *jsonSchemaValidator) validateObject(path string, obj map[string]interface{}, s map[string]interface{}) {
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, found := obj[name]; !found {
+					v.fail(path, "missing required property %q", name)
+				}
+			}
+		}
+	}
+
+	properties, _ := s["properties"].(map[string]interface{})
+	patterns, _ := s["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := s["additionalProperties"]
+
+	// Iterate in a stable order so that the errors are reproducible.
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		childPath := jsonChildPath(path, k)
+		matched := false
+		if sub, found := properties[k]; found {
+			matched = true
+			v.validate(childPath, obj[k], sub)
+		}
+		for pattern, sub := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				v.fail(path, "invalid patternProperties regexp %q: %v", pattern, err)
+				continue
+			}
+			if re.MatchString(k) {
+				matched = true
+				v.validate(childPath, obj[k], sub)
+			}
+		}
+		if !matched && hasAdditional {
+			if b, ok := additional.(bool); ok && !b {
+				v.fail(childPath, "additional property is not allowed")
+			} else {
+				v.validate(childPath, obj[k], additional)
+			}
+		}
+	}
+}
+
+func (v *jsonSchemaValidator) validateArray(path string, arr []interface{}, s map[string]interface{}) {
+	if min, ok := s["minItems"].(float64); ok && float64(len(arr)) < min {
+		v.fail(path, "array has %d items, expected at least %v", len(arr), min)
+	}
+	if max, ok := s["maxItems"].(float64); ok && float64(len(arr)) > max {
+		v.fail(path, "array has %d items, expected at most %v", len(arr), max)
+	}
+	if unique, _ := s["uniqueItems"].(bool); unique {
+		for i := range arr {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(arr[i], arr[j]) {
+					v.fail(fmt.Sprintf("%v[%d]", path, i), "duplicate of item %d", j)
+				}
+			}
+		}
+	}
+	if items, found := s["items"]; found {
+		for i, item := range arr {
+			v.validate(fmt.Sprintf("%v[%d]", path, i), item, items)
+		}
+	}
+}
+
+func (v *jsonSchemaValidator) validateString(path string, str string, s map[string]interface{}) {
+	length := float64(len([]rune(str)))
+	if min, ok := s["minLength"].(float64); ok && length < min {
+		v.fail(path, "string is shorter than %v characters", min)
+	}
+	if max, ok := s["maxLength"].(float64); ok && length > max {
+		v.fail(path, "string is longer than %v characters", max)
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			v.fail(path, "invalid pattern %q: %v", pattern, err)
+		} else if !re.MatchString(str) {
+			v.fail(path, "string %q does not match pattern %q", str, pattern)
+		}
+	}
+}
+
+func (v *jsonSchemaValidator) validateNumber(path string, n float64, s map[string]interface{}) {
+	if min, ok := s["minimum"].(float64); ok && n < min {
+		v.fail(path, "value %v is less than the minimum %v", n, min)
+	}
+	if max, ok := s["maximum"].(float64); ok && n > max {
+		v.fail(path, "value %v is greater than the maximum %v", n, max)
+	}
+	if min, ok := s["exclusiveMinimum"].(float64); ok && n <= min {
+		v.fail(path, "value %v must be greater than %v", n, min)
+	}
+	if max, ok := s["exclusiveMaximum"].(float64); ok && n >= max {
+		v.fail(path, "value %v must be less than %v", n, max)
+	}
+}
+
+// resolve returns the schema referenced by a local JSON pointer such as
+// #/definitions/input.
+func (v *jsonSchemaValidator) resolve(ref string) (interface{}, error) {
+	if ref == "#" {
+		return v.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, errors.Errorf("unsupported $ref %q, only local references are supported", ref)
+	}
+
+	current := v.root
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("unresolvable $ref %q", ref)
+		}
+		if current, ok = obj[token]; !ok {
+			return nil, errors.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	return current, nil
+}
+
+// jsonTypeOf returns the JSON schema type name of a decoded JSON value.
+func jsonTypeOf(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// jsonTypeMatches returns true if the value has the type (or one of the
+// types) given by the schema's type keyword.
+func jsonTypeMatches(value interface{}, t interface{}) bool {
+	actual := jsonTypeOf(value)
+	for _, name := range jsonTypeList(t) {
+		if name == actual || (name == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonTypeList(t interface{}) []string {
+	switch t := t.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var names []string
+		for _, name := range t {
+			if name, ok := name.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+func jsonTypeNames(t interface{}) string {
+	return strings.Join(jsonTypeList(t), " or ")
+}
+
+func jsonContains(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonString returns the compact JSON encoding of a value for use in errors.
+func jsonString(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(bytes.TrimSpace(data))
+}
+
+// jsonChildPath returns the path of an object property. Names that are not
+// identifiers are quoted.
+func jsonChildPath(path, name string) string {
+	if jsonIdentifier.MatchString(name) {
+		return path + "." + name
+	}
+	return fmt.Sprintf("%v[%q]", path, name)
+}
+
+var jsonIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
@@ -0,0 +1,123 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testInputsSchema = `{
+  "type": "object",
+  "required": ["name", "inputs"],
+  "additionalProperties": false,
+  "properties": {
+    "name": {"type": "string", "minLength": 1},
+    "port": {"type": "integer", "minimum": 1, "maximum": 65535},
+    "inputs": {
+      "type": "array",
+      "minItems": 1,
+      "items": {"$ref": "#/definitions/input"}
+    }
+  },
+  "definitions": {
+    "input": {
+      "type": "object",
+      "required": ["type"],
+      "properties": {
+        "type": {"enum": ["log", "stdin"]},
+        "paths": {"type": "array", "items": {"type": "string", "pattern": "^/"}}
+      }
+    }
+  }
+}`
+
+func TestExpandAndValidateJSON(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	src := filepath.Join(dir, "config.json.tmpl")
+	tmpl := `{"name": "{{.Name}}", "port": {{.Port}}, "inputs": [{"type": "{{.Type}}", "paths": ["{{.Path}}"]}]}`
+	if err := ioutil.WriteFile(src, []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ExpandAndValidateJSON(src, []byte(testInputsSchema), map[string]interface{}{
+		"Name": "filebeat", "Port": 5044, "Type": "log", "Path": "/var/log/*.log",
+	})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(out), `"name": "filebeat"`)
+	}
+
+	_, err = ExpandAndValidateJSON(src, []byte(testInputsSchema), map[string]interface{}{
+		"Name": "", "Port": 70000, "Type": "syslog", "Path": "relative.log",
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "$.name: string is shorter than 1 characters")
+		assert.Contains(t, err.Error(), "$.port: value 70000 is greater than the maximum 65535")
+		assert.Contains(t, err.Error(), `$.inputs[0].type: value "syslog" is not one of ["log","stdin"]`)
+		assert.Contains(t, err.Error(), `$.inputs[0].paths[0]: string "relative.log" does not match pattern "^/"`)
+	}
+
+	_, err = ExpandAndValidateJSON(src, []byte(testInputsSchema), map[string]interface{}{
+		"Name": "filebeat", "Port": "5044,", "Type": "log", "Path": "/",
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not valid JSON")
+	}
+}
+
+func TestJSONSchemaValidator(t *testing.T) {
+	cases := []struct {
+		schema string
+		doc    interface{}
+		errs   []string
+	}{
+		{`{"type": "integer"}`, 1.5, []string{"$: expected integer, got number"}},
+		{`{"type": ["string", "null"]}`, nil, nil},
+		{`{"required": ["a"], "additionalProperties": false}`,
+			map[string]interface{}{"b": true},
+			[]string{`$: missing required property "a"`, "$.b: additional property is not allowed"}},
+		{`{"patternProperties": {"^x-": {"type": "string"}}, "additionalProperties": false}`,
+			map[string]interface{}{"x-a": "ok", "x-b": 1.0},
+			[]string{`$["x-b"]: expected string, got integer`}},
+		{`{"uniqueItems": true, "maxItems": 2}`, []interface{}{1.0, 1.0, 2.0},
+			[]string{"$: array has 3 items, expected at most 2", "$[1]: duplicate of item 0"}},
+		{`{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, 1.0,
+			[]string{"$: value matches 2 of the oneOf schemas, expected exactly 1"}},
+		{`{"anyOf": [{"type": "string"}, {"type": "boolean"}]}`, true, nil},
+		{`{"not": {"const": "x"}}`, "x", []string{"$: value must not match the schema in not"}},
+		{`{"$ref": "#/$defs/missing"}`, 1.0, []string{`$: unresolvable $ref "#/$defs/missing"`}},
+		{`{"exclusiveMinimum": 0}`, 0.0, []string{"$: value 0 must be greater than 0"}},
+		{`false`, 1.0, []string{"$: no value is allowed"}},
+	}
+
+	for _, tc := range cases {
+		var schema interface{}
+		if err := json.Unmarshal([]byte(tc.schema), &schema); err != nil {
+			t.Fatal(err)
+		}
+		v := &jsonSchemaValidator{root: schema}
+		v.validate("$", tc.doc, schema)
+		assert.Equal(t, tc.errs, v.errs, tc.schema)
+	}
+}
@@ -0,0 +1,201 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/magefile/mage/mg"
+)
+
+// LogLevel is the minimum level of the messages that are written by a Logger.
+type LogLevel int
+
+// List of log levels. LogLevelFromEnv determines the level from the
+// DEV_TOOLS_LOG environment variable and mage's verbose flag each time a
+// message is logged.
+const (
+	LogLevelFromEnv LogLevel = iota
+	DebugLevel
+	InfoLevel
+	WarnLevel
+)
+
+// String returns the name of the log level.
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelFromEnv:
+		return "env"
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	default:
+		return "invalid"
+	}
+}
+
+// envLogLevel returns the log level configured by DEV_TOOLS_LOG
+// (debug|info|quiet). When it is unset the level is debug if mage -v was used
+// and info otherwise.
+func envLogLevel() LogLevel {
+	switch strings.ToLower(os.Getenv("DEV_TOOLS_LOG")) {
+	case "debug":
+		return DebugLevel
+	case "info":
+		return InfoLevel
+	case "quiet", "warn":
+		return WarnLevel
+	}
+
+	if mg.Verbose() {
+		return DebugLevel
+	}
+	return InfoLevel
+}
+
+// Logger is a leveled logger used by the dev-tools. Warnings are always
+// written regardless of the level.
+type Logger struct {
+	out   *log.Logger // Standard logger is used when nil.
+	level LogLevel
+}
+
+// NewLogger returns a Logger that writes messages of the given level or higher
+// to w.
+func NewLogger(w io.Writer, level LogLevel) *Logger {
+	return &Logger{out: log.New(w, "", log.LstdFlags), level: level}
+}
+
+// defaultLogger is used when a context does not carry a Logger.
+var defaultLogger = &Logger{}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx that causes the dev-tools functions that
+// are given it to write their messages to l. Because the Logger is scoped to
+// the context it is safe to capture the log output of each parallel test.
+func WithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFromContext returns the Logger associated with ctx. The default
+// Logger, which writes to the standard logger, is returned if there is none.
+func LoggerFromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok && l != nil {
+		return l
+	}
+	return defaultLogger
+}
+
+// Enabled returns true if messages of the given level are written.
+func (l *Logger) Enabled(level LogLevel) bool {
+	min := l.level
+	if min == LogLevelFromEnv {
+		min = envLogLevel()
+	}
+	return level >= min
+}
+
+func (l *Logger) output(level LogLevel, msg string) {
+	if !l.Enabled(level) {
+		return
+	}
+	if level == WarnLevel {
+		msg = "WARN: " + msg
+	}
+	if l.out == nil {
+		log.Print(msg)
+		return
+	}
+	l.out.Print(msg)
+}
+
+// Debug logs a message at debug level. Arguments are handled in the manner of
+// fmt.Println.
+func (l *Logger) Debug(v ...interface{}) {
+	l.output(DebugLevel, sprintln(v...))
+}
+
+// Debugf logs a message at debug level. Arguments are handled in the manner of
+// fmt.Printf.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.output(DebugLevel, fmt.Sprintf(format, v...))
+}
+
+// Info logs a message at info level. Arguments are handled in the manner of
+// fmt.Println.
+func (l *Logger) Info(v ...interface{}) {
+	l.output(InfoLevel, sprintln(v...))
+}
+
+// Infof logs a message at info level. Arguments are handled in the manner of
+// fmt.Printf.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.output(InfoLevel, fmt.Sprintf(format, v...))
+}
+
+// Warn logs a message at warn level. Arguments are handled in the manner of
+// fmt.Println.
+func (l *Logger) Warn(v ...interface{}) {
+	l.output(WarnLevel, sprintln(v...))
+}
+
+// Warnf logs a message at warn level. Arguments are handled in the manner of
+// fmt.Printf.
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.output(WarnLevel, fmt.Sprintf(format, v...))
+}
+
+func sprintln(v ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
+
+// Package level helpers that write to the default logger. Functions that
+// accept a context use LoggerFromContext instead.
+
+func logDebug(v ...interface{}) {
+	defaultLogger.Debug(v...)
+}
+
+func logDebugf(format string, v ...interface{}) {
+	defaultLogger.Debugf(format, v...)
+}
+
+func logInfo(v ...interface{}) {
+	defaultLogger.Info(v...)
+}
+
+func logInfof(format string, v ...interface{}) {
+	defaultLogger.Infof(format, v...)
+}
+
+func logWarn(v ...interface{}) {
+	defaultLogger.Warn(v...)
+}
+
+func logWarnf(format string, v ...interface{}) {
+	defaultLogger.Warnf(format, v...)
+}
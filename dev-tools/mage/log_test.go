@@ -0,0 +1,93 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLog returns a context that carries a logger writing the messages of
+// the given level or higher to the returned buffer. The buffer must only be
+// read after the functions that log to it have returned.
+func captureLog(level LogLevel) (context.Context, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	return WithLogger(context.Background(), NewLogger(buf, level)), buf
+}
+
+func TestLoggerLevels(t *testing.T) {
+	t.Parallel()
+	ctx, buf := captureLog(InfoLevel)
+
+	log := LoggerFromContext(ctx)
+	log.Debug("debug message")
+	log.Info("info message")
+	log.Warnf("warn %v", "message")
+
+	out := buf.String()
+	assert.NotContains(t, out, "debug message")
+	assert.Contains(t, out, "info message")
+	assert.Contains(t, out, "WARN: warn message")
+}
+
+func TestLoggerQuietStillWarns(t *testing.T) {
+	t.Parallel()
+	ctx, buf := captureLog(WarnLevel)
+
+	log := LoggerFromContext(ctx)
+	log.Info("info message")
+	log.Warn("warn message")
+
+	out := buf.String()
+	assert.NotContains(t, out, "info message")
+	assert.Contains(t, out, "warn message")
+}
+
+func TestLoggerFromContext(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, LoggerFromContext(context.Background()) == defaultLogger)
+
+	// Each context logs to its own logger.
+	ctx1, buf1 := captureLog(InfoLevel)
+	ctx2, buf2 := captureLog(InfoLevel)
+	LoggerFromContext(ctx1).Info("first")
+	LoggerFromContext(ctx2).Info("second")
+	assert.Contains(t, buf1.String(), "first")
+	assert.NotContains(t, buf1.String(), "second")
+	assert.Contains(t, buf2.String(), "second")
+	assert.NotContains(t, buf2.String(), "first")
+}
+
+func TestEnvLogLevel(t *testing.T) {
+	defer os.Setenv("DEV_TOOLS_LOG", os.Getenv("DEV_TOOLS_LOG"))
+
+	os.Setenv("DEV_TOOLS_LOG", "debug")
+	assert.Equal(t, DebugLevel, envLogLevel())
+
+	os.Setenv("DEV_TOOLS_LOG", "QUIET")
+	assert.Equal(t, WarnLevel, envLogLevel())
+
+	logger := NewLogger(new(bytes.Buffer), LogLevelFromEnv)
+	assert.False(t, logger.Enabled(InfoLevel))
+	assert.True(t, logger.Enabled(WarnLevel))
+}
@@ -0,0 +1,247 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RunPipeline runs the given commands with the stdout of each command
+// connected to the stdin of the next, like a shell pipeline. The stdout of the
+// last command is written to os.Stdout. The stderr of each command is written
+// to the log, prefixed with the stage that produced it.
+//
+// All commands run concurrently. If any command fails the error of the first
+// command to fail is returned. When a command exits before consuming all of
+// its input the command writing to it fails with a broken pipe.
+func RunPipeline(cmds ...[]string) error {
+	return newPipeline(cmds).run(context.Background(), os.Stdout, "")
+}
+
+// RunPipelineTo is like RunPipeline except that the stdout of the last command
+// is written to w.
+func RunPipelineTo(w io.Writer, cmds ...[]string) error {
+	return newPipeline(cmds).run(context.Background(), w, "")
+}
+
+// RunPipelineToFile is like RunPipeline except that the stdout of the last
+// command is written to the given file. The file is created or truncated.
+func RunPipelineToFile(file string, cmds ...[]string) error {
+	p := newPipeline(cmds)
+	if envFlag("DEV_TOOLS_DRY_RUN") {
+		return p.run(context.Background(), nil, file)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to create pipeline output file")
+	}
+	defer f.Close()
+
+	if err = p.run(context.Background(), f, file); err != nil {
+		return err
+	}
+	return errors.Wrap(f.Close(), "failed to close pipeline output file")
+}
+
+type pipeline []Cmd
+
+func newPipeline(cmds [][]string) pipeline {
+	p := make(pipeline, 0, len(cmds))
+	for _, args := range cmds {
+		p = append(p, Cmd{Args: args})
+	}
+	return p
+}
+
+// String returns the pipeline as a command line using '|' between commands.
+func (p pipeline) String() string {
+	parts := make([]string, 0, len(p))
+	for _, c := range p {
+		parts = append(parts, c.String())
+	}
+	return strings.Join(parts, " | ")
+}
+
+// ShellString returns the pipeline quoted such that it can be executed by a
+// POSIX shell.
+func (p pipeline) ShellString() string {
+	parts := make([]string, 0, len(p))
+	for _, c := range p {
+		parts = append(parts, c.ShellString())
+	}
+	return strings.Join(parts, " | ")
+}
+
+// announce logs the pipeline to the logger of ctx prior to its execution. It
+// returns true if the pipeline must not be executed because dry-run mode is
+// enabled.
+func (p pipeline) announce(ctx context.Context, outFile string) (dryRun bool) {
+	log := LoggerFromContext(ctx)
+	var redirect string
+	if outFile != "" {
+		redirect = " > " + shellQuote(outFile)
+	}
+
+	switch {
+	case envFlag("DEV_TOOLS_DRY_RUN"):
+		log.Info("dry-run:", p.ShellString()+redirect)
+		return true
+	case envFlag("DEV_TOOLS_ECHO"):
+		log.Info("exec:", p.ShellString()+redirect)
+	default:
+		log.Debug("exec:", p.String()+redirect)
+	}
+	return false
+}
+
+// run executes the pipeline. The stages are killed if ctx is done.
+func (p pipeline) run(ctx context.Context, stdout io.Writer, outFile string) error {
+	if len(p) == 0 {
+		return errors.New("no commands specified")
+	}
+	if p.announce(ctx, outFile) {
+		return nil
+	}
+
+	var (
+		cmds    = make([]*exec.Cmd, len(p))
+		stderrs = make([]*stageWriter, len(p))
+		tails   = make([]*tailBuffer, len(p))
+
+		// inputs[i] is the stdin of stage i and outputs[i] is the stdout of
+		// stage i. The first and last stages have no pipes.
+		inputs  = make([]*io.PipeReader, len(p))
+		outputs = make([]*io.PipeWriter, len(p))
+	)
+	for i, c := range p {
+		cmd, err := c.command(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "invalid pipeline stage %d", i+1)
+		}
+
+		if i < len(p)-1 {
+			inputs[i+1], outputs[i] = io.Pipe()
+			cmd.Stdout = outputs[i]
+		} else {
+			cmd.Stdout = stdout
+		}
+		if i > 0 {
+			cmd.Stdin = inputs[i]
+		}
+
+		stderrs[i] = &stageWriter{log: LoggerFromContext(ctx), prefix: fmt.Sprintf("[%d %v] ", i+1, c.Args[0])}
+		tails[i] = &tailBuffer{limit: 2048}
+		cmd.Stderr = io.MultiWriter(stderrs[i], tails[i])
+		cmds[i] = cmd
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	start := time.Now()
+	for i, cmd := range cmds {
+		if err := cmd.Start(); err != nil {
+			fail(errors.Wrapf(err, "failed to start pipeline stage %d (%v)", i+1, p[i]))
+
+			// Terminate the stages that were already started.
+			if inputs[i] != nil {
+				inputs[i].Close()
+			}
+			for _, started := range cmds[:i] {
+				started.Process.Kill()
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, cmd *exec.Cmd) {
+			defer wg.Done()
+
+			stopKill := killProcessGroupOnCancel(ctx, cmd)
+			err := cmd.Wait()
+			stopKill()
+			stderrs[i].Flush()
+
+			// Signal EOF to the next stage and cause writes by the previous
+			// stage to fail now that nothing reads its output.
+			if outputs[i] != nil {
+				outputs[i].Close()
+			}
+			if inputs[i] != nil {
+				inputs[i].Close()
+			}
+
+			if err != nil {
+				fail(errors.Wrapf(p[i].wrapError(ctx, err, tails[i].String(), time.Since(start)),
+					"pipeline stage %d of %d failed", i+1, len(p)))
+			}
+		}(i, cmd)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// stageWriter writes each line that it receives to the log with a prefix.
+// Incomplete lines are buffered until the next newline or Flush.
+type stageWriter struct {
+	log    *Logger
+	prefix string
+	buf    bytes.Buffer
+}
+
+func (w *stageWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		idx := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if idx == -1 {
+			return len(p), nil
+		}
+		line := w.buf.Next(idx + 1)
+		w.log.Info(w.prefix + strings.TrimRight(string(line), "\r\n"))
+	}
+}
+
+// Flush logs any buffered incomplete line.
+func (w *stageWriter) Flush() {
+	if w.buf.Len() > 0 {
+		w.log.Info(w.prefix + w.buf.String())
+		w.buf.Reset()
+	}
+}
@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunPipeline(t *testing.T) {
+	skipIfNoShell(t)
+
+	var out bytes.Buffer
+	err := RunPipelineTo(&out,
+		[]string{"sh", "-c", "echo apple; echo banana; echo cherry; echo avocado"},
+		[]string{"grep", "^a"},
+		[]string{"wc", "-l"},
+	)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2", strings.TrimSpace(out.String()))
+	}
+}
+
+func TestRunPipelineToFile(t *testing.T) {
+	skipIfNoShell(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	file := filepath.Join(dir, "out.txt")
+	if err := RunPipelineToFile(file, []string{"echo", "hello"}, []string{"tr", "a-z", "A-Z"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "HELLO\n", string(data))
+	}
+}
+
+func TestRunPipelineStageFailure(t *testing.T) {
+	skipIfNoShell(t)
+
+	err := RunPipelineTo(ioutil.Discard,
+		[]string{"echo", "hello"},
+		[]string{"sh", "-c", "cat; echo oops >&2; exit 3"},
+		[]string{"cat"},
+	)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "pipeline stage 2 of 3 failed")
+		assert.Contains(t, err.Error(), "exit code 3")
+		assert.Contains(t, err.Error(), "oops")
+	}
+}
+
+func TestRunPipelineEarlyExit(t *testing.T) {
+	skipIfNoShell(t)
+
+	// The downstream command exits before consuming all of its input so the
+	// upstream command fails with a broken pipe instead of blocking forever.
+	err := RunPipelineTo(ioutil.Discard,
+		[]string{"yes"},
+		[]string{"sh", "-c", "read line; exit 1"},
+	)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "pipeline stage 2 of 2 failed")
+	}
+}
+
+func TestRunPipelineStderrLogged(t *testing.T) {
+	skipIfNoShell(t)
+	ctx, buf := captureLog(InfoLevel)
+
+	err := newPipeline([][]string{
+		{"sh", "-c", "echo first-stage >&2; echo data"},
+		{"sh", "-c", "cat; printf second-stage >&2"},
+	}).run(ctx, ioutil.Discard, "")
+	if assert.NoError(t, err) {
+		assert.Contains(t, buf.String(), "[1 sh] first-stage\n")
+		assert.Contains(t, buf.String(), "[2 sh] second-stage\n")
+	}
+}
+
+func TestRunPipelineStartFailure(t *testing.T) {
+	skipIfNoShell(t)
+
+	err := RunPipelineTo(ioutil.Discard,
+		[]string{"sleep", "10"},
+		[]string{"mage-no-such-command"},
+	)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to start pipeline stage 2")
+	}
+}
@@ -19,7 +19,6 @@ package mage
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/magefile/mage/mg"
 	"github.com/magefile/mage/sh"
@@ -49,7 +48,7 @@ func Package() error {
 			for _, pkgType := range pkg.Types {
 				packageArch, err := getOSArchName(target, pkgType)
 				if err != nil {
-					log.Printf("Skipping arch %v for package type %v: %v", target.Arch(), pkgType, err)
+					logInfof("Skipping arch %v for package type %v: %v", target.Arch(), pkgType, err)
 					continue
 				}
 
@@ -68,7 +67,8 @@ func Package() error {
 				spec.packageDir = packageStagingDir + "/" + pkgType.AddFileExtension(spec.Name+"-"+target.GOOS()+"-"+target.Arch())
 				spec = spec.Evaluate()
 
-				tasks = append(tasks, packageBuilder{target, spec, pkgType}.Build)
+				jobName := "package-" + pkgType.String() + "-" + target.GOOS() + "-" + target.Arch()
+				tasks = append(tasks, NamedJob(jobName, packageBuilder{target, spec, pkgType}.Build))
 			}
 		}
 	}
@@ -85,7 +85,7 @@ type packageBuilder struct {
 
 func (b packageBuilder) Build() error {
 	fmt.Printf(">> package: Building %v type=%v for platform=%v\n", b.Spec.Name, b.Type, b.Platform.Name)
-	log.Printf("Package spec: %+v", b.Spec)
+	logDebugf("Package spec: %+v", b.Spec)
 	return errors.Wrapf(b.Type.Build(b.Spec), "failed building %v type=%v for platform=%v",
 		b.Spec.Name, b.Type, b.Platform.Name)
 }
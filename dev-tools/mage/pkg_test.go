@@ -118,3 +118,25 @@ func TestLoadSpecs(t *testing.T) {
 		}
 	}
 }
+
+func TestPackageSpecArchiveFiles(t *testing.T) {
+	spec := PackageSpec{Files: map[string]PackageFile{
+		"b.yml":   {Source: "testdata/config.yml"},
+		"./b.yml": {Source: "./testdata/../testdata/config.yml"},
+		"a.yml":   {Source: "testdata/config.yml"},
+	}}
+
+	files, err := spec.archiveFiles()
+	if assert.NoError(t, err) && assert.Len(t, files, 2) {
+		source, _ := filepath.Abs("testdata/config.yml")
+		assert.Equal(t, "./b.yml", files[0].Target)
+		assert.Equal(t, "a.yml", files[1].Target)
+		for _, f := range files {
+			assert.Equal(t, source, f.Source)
+		}
+	}
+
+	spec.Files["b.yml"] = PackageFile{Source: "testdata/other.yml"}
+	_, err = spec.archiveFiles()
+	assert.Error(t, err)
+}
@@ -19,7 +19,6 @@ package mage
 
 import (
 	"io/ioutil"
-	"log"
 	"path/filepath"
 
 	"github.com/pkg/errors"
@@ -75,7 +74,7 @@ func LoadNamedSpec(name, file string) error {
 		return errors.Errorf("%v not found in package specs", name)
 	}
 
-	log.Printf("%v package spec loaded from %v", name, file)
+	logDebugf("%v package spec loaded from %v", name, file)
 	Packages = packages
 	return nil
 }
@@ -25,11 +25,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -432,6 +432,44 @@ func (s PackageSpec) rootDir() string {
 	return s.MustExpand("{{.BeatName}}-{{.Version}}{{if .Snapshot}}-SNAPSHOT{{end}}{{if .OS}}-{{.OS}}{{end}}{{if .Arch}}-{{.Arch}}{{end}}")
 }
 
+// archiveFiles returns the spec's files ordered by target with each source
+// normalized to a clean absolute path (see NormalizePaths). Entries whose
+// targets differ only in spelling are added once. It is an error if they refer
+// to different sources.
+func (s PackageSpec) archiveFiles() ([]PackageFile, error) {
+	targets := make([]string, 0, len(s.Files))
+	for target := range s.Files {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	sources := make(map[string]string, len(targets))
+	files := make([]PackageFile, 0, len(targets))
+	for _, target := range targets {
+		f := s.Files[target]
+		if f.Target == "" {
+			f.Target = target
+		}
+
+		normalized, err := NormalizePaths([]string{f.Source})
+		if err != nil {
+			return nil, err
+		}
+		f.Source = normalized[0]
+
+		key := filepath.Clean(f.Target)
+		if source, found := sources[key]; found {
+			if source == f.Source {
+				continue
+			}
+			return nil, errors.Errorf("package target %v has conflicting sources %v and %v", key, source, f.Source)
+		}
+		sources[key] = f.Source
+		files = append(files, f)
+	}
+	return files, nil
+}
+
 // PackageZip packages a zip file.
 func PackageZip(spec PackageSpec) error {
 	// Create a buffer to write our archive to.
@@ -442,7 +480,11 @@ func PackageZip(spec PackageSpec) error {
 	baseDir := spec.rootDir()
 
 	// Add files to zip.
-	for _, pkgFile := range spec.Files {
+	files, err := spec.archiveFiles()
+	if err != nil {
+		return err
+	}
+	for _, pkgFile := range files {
 		if err := addFileToZip(w, baseDir, pkgFile); err != nil {
 			return errors.Wrapf(err, "failed adding file=%+v to zip", pkgFile)
 		}
@@ -486,7 +528,11 @@ func PackageTarGz(spec PackageSpec) error {
 	baseDir := spec.rootDir()
 
 	// Add files to tar.
-	for _, pkgFile := range spec.Files {
+	files, err := spec.archiveFiles()
+	if err != nil {
+		return err
+	}
+	for _, pkgFile := range files {
 		if err := addFileToTar(w, baseDir, pkgFile); err != nil {
 			return errors.Wrapf(err, "failed adding file=%+v to tar", pkgFile)
 		}
@@ -507,7 +553,7 @@ func PackageTarGz(spec PackageSpec) error {
 	spec.OutputFile = TarGz.AddFileExtension(spec.OutputFile)
 
 	// Open the output file.
-	log.Println("Creating output file at", spec.OutputFile)
+	logDebug("Creating output file at", spec.OutputFile)
 	outFile, err := os.Create(createDir(spec.OutputFile))
 	if err != nil {
 		return err
@@ -571,6 +617,15 @@ func runFPM(spec PackageSpec, packageType PackageType) error {
 	}
 	spec.OutputFile = packageType.AddFileExtension(filepath.Join(distributionsDir, outputFile))
 
+	workDir, err := DockerMountPath(CWD())
+	if err != nil {
+		return err
+	}
+
+	if err = EnsureDockerImage(beatsFPMImage + ":" + fpmVersion); err != nil {
+		return err
+	}
+
 	dockerRun := sh.RunCmd("docker", "run")
 	var args []string
 
@@ -582,7 +637,7 @@ func runFPM(spec PackageSpec, packageType PackageType) error {
 	args = append(args,
 		"--rm",
 		"-w", "/app",
-		"-v", CWD()+":/app",
+		"-v", workDir+":/app",
 		beatsFPMImage+":"+fpmVersion,
 		"fpm", "--force",
 		"--input-type", "tar",
@@ -634,7 +689,7 @@ func addUidGidEnvArgs(args []string) ([]string, error) {
 	if info.IsBoot2Docker() {
 		// Boot2Docker mounts vboxfs using 1000:50.
 		uid, gid = 1000, 50
-		log.Printf("Boot2Docker is in use. Deploying workaround. "+
+		logInfof("Boot2Docker is in use. Deploying workaround. "+
 			"Using UID=%d GID=%d", uid, gid)
 	}
 
@@ -666,11 +721,7 @@ func addFileToZip(ar *zip.Writer, baseDir string, pkgFile PackageFile) error {
 			baseDir = ""
 		}
 
-		relPath, err := filepath.Rel(pkgFile.Source, path)
-		if err != nil {
-			return err
-		}
-
+		relPath := RelOrAbs(pkgFile.Source, path)
 		header.Name = filepath.Join(baseDir, pkgFile.Target, relPath)
 
 		if info.IsDir() {
@@ -680,7 +731,7 @@ func addFileToZip(ar *zip.Writer, baseDir string, pkgFile PackageFile) error {
 		}
 
 		if mg.Verbose() {
-			log.Println("Adding", header.Mode(), header.Name)
+			logDebug("Adding", header.Mode(), header.Name)
 		}
 
 		w, err := ar.CreateHeader(header)
@@ -729,18 +780,14 @@ func addFileToTar(ar *tar.Writer, baseDir string, pkgFile PackageFile) error {
 			baseDir = ""
 		}
 
-		relPath, err := filepath.Rel(pkgFile.Source, path)
-		if err != nil {
-			return err
-		}
-
+		relPath := RelOrAbs(pkgFile.Source, path)
 		header.Name = filepath.Join(baseDir, pkgFile.Target, relPath)
 		if info.IsDir() {
 			header.Name += string(filepath.Separator)
 		}
 
 		if mg.Verbose() {
-			log.Println("Adding", os.FileMode(header.Mode), header.Name)
+			logDebug("Adding", os.FileMode(header.Mode), header.Name)
 		}
 		if err := ar.WriteHeader(header); err != nil {
 			return err
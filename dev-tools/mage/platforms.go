@@ -18,6 +18,7 @@
 package mage
 
 import (
+	"runtime"
 	"sort"
 	"strings"
 
@@ -69,6 +70,46 @@ var BuildPlatforms = BuildPlatformList{
 	{"windows/amd64", CGOSupported | CrossBuildSupported | Default},
 }
 
+// knownGOOS and knownGOARCH are the GOOS and GOARCH values recognized by
+// ParsePlatform. They are a superset of the values used in BuildPlatforms.
+var (
+	knownGOOS = map[string]struct{}{
+		"aix": {}, "android": {}, "darwin": {}, "dragonfly": {}, "freebsd": {},
+		"illumos": {}, "ios": {}, "js": {}, "linux": {}, "nacl": {},
+		"netbsd": {}, "openbsd": {}, "plan9": {}, "solaris": {}, "wasip1": {},
+		"windows": {},
+	}
+
+	knownGOARCH = map[string]struct{}{
+		"386": {}, "amd64": {}, "amd64p32": {}, "arm": {}, "arm64": {},
+		"loong64": {}, "mips": {}, "mips64": {}, "mips64le": {}, "mipsle": {},
+		"ppc64": {}, "ppc64le": {}, "riscv64": {}, "s390x": {}, "wasm": {},
+	}
+)
+
+// HostPlatform returns the platform of the host in the form <goos>/<goarch>.
+func HostPlatform() string {
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// ParsePlatform splits a <goos>/<goarch> platform string into its parts and
+// returns an error if either part is not a known GOOS or GOARCH value.
+func ParsePlatform(s string) (goos, goarch string, err error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return "", "", errors.Errorf("invalid platform %q, expected <goos>/<goarch>", s)
+	}
+
+	goos, goarch = parts[0], parts[1]
+	if _, found := knownGOOS[goos]; !found {
+		return "", "", errors.Errorf("invalid platform %q, unknown GOOS %q", s, goos)
+	}
+	if _, found := knownGOARCH[goarch]; !found {
+		return "", "", errors.Errorf("invalid platform %q, unknown GOARCH %q", s, goarch)
+	}
+	return goos, goarch, nil
+}
+
 // PlatformFeature specifies features that are supported for a platform.
 type PlatformFeature uint8
 
@@ -18,6 +18,7 @@
 package mage
 
 import (
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -156,3 +157,30 @@ func TestNewPlatformList(t *testing.T) {
 		BuildPlatforms,
 		NewPlatformList("+all"))
 }
+
+func TestHostPlatform(t *testing.T) {
+	goos, goarch, err := ParsePlatform(HostPlatform())
+	if assert.NoError(t, err) {
+		assert.Equal(t, runtime.GOOS, goos)
+		assert.Equal(t, runtime.GOARCH, goarch)
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	goos, goarch, err := ParsePlatform("windows/amd64")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "windows", goos)
+		assert.Equal(t, "amd64", goarch)
+	}
+
+	for _, s := range []string{"", "linux", "linux/amd64/v2", "windows/amd65", "linx/amd64", "linux/armv7"} {
+		_, _, err = ParsePlatform(s)
+		assert.Error(t, err, s)
+	}
+
+	// Every platform in BuildPlatforms must be parseable by its GOOS/GOARCH.
+	for _, bp := range BuildPlatforms {
+		_, _, err = ParsePlatform(bp.GOOS() + "/" + bp.GOARCH())
+		assert.NoError(t, err, bp.Name)
+	}
+}
@@ -0,0 +1,28 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+// windowsMaxOpenFiles is reported as the limit on Windows. The number of
+// handles a process can open is only limited by the available memory.
+const windowsMaxOpenFiles = 16384
+
+// maxOpenFiles returns a large constant because Windows has no per-process
+// descriptor limit comparable to RLIMIT_NOFILE.
+func maxOpenFiles() (int, error) {
+	return windowsMaxOpenFiles, nil
+}
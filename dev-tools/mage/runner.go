@@ -0,0 +1,59 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import "context"
+
+// Runner executes a single attempt of a command. Retries are handled by Cmd
+// before the Runner is invoked.
+type Runner interface {
+	// Run executes the command.
+	Run(ctx context.Context, c Cmd) error
+
+	// Output executes the command and captures its output.
+	Output(ctx context.Context, c Cmd) (CmdOutput, error)
+}
+
+// execRunner is the default Runner. It executes commands with os/exec.
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, c Cmd) error {
+	return c.run(ctx)
+}
+
+func (execRunner) Output(ctx context.Context, c Cmd) (CmdOutput, error) {
+	return c.output(ctx)
+}
+
+type runnerKey struct{}
+
+// WithRunner returns a copy of ctx that causes the commands executed with it
+// to use the given Runner. Because the Runner is scoped to the context it is
+// safe to use a different Runner in each parallel test.
+func WithRunner(ctx context.Context, r Runner) context.Context {
+	return context.WithValue(ctx, runnerKey{}, r)
+}
+
+// RunnerFromContext returns the Runner associated with ctx. The default
+// Runner, which uses os/exec, is returned if there is none.
+func RunnerFromContext(ctx context.Context) Runner {
+	if r, ok := ctx.Value(runnerKey{}).(Runner); ok && r != nil {
+		return r
+	}
+	return execRunner{}
+}
@@ -0,0 +1,180 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCall is a command invocation that was recorded by a fakeRunner.
+type fakeCall struct {
+	Args   []string
+	Env    map[string]string
+	Dir    string
+	Stdin  string
+	Stream bool
+}
+
+// fakeResult is the scripted result of a command executed by a fakeRunner.
+type fakeResult struct {
+	Stdout string
+	Stderr string
+	Err    error
+}
+
+// fakeRunner is a Runner for tests. It records each command that it is asked
+// to execute and returns scripted results instead of executing anything.
+type fakeRunner struct {
+	// Results are keyed by command line (the args joined by spaces). Commands
+	// without a result succeed with no output.
+	Results map[string]fakeResult
+
+	mu    sync.Mutex
+	calls []fakeCall
+}
+
+// Run records the command, writes its scripted stdout and stderr to c.Stdout
+// and c.Stderr if they are set, and returns its scripted error.
+func (f *fakeRunner) Run(ctx context.Context, c Cmd) error {
+	out, err := f.Output(ctx, c)
+	for _, stream := range []struct {
+		w    io.Writer
+		data string
+	}{{c.Stdout, out.Stdout}, {c.Stderr, out.Stderr}} {
+		if stream.w == nil || stream.data == "" {
+			continue
+		}
+		if _, werr := io.WriteString(stream.w, stream.data); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// Output records the command and returns its scripted output and error.
+func (f *fakeRunner) Output(ctx context.Context, c Cmd) (CmdOutput, error) {
+	call := fakeCall{Args: c.Args, Env: c.Env, Dir: c.Dir, Stream: c.Stream}
+	if c.Stdin != nil {
+		data, err := ioutil.ReadAll(c.Stdin)
+		if err != nil {
+			return CmdOutput{}, errors.Wrap(err, "failed to read stdin")
+		}
+		call.Stdin = string(data)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+
+	result := f.Results[strings.Join(c.Args, " ")]
+	return CmdOutput{Stdout: result.Stdout, Stderr: result.Stderr}, result.Err
+}
+
+// Calls returns the commands that were executed in the order they were
+// received.
+func (f *fakeRunner) Calls() []fakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeCall(nil), f.calls...)
+}
+
+func TestFakeRunnerRunCmds(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"false": {Err: errors.New("exit status 1")},
+	}}
+	ctx := WithRunner(context.Background(), fake)
+
+	assert.NoError(t, RunCmdsContext(ctx, []string{"go", "version"}, []string{"git", "status"}))
+	assert.Error(t, RunCmdsContext(ctx, []string{"false"}, []string{"never-run"}))
+
+	var cmds []string
+	for _, call := range fake.Calls() {
+		cmds = append(cmds, strings.Join(call.Args, " "))
+	}
+	assert.Equal(t, []string{"go version", "git status", "false"}, cmds)
+}
+
+func TestFakeRunnerCmdOptions(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"echo hi": {Stdout: "hi"},
+	}}
+	ctx := WithRunner(context.Background(), fake)
+
+	out, err := Cmd{Args: []string{"echo", "hi"}}.OutputContext(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hi", out.Stdout)
+	}
+
+	c := Cmd{
+		Args:  []string{"login"},
+		Env:   map[string]string{"A": "1"},
+		Dir:   "build",
+		Stdin: strings.NewReader("secret"),
+	}
+	assert.NoError(t, c.RunContext(ctx))
+
+	calls := fake.Calls()
+	if assert.Len(t, calls, 2) {
+		assert.Equal(t, fakeCall{Args: []string{"login"}, Env: map[string]string{"A": "1"}, Dir: "build", Stdin: "secret"}, calls[1])
+	}
+}
+
+func TestFakeRunnerRetries(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"flaky": {Err: errors.New("failed")},
+	}}
+	ctx := WithRunner(context.Background(), fake)
+
+	err := Cmd{Args: []string{"flaky"}, Retries: 2, Stdin: strings.NewReader("data")}.RunContext(ctx)
+	assert.Error(t, err)
+
+	calls := fake.Calls()
+	if assert.Len(t, calls, 3) {
+		for _, call := range calls {
+			assert.Equal(t, "data", call.Stdin)
+		}
+	}
+}
+
+func TestDockerInfoRunner(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"docker info -f {{ json .}}": {Stdout: `{"OperatingSystem":"Boot2Docker 18.06","NCPU":4}`},
+	}}
+
+	info, err := dockerCLIInfo(WithRunner(context.Background(), fake))
+	if assert.NoError(t, err) {
+		assert.True(t, info.IsBoot2Docker())
+		assert.Equal(t, 4, info.NCPU)
+	}
+}
@@ -18,10 +18,10 @@
 package mage
 
 import (
+	"context"
 	"fmt"
 	"go/build"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -66,24 +66,59 @@ var (
 	FuncMap = map[string]interface{}{
 		"beat_doc_branch":   BeatDocBranch,
 		"beat_version":      BeatVersion,
+		"buildTime":         buildTime,
 		"commit":            CommitHash,
 		"date":              BuildDate,
 		"elastic_beats_dir": ElasticBeatsDir,
+		"gitBranch":         gitBranch,
+		"gitCommit":         gitCommit,
 		"go_version":        GoVersion,
+		"humanSize":         HumanSize,
+		"humanSizeSI":       HumanSizeSI,
+		"join":              joinList,
+		"splitList":         splitList,
 		"repo":              GetProjectRepoInfo,
 		"title":             strings.Title,
 	}
 )
 
+// joinList joins the elements of a []string or []interface{} using sep. It is
+// the "join" template function.
+func joinList(sep string, list interface{}) (string, error) {
+	switch v := list.(type) {
+	case nil:
+		return "", nil
+	case []string:
+		return strings.Join(v, sep), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, sep), nil
+	default:
+		return "", errors.Errorf("join requires a list but got %T", list)
+	}
+}
+
+// splitList splits s into a list using sep. An empty string results in an
+// empty list. It is the "splitList" template function.
+func splitList(sep, s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, sep)
+}
+
 func init() {
 	if GOOS == "windows" {
 		BinaryExt = ".exe"
 	}
 
 	var err error
-	Snapshot, err = strconv.ParseBool(EnvOr("SNAPSHOT", "false"))
+	Snapshot, err = EnvBoolE("SNAPSHOT", false)
 	if err != nil {
-		panic(errors.Errorf("failed to parse SNAPSHOT value", err))
+		panic(err)
 	}
 }
 
@@ -204,7 +239,7 @@ func ElasticBeatsDir() (string, error) {
 
 	elasticBeatsDirValue, elasticBeatsDirErr = findElasticBeatsDir()
 	if elasticBeatsDirErr == nil {
-		log.Println("Found Elastic Beats dir at", elasticBeatsDirValue)
+		logDebug("Found Elastic Beats dir at", elasticBeatsDirValue)
 	}
 	return elasticBeatsDirValue, elasticBeatsDirErr
 }
@@ -269,6 +304,39 @@ func BuildDate() string {
 	return buildDate
 }
 
+// gitCommit returns the commit hash of HEAD. It is the "gitCommit" template
+// function and is the same as "commit".
+func gitCommit() (string, error) {
+	return CommitHash()
+}
+
+// gitBranch returns the name of the current branch, or HEAD if it is
+// detached. It is the "gitBranch" template function.
+func gitBranch() (string, error) {
+	return gitBranchContext(context.Background())
+}
+
+func gitBranchContext(ctx context.Context) (string, error) {
+	out, err := Cmd{Args: []string{"git", "rev-parse", "--abbrev-ref", "HEAD"}}.OutputContext(ctx)
+	return out.Stdout, err
+}
+
+// buildTime returns the build time in RFC3339 format. For reproducible builds
+// the time is taken from SOURCE_DATE_EPOCH (seconds since the Unix epoch) if
+// it is set, otherwise it is the time that the build started. It is the
+// "buildTime" template function.
+func buildTime() (string, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return buildDate, nil
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid SOURCE_DATE_EPOCH %q", epoch)
+	}
+	return time.Unix(sec, 0).UTC().Format(time.RFC3339), nil
+}
+
 var (
 	goVersionValue string
 	goVersionErr   error
@@ -0,0 +1,69 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildMetadataTemplateFuncs(t *testing.T) {
+	defer os.Setenv("SOURCE_DATE_EPOCH", os.Getenv("SOURCE_DATE_EPOCH"))
+	os.Setenv("SOURCE_DATE_EPOCH", "1577934245")
+
+	out, err := Expand("{{ buildTime }}")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2020-01-02T03:04:05Z", out)
+	}
+
+	os.Unsetenv("SOURCE_DATE_EPOCH")
+	out, err = Expand("{{ buildTime }}")
+	if assert.NoError(t, err) {
+		assert.Equal(t, BuildDate(), out)
+	}
+
+	os.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	_, err = Expand("{{ buildTime }}")
+	assert.Error(t, err)
+
+	// gitCommit shares the cached result of CommitHash.
+	expected, expectedErr := CommitHash()
+	commit, err := gitCommit()
+	assert.Equal(t, expected, commit)
+	assert.Equal(t, expectedErr, err)
+}
+
+func TestGitBranch(t *testing.T) {
+	fake := &fakeRunner{Results: map[string]fakeResult{
+		"git rev-parse --abbrev-ref HEAD": {Stdout: "main"},
+	}}
+	branch, err := gitBranchContext(WithRunner(context.Background(), fake))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "main", branch)
+	}
+
+	fake = &fakeRunner{Results: map[string]fakeResult{
+		"git rev-parse --abbrev-ref HEAD": {Err: errors.New("not a git repository")},
+	}}
+	_, err = gitBranchContext(WithRunner(context.Background(), fake))
+	assert.Error(t, err)
+}
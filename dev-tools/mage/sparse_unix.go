@@ -0,0 +1,97 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build !windows
+// +build !windows
+
+package mage
+
+import (
+	"io"
+	"os"
+)
+
+// sparseBlockSize is the granularity at which runs of zeros are detected. It
+// matches the block size of most file systems.
+const sparseBlockSize = 4096
+
+// copySparse copies src to dst but seeks over blocks that contain only zeros
+// instead of writing them so that holes in src remain holes in dst.
+func copySparse(dst, src *os.File) error {
+	buf := make([]byte, 32*sparseBlockSize)
+	for {
+		n, err := readChunk(src, buf)
+		if err != nil {
+			return err
+		}
+		if err = writeSparse(dst, buf[:n]); err != nil {
+			return err
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+
+	// Extend the file if it ends with a hole.
+	end, err := dst.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return dst.Truncate(end)
+}
+
+// writeSparse writes p to f block by block, skipping the zero blocks.
+func writeSparse(f *os.File, p []byte) error {
+	for len(p) > 0 {
+		// Find the run of blocks that are all zero or all non-zero.
+		zero := isZeroBlock(p[:minInt(len(p), sparseBlockSize)])
+		n := 0
+		for n < len(p) {
+			end := minInt(len(p), n+sparseBlockSize)
+			if isZeroBlock(p[n:end]) != zero {
+				break
+			}
+			n = end
+		}
+
+		if zero {
+			if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+				return err
+			}
+		} else if _, err := f.Write(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func isZeroBlock(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,66 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build !windows
+// +build !windows
+
+package mage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopySparseAllocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mage-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 64 << 20
+	src := filepath.Join(dir, "disk.img")
+	writeSparseTestFile(t, src, size, map[int64]string{size / 2: "data"})
+	if allocated(t, src) >= size/2 {
+		t.Skip("file system does not support sparse files")
+	}
+
+	dest := filepath.Join(dir, "copy.img")
+	if err = CopyWith(src, dest, CopyOptions{PreserveSparse: true}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, size, info.Size())
+	assert.True(t, allocated(t, dest) < size/2, "expected the copy to be sparse")
+}
+
+// allocated returns the number of bytes allocated on disk for the file.
+func allocated(t testing.TB, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(info.Sys().(*syscall.Stat_t).Blocks) * 512
+}
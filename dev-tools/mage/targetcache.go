@@ -0,0 +1,215 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// TargetCacheDisableEnv is the environment variable that disables the
+// TargetCache when it is set to true (e.g. for clean builds).
+const TargetCacheDisableEnv = "DEV_TOOLS_NO_CACHE"
+
+var (
+	// targetCacheDir is the directory that holds the TargetCache state
+	// files. Replaced in tests.
+	targetCacheDir = filepath.Join("build", ".mage-cache")
+
+	// targetCacheVersion returns the version of the dev-tools that is stored
+	// with the state. Replaced in tests.
+	targetCacheVersion = devToolsVersion
+)
+
+// TargetCache records the digests of the inputs of a target after it ran
+// successfully so that the target can skip itself when none of its inputs
+// changed. The state of each target is stored in its own file under
+// build/.mage-cache and is written atomically, so targets running in parallel
+// don't interfere. The state is discarded when the dev-tools (i.e. the
+// compiled mage binary) change.
+//
+//	cache := mage.NewTargetCache("fields")
+//	if changed, err := cache.Changed("_meta", "module"); err != nil || !changed {
+//		return err
+//	}
+//	// Generate the fields...
+//	return cache.MarkDone()
+type TargetCache struct {
+	name string
+
+	mu     sync.Mutex
+	inputs *upToDateHashState // Digests computed by the last Changed call.
+}
+
+// targetCacheState is the content of a TargetCache state file. The inputs are
+// recorded like by RecordUpToDateHash, with paths relative to the CWD, so that
+// the state is valid in other checkouts of the repo.
+type targetCacheState struct {
+	Version string             `json:"version"`
+	Done    bool               `json:"done"`
+	Inputs  *upToDateHashState `json:"inputs"`
+}
+
+// NewTargetCache returns a TargetCache for the named target.
+func NewTargetCache(target string) *TargetCache {
+	return &TargetCache{name: target}
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// path returns the path of the state file.
+func (c *TargetCache) path() string {
+	return filepath.Join(targetCacheDir, unsafeFileNameChars.ReplaceAllString(c.name, "_")+".json")
+}
+
+// Changed returns true if any of the inputs changed since the last MarkDone
+// call, or if the target never completed. Inputs can be files or directories
+// (which are walked recursively). Adding or removing an input is a change. It
+// always returns true when DEV_TOOLS_NO_CACHE is set.
+func (c *TargetCache) Changed(inputs ...string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current, err := sourcesDigest(inputs)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to compute digest of inputs of target %v", c.name)
+	}
+	c.inputs = current
+
+	if envFlag(TargetCacheDisableEnv) {
+		logDebugf("Target cache is disabled by %v, running %v", TargetCacheDisableEnv, c.name)
+		return true, nil
+	}
+
+	version, err := targetCacheVersion()
+	if err != nil {
+		return false, err
+	}
+	state, err := c.load()
+	switch {
+	case err != nil:
+		logDebugf("Ignoring the cache of target %v: %v", c.name, err)
+		return true, nil
+	case state == nil, !state.Done, state.Inputs == nil:
+		return true, nil
+	case state.Version != version:
+		logDebugf("Ignoring the cache of target %v because the dev-tools changed", c.name)
+		return true, nil
+	}
+
+	if state.Inputs.Digest != current.Digest {
+		logDebugf("Inputs of target %v changed: %v", c.name, changedInputs(state.Inputs, current))
+		return true, nil
+	}
+	return false, nil
+}
+
+// changedInputs describes the difference between the recorded and the current
+// inputs for logging.
+func changedInputs(recorded, current *upToDateHashState) string {
+	var changes []string
+	for path, digest := range current.Files {
+		switch old, found := recorded.Files[path]; {
+		case !found:
+			changes = append(changes, path+" added")
+		case old != digest:
+			changes = append(changes, path+" modified")
+		}
+	}
+	for path := range recorded.Files {
+		if _, found := current.Files[path]; !found {
+			changes = append(changes, path+" removed")
+		}
+	}
+	if len(changes) == 0 {
+		return "list of inputs changed"
+	}
+	sort.Strings(changes)
+	return strings.Join(changes, ", ")
+}
+
+// MarkDone records that the target completed successfully along with the
+// digests of the inputs computed by the last Changed call.
+func (c *TargetCache) MarkDone() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inputs == nil {
+		return errors.Errorf("MarkDone called before Changed for target %v", c.name)
+	}
+	version, err := targetCacheVersion()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(targetCacheState{Version: version, Done: true, Inputs: c.inputs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The target ran so the directories that it generated files into may
+	// have changed.
+	InvalidateModTimeCache()
+	return writeFileAtomic(createDir(c.path()), append(data, '\n'), 0644)
+}
+
+// load reads the state file. It returns nil if the file does not exist.
+func (c *TargetCache) load() (*targetCacheState, error) {
+	data, err := ioutil.ReadFile(c.path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var state targetCacheState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %v", c.path())
+	}
+	return &state, nil
+}
+
+var (
+	devToolsVersionValue string
+	devToolsVersionErr   error
+	devToolsVersionOnce  sync.Once
+)
+
+// devToolsVersion returns the sha256 digest of the running executable, which
+// is the mage binary that the dev-tools are compiled into.
+func devToolsVersion() (string, error) {
+	devToolsVersionOnce.Do(func() {
+		var exe string
+		if exe, devToolsVersionErr = os.Executable(); devToolsVersionErr != nil {
+			return
+		}
+		var sums map[string]string
+		if sums, devToolsVersionErr = MultiHash(exe, "sha256"); devToolsVersionErr != nil {
+			return
+		}
+		devToolsVersionValue = sums["sha256"]
+	})
+	return devToolsVersionValue, devToolsVersionErr
+}
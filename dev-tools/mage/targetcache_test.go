@@ -0,0 +1,160 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetCache(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	defer func(dir string, version func() (string, error)) {
+		targetCacheDir, targetCacheVersion = dir, version
+	}(targetCacheDir, targetCacheVersion)
+	targetCacheDir = filepath.Join(dir, "cache")
+	version := "1"
+	targetCacheVersion = func() (string, error) { return version, nil }
+
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("_meta/fields.yml", "a")
+	write("module/x/fields.yml", "b")
+	inputs := []string{filepath.Join(dir, "_meta"), filepath.Join(dir, "module")}
+
+	changed := func() bool {
+		changed, err := NewTargetCache("fields").Changed(inputs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changed
+	}
+	markDone := func() {
+		cache := NewTargetCache("fields")
+		if _, err := cache.Changed(inputs...); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.MarkDone(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assert.True(t, changed(), "never completed")
+	markDone()
+	assert.False(t, changed())
+
+	// Other targets have their own state.
+	other, err := NewTargetCache("docs:build").Changed(inputs...)
+	assert.NoError(t, err)
+	assert.True(t, other)
+
+	write("module/x/fields.yml", "c")
+	assert.True(t, changed(), "content changed")
+	markDone()
+	write("module/y/fields.yml", "d")
+	assert.True(t, changed(), "input added")
+	markDone()
+	if err := os.Remove(filepath.Join(dir, "module/y/fields.yml")); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, changed(), "input removed")
+	markDone()
+	assert.False(t, changed())
+
+	version = "2"
+	assert.True(t, changed(), "dev-tools changed")
+	markDone()
+	assert.False(t, changed())
+
+	defer os.Setenv(TargetCacheDisableEnv, os.Getenv(TargetCacheDisableEnv))
+	os.Setenv(TargetCacheDisableEnv, "true")
+	assert.True(t, changed(), "cache disabled")
+	os.Unsetenv(TargetCacheDisableEnv)
+
+	// A corrupt state file is ignored.
+	if err := ioutil.WriteFile(NewTargetCache("fields").path(), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, changed())
+
+	assert.Error(t, NewTargetCache("fields").MarkDone())
+	_, err = NewTargetCache("fields").Changed(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestTargetCacheRelocatedCheckout(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	defer func(dir string, version func() (string, error)) {
+		targetCacheDir, targetCacheVersion = dir, version
+	}(targetCacheDir, targetCacheVersion)
+	targetCacheDir = filepath.Join(dir, "cache")
+	targetCacheVersion = func() (string, error) { return "1", nil }
+
+	// Two checkouts with the same content at different paths.
+	for _, checkout := range []string{"job-1", "job-2"} {
+		path := filepath.Join(dir, checkout, "_meta", "fields.yml")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("a"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer os.Chdir(CWD())
+	if err := os.Chdir(filepath.Join(dir, "job-1")); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewTargetCache("fields")
+	if _, err := cache.Changed("_meta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.MarkDone(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(filepath.Join(dir, "job-2")); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := NewTargetCache("fields").Changed("_meta")
+	if assert.NoError(t, err) {
+		assert.False(t, changed)
+	}
+}
+
+func TestDevToolsVersion(t *testing.T) {
+	version, err := devToolsVersion()
+	if assert.NoError(t, err) {
+		assert.Len(t, version, 64)
+	}
+}
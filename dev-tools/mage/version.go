@@ -0,0 +1,199 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CompareVersions compares two dot separated version numbers like "1.2.3" or
+// "20.10". An optional "v" prefix is ignored and missing components are
+// treated as zero. A pre-release suffix (e.g. "-rc1") makes a version lower
+// than the same version without a suffix. Build metadata (e.g. "+build.1") is
+// ignored. It returns -1 if a < b, 0 if a == b, and 1 if a > b.
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	return va.compare(vb), nil
+}
+
+type version struct {
+	numbers    []int
+	prerelease string
+}
+
+func parseVersion(s string) (version, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if idx := strings.IndexByte(v, '+'); idx != -1 {
+		v = v[:idx]
+	}
+
+	var out version
+	if idx := strings.IndexByte(v, '-'); idx != -1 {
+		v, out.prerelease = v[:idx], v[idx+1:]
+	}
+
+	for _, part := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return version{}, errors.Errorf("invalid version %q", s)
+		}
+		out.numbers = append(out.numbers, n)
+	}
+	return out, nil
+}
+
+func (v version) compare(other version) int {
+	for i := 0; i < len(v.numbers) || i < len(other.numbers); i++ {
+		var a, b int
+		if i < len(v.numbers) {
+			a = v.numbers[i]
+		}
+		if i < len(other.numbers) {
+			b = other.numbers[i]
+		}
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case v.prerelease == other.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case other.prerelease == "":
+		return -1
+	case v.prerelease < other.prerelease:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// VerifyToolVersion runs the given binary with args and checks that the
+// version reported in its output equals expected. The version is extracted
+// from stdout, or from stderr if stdout does not match, using the first
+// capture group of versionRe. This guards against a stale or unexpected
+// binary being found in the PATH.
+func VerifyToolVersion(binary string, args []string, versionRe *regexp.Regexp, expected string) error {
+	actual, err := toolVersion(binary, args, versionRe)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return errors.Errorf("%v has version %v but version %v is expected", binary, actual, expected)
+	}
+	return nil
+}
+
+// toolVersion runs the binary with args and returns the first capture group
+// of versionRe found in stdout or stderr.
+func toolVersion(binary string, args []string, versionRe *regexp.Regexp) (string, error) {
+	if versionRe.NumSubexp() < 1 {
+		return "", errors.Errorf("version regexp %v must contain a capture group", versionRe)
+	}
+
+	out, err := Cmd{Args: append([]string{binary}, args...)}.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get the version of %v", binary)
+	}
+
+	for _, output := range []string{out.Stdout, out.Stderr} {
+		if m := versionRe.FindStringSubmatch(output); m != nil {
+			return m[1], nil
+		}
+	}
+	return "", errors.Errorf("failed to find the version of %v in its output using %v", binary, versionRe)
+}
+
+// ToolVersionArgs contains the arguments used by RequireToolVersions to make
+// a tool print its version. Tools that are not listed are run with
+// --version.
+var ToolVersionArgs = map[string][]string{
+	"docker": {"version", "--format", "{{.Client.Version}}"},
+	"go":     {"version"},
+	"mage":   {"-version"},
+}
+
+// anyVersionRegexp matches the first version number in a tool's output, like
+// 1.14.2 in "go version go1.14.2 linux/amd64".
+var anyVersionRegexp = regexp.MustCompile(`(\d+(?:\.\d+)+(?:-[0-9A-Za-z.]+)?)`)
+
+// RequireToolVersions checks that each tool is installed with at least the
+// given minimum version. reqs maps tool names to minimum versions (e.g.
+// {"docker": "19.03"}). The version is obtained by running the tool with the
+// arguments from ToolVersionArgs. The returned error lists every tool that is
+// missing or too old.
+func RequireToolVersions(reqs map[string]string) error {
+	tools := make([]string, 0, len(reqs))
+	for tool := range reqs {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+
+	var problems []string
+	for _, tool := range tools {
+		if err := requireToolVersion(tool, reqs[tool]); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("tool requirements not met:\n  %v", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func requireToolVersion(tool, minimum string) error {
+	if _, err := LookPathVerbose(tool); err != nil {
+		return err
+	}
+
+	args, found := ToolVersionArgs[tool]
+	if !found {
+		args = []string{"--version"}
+	}
+	actual, err := toolVersion(tool, args, anyVersionRegexp)
+	if err != nil {
+		return errors.Wrapf(err, "%v", tool)
+	}
+
+	cmp, err := CompareVersions(actual, minimum)
+	if err != nil {
+		return errors.Wrapf(err, "%v", tool)
+	}
+	if cmp < 0 {
+		return errors.Errorf("%v has version %v but at least %v is required", tool, actual, minimum)
+	}
+	logDebugf("Found %v version %v (>= %v)", tool, actual, minimum)
+	return nil
+}
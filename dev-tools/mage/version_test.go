@@ -0,0 +1,119 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"20.10.7", "20.10", 1},
+		{"20.10", "20.10.0", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.10.0", "1.9.0", 1},
+		{"1.2.3-rc1", "1.2.3", -1},
+		{"1.2.3-rc1", "1.2.3-rc2", -1},
+		{"1.2.3+build.5", "1.2.3", 0},
+		{"2", "10", -1},
+	}
+	for _, c := range cases {
+		cmp, err := CompareVersions(c.a, c.b)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.expected, cmp, "%v vs %v", c.a, c.b)
+		}
+		cmp, err = CompareVersions(c.b, c.a)
+		if assert.NoError(t, err) {
+			assert.Equal(t, -c.expected, cmp, "%v vs %v", c.b, c.a)
+		}
+	}
+
+	for _, invalid := range []string{"", "1..2", "a.b", "1.-2"} {
+		_, err := CompareVersions(invalid, "1.0")
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestVerifyToolVersion(t *testing.T) {
+	skipIfNoShell(t)
+	re := regexp.MustCompile(`tool version (\S+)`)
+
+	assert.NoError(t, VerifyToolVersion("sh", []string{"-c", "echo tool version 1.2.3"}, re, "1.2.3"))
+	assert.NoError(t, VerifyToolVersion("sh", []string{"-c", "echo tool version 1.2.3 >&2"}, re, "1.2.3"))
+
+	err := VerifyToolVersion("sh", []string{"-c", "echo tool version 1.2.4"}, re, "1.2.3")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "has version 1.2.4 but version 1.2.3 is expected")
+	}
+
+	err = VerifyToolVersion("sh", []string{"-c", "echo unknown"}, re, "1.2.3")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to find the version")
+	}
+
+	assert.Error(t, VerifyToolVersion("sh", []string{"-c", "exit 1"}, re, "1.2.3"))
+	assert.Error(t, VerifyToolVersion("sh", nil, regexp.MustCompile(`version`), "1.2.3"))
+}
+
+func TestRequireToolVersions(t *testing.T) {
+	skipIfNoShell(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	tools := map[string]string{
+		"mage-test-go":        `echo "go version go1.14.2 linux/amd64"`,
+		"mage-test-docker":    `echo "Docker version 19.03.5, build 633a0ea" >&2`,
+		"mage-test-noversion": `echo "no version here"`,
+	}
+	for name, script := range tools {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	assert.NoError(t, RequireToolVersions(map[string]string{
+		"mage-test-go":     "1.14",
+		"mage-test-docker": "19.03.5",
+	}))
+	assert.NoError(t, RequireToolVersions(nil))
+
+	err := RequireToolVersions(map[string]string{
+		"mage-test-go":        "1.14.2",
+		"mage-test-docker":    "20.10",
+		"mage-test-noversion": "1.0",
+		"mage-test-missing":   "1.0",
+	})
+	if assert.Error(t, err) {
+		msg := err.Error()
+		assert.Contains(t, msg, "mage-test-docker has version 19.03.5 but at least 20.10 is required")
+		assert.Contains(t, msg, "mage-test-missing not found on PATH")
+		assert.Contains(t, msg, "failed to find the version of mage-test-noversion")
+		assert.NotContains(t, msg, "mage-test-go")
+	}
+}
@@ -0,0 +1,107 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// WatchPollInterval is the interval at which Watch checks the files for
+// changes.
+var WatchPollInterval = time.Second
+
+// fileState is the state of a file that is compared by Watch.
+type fileState struct {
+	ModTime time.Time
+	Size    int64
+}
+
+// Watch invokes fn once and then again each time the files matching the glob
+// patterns (see FindFiles) change. Files are polled every WatchPollInterval so
+// no OS specific file watchers are needed. Adding, removing, or modifying a
+// matching file is a change. fn is only invoked after no more changes were
+// seen for the debounce period. Errors returned by fn are logged and watching
+// continues. Watch returns nil when ctx is done.
+func Watch(ctx context.Context, globs []string, debounce time.Duration, fn func() error) error {
+	run := func() {
+		if err := fn(); err != nil {
+			LoggerFromContext(ctx).Warn("Watch: run failed:", err)
+		}
+	}
+
+	last := watchSnapshot(globs)
+	run()
+
+	ticker := time.NewTicker(WatchPollInterval)
+	defer ticker.Stop()
+
+	var pending bool
+	var changedAt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if current := watchSnapshot(globs); !sameFileStates(last, current) {
+			LoggerFromContext(ctx).Debug("Watch: detected changes in", globs)
+			last = current
+			pending = true
+			changedAt = time.Now()
+		}
+		if pending && time.Since(changedAt) >= debounce {
+			pending = false
+			run()
+		}
+	}
+}
+
+// watchSnapshot returns the state of the files matching the globs. Errors are
+// logged and an empty or partial snapshot is returned.
+func watchSnapshot(globs []string) map[string]fileState {
+	files, err := FindFiles(globs...)
+	if err != nil {
+		logWarn("Watch: failed to find files:", err)
+	}
+
+	states := make(map[string]fileState, len(files))
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			// The file was removed after it was matched.
+			continue
+		}
+		states[f] = fileState{ModTime: info.ModTime(), Size: info.Size()}
+	}
+	return states
+}
+
+func sameFileStates(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, state := range a {
+		if other, found := b[path]; !found || !other.ModTime.Equal(state.ModTime) || other.Size != state.Size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	defer func(interval time.Duration) { WatchPollInterval = interval }(WatchPollInterval)
+	WatchPollInterval = 10 * time.Millisecond
+
+	write := func(name, content string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("module/a/fields.yml", "a")
+
+	runs := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Watch(ctx, []string{filepath.Join(dir, "module", "**", "*.yml")}, 30*time.Millisecond, func() error {
+			runs <- struct{}{}
+			return errors.New("failures don't stop watching")
+		})
+	}()
+
+	waitForRun := func(what string) {
+		select {
+		case <-runs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fn was not run after %v", what)
+		}
+	}
+	expectNoRun := func(what string) {
+		select {
+		case <-runs:
+			t.Fatalf("fn was run after %v", what)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	waitForRun("starting")
+	expectNoRun("no changes")
+
+	write("module/a/fields.yml", "modified")
+	waitForRun("modifying a file")
+
+	write("module/b/c/fields.yml", "b")
+	waitForRun("adding a file")
+
+	if err := os.Remove(filepath.Join(dir, "module", "a", "fields.yml")); err != nil {
+		t.Fatal(err)
+	}
+	waitForRun("removing a file")
+
+	write("module/b/README.md", "not matched")
+	expectNoRun("changing an unmatched file")
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not return after cancel")
+	}
+}